@@ -22,5 +22,7 @@ func main() {
 		Stdin:  os.Stdin,
 		Getenv: os.Getenv,
 		IsTTY:  cli.IsTerminal,
+
+		UserCacheDir: os.UserCacheDir,
 	})))
 }
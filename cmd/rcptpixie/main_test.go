@@ -68,6 +68,14 @@ func useFake(t *testing.T, replies ...string) *testutil.Fake {
 	t.Setenv("RCPTPIXIE_HOST", f.URL)
 	t.Setenv("RCPTPIXIE_MODEL", testModel)
 	t.Setenv("OLLAMA_HOST", f.URL)
+	// os.UserCacheDir reads a different variable on each platform. Pointing all
+	// of them at a fresh directory keeps one test's cached answers from turning
+	// the next test's model call into a hit, and keeps the developer's own cache
+	// out of it.
+	cache := t.TempDir()
+	for _, k := range []string{"XDG_CACHE_HOME", "HOME", "LocalAppData"} {
+		t.Setenv(k, cache)
+	}
 	return f
 }
 
@@ -2,11 +2,14 @@ package analyze
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -16,11 +19,11 @@ import (
 	"unicode/utf8"
 
 	"github.com/scottdensmore/rcptpixie/v2/internal/doc"
-	"github.com/scottdensmore/rcptpixie/v2/internal/ollama"
+	"github.com/scottdensmore/rcptpixie/v2/internal/llm"
 )
 
 type Analyzer struct {
-	C     *ollama.Client
+	C     llm.Backend
 	Model string
 	Log   *slog.Logger
 
@@ -30,12 +33,21 @@ type Analyzer struct {
 	// creased photograph.
 	DateOrder DateOrder
 
+	// Items asks for every line of the receipt as well. It is off by default:
+	// a long receipt costs several times the tokens of the shallow answer.
+	Items bool
+
+	// Categories is the list a receipt's category is chosen from, with the
+	// vendor rules that override the model; nil is DefaultCategories.
+	Categories *Categories
+
 	// raised once the run meets its first scanned page; see numCtxFor.
 	wideCtx atomic.Bool
 }
 
 const (
-	receiptPredict = 300
+	receiptPredict = 400
+	itemsPredict   = 2400
 	subjectPredict = 200
 
 	// num_ctx must be explicit: Ollama defaults to 4096 and silently truncates
@@ -63,6 +75,15 @@ var (
 	errNoDate   = errors.New("could not determine date")
 )
 
+// Misread reports whether err means the model answered but its answer could
+// not be used: a reply that is not JSON, or one missing the vendor, date or
+// subject. A larger model often reads such a document, whereas a document that
+// cannot be loaded or a server that is down is no better for a second model.
+func Misread(err error) bool {
+	var ue *UnparseableError
+	return errors.As(err, &ue) || errors.Is(err, errNoVendor) || errors.Is(err, errNoDate) || errors.Is(err, ErrNoSubject)
+}
+
 type UnparseableError struct {
 	Path string
 	Raw  string
@@ -73,14 +94,28 @@ func (e *UnparseableError) Error() string {
 }
 
 type receiptWire struct {
-	IsHotel   bool   `json:"is_hotel"`
-	Vendor    string `json:"vendor"`
-	Date      string `json:"date"`
-	DateRaw   string `json:"date_raw"`
-	DateOrder string `json:"date_order"`
-	EndDate   string `json:"end_date"`
-	Total     number `json:"total"`
-	Category  string `json:"category"`
+	IsHotel   bool       `json:"is_hotel"`
+	Vendor    string     `json:"vendor"`
+	Date      string     `json:"date"`
+	DateRaw   string     `json:"date_raw"`
+	DateOrder string     `json:"date_order"`
+	EndDate   string     `json:"end_date"`
+	Total     number     `json:"total"`
+	Subtotal  number     `json:"subtotal"`
+	Tax       number     `json:"tax"`
+	Tip       number     `json:"tip"`
+	Payment   string     `json:"payment_method"`
+	CardLast4 string     `json:"card_last4"`
+	Currency  string     `json:"currency"`
+	Category  string     `json:"category"`
+	Items     []lineWire `json:"items"`
+}
+
+type lineWire struct {
+	Description string `json:"description"`
+	Quantity    number `json:"quantity"`
+	UnitPrice   number `json:"unit_price"`
+	Amount      number `json:"amount"`
 }
 
 type subjectWire struct {
@@ -137,42 +172,84 @@ func (a *Analyzer) numCtxFor(d *doc.Doc) int {
 
 func (a *Analyzer) Receipt(ctx context.Context, d *doc.Doc) (Receipt, error) {
 	var w receiptWire
-	if err := a.generateJSON(ctx, kindReceipt, receiptSystem, ReceiptSchema, d, receiptPredict, &w); err != nil {
+	rules, schema, predict := a.receiptTask()
+	if err := a.generateJSON(ctx, kindReceipt, receiptSystem, rules, schema, d, predict, &w); err != nil {
 		return Receipt{}, err
 	}
-	return a.receiptFrom(w, d)
+	return a.receiptFrom(w, d, TraceFrom(ctx))
 }
 
 func (a *Analyzer) Subject(ctx context.Context, d *doc.Doc) (Subject, error) {
 	var w subjectWire
-	if err := a.generateJSON(ctx, kindDocument, organizeSystem, OrganizeSchema, d, subjectPredict, &w); err != nil {
+	if err := a.generateJSON(ctx, kindDocument, organizeSystem, organizeRules, OrganizeSchema, d, subjectPredict, &w); err != nil {
 		return Subject{}, err
 	}
-	return a.subjectFrom(w, d)
+	return a.subjectFrom(w, d, TraceFrom(ctx))
+}
+
+// answerVersion is bumped whenever receiptFrom or subjectFrom change what they
+// make of the same reply, which the prompt and schema alone cannot show.
+const answerVersion = "4"
+
+// ReceiptFingerprint names everything besides the document that decides what
+// Receipt returns: the model, the prompt and schema, the category rules and the
+// date order. The original filename is deliberately left out even though the
+// prompt shows it, so that a receipt already renamed by an earlier run is still
+// recognised.
+func (a *Analyzer) ReceiptFingerprint() string {
+	rules, schema, _ := a.receiptTask()
+	return a.fingerprint(kindReceipt, receiptSystem, rules+a.Categories.fingerprint(), schema)
 }
 
-func (a *Analyzer) generateJSON(ctx context.Context, kind, system string, schema json.RawMessage, d *doc.Doc, numPredict int, v any) error {
+// receiptTask is what Receipt asks for, with or without line items, from the
+// run's categories.
+func (a *Analyzer) receiptTask() (rules string, schema json.RawMessage, predict int) {
+	custom := a.Categories != nil && len(a.Categories.Names) > 0
+	switch {
+	case a.Items && custom:
+		return receiptRules + itemRules, receiptSchema(a.Categories.Names, itemsProperty, `, "items"`), itemsPredict
+	case a.Items:
+		return receiptRules + itemRules, ReceiptItemsSchema, itemsPredict
+	case custom:
+		return receiptRules, receiptSchema(a.Categories.Names, "", ""), receiptPredict
+	}
+	return receiptRules, ReceiptSchema, receiptPredict
+}
+
+// SubjectFingerprint is ReceiptFingerprint for Subject.
+func (a *Analyzer) SubjectFingerprint() string {
+	return a.fingerprint(kindDocument, organizeSystem, organizeRules, OrganizeSchema)
+}
+
+func (a *Analyzer) fingerprint(kind, system, rules string, schema json.RawMessage) string {
+	h := sha256.New()
+	for _, part := range []string{answerVersion, kind, a.Model, strconv.Itoa(int(a.DateOrder)), system, rules, string(schema)} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (a *Analyzer) generateJSON(ctx context.Context, kind, system, rules string, schema json.RawMessage, d *doc.Doc, numPredict int, v any) error {
 	numCtx := a.numCtxFor(d)
+	trace := TraceFrom(ctx)
 
-	prompt := buildPrompt(kind, d)
+	prompt := buildPrompt(kind, rules, d)
 	var raw string
 	for _, seed := range []int{firstSeed, retrySeed} {
-		out, err := a.C.Generate(ctx, ollama.GenerateRequest{
-			Model:  a.Model,
-			System: system,
-			Prompt: prompt,
-			Images: d.Images,
-			Format: schema,
-			Stream: false,
-			Options: map[string]any{
-				"temperature": 0,
-				"top_p":       1,
-				"top_k":       1,
-				"seed":        seed,
-				"num_predict": numPredict,
-				"num_ctx":     numCtx,
-			},
-		})
+		req := llm.Request{
+			Model:     a.Model,
+			System:    system,
+			Prompt:    prompt,
+			Images:    d.Images,
+			Schema:    schema,
+			Seed:      seed,
+			MaxTokens: numPredict,
+			Context:   numCtx,
+		}
+		start := time.Now()
+		out, err := a.C.Complete(ctx, req)
+		trace.called(req, out, err, time.Since(start))
 		if err != nil {
 			return err
 		}
@@ -187,7 +264,7 @@ func (a *Analyzer) generateJSON(ctx context.Context, kind, system string, schema
 		}
 		a.log().Warn("model reply was not usable JSON, retrying once", "path", d.Path, "err", derr)
 		prompt = fmt.Sprintf("Your previous reply could not be used: %s. Reply with ONLY a JSON object and no other text.\n\n%s",
-			derr, buildPrompt(kind, d))
+			derr, buildPrompt(kind, rules, d))
 	}
 	return &UnparseableError{Path: d.Path, Raw: condense(raw, maxRawInError)}
 }
@@ -289,10 +366,13 @@ func nextJSONObject(s string) (span, rest string, ok bool) {
 	return "", "", false
 }
 
-func (a *Analyzer) receiptFrom(w receiptWire, d *doc.Doc) (Receipt, error) {
+// receiptFrom checks and corrects the model's answer, noting each correction in
+// t, which may be nil.
+func (a *Analyzer) receiptFrom(w receiptWire, d *doc.Doc, t *Trace) (Receipt, error) {
 	r := Receipt{
-		Vendor:   strings.TrimSpace(w.Vendor),
-		Category: strings.TrimSpace(w.Category),
+		Vendor:     strings.TrimSpace(w.Vendor),
+		Category:   strings.TrimSpace(w.Category),
+		Assessment: Assessment{Confidence: ConfidenceHigh},
 	}
 	if r.Vendor == "" {
 		return Receipt{}, errNoVendor
@@ -309,6 +389,8 @@ func (a *Analyzer) receiptFrom(w receiptWire, d *doc.Doc) (Receipt, error) {
 		if rescued, rok := dateFromRaw(w.DateRaw, order); rok {
 			a.log().Warn("the model's date was unusable, reading the printed one instead",
 				"path", d.Path, "date", w.Date, "printed", w.DateRaw)
+			r.doubt(ConfidenceLow, "the model's date was unusable, the printed one was read instead")
+			t.Corrected("date: %q was unusable; the printed %q was read as %s", w.Date, w.DateRaw, rescued.Format("2006-01-02"))
 			start = rescued
 		} else {
 			return Receipt{}, errNoDate
@@ -321,8 +403,18 @@ func (a *Analyzer) receiptFrom(w receiptWire, d *doc.Doc) (Receipt, error) {
 		a.log().Debug("re-read an ambiguous date using the document's own convention",
 			"path", d.Path, "printed", w.DateRaw, "order", w.DateOrder,
 			"was", start.Format("2006-01-02"), "now", fixed.Format("2006-01-02"))
+		by := "the document"
+		if a.DateOrder != OrderUnknown {
+			by = "-date-order"
+		}
+		t.Corrected("date: %s re-read as %s, the printed %q being %s by %s", start.Format("2006-01-02"), fixed.Format("2006-01-02"), w.DateRaw, order, by)
 		start = fixed
 	}
+	// Only a date the user settled with -date-order is certain; the document's
+	// convention is the model's own reading of it.
+	if nd, ok := splitNumericDate(w.DateRaw); ok && nd.ambiguous() && a.DateOrder == OrderUnknown {
+		r.doubt(ConfidenceMedium, "the printed date could be day-first or month-first")
+	}
 
 	end := start
 	if w.IsHotel {
@@ -335,6 +427,8 @@ func (a *Analyzer) receiptFrom(w receiptWire, d *doc.Doc) (Receipt, error) {
 		// dates in the wrong order, otherwise yields a backwards name.
 		a.log().Warn("hotel dates arrived reversed, swapping", "path", d.Path,
 			"check_in", end.Format("2006-01-02"), "check_out", start.Format("2006-01-02"))
+		r.doubt(ConfidenceMedium, "hotel dates arrived reversed")
+		t.Corrected("hotel: check-in %s came after check-out %s; swapped", start.Format("2006-01-02"), end.Format("2006-01-02"))
 		start, end = end, start
 	}
 	if end.Sub(start) > maxStay {
@@ -343,6 +437,8 @@ func (a *Analyzer) receiptFrom(w receiptWire, d *doc.Doc) (Receipt, error) {
 		// than that misread, so the range is dropped rather than trusted.
 		a.log().Warn("implausible stay length, using the check-in date alone", "path", d.Path,
 			"check_in", start.Format("2006-01-02"), "check_out", end.Format("2006-01-02"))
+		r.doubt(ConfidenceLow, "implausible stay length, only the check-in date was kept")
+		t.Corrected("hotel: a stay from %s to %s is implausible; check-out dropped", start.Format("2006-01-02"), end.Format("2006-01-02"))
 		end = start
 	}
 	r.StartDate, r.EndDate = start, end
@@ -352,31 +448,173 @@ func (a *Analyzer) receiptFrom(w receiptWire, d *doc.Doc) (Receipt, error) {
 	hasTotal := false
 	if s := strings.TrimSpace(string(w.Total)); s == "" {
 		a.log().Warn("no total in the model output, using 0.00", "path", d.Path)
+		r.doubt(ConfidenceLow, "no total in the model output, 0.00 was used")
+		t.Corrected("total: none in the reply; 0.00 used")
 	} else if v, err := parseMoney(s); err != nil {
 		a.log().Warn("could not read the total, using 0.00", "path", d.Path, "total", s, "err", err)
+		r.doubt(ConfidenceLow, "could not read the total, 0.00 was used")
+		t.Corrected("total: %q could not be read (%v); 0.00 used", s, err)
 	} else {
 		r.Total, hasTotal = v, true
 	}
 
-	if r.Category == "" {
-		r.Category = "Other"
+	r.Subtotal = a.optionalMoney(d, "subtotal", w.Subtotal, t)
+	r.Tax = a.optionalMoney(d, "tax", w.Tax, t)
+	r.Tip = a.optionalMoney(d, "tip", w.Tip, t)
+	r.Payment = strings.TrimSpace(w.Payment)
+	if last4 := strings.TrimSpace(w.CardLast4); last4Re.MatchString(last4) {
+		r.CardLast4 = last4
+	} else if last4 != "" {
+		t.Corrected("card_last4: %q is not four digits; left out", last4)
+	}
+
+	// The model's code first, then one printed beside the total ("12.00 EUR"),
+	// then whatever single currency the document's text names.
+	r.Currency = normalizeCurrency(w.Currency)
+	if r.Currency == "" {
+		r.Currency = currencyIn(string(w.Total))
+	}
+	if r.Currency == "" && d.Kind == doc.KindText {
+		if r.Currency = currencyIn(d.Text); r.Currency != "" {
+			a.log().Debug("currency taken from the document text", "path", d.Path, "currency", r.Currency)
+			t.Corrected("currency: none in the reply; %s taken from the document text", r.Currency)
+		}
+	}
+
+	if category, byRule := a.Categories.settle(r.Vendor, r.Category); category != r.Category {
+		switch {
+		case byRule:
+			a.log().Debug("category set by a vendor rule", "path", d.Path, "vendor", r.Vendor, "model", r.Category, "category", category)
+			t.Corrected("category: %q replaced by %q, a -category-rule matching %q", r.Category, category, r.Vendor)
+		case !strings.EqualFold(category, r.Category):
+			t.Corrected("category: %q is not on the list; %q used", r.Category, category)
+		}
+		r.Category = category
+	}
+	if a.Items {
+		r.Items = a.lineItems(d, w.Items)
+	}
+	if hasTotal && len(r.Items) > 0 && !r.itemsAddUp() {
+		a.log().Warn("line items do not add up to the total", "path", d.Path, "items", len(r.Items), "total", r.Total)
+		r.doubt(ConfidenceMedium, "line items do not add up to the total")
+	}
+	if hasTotal && !r.addsUp() {
+		a.log().Warn("subtotal, tax and tip do not add up to the total", "path", d.Path,
+			"subtotal", deref(r.Subtotal), "tax", deref(r.Tax), "tip", deref(r.Tip), "total", r.Total)
+		r.doubt(ConfidenceLow, "subtotal, tax and tip do not add up to the total")
 	}
 	a.log().Debug("receipt analyzed", "path", d.Path, "vendor", r.Vendor,
-		"category", r.Category, "has_total", hasTotal, "hotel", w.IsHotel)
+		"category", r.Category, "currency", r.Currency, "has_total", hasTotal, "hotel", w.IsHotel)
 	return r, nil
 }
 
+// optionalMoney reads an amount the receipt may not show. Absent and
+// unreadable are both nil: neither is worth failing the file over.
+func (a *Analyzer) optionalMoney(d *doc.Doc, field string, n number, t *Trace) *float64 {
+	s := strings.TrimSpace(string(n))
+	if s == "" {
+		return nil
+	}
+	v, err := parseMoney(s)
+	if err != nil {
+		a.log().Debug("could not read an amount, leaving it out", "path", d.Path, "field", field, "value", s, "err", err)
+		t.Corrected("%s: %q could not be read (%v); left out", field, s, err)
+		return nil
+	}
+	return &v
+}
+
+var last4Re = regexp.MustCompile(`^[0-9]{4}$`)
+
+// lineItems keeps the lines that say what was bought and what it cost. A line
+// missing either is dropped rather than guessed at; the check against the
+// total then shows that something was lost.
+func (a *Analyzer) lineItems(d *doc.Doc, lines []lineWire) []LineItem {
+	var items []LineItem
+	for _, l := range lines {
+		desc := strings.TrimSpace(l.Description)
+		amount, err := parseMoney(string(l.Amount))
+		if desc == "" || err != nil {
+			a.log().Debug("dropping an unreadable line item", "path", d.Path, "description", desc, "amount", string(l.Amount))
+			continue
+		}
+		it := LineItem{Description: desc, Quantity: 1, Amount: amount}
+		if q, err := parseMoney(string(l.Quantity)); err == nil && q > 0 {
+			it.Quantity = q
+		}
+		if s := strings.TrimSpace(string(l.UnitPrice)); s != "" {
+			if v, err := parseMoney(s); err == nil {
+				it.UnitPrice = &v
+			}
+		}
+		items = append(items, it)
+	}
+	return items
+}
+
+// itemsAddUp reports whether the lines sum to the subtotal or to the total,
+// with or without the tax and tip, since receipts disagree on whether tax is
+// itemised.
+func (r Receipt) itemsAddUp() bool {
+	sum := 0.0
+	for _, it := range r.Items {
+		sum += it.Amount
+	}
+	targets := []float64{r.Total, r.Total - deref(r.Tax) - deref(r.Tip), r.Total - deref(r.Tip)}
+	if r.Subtotal != nil {
+		targets = append(targets, *r.Subtotal)
+	}
+	unit := r.unit()
+	for _, want := range targets {
+		if math.Abs(sum-want) <= unit {
+			return true
+		}
+	}
+	return false
+}
+
+// unit is one of the currency's smallest coin, the tolerance for rounding.
+func (r Receipt) unit() float64 {
+	places, ok := minorUnits[r.Currency]
+	if !ok {
+		places = 2
+	}
+	return math.Pow10(-places) + 1e-9
+}
+
+// addsUp reports whether the breakdown agrees with the total to within one
+// unit of the currency's smallest coin. A receipt with no subtotal has nothing
+// to check. Tax is allowed to be already inside the subtotal, as VAT usually
+// is on a European receipt, which prints it as "of which VAT".
+func (r Receipt) addsUp() bool {
+	if r.Subtotal == nil {
+		return true
+	}
+	unit := r.unit()
+	sum := *r.Subtotal + deref(r.Tip)
+	return math.Abs(sum+deref(r.Tax)-r.Total) <= unit || math.Abs(sum-r.Total) <= unit
+}
+
+func deref(v *float64) float64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
 // subjectFrom leaves Date zero when the document states none; the caller falls
 // back to the file's modification time.
-func (a *Analyzer) subjectFrom(w subjectWire, d *doc.Doc) (Subject, error) {
-	s := Subject{Title: strings.TrimSpace(w.Subject)}
+func (a *Analyzer) subjectFrom(w subjectWire, d *doc.Doc, t *Trace) (Subject, error) {
+	s := Subject{Title: strings.TrimSpace(w.Subject), Assessment: Assessment{Confidence: ConfidenceHigh}}
 	if s.Title == "" {
 		return Subject{}, ErrNoSubject
 	}
-	if t, ok := parseDate(w.Date); ok && plausibleDate(t) {
-		s.Date = t
+	if date, ok := parseDate(w.Date); ok && plausibleDate(date) {
+		s.Date = date
 	} else {
 		a.log().Debug("no usable date in the model output", "path", d.Path, "date", w.Date)
+		s.doubt(ConfidenceMedium, "no date in the document, the file's modification time stands in")
+		t.Corrected("date: %q is not a usable date; the file's modification time stands in", w.Date)
 	}
 	return s, nil
 }
@@ -412,6 +650,9 @@ func plausibleDate(t time.Time) bool {
 	return y >= 1970 && y <= time.Now().Year()+10
 }
 
+// ParseAmount reads an amount typed by hand the same way a model's is read.
+func ParseAmount(s string) (float64, error) { return parseMoney(s) }
+
 // parseMoney reads the totals the README has always claimed to support:
 // "1,234.56", "$1,234.56", "1.234,56", "12.00 USD" and "(12.00)".
 func parseMoney(s string) (float64, error) {
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"path/filepath"
 	"reflect"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -411,8 +412,9 @@ func TestSchemasAreWellFormed(t *testing.T) {
 	t.Parallel()
 
 	schemas := map[string]json.RawMessage{
-		"ReceiptSchema":  analyze.ReceiptSchema,
-		"OrganizeSchema": analyze.OrganizeSchema,
+		"ReceiptSchema":      analyze.ReceiptSchema,
+		"ReceiptItemsSchema": analyze.ReceiptItemsSchema,
+		"OrganizeSchema":     analyze.OrganizeSchema,
 	}
 	for name, raw := range schemas {
 		var s struct {
@@ -1277,3 +1279,472 @@ func TestUnsetDateOrderLeavesTheDocumentInCharge(t *testing.T) {
 		t.Errorf("ReceiptName() = %q, want %q", got, want)
 	}
 }
+
+func TestCurrencyIsReadAndNormalised(t *testing.T) {
+	tests := []struct {
+		name     string
+		currency string // the model's answer; "-" leaves the field out
+		total    string
+		text     string
+		want     string
+	}{
+		{"model's code", "JPY", "1200", "receipt text", "JPY"},
+		{"lowercase code", "eur", "12.5", "receipt text", "EUR"},
+		{"symbol instead of a code", "£", "12.5", "receipt text", "GBP"},
+		{"junk is no currency", "dollars", "12.5", "receipt text", ""},
+		{"printed beside the total", "", `"12.00 CHF"`, "receipt text", "CHF"},
+		{"from the document text", "-", "12.5", "Café Luna\nSUMME 12,50 €", "EUR"},
+		{"HK$ is not S$", "", "88", "Total HK$88.00", "HKD"},
+		{"a bare $ says nothing", "", "12.5", "TOTAL $12.50", ""},
+		{"nor does a bare ¥", "", "12.5", "合计 ¥12.50", ""},
+		{"nor does ¥ from the model", "¥", "12.5", "receipt text", ""},
+		{"two currencies say nothing", "", "12.5", "12.50 EUR = 13.40 USD", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := fmt.Sprintf(`{"is_hotel":false,"vendor":"Shop","date":"2024-03-01","end_date":"","total":%s,"currency":%q,"category":"Food"}`, tt.total, tt.currency)
+			if tt.currency == "-" {
+				reply = receiptReply(false, "Shop", "2024-03-01", "", tt.total, "Food")
+			}
+			a, _ := newAnalyzer(t, reply)
+			r, err := a.Receipt(context.Background(), textDoc(tt.text))
+			if err != nil {
+				t.Fatalf("Receipt: %v", err)
+			}
+			if r.Currency != tt.want {
+				t.Errorf("Currency = %q, want %q", r.Currency, tt.want)
+			}
+		})
+	}
+}
+
+func TestTotalsUseTheCurrencysDecimals(t *testing.T) {
+	for _, tt := range []struct {
+		total    float64
+		currency string
+		want     string
+	}{
+		{1200, "JPY", "1200"},
+		{35000, "KRW", "35000"},
+		{12.5, "KWD", "12.500"},
+		{12.5, "EUR", "12.50"},
+		{12.5, "", "12.50"},
+	} {
+		if got := analyze.FormatTotal(tt.total, tt.currency); got != tt.want {
+			t.Errorf("FormatTotal(%v, %q) = %q, want %q", tt.total, tt.currency, got, tt.want)
+		}
+	}
+
+	yen := analyze.Receipt{StartDate: day(2024, 3, 1), EndDate: day(2024, 3, 1), Total: 1200, Currency: "JPY", Vendor: "Lawson", Category: "Food"}
+	dollars := yen
+	dollars.Currency = "USD"
+	if a, b := analyze.ReceiptName(yen, ".jpg"), analyze.ReceiptName(dollars, ".jpg"); a == b || a != "03-01-2024 - 1200 - Lawson - Food.jpg" {
+		t.Errorf("names = %q and %q, want ¥1200 written as 1200 and unlike $1200", a, b)
+	}
+	nt, err := analyze.ParseNameTemplate("{{.Vendor}} {{.Total}} {{.Currency}}", analyze.ReceiptTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := nt.Receipt(yen, "scan", ".jpg"); got != "Lawson 1200 JPY.jpg" {
+		t.Errorf("template name = %q", got)
+	}
+}
+
+func breakdownReply(total, subtotal, tax, tip, last4 string) string {
+	return fmt.Sprintf(`{"is_hotel":false,"vendor":"Bistro","date":"2024-03-01","end_date":"","total":%s,"subtotal":%q,"tax":%q,"tip":%q,"payment_method":"Visa","card_last4":%q,"currency":"USD","category":"Food"}`,
+		total, subtotal, tax, tip, last4)
+}
+
+func TestBreakdownAndPaymentAreRead(t *testing.T) {
+	r := mustReceipt(t, breakdownReply("57.50", "$45.00", "3.50", "9.00", "4242"))
+	if r.Subtotal == nil || *r.Subtotal != 45 || r.Tax == nil || *r.Tax != 3.5 || r.Tip == nil || *r.Tip != 9 {
+		t.Errorf("breakdown = %v %v %v, want 45, 3.5 and 9", r.Subtotal, r.Tax, r.Tip)
+	}
+	if r.Payment != "Visa" || r.CardLast4 != "4242" {
+		t.Errorf("payment = %q %q", r.Payment, r.CardLast4)
+	}
+	if len(r.Doubts) != 0 {
+		t.Errorf("Doubts = %q, want none for a receipt that adds up", r.Doubts)
+	}
+}
+
+func TestBreakdownConsistency(t *testing.T) {
+	tests := []struct {
+		name                 string
+		total, sub, tax, tip string
+		doubt                bool
+	}{
+		{"adds up", "57.50", "45.00", "3.50", "9.00", false},
+		{"rounding", "10.00", "9.26", "0.74", "", false},
+		{"VAT already inside the subtotal", "11.90", "11.90", "1.90", "", false},
+		{"no subtotal, nothing to check", "20.00", "", "1.00", "", false},
+		{"a misread subtotal", "57.50", "50.00", "3.50", "9.00", true},
+		{"missing tip", "57.50", "45.00", "3.50", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mustReceipt(t, breakdownReply(tt.total, tt.sub, tt.tax, tt.tip, ""))
+			if got := len(r.Doubts) > 0; got != tt.doubt {
+				t.Errorf("Doubts = %q, want doubt %t", r.Doubts, tt.doubt)
+			}
+		})
+	}
+}
+
+func TestBreakdownFieldsAreOptional(t *testing.T) {
+	r := mustReceipt(t, breakdownReply("12.00", "", "n/a", "", "4111111111111111"))
+	if r.Subtotal != nil || r.Tax != nil || r.Tip != nil {
+		t.Errorf("breakdown = %v %v %v, want all absent", r.Subtotal, r.Tax, r.Tip)
+	}
+	if r.CardLast4 != "" {
+		t.Errorf("CardLast4 = %q, want a full card number refused", r.CardLast4)
+	}
+	// An answer from before the breakdown existed still reads.
+	if r := mustReceipt(t, receiptReply(false, "Shop", "2024-03-01", "", "5", "Food")); r.Subtotal != nil || len(r.Doubts) != 0 {
+		t.Errorf("old-shape reply = %+v", r)
+	}
+}
+
+func itemsReply(total, subtotal string, lines ...string) string {
+	return fmt.Sprintf(`{"is_hotel":false,"vendor":"Deli","date":"2024-03-01","end_date":"","total":%s,"subtotal":%q,"tax":"","tip":"","payment_method":"","card_last4":"","currency":"USD","category":"Food","items":[%s]}`,
+		total, subtotal, strings.Join(lines, ","))
+}
+
+func TestLineItemsAreRead(t *testing.T) {
+	a, f := newAnalyzer(t, itemsReply("9.50", "9.50",
+		`{"description":"Coffee","quantity":2,"unit_price":"$2.50","amount":"5.00"}`,
+		`{"description":"Bagel","quantity":1,"unit_price":"","amount":"4.50"}`,
+		`{"description":"","quantity":1,"unit_price":"","amount":"1.00"}`,
+	))
+	a.Items = true
+	r, err := a.Receipt(context.Background(), textDoc("receipt text"))
+	if err != nil {
+		t.Fatalf("Receipt: %v", err)
+	}
+	if len(r.Items) != 2 {
+		t.Fatalf("Items = %+v, want the two readable lines", r.Items)
+	}
+	if it := r.Items[0]; it.Description != "Coffee" || it.Quantity != 2 || it.UnitPrice == nil || *it.UnitPrice != 2.5 || it.Amount != 5 {
+		t.Errorf("Items[0] = %+v", it)
+	}
+	if it := r.Items[1]; it.UnitPrice != nil || it.Amount != 4.5 {
+		t.Errorf("Items[1] = %+v, want no unit price", it)
+	}
+	if len(r.Doubts) != 0 {
+		t.Errorf("Doubts = %q, want none for lines that add up", r.Doubts)
+	}
+
+	var schema struct {
+		Properties struct {
+			Items struct {
+				MaxItems int `json:"maxItems"`
+			} `json:"items"`
+		} `json:"properties"`
+	}
+	raw, _ := json.Marshal(request(t, f, 0)["format"])
+	if err := json.Unmarshal(raw, &schema); err != nil || schema.Properties.Items.MaxItems == 0 {
+		t.Errorf("request format = %s, want the items schema with a bounded array", raw)
+	}
+}
+
+func TestLineItemsThatDoNotAddUpAreDoubted(t *testing.T) {
+	a, _ := newAnalyzer(t, itemsReply("12.00", "",
+		`{"description":"Soup","quantity":1,"unit_price":"","amount":"6.00"}`,
+	))
+	a.Items = true
+	r, err := a.Receipt(context.Background(), textDoc("receipt text"))
+	if err != nil {
+		t.Fatalf("Receipt: %v", err)
+	}
+	if !slices.Contains(r.Doubts, "line items do not add up to the total") {
+		t.Errorf("Doubts = %q, want the line items doubted", r.Doubts)
+	}
+}
+
+// Items is off by default: the shallow schema is the fast one.
+func TestLineItemsAreOptIn(t *testing.T) {
+	a, f := newAnalyzer(t, itemsReply("9.50", "", `{"description":"Coffee","quantity":1,"unit_price":"","amount":"9.50"}`))
+	r, err := a.Receipt(context.Background(), textDoc("receipt text"))
+	if err != nil {
+		t.Fatalf("Receipt: %v", err)
+	}
+	if len(r.Items) != 0 {
+		t.Errorf("Items = %+v, want none without -items", r.Items)
+	}
+	if raw, _ := json.Marshal(request(t, f, 0)["format"]); strings.Contains(string(raw), `"items"`) {
+		t.Errorf("request format asks for items without -items: %s", raw)
+	}
+	withItems := &analyze.Analyzer{Model: testModel, Items: true}
+	if a.ReceiptFingerprint() == withItems.ReceiptFingerprint() {
+		t.Error("ReceiptFingerprint is the same with and without Items, so the cache would mix them")
+	}
+}
+
+func TestConfidence(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		order analyze.DateOrder
+		want  analyze.Confidence
+	}{
+		{"clean", receiptReply(false, "Shop", "2024-03-01", "", "5", "Food"), analyze.OrderUnknown, analyze.ConfidenceHigh},
+		{"missing total", `{"is_hotel":false,"vendor":"Shop","date":"2024-03-01","end_date":"","category":"Food"}`, analyze.OrderUnknown, analyze.ConfidenceLow},
+		{"reversed hotel dates", receiptReply(true, "Inn", "2024-03-05", "2024-03-01", "300", "Lodging"), analyze.OrderUnknown, analyze.ConfidenceMedium},
+		{"implausible stay", receiptReply(true, "Inn", "2024-01-01", "2024-06-01", "300", "Lodging"), analyze.OrderUnknown, analyze.ConfidenceLow},
+		{"ambiguous date", `{"is_hotel":false,"vendor":"Shop","date_raw":"06/03/2025","date_order":"day-first","date":"2025-03-06","end_date":"","total":5,"category":"Food"}`, analyze.OrderUnknown, analyze.ConfidenceMedium},
+		{"ambiguous date settled by -date-order", `{"is_hotel":false,"vendor":"Shop","date_raw":"06/03/2025","date_order":"day-first","date":"2025-03-06","end_date":"","total":5,"category":"Food"}`, analyze.OrderDayFirst, analyze.ConfidenceHigh},
+		{"rescued date", `{"is_hotel":false,"vendor":"Shop","date_raw":"March 4, 2024","date":"0682-20-23","end_date":"","total":5,"category":"Food"}`, analyze.OrderUnknown, analyze.ConfidenceLow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := newAnalyzer(t, tt.reply)
+			a.DateOrder = tt.order
+			r, err := a.Receipt(context.Background(), textDoc("receipt text"))
+			if err != nil {
+				t.Fatalf("Receipt: %v", err)
+			}
+			if r.Confidence != tt.want {
+				t.Errorf("Confidence = %v, want %v (doubts %q)", r.Confidence, tt.want, r.Doubts)
+			}
+			if (tt.want == analyze.ConfidenceHigh) != (len(r.Doubts) == 0) {
+				t.Errorf("Doubts = %q, want a reason exactly when confidence is lowered", r.Doubts)
+			}
+		})
+	}
+}
+
+func TestSubjectWithoutDateIsDoubted(t *testing.T) {
+	a, _ := newAnalyzer(t, `{"date":"","subject":"Lease Agreement"}`)
+	s, err := a.Subject(context.Background(), textDoc("a lease"))
+	if err != nil {
+		t.Fatalf("Subject: %v", err)
+	}
+	if s.Confidence != analyze.ConfidenceMedium || len(s.Doubts) != 1 {
+		t.Errorf("assessment = %v %q, want medium with one reason", s.Confidence, s.Doubts)
+	}
+}
+
+func TestAssessmentBelow(t *testing.T) {
+	low := analyze.Assessment{Confidence: analyze.ConfidenceLow}
+	if !low.Below(analyze.ConfidenceMedium) || low.Below(analyze.ConfidenceLow) {
+		t.Error("low is below medium and not below low")
+	}
+	if (analyze.Assessment{}).Below(analyze.ConfidenceHigh) {
+		t.Error("an unassessed answer must not be held back")
+	}
+	if c, ok := analyze.ParseConfidence(" Medium "); !ok || c != analyze.ConfidenceMedium || c.String() != "medium" {
+		t.Errorf("ParseConfidence = %v, %t", c, ok)
+	}
+	if _, ok := analyze.ParseConfidence("sure"); ok {
+		t.Error("ParseConfidence accepted \"sure\"")
+	}
+}
+
+func TestMisread(t *testing.T) {
+	a, _ := newAnalyzer(t, `{"vendor":"","date":"2024-03-01"}`, `not json`)
+	_, err := a.Receipt(context.Background(), textDoc("receipt text"))
+	if !analyze.Misread(err) {
+		t.Errorf("Misread(%v) = false, want a missing vendor to count", err)
+	}
+	a, _ = newAnalyzer(t, `not json`)
+	if _, err := a.Receipt(context.Background(), textDoc("receipt text")); !analyze.Misread(err) {
+		t.Errorf("Misread(%v) = false, want unparseable JSON to count", err)
+	}
+	if analyze.Misread(errors.New("connection refused")) || analyze.Misread(nil) {
+		t.Error("Misread counts an error that is not about the answer")
+	}
+}
+
+func TestCustomCategories(t *testing.T) {
+	cats, err := analyze.NewCategories(
+		[]string{"6100 Travel-Air", "Hotel", "Food", "Software", "6999 Misc"},
+		[]string{"starbucks=Food", `^aws\b=software`},
+	)
+	if err != nil {
+		t.Fatalf("NewCategories: %v", err)
+	}
+	tests := []struct {
+		vendor, category, want string
+	}{
+		{"Delta", "6100 Travel-Air", "6100 Travel-Air"},
+		{"Marriott", "hotel", "Hotel"},
+		{"STARBUCKS #1234", "Software", "Food"},
+		{"AWS EMEA", "Food", "Software"},
+		{"Corner Shop", "Lodging", "6999 Misc"}, // off the list: the catch-all, last
+	}
+	for _, tc := range tests {
+		a, f := newAnalyzer(t, receiptReply(false, tc.vendor, "2024-03-01", "", "5", tc.category))
+		a.Categories = cats
+		r, err := a.Receipt(context.Background(), textDoc("receipt text"))
+		if err != nil {
+			t.Fatalf("%s: Receipt: %v", tc.vendor, err)
+		}
+		if r.Category != tc.want {
+			t.Errorf("%s/%s: Category = %q, want %q", tc.vendor, tc.category, r.Category, tc.want)
+		}
+		raw, _ := json.Marshal(request(t, f, 0)["format"])
+		if !strings.Contains(string(raw), `"6100 Travel-Air"`) || strings.Contains(string(raw), `"Lodging"`) {
+			t.Errorf("schema enum is not the custom list: %s", raw)
+		}
+	}
+
+	plain := &analyze.Analyzer{Model: testModel}
+	if (&analyze.Analyzer{Model: testModel, Categories: cats}).ReceiptFingerprint() == plain.ReceiptFingerprint() {
+		t.Error("ReceiptFingerprint ignores the categories, so the cache would mix them")
+	}
+	rulesOnly, _ := analyze.NewCategories(nil, []string{"starbucks=Food"})
+	if (&analyze.Analyzer{Model: testModel, Categories: rulesOnly}).ReceiptFingerprint() == plain.ReceiptFingerprint() {
+		t.Error("ReceiptFingerprint ignores the rules, so the cache would mix them")
+	}
+}
+
+func TestNewCategoriesRejects(t *testing.T) {
+	for _, tc := range []struct {
+		names, rules []string
+	}{
+		{[]string{"Food", "food"}, nil},
+		{nil, []string{"starbucks"}},
+		{nil, []string{"starbucks=Coffee"}},
+		{nil, []string{"(=Food"}},
+		{[]string{"Hotel"}, []string{"marriott=Lodging"}},
+	} {
+		if _, err := analyze.NewCategories(tc.names, tc.rules); err == nil {
+			t.Errorf("NewCategories(%q, %q) = nil error", tc.names, tc.rules)
+		}
+	}
+}
+
+func TestVendorKey(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"STARBUCKS #10234", "starbucks"},
+		{"Starbucks Store 0452", "starbucks"},
+		{"TEST STORE #0452", "test store"},
+		{"Joe's Café", "joes café"},
+		{"Target  T-1234", "target t 1234"},
+		{"Walgreens 04512", "walgreens 04512"}, // only the table knows it is a branch
+		{"Hotel 1000", "hotel 1000"},
+		{"Studio 54", "studio 54"},
+		{"7-Eleven", "7 eleven"},
+	} {
+		if got := analyze.VendorKey(tc.in); got != tc.want {
+			t.Errorf("VendorKey(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestVendorAliases(t *testing.T) {
+	v, err := analyze.ParseVendors(strings.NewReader(`
+# coffee
+SBUX = Starbucks
+Starbucks
+amzn mktp us = Amazon
+Amazon.com = Amazon
+`))
+	if err != nil {
+		t.Fatalf("ParseVendors: %v", err)
+	}
+	for in, want := range map[string]string{
+		"STARBUCKS #10234": "Starbucks",
+		"sbux 0452":        "Starbucks",
+		"AMZN Mktp US":     "Amazon",
+		"amazon.com":       "Amazon",
+		"Corner Shop #12":  "Corner Shop #12", // unknown and not learning: as read
+		"Amazon 1001":      "Amazon",
+		"Club 1001":        "Club 1001",
+	} {
+		if got := v.Canonical(in); got != want {
+			t.Errorf("Canonical(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if v.HasLearned() {
+		t.Error("HasLearned without Learn")
+	}
+	if _, err := analyze.ParseVendors(strings.NewReader("= Starbucks\n")); err == nil {
+		t.Error("ParseVendors took a line with no alias")
+	}
+}
+
+func TestVendorsLearn(t *testing.T) {
+	v := &analyze.Vendors{Learn: true}
+	if got := v.Canonical("Corner Shop #12"); got != "Corner Shop" {
+		t.Errorf("Canonical = %q, want the store number stripped", got)
+	}
+	if got := v.Canonical("CORNER SHOP 0031"); got != "Corner Shop" {
+		t.Errorf("Canonical = %q, want the spelling learned first", got)
+	}
+	if got := v.Canonical("Hotel 1000"); got != "Hotel 1000" {
+		t.Errorf("Canonical = %q, want a bare number kept for a new name", got)
+	}
+	v.Correct("Corner Shop", "Corner Shop")
+	v.Correct("Bobs Diner", "Bob's Diner")
+
+	var b strings.Builder
+	if err := v.WriteLearned(&b); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Corner Shop\nHotel 1000\nBobs Diner = Bob's Diner\n"; b.String() != want {
+		t.Errorf("WriteLearned = %q, want %q", b.String(), want)
+	}
+	if v.HasLearned() {
+		t.Error("WriteLearned did not forget what it wrote")
+	}
+	again, err := analyze.ParseVendors(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatalf("ParseVendors(WriteLearned): %v", err)
+	}
+	if got := again.Canonical("BOBS DINER"); got != "Bob's Diner" {
+		t.Errorf("read back: Canonical = %q, want %q", got, "Bob's Diner")
+	}
+}
+
+func TestVendorFromName(t *testing.T) {
+	for _, tc := range []struct {
+		base, want string
+		ok         bool
+	}{
+		{"01-15-2023 - 123.45 - Test_Store - Food.pdf", "Test Store", true},
+		{"03-01-2024 to 03-03-2024 - 412.00 - Hotel_Zed - Lodging (2).pdf", "Hotel Zed", true},
+		{"2024-03-01 - Lease Renewal.pdf", "", false},
+		{"scan0001.jpg", "", false},
+	} {
+		got, ok := analyze.VendorFromName(tc.base)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("VendorFromName(%q) = %q, %v, want %q, %v", tc.base, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestTraceRecordsCallsAndCorrections(t *testing.T) {
+	a, _ := newAnalyzer(t, "not json", receiptReply(true, "Inn", "2024-03-05", "2024-03-01", `""`, "Lodging"))
+	trace := &analyze.Trace{}
+	d := textDoc("receipt text")
+	if _, err := a.Receipt(analyze.WithTrace(context.Background(), trace), d); err != nil {
+		t.Fatalf("Receipt: %v", err)
+	}
+
+	if len(trace.Calls) != 2 {
+		t.Fatalf("Calls = %d, want the first and the retry", len(trace.Calls))
+	}
+	first, retry := trace.Calls[0], trace.Calls[1]
+	if first.Reply != "not json" || first.Seed != 42 || retry.Seed != 43 || first.Context == 0 || first.MaxTokens == 0 {
+		t.Errorf("calls = %+v", trace.Calls)
+	}
+	if !strings.Contains(first.Prompt, "receipt text") || !strings.HasPrefix(retry.Prompt, "Your previous reply could not be used") {
+		t.Errorf("prompts = %q, %q", first.Prompt, retry.Prompt)
+	}
+	want := []string{
+		"hotel: check-in 2024-03-05 came after check-out 2024-03-01; swapped",
+		"total: none in the reply; 0.00 used",
+	}
+	if !slices.Equal(trace.Corrections, want) {
+		t.Errorf("Corrections = %q, want %q", trace.Corrections, want)
+	}
+
+	// Without a trace on the context nothing is recorded, and nothing breaks.
+	if _, err := a.Receipt(context.Background(), d); err != nil {
+		t.Fatalf("Receipt without a trace: %v", err)
+	}
+	if len(trace.Calls) != 2 {
+		t.Errorf("Calls = %d after an untraced call, want 2", len(trace.Calls))
+	}
+}
@@ -0,0 +1,123 @@
+package analyze
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultCategories is what the model chooses from unless the user names a list
+// of their own.
+var DefaultCategories = []string{"Airfare", "Lodging", "Food", "Transportation", "Fuel", "Groceries", "Software", "Office", "Utilities", "Medical", "Entertainment", "Other"}
+
+// catchAll is the category of a receipt the model could not place.
+const catchAll = "Other"
+
+// Categories is the list a receipt's category comes from, and the rules that
+// decide it by vendor whatever the model chose. The zero value, like nil, is
+// DefaultCategories with no rules.
+type Categories struct {
+	Names []string
+	Rules []CategoryRule
+}
+
+// CategoryRule files every vendor Vendor matches under Category.
+type CategoryRule struct {
+	Vendor   *regexp.Regexp
+	Category string
+}
+
+// NewCategories checks a category list and compiles rules written as
+// REGEX=CATEGORY. An empty list is DefaultCategories. A rule's regular
+// expression ignores case, and its category must be one of the list.
+func NewCategories(names, rules []string) (*Categories, error) {
+	c := &Categories{}
+	seen := make(map[string]bool)
+	for _, n := range names {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		if seen[strings.ToLower(n)] {
+			return nil, fmt.Errorf("category %q is listed twice", n)
+		}
+		seen[strings.ToLower(n)] = true
+		c.Names = append(c.Names, n)
+	}
+	for _, r := range rules {
+		i := strings.LastIndex(r, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("rule %q is not REGEX=CATEGORY", r)
+		}
+		pattern, category := strings.TrimSpace(r[:i]), strings.TrimSpace(r[i+1:])
+		name, ok := c.Lookup(category)
+		if pattern == "" || !ok {
+			return nil, fmt.Errorf("rule %q: %q is not one of the categories", r, category)
+		}
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r, err)
+		}
+		c.Rules = append(c.Rules, CategoryRule{Vendor: re, Category: name})
+	}
+	return c, nil
+}
+
+// List is the categories in effect: the user's own, or DefaultCategories.
+func (c *Categories) List() []string {
+	if c == nil || len(c.Names) == 0 {
+		return DefaultCategories
+	}
+	return c.Names
+}
+
+// Lookup finds category in the list whatever its case, and returns it as the
+// list spells it.
+func (c *Categories) Lookup(category string) (string, bool) {
+	for _, n := range c.List() {
+		if strings.EqualFold(n, category) {
+			return n, true
+		}
+	}
+	return "", false
+}
+
+// settle is the category a receipt from vendor is filed under. The first rule
+// that matches decides; otherwise the model's choice stands if it is on the
+// list. Off the built-in list, a choice a server let past the schema is still
+// kept, as it always was; off a list of the user's own, which an accounting
+// system depends on, it goes to "Other", or to the last category of a list
+// that has none, which is where a catch-all belongs.
+func (c *Categories) settle(vendor, chosen string) (category string, byRule bool) {
+	custom := c != nil && len(c.Names) > 0
+	if c != nil {
+		for _, r := range c.Rules {
+			if r.Vendor.MatchString(vendor) {
+				return r.Category, true
+			}
+		}
+	}
+	if n, ok := c.Lookup(chosen); ok {
+		return n, false
+	}
+	if chosen != "" && !custom {
+		return chosen, false
+	}
+	if n, ok := c.Lookup(catchAll); ok {
+		return n, false
+	}
+	names := c.List()
+	return names[len(names)-1], false
+}
+
+// fingerprint is what of c changes an answer beyond the schema: the rules.
+func (c *Categories) fingerprint() string {
+	if c == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, r := range c.Rules {
+		fmt.Fprintf(&b, "%s=%s\x00", r.Vendor, r.Category)
+	}
+	return b.String()
+}
@@ -0,0 +1,62 @@
+package analyze
+
+import "strings"
+
+// Confidence is how far an answer can be trusted without a look at the
+// document. The zero value means the answer was never assessed.
+type Confidence int
+
+const (
+	ConfidenceLow Confidence = iota + 1
+	ConfidenceMedium
+	ConfidenceHigh
+)
+
+func (c Confidence) String() string {
+	switch c {
+	case ConfidenceLow:
+		return "low"
+	case ConfidenceMedium:
+		return "medium"
+	case ConfidenceHigh:
+		return "high"
+	}
+	return ""
+}
+
+// ParseConfidence reads the -min-confidence flag.
+func ParseConfidence(s string) (Confidence, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "low":
+		return ConfidenceLow, true
+	case "medium":
+		return ConfidenceMedium, true
+	case "high":
+		return ConfidenceHigh, true
+	}
+	return 0, false
+}
+
+// Assessment is what the analyzer thinks of its own answer. Confidence starts
+// high and each doubt can only lower it, so one serious doubt is never diluted
+// by the fields that read cleanly.
+type Assessment struct {
+	Confidence Confidence
+
+	// Doubts are the reasons to check the answer by hand, in the words the log
+	// uses. An empty list means nothing looked wrong.
+	Doubts []string
+}
+
+func (a *Assessment) doubt(c Confidence, reason string) {
+	if a.Confidence == 0 || c < a.Confidence {
+		a.Confidence = c
+	}
+	a.Doubts = append(a.Doubts, reason)
+}
+
+// Below reports whether the answer is less certain than min. An answer that was
+// never assessed is not held back.
+func (a Assessment) Below(min Confidence) bool {
+	return a.Confidence != 0 && a.Confidence < min
+}
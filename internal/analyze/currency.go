@@ -0,0 +1,120 @@
+package analyze
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// currencyPattern admits an ISO 4217 code or nothing, anchored as datePattern
+// is and for the same reason.
+const currencyPattern = `^([A-Z]{3})?$`
+
+// minorUnits lists the currencies that do not use two decimals. A yen total is
+// whole yen: writing ¥1200 as 1200.00 reads as a misplaced decimal point.
+var minorUnits = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// FormatTotal writes v with as many decimals as currency uses; an unknown or
+// empty currency gets two, as every name had before currencies were read.
+func FormatTotal(v float64, currency string) string {
+	places, ok := minorUnits[currency]
+	if !ok {
+		places = 2
+	}
+	return strconv.FormatFloat(v, 'f', places, 64)
+}
+
+// currencySymbols are the signs that name one currency. "$" is not here: it is
+// the dollar of a dozen countries, kr is three different crowns, and ¥ is the
+// yuan's sign as well as the yen's.
+var currencySymbols = map[string]string{
+	"€":  "EUR",
+	"£":  "GBP",
+	"₩":  "KRW",
+	"₹":  "INR",
+	"₽":  "RUB",
+	"₺":  "TRY",
+	"₪":  "ILS",
+	"₫":  "VND",
+	"฿":  "THB",
+	"zł": "PLN",
+}
+
+// dollars are the dollars that say whose they are.
+var dollars = map[string]string{
+	"US$": "USD",
+	"C$":  "CAD",
+	"A$":  "AUD",
+	"NZ$": "NZD",
+	"R$":  "BRL",
+	"HK$": "HKD",
+	"S$":  "SGD",
+}
+
+// knownCodes are the codes looked for in a document's text. Any three capitals
+// are accepted from the model, which was asked for a code, but a document is
+// full of words like TAX and THE.
+var knownCodes = []string{
+	"AED", "AUD", "BRL", "CAD", "CHF", "CLP", "CNY", "CZK", "DKK", "EUR", "GBP",
+	"HKD", "HUF", "IDR", "ILS", "INR", "ISK", "JPY", "KRW", "MXN", "MYR", "NOK",
+	"NZD", "PHP", "PLN", "RUB", "SAR", "SEK", "SGD", "THB", "TRY", "TWD", "USD",
+	"VND", "ZAR",
+}
+
+var (
+	codeRe   = regexp.MustCompile(`^[A-Z]{3}$`)
+	codeInRe = regexp.MustCompile(`\b(` + strings.Join(knownCodes, "|") + `)\b`)
+	// The longer prefixes come first so "HK$" is not read as "S$"'s neighbour.
+	dollarInRe = regexp.MustCompile(`\b(US|NZ|HK|C|A|R|S)\$`)
+)
+
+// normalizeCurrency accepts the model's answer as a code in any case, or as one
+// of the unambiguous symbols, and returns "" for anything else.
+func normalizeCurrency(s string) string {
+	s = strings.TrimSpace(s)
+	if code, ok := currencySymbols[s]; ok {
+		return code
+	}
+	if code, ok := dollars[strings.ToUpper(s)]; ok {
+		return code
+	}
+	if s = strings.ToUpper(s); codeRe.MatchString(s) {
+		return s
+	}
+	return ""
+}
+
+// currencyIn finds the one currency s names, from the same evidence the prompt
+// already tells the model to read for the date order: a code such as EUR, GBP
+// or USD, or an unambiguous symbol. It returns "" when s names none, or more
+// than one, since a receipt quoting a conversion is no evidence either way.
+func currencyIn(s string) string {
+	found := ""
+	note := func(code string) bool {
+		if found != "" && found != code {
+			return false
+		}
+		found = code
+		return true
+	}
+	for _, m := range codeInRe.FindAllString(s, -1) {
+		if !note(m) {
+			return ""
+		}
+	}
+	for _, m := range dollarInRe.FindAllString(s, -1) {
+		if !note(dollars[m]) {
+			return ""
+		}
+	}
+	for sym, code := range currencySymbols {
+		if strings.Contains(s, sym) && !note(code) {
+			return ""
+		}
+	}
+	return found
+}
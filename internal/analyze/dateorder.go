@@ -15,6 +15,17 @@ const (
 	OrderMonthFirst
 )
 
+// String is the name -date-order and the schema's date_order give o.
+func (o DateOrder) String() string {
+	switch o {
+	case OrderDayFirst:
+		return "day-first"
+	case OrderMonthFirst:
+		return "month-first"
+	}
+	return "unknown"
+}
+
 // ParseDateOrder reads the -date-order flag. Anything unrecognised, including
 // "auto", leaves the decision to the document.
 func ParseDateOrder(s string) DateOrder { return parseOrder(s) }
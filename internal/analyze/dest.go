@@ -0,0 +1,88 @@
+package analyze
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/rename"
+)
+
+// DestTemplate is a -dest pattern: a directory whose folders below a fixed
+// root may be templates over the same fields as -template, as in
+// "/home/me/Archive/{{year}}/{{category}}".
+//
+// Every "/" in the pattern separates two folders, and no field can add one: a
+// rendered folder goes through the filename sanitizer, so a category of
+// "../../etc" names one odd folder under the root rather than leaving it.
+type DestTemplate struct {
+	root    string
+	folders []*template.Template
+}
+
+// ParseDestTemplate splits pattern at its first template action into a literal
+// root and templated folders, and renders the sample fields once so a mistake
+// is caught before the first file is read.
+func ParseDestTemplate(pattern string) (*DestTemplate, error) {
+	if strings.TrimSpace(pattern) == "" {
+		return nil, errors.New("empty destination")
+	}
+	slashed := filepath.ToSlash(pattern)
+	root, rest := slashed, ""
+	if i := strings.Index(slashed, "{{"); i >= 0 {
+		cut := strings.LastIndex(slashed[:i], "/")
+		root, rest = slashed[:cut+1], slashed[cut+1:]
+	}
+	if root == "" {
+		root = "."
+	}
+	dt := &DestTemplate{root: filepath.Clean(filepath.FromSlash(root))}
+	for _, folder := range strings.Split(rest, "/") {
+		if folder == "" {
+			continue
+		}
+		t, err := newTemplate("dest", folder)
+		if err != nil {
+			return nil, err
+		}
+		dt.folders = append(dt.folders, t)
+	}
+	if _, err := dt.render(sampleFields); err != nil {
+		return nil, err
+	}
+	return dt, nil
+}
+
+// Receipt returns the directory r belongs in.
+func (dt *DestTemplate) Receipt(r Receipt, original string) (string, error) {
+	return dt.render(receiptFields(r, original))
+}
+
+// Subject returns the directory s belongs in.
+func (dt *DestTemplate) Subject(s Subject, original string) (string, error) {
+	return dt.render(subjectFields(s, original))
+}
+
+func (dt *DestTemplate) render(f NameFields) (string, error) {
+	parts := []string{dt.root}
+	for _, t := range dt.folders {
+		out, err := execute(t, f)
+		if err != nil {
+			return "", err
+		}
+		// A folder for a field the document did not have still has to exist,
+		// and "Unknown" says why better than the sanitizer's "Untitled".
+		name := "Unknown"
+		if strings.TrimSpace(out) != "" {
+			name = rename.SanitizeFilename(out, "")
+		}
+		// Assertion, not a repair: unreachable if the sanitizer is correct.
+		if !rename.IsSafeBase(name) {
+			return "", fmt.Errorf("%w: %q", rename.ErrUnsafeName, name)
+		}
+		parts = append(parts, name)
+	}
+	return filepath.Join(parts...), nil
+}
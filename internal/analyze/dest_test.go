@@ -0,0 +1,65 @@
+package analyze_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/analyze"
+)
+
+func TestDestTemplate(t *testing.T) {
+	t.Parallel()
+
+	r := analyze.Receipt{StartDate: day(2023, 1, 15), EndDate: day(2023, 1, 15), Total: 12.5, Vendor: "Test Store", Category: "Food"}
+	root := filepath.Join(t.TempDir(), "Archive")
+	tests := []struct {
+		name    string
+		pattern string
+		r       analyze.Receipt
+		want    string
+	}{
+		{"year and category", root + "/{{year}}/{{category}}", r, filepath.Join(root, "2023", "Food")},
+		{"field syntax", root + "/{{.Date.Year}}/{{month}}", r, filepath.Join(root, "2023", "01")},
+		{"literal only", root, r, root},
+		{"mixed folder", root + "/FY{{year}}-{{lower .Category}}", r, filepath.Join(root, "FY2023-food")},
+		// A field cannot climb out of the root or add a level.
+		{"traversal in the category", root + "/{{category}}", analyze.Receipt{StartDate: day(2023, 1, 15), Vendor: "x", Category: "../../etc"}, filepath.Join(root, "etc")},
+		{"missing date", root + "/{{year}}", analyze.Receipt{Vendor: "x"}, filepath.Join(root, "Unknown")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			dt, err := analyze.ParseDestTemplate(tt.pattern)
+			if err != nil {
+				t.Fatalf("ParseDestTemplate(%q): %v", tt.pattern, err)
+			}
+			got, err := dt.Receipt(tt.r, "scan")
+			if err != nil || got != tt.want {
+				t.Errorf("Receipt = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDestTemplateSubject(t *testing.T) {
+	t.Parallel()
+	dt, err := analyze.ParseDestTemplate("Docs/{{year}}/{{subject}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := analyze.Subject{Date: time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC), Title: "Comcast Invoice"}
+	got, err := dt.Subject(s, "scan")
+	if want := filepath.Join("Docs", "2024", "Comcast Invoice"); err != nil || got != want {
+		t.Errorf("Subject = %q, %v; want %q", got, err, want)
+	}
+}
+
+func TestDestTemplateRejectedUpFront(t *testing.T) {
+	t.Parallel()
+	for _, pattern := range []string{"", "out/{{.Nope}}", "out/{{year"} {
+		if _, err := analyze.ParseDestTemplate(pattern); err == nil {
+			t.Errorf("ParseDestTemplate(%q) succeeded", pattern)
+		}
+	}
+}
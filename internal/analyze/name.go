@@ -15,17 +15,40 @@ type Receipt struct {
 	StartDate time.Time
 	EndDate   time.Time
 	Total     float64
+	Currency  string // ISO 4217 code; empty when the document does not say
 	Vendor    string
 	Category  string
+
+	// The breakdown, when the receipt prints it; nil when it does not.
+	Subtotal, Tax, Tip *float64
+	Payment            string // as printed: Visa, Amex, Cash, ...
+	CardLast4          string
+
+	// Items are the purchased lines, read only under -items.
+	Items []LineItem
+
+	Assessment
+}
+
+// LineItem is one purchased line of an itemised receipt.
+type LineItem struct {
+	Description string
+	Quantity    float64
+	UnitPrice   *float64 // nil when the receipt prints only the line's amount
+	Amount      float64
 }
 
 type Subject struct {
 	Date  time.Time
 	Title string
+
+	Assessment
 }
 
 // ReceiptName reproduces the historical receipt format byte for byte, including
 // the space-to-underscore substitution, and preserves the original extension.
+// The one departure is the total of a currency without cents, which is written
+// as the receipt prints it: ¥1200 is 1200, not 1200.00.
 func ReceiptName(r Receipt, ext string) string {
 	datePart := r.StartDate.Format("01-02-2006")
 	if !r.EndDate.IsZero() && !r.StartDate.Equal(r.EndDate) {
@@ -35,7 +58,7 @@ func ReceiptName(r Receipt, ext string) string {
 	// "Food, Drink" into "Food,__Drink".
 	vendorPart := underscoreSpaces(rename.SanitizeComponent(r.Vendor))
 	categoryPart := underscoreSpaces(rename.SanitizeComponent(r.Category))
-	stem := fmt.Sprintf("%s - %.2f - %s - %s", datePart, r.Total, vendorPart, categoryPart)
+	stem := fmt.Sprintf("%s - %s - %s - %s", datePart, FormatTotal(r.Total, r.Currency), vendorPart, categoryPart)
 	return rename.SanitizeFilename(stem, ext)
 }
 
@@ -113,3 +136,16 @@ func IsOrganized(base string) bool {
 	}
 	return rename.SanitizeFilename(stem, ext) == base
 }
+
+var receiptNameRe = regexp.MustCompile(`^\d{2}-\d{2}-\d{4}(?: to \d{2}-\d{2}-\d{4})? - \S+ - (\S+) - \S+`)
+
+// VendorFromName reads the vendor back out of a name in the built-in receipts
+// format, underscores turned back into spaces. A name in any other form, such
+// as one made by -template, has none to give.
+func VendorFromName(base string) (string, bool) {
+	m := receiptNameRe.FindStringSubmatch(strings.TrimSuffix(base, filepath.Ext(base)))
+	if m == nil {
+		return "", false
+	}
+	return strings.ReplaceAll(m[1], "_", " "), true
+}
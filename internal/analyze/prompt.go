@@ -27,10 +27,37 @@ const organizeSystem = "You name scanned documents. Reply with a single JSON obj
 // that form is accepted and then lets the model answer "$".
 const datePattern = `^([0-9]{4}-[0-9]{2}-[0-9]{2})?$`
 
+// last4Pattern keeps a full card number out of the answer, and so out of the
+// cache and any export, even if the receipt prints one.
+const last4Pattern = `^([0-9]{4})?$`
+
 // ReceiptSchema is deliberately shallow and enum-heavy: this is the subset that
 // compiles to a reliable grammar. Closing category to an enum is what keeps a
 // free-text answer such as "Groceries/Food" out of a filename.
-var ReceiptSchema = json.RawMessage(fmt.Sprintf(`{
+var ReceiptSchema = receiptSchema(DefaultCategories, "", "")
+
+// ReceiptItemsSchema is ReceiptSchema with the line items -items asks for. The
+// array is bounded so a long till roll cannot run generation on forever, and
+// it comes last so the fields every run needs are written before it.
+var ReceiptItemsSchema = receiptSchema(DefaultCategories, itemsProperty, `, "items"`)
+
+const itemsProperty = `,
+    "items": {"type": "array", "maxItems": 60, "description": "Every purchased line in the order printed. Not subtotal, tax, tip, total, change or payment lines.", "items": {
+      "type": "object",
+      "properties": {
+        "description": {"type": "string", "description": "The line as printed, without its price."},
+        "quantity": {"type": "number", "description": "How many were bought; 1 if not printed."},
+        "unit_price": {"type": "string", "description": "The price of one, as printed. Empty string if not shown."},
+        "amount": {"type": "string", "description": "The line's total as printed. A discount or refund is negative."}
+      },
+      "required": ["description", "quantity", "unit_price", "amount"]
+    }}`
+
+// receiptSchema closes category to categories, which is the user's own list
+// when they gave one.
+func receiptSchema(categories []string, extra, extraRequired string) json.RawMessage {
+	enum, _ := json.Marshal(categories)
+	return json.RawMessage(fmt.Sprintf(`{
   "type": "object",
   "properties": {
     "is_hotel": {"type": "boolean", "description": "True only for a hotel or lodging stay covering one or more nights."},
@@ -40,10 +67,17 @@ var ReceiptSchema = json.RawMessage(fmt.Sprintf(`{
     "date": {"type": "string", "pattern": %[1]q, "description": "The transaction date as YYYY-MM-DD, where the first number is the four-digit year, the second is the month and the third is the day. For a hotel folio this is the check-in date, the EARLIER of the two dates. Empty string if not stated."},
     "end_date": {"type": "string", "pattern": %[1]q, "description": "The check-out date as YYYY-MM-DD, the LATER of the two dates on a hotel folio. Empty string unless is_hotel is true."},
     "total": {"type": "number", "description": "Grand total actually charged, as a plain number. No currency symbol, no thousands separator, no conversion."},
-    "category": {"type": "string", "enum": ["Airfare", "Lodging", "Food", "Transportation", "Fuel", "Groceries", "Software", "Office", "Utilities", "Medical", "Entertainment", "Other"], "description": "The single closest category from the list."}
+    "subtotal": {"type": "string", "description": "The amount before tax and tip, as printed. Empty string if not shown."},
+    "tax": {"type": "string", "description": "The tax charged (VAT, GST, sales tax), as printed; the sum if there are several rates. Empty string if not shown."},
+    "tip": {"type": "string", "description": "The tip or gratuity, as printed. Empty string if none."},
+    "payment_method": {"type": "string", "description": "How it was paid as printed, for example Visa, Mastercard, Amex, Debit or Cash. Empty string if not shown."},
+    "card_last4": {"type": "string", "pattern": %[3]q, "description": "The last four digits of the card used. Empty string if not shown."},
+    "currency": {"type": "string", "pattern": %[2]q, "description": "The ISO 4217 code of the currency the total is in, for example USD, EUR, GBP or JPY. Empty string if the document does not show it."},
+    "category": {"type": "string", "enum": %[6]s, "description": "The single closest category from the list."}%[4]s
   },
-  "required": ["is_hotel", "vendor", "date_raw", "date_order", "date", "end_date", "total", "category"]
-}`, datePattern))
+  "required": ["is_hotel", "vendor", "date_raw", "date_order", "date", "end_date", "total", "subtotal", "tax", "tip", "payment_method", "card_last4", "currency", "category"%[5]s]
+}`, datePattern, currencyPattern, last4Pattern, extra, extraRequired, enum))
+}
 
 var OrganizeSchema = json.RawMessage(fmt.Sprintf(`{
   "type": "object",
@@ -71,20 +105,20 @@ const dateRules = "Write every date as YYYY-MM-DD: the first number is the four-
 const receiptRules = "vendor is the business that issued the receipt, not the customer and not a person's name.\n" +
 	orderRules +
 	"total is the grand total actually charged including tax, not a subtotal and not one line item. 1,234.56 and 1.234,56 both mean 1234.56.\n" +
+	"subtotal, tax and tip are copied as printed and left empty when the receipt does not show them; never work one out from the others. card_last4 is only the last four digits of a card number, never more.\n" +
+	"currency is the three-letter code of the total's currency: € is EUR, £ is GBP, ₩ is KRW. A bare $ is USD only if the document is American, and a bare ¥ is JPY only if the document is Japanese or CNY only if it is Chinese; otherwise use the code it prints, or an empty string.\n" +
 	"For a hotel stay set is_hotel true, put the EARLIER (check-in, arrival) date in date and the LATER (check-out, departure) date in end_date. For anything else leave end_date empty.\n" +
 	"Choose category from the allowed list only.\n" +
 	dateRules
 
+// itemRules is added to receiptRules under -items.
+const itemRules = "items lists every purchased line in the order printed, each with its description, quantity, unit_price and amount copied as printed. Leave out the subtotal, tax, tip, total, change and payment lines. A discount line is an item with a negative amount.\n"
+
 const organizeRules = "subject names the issuer and the kind of document, in 3 to 8 Title Case words, the way a person would label the folder entry. No dates, no file extension, no punctuation you would not type in a filename.\n" +
 	"date is the one date that best identifies the document: its statement, invoice, letter or event date.\n" +
 	dateRules
 
-func buildPrompt(kind string, d *doc.Doc) string {
-	rules := receiptRules
-	if kind == kindDocument {
-		rules = organizeRules
-	}
-
+func buildPrompt(kind, rules string, d *doc.Doc) string {
 	var b strings.Builder
 	fmt.Fprintf(&b, "Original filename (a weak hint, do not trust it over the content): %s\n\n", filepath.Base(d.Path))
 
@@ -0,0 +1,292 @@
+package analyze
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/rename"
+)
+
+// NameTemplate is a -template pattern, parsed once and checked against sample
+// fields before the first file is read, so a typo is a usage error rather than
+// forty failed renames.
+type NameTemplate struct {
+	t *template.Template
+}
+
+// NameFields is everything a -template pattern can refer to. Strings arrive
+// already passed through rename.SanitizeComponent, so a vendor written as
+// "AC/DC" cannot smuggle a separator into the name.
+type NameFields struct {
+	Date     Date   // the transaction, statement or check-in date
+	EndDate  Date   // the check-out date of a hotel stay; empty otherwise
+	Total    string // formatted as in the default name: two decimals, or as many as Currency uses
+	Currency string // ISO 4217 code, e.g. USD; empty when the document does not say
+	Vendor   string
+	Category string
+	Subject  string // organize mode only
+	Original string // the file's name before renaming, without its extension
+}
+
+// Date prints as YYYY-MM-DD and keeps every time.Time method, so a pattern can
+// say {{.Date}}, {{.Date.Format "01-02-2006"}} or {{.Date.Year}}. A zero Date
+// prints as nothing, which is what lets {{.EndDate}} vanish for a one-day
+// receipt.
+type Date struct{ time.Time }
+
+func (d Date) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.Format("2006-01-02")
+}
+
+var templateFuncs = template.FuncMap{
+	"underscore": underscoreSpaces,
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+}
+
+// fieldFuncs exposes the fields as lowercase functions too, so a folder pattern
+// can read {{year}}/{{category}} rather than {{.Date.Year}}/{{.Category}}. They
+// are bound to one file's fields at execution; the values here at parse time
+// only declare the names.
+func fieldFuncs(f NameFields) template.FuncMap {
+	part := func(layout string) func() string {
+		return func() string {
+			if f.Date.IsZero() {
+				return ""
+			}
+			return f.Date.Format(layout)
+		}
+	}
+	return template.FuncMap{
+		"date":     f.Date.String,
+		"year":     part("2006"),
+		"month":    part("01"),
+		"day":      part("02"),
+		"total":    func() string { return f.Total },
+		"currency": func() string { return f.Currency },
+		"vendor":   func() string { return f.Vendor },
+		"category": func() string { return f.Category },
+		"subject":  func() string { return f.Subject },
+		"original": func() string { return f.Original },
+	}
+}
+
+// newTemplate parses pattern with every function a pattern may call.
+func newTemplate(name, pattern string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Funcs(fieldFuncs(NameFields{})).Parse(pattern)
+}
+
+// execute runs t over f on a clone, so the field functions are bound to f
+// without touching a template another file may be rendering at the same time.
+func execute(t *template.Template, f NameFields) (string, error) {
+	c, err := t.Clone()
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := c.Funcs(fieldFuncs(f)).Execute(&b, f); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// sampleFields exercise every field, so executing against them reaches any
+// reference a parse alone would accept and the first real file would reject.
+var sampleFields = NameFields{
+	Date:     Date{time.Date(2023, 1, 15, 0, 0, 0, 0, time.UTC)},
+	EndDate:  Date{time.Date(2023, 1, 18, 0, 0, 0, 0, time.UTC)},
+	Total:    "123.45",
+	Currency: "USD",
+	Vendor:   "Test Store",
+	Category: "Food",
+	Subject:  "Comcast Internet Service Invoice",
+	Original: "scan-0001",
+}
+
+// TemplateMode is the kind of document a -template pattern names, which decides
+// the fields it has to work with.
+type TemplateMode int
+
+const (
+	ReceiptTemplate TemplateMode = iota // receipts mode
+	SubjectTemplate                     // organize mode
+)
+
+func (m TemplateMode) String() string {
+	if m == SubjectTemplate {
+		return "organize mode"
+	}
+	return "receipts mode"
+}
+
+// unfilled is what each mode leaves empty in every file. A pattern that reads
+// one would name every file without it, so it is refused along with a typo.
+var unfilled = map[TemplateMode][]string{
+	ReceiptTemplate: {"Subject"},
+	SubjectTemplate: {"EndDate", "Total", "Currency", "Vendor", "Category"},
+}
+
+// sample is sampleFields as m fills them.
+func (m TemplateMode) sample() NameFields {
+	f := sampleFields
+	if m == SubjectTemplate {
+		return NameFields{Date: f.Date, Subject: f.Subject, Original: f.Original}
+	}
+	f.Subject = ""
+	return f
+}
+
+// ParseNameTemplate compiles pattern and proves it renders a non-empty name
+// from the fields mode fills.
+func ParseNameTemplate(pattern string, mode TemplateMode) (*NameTemplate, error) {
+	t, err := newTemplate("name", pattern)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range unfilled[mode] {
+		if ref, ok := refersTo(t, name); ok {
+			return nil, fmt.Errorf("%s is never filled in %s", ref, mode)
+		}
+	}
+	nt := &NameTemplate{t: t}
+	out, err := nt.render(mode.sample())
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(out) == "" {
+		return nil, errors.New("the template renders an empty name")
+	}
+	return nt, nil
+}
+
+// refersTo finds a reference in t, or in a template it defines, to the field
+// name, as {{.Name}}, {{$.Name}} or the lowercase {{name}}.
+func refersTo(t *template.Template, name string) (string, bool) {
+	fn := strings.ToLower(name)
+	var ref string
+	var walk func(n parse.Node) bool
+	walk = func(n parse.Node) bool {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return false
+			}
+			for _, c := range n.Nodes {
+				if walk(c) {
+					return true
+				}
+			}
+		case *parse.ActionNode:
+			return walk(n.Pipe)
+		case *parse.IfNode:
+			return walk(n.Pipe) || walk(n.List) || walk(n.ElseList)
+		case *parse.RangeNode:
+			return walk(n.Pipe) || walk(n.List) || walk(n.ElseList)
+		case *parse.WithNode:
+			return walk(n.Pipe) || walk(n.List) || walk(n.ElseList)
+		case *parse.TemplateNode:
+			return walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return false
+			}
+			for _, c := range n.Cmds {
+				if walk(c) {
+					return true
+				}
+			}
+		case *parse.CommandNode:
+			for _, a := range n.Args {
+				if walk(a) {
+					return true
+				}
+			}
+		case *parse.ChainNode:
+			return walk(n.Node)
+		case *parse.FieldNode:
+			if n.Ident[0] == name {
+				ref = "{{." + name + "}}"
+				return true
+			}
+		case *parse.VariableNode:
+			if len(n.Ident) > 1 && n.Ident[0] == "$" && n.Ident[1] == name {
+				ref = "{{." + name + "}}"
+				return true
+			}
+		case *parse.IdentifierNode:
+			if n.Ident == fn {
+				ref = "{{" + fn + "}}"
+				return true
+			}
+		}
+		return false
+	}
+	for _, d := range t.Templates() {
+		if d.Tree != nil && walk(d.Tree.Root) {
+			return ref, true
+		}
+	}
+	return "", false
+}
+
+// Receipt renders r. The result still goes through rename.SanitizeFilename, so
+// a literal "/" in the pattern becomes "-" exactly as one in a vendor would.
+func (nt *NameTemplate) Receipt(r Receipt, original, ext string) (string, error) {
+	return nt.name(receiptFields(r, original), ext)
+}
+
+// Subject renders s for organize mode.
+func (nt *NameTemplate) Subject(s Subject, original, ext string) (string, error) {
+	return nt.name(subjectFields(s, original), ext)
+}
+
+func receiptFields(r Receipt, original string) NameFields {
+	f := NameFields{
+		Date:     Date{r.StartDate},
+		Total:    FormatTotal(r.Total, r.Currency),
+		Currency: r.Currency,
+		Vendor:   sanitizeField(r.Vendor),
+		Category: sanitizeField(r.Category),
+		Original: sanitizeField(original),
+	}
+	if !r.EndDate.IsZero() && !r.EndDate.Equal(r.StartDate) {
+		f.EndDate = Date{r.EndDate}
+	}
+	return f
+}
+
+func subjectFields(s Subject, original string) NameFields {
+	return NameFields{
+		Date:     Date{s.Date},
+		Subject:  sanitizeField(s.Title),
+		Original: sanitizeField(original),
+	}
+}
+
+func (nt *NameTemplate) name(f NameFields, ext string) (string, error) {
+	stem, err := nt.render(f)
+	if err != nil {
+		return "", err
+	}
+	return rename.SanitizeFilename(stem, ext), nil
+}
+
+func (nt *NameTemplate) render(f NameFields) (string, error) {
+	return execute(nt.t, f)
+}
+
+// sanitizeField leaves an empty field empty: SanitizeComponent would turn it
+// into "Untitled", which reads as data in a name that never asked for it.
+func sanitizeField(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return ""
+	}
+	return rename.SanitizeComponent(s)
+}
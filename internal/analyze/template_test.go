@@ -0,0 +1,127 @@
+package analyze_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/analyze"
+)
+
+func TestNameTemplateReceipt(t *testing.T) {
+	t.Parallel()
+
+	regular := analyze.Receipt{StartDate: day(2023, 1, 15), EndDate: day(2023, 1, 15), Total: 123.45, Vendor: "Test Store", Category: "Food"}
+	hotel := analyze.Receipt{StartDate: day(2023, 1, 15), EndDate: day(2023, 1, 18), Total: 456.78, Vendor: "Grand Hotel", Category: "Lodging"}
+
+	tests := []struct {
+		name    string
+		pattern string
+		r       analyze.Receipt
+		want    string
+	}{
+		{"iso first", "{{.Date}} - {{.Total}} - {{.Vendor}} - {{.Category}}", regular, "2023-01-15 - 123.45 - Test Store - Food.pdf"},
+		{"vendor date total", "{{underscore .Vendor}}_{{.Date}}_{{.Total}}", regular, "Test_Store_2023-01-15_123.45.pdf"},
+		{"custom layout", `{{.Date.Format "02.01.2006"}} {{.Vendor}}`, regular, "15.01.2023 Test Store.pdf"},
+		{"end date is empty for one day", "{{.Date}}{{with .EndDate.String}} to {{.}}{{end}} {{.Vendor}}", regular, "2023-01-15 Test Store.pdf"},
+		{"end date for a stay", "{{.Date}}{{with .EndDate.String}} to {{.}}{{end}} {{.Vendor}}", hotel, "2023-01-15 to 2023-01-18 Grand Hotel.pdf"},
+		{"original name", "{{.Original}} - {{.Vendor}}", regular, "scan-0042 - Test Store.pdf"},
+		{"year", "{{.Date.Year}} {{upper .Category}}", regular, "2023 FOOD.pdf"},
+		// A separator written into the pattern itself is still only a character.
+		{"slash in the pattern", "{{.Date.Year}}/{{.Vendor}}", regular, "2023-Test Store.pdf"},
+		{"traversal in the vendor", "{{.Vendor}}", analyze.Receipt{StartDate: day(2023, 1, 15), Vendor: "../../etc/passwd"}, "etc-passwd.pdf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			nt, err := analyze.ParseNameTemplate(tt.pattern, analyze.ReceiptTemplate)
+			if err != nil {
+				t.Fatalf("ParseNameTemplate(%q): %v", tt.pattern, err)
+			}
+			got, err := nt.Receipt(tt.r, "scan-0042", ".PDF")
+			if err != nil {
+				t.Fatalf("Receipt: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Receipt() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNameTemplateSubject(t *testing.T) {
+	t.Parallel()
+	nt, err := analyze.ParseNameTemplate(`{{.Subject}} ({{.Date.Format "Jan 2006"}})`, analyze.SubjectTemplate)
+	if err != nil {
+		t.Fatalf("ParseNameTemplate: %v", err)
+	}
+	got, err := nt.Subject(analyze.Subject{Date: day(2024, 3, 11), Title: "Comcast Invoice"}, "scan", ".pdf")
+	if err != nil {
+		t.Fatalf("Subject: %v", err)
+	}
+	if want := "Comcast Invoice (Mar 2024).pdf"; got != want {
+		t.Errorf("Subject() = %q, want %q", got, want)
+	}
+}
+
+// A bad pattern must fail when it is parsed, not on the first file: a field
+// name typo passes text/template's parser and only fails on execution.
+func TestNameTemplateRejectedUpFront(t *testing.T) {
+	t.Parallel()
+	for _, pattern := range []string{
+		"{{.Date",
+		"{{.Vendr}}",
+		"{{nosuchfunc .Vendor}}",
+		`{{.Date.Format}}`,
+		"   ",
+		"{{if false}}x{{end}}",
+	} {
+		if _, err := analyze.ParseNameTemplate(pattern, analyze.ReceiptTemplate); err == nil {
+			t.Errorf("ParseNameTemplate(%q) accepted a pattern that cannot produce a name", pattern)
+		}
+	}
+}
+
+// A field the mode never fills parses and renders, as nothing, on every file;
+// it is refused as surely as a typo.
+func TestNameTemplateOnlyTheModesFields(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		pattern string
+		mode    analyze.TemplateMode
+		ref     string
+	}{
+		{"{{.Date}} {{.Subject}}", analyze.ReceiptTemplate, "{{.Subject}}"},
+		{"{{.Date}} {{subject}}", analyze.ReceiptTemplate, "{{subject}}"},
+		{"{{.Date}}{{with .Original}} {{$.Subject}}{{end}}", analyze.ReceiptTemplate, "{{.Subject}}"},
+		{"{{.Date}} {{.Vendor}}", analyze.SubjectTemplate, "{{.Vendor}}"},
+		{"{{.Date}} {{upper category}}", analyze.SubjectTemplate, "{{category}}"},
+		{"{{.Date}} {{.Total}}", analyze.SubjectTemplate, "{{.Total}}"},
+		{"{{.Date}}{{if .EndDate.IsZero}}{{else}} {{.EndDate}}{{end}}", analyze.SubjectTemplate, "{{.EndDate}}"},
+	} {
+		_, err := analyze.ParseNameTemplate(tt.pattern, tt.mode)
+		if err == nil || !strings.Contains(err.Error(), tt.ref+" is never filled in "+tt.mode.String()) {
+			t.Errorf("ParseNameTemplate(%q, %s) = %v, want %s refused", tt.pattern, tt.mode, err, tt.ref)
+		}
+	}
+	// What both modes fill is fine in either.
+	for _, mode := range []analyze.TemplateMode{analyze.ReceiptTemplate, analyze.SubjectTemplate} {
+		if _, err := analyze.ParseNameTemplate("{{year}} {{.Date}} {{original}} {{.Original}}", mode); err != nil {
+			t.Errorf("%s: %v", mode, err)
+		}
+	}
+}
+
+func TestNameTemplateNeverEscapes(t *testing.T) {
+	t.Parallel()
+	nt, err := analyze.ParseNameTemplate("../{{.Vendor}}/..", analyze.ReceiptTemplate)
+	if err != nil {
+		t.Fatalf("ParseNameTemplate: %v", err)
+	}
+	got, err := nt.Receipt(analyze.Receipt{StartDate: day(2023, 1, 15), Vendor: "x"}, "a", ".pdf")
+	if err != nil {
+		t.Fatalf("Receipt: %v", err)
+	}
+	if strings.ContainsAny(got, `/\`) || strings.Contains(got, "..") {
+		t.Errorf("name %q is not a plain file name", got)
+	}
+}
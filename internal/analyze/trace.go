@@ -0,0 +1,76 @@
+package analyze
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/llm"
+)
+
+// Trace records what Receipt or Subject did with one document: every request
+// sent to the model with the reply it got, and every correction made to the
+// answer afterwards. It rides on the context, so files read at once each keep
+// their own; without one nothing is recorded.
+type Trace struct {
+	Calls       []Call
+	Corrections []string
+}
+
+// Call is one request to the model and its reply, exactly as sent and
+// received. A retry after an unusable reply is a second Call.
+type Call struct {
+	System    string
+	Prompt    string
+	Images    int
+	Schema    json.RawMessage
+	Seed      int
+	Context   int // num_ctx
+	MaxTokens int // num_predict
+	Reply     string
+	Err       string
+	Took      time.Duration
+}
+
+type traceKey struct{}
+
+// WithTrace returns a context that records into t.
+func WithTrace(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// TraceFrom returns the Trace ctx records into, or nil.
+func TraceFrom(ctx context.Context) *Trace {
+	t, _ := ctx.Value(traceKey{}).(*Trace)
+	return t
+}
+
+// Corrected notes a change made to what the model answered. It does nothing on
+// a nil Trace, so callers need not check for one.
+func (t *Trace) Corrected(format string, args ...any) {
+	if t != nil {
+		t.Corrections = append(t.Corrections, fmt.Sprintf(format, args...))
+	}
+}
+
+func (t *Trace) called(req llm.Request, reply string, err error, took time.Duration) {
+	if t == nil {
+		return
+	}
+	c := Call{
+		System:    req.System,
+		Prompt:    req.Prompt,
+		Images:    len(req.Images),
+		Schema:    req.Schema,
+		Seed:      req.Seed,
+		Context:   req.Context,
+		MaxTokens: req.MaxTokens,
+		Reply:     reply,
+		Took:      took,
+	}
+	if err != nil {
+		c.Err = err.Error()
+	}
+	t.Calls = append(t.Calls, c)
+}
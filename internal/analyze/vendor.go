@@ -0,0 +1,189 @@
+package analyze
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// storeNumberRes match the branch numbers a chain prints after its name, tried
+// in order: "#10234", then "Store 0452" or "No. 12". Order matters, or the
+// "Store" of "Test Store #0452" would go with the number.
+var storeNumberRes = []*regexp.Regexp{
+	regexp.MustCompile(`\s*#\s*\d+\s*$`),
+	regexp.MustCompile(`(?i)\s+(store|str|no|nr|unit|loc)\.?\s*\d+\s*$`),
+}
+
+// bareNumberRe is a run of three or more digits after a name with nothing to
+// mark it as a store number. "Walgreens 04512" is a branch, but "Hotel 1000"
+// is a name, and only the table can tell them apart, so Canonical strips it
+// only for a name the table already has. Two digits alone are never taken,
+// so "Studio 54" keeps its name.
+var bareNumberRe = regexp.MustCompile(`\s+\d{3,}\s*$`)
+
+// StripStoreNumber removes a trailing store number from vendor, as many times
+// as one follows another.
+func StripStoreNumber(vendor string) string {
+	v := strings.TrimSpace(vendor)
+	for {
+		stripped := v
+		for _, re := range storeNumberRes {
+			if re.MatchString(v) {
+				stripped = strings.TrimRight(re.ReplaceAllString(v, ""), " -,")
+				break
+			}
+		}
+		if stripped == v || stripped == "" {
+			return v
+		}
+		v = stripped
+	}
+}
+
+// VendorKey is what two spellings of a vendor must share to be the same one:
+// the name without its store number, in lower case, with punctuation and runs
+// of spaces reduced to one space.
+func VendorKey(vendor string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range strings.ToLower(StripStoreNumber(vendor)) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteRune(r)
+			space = false
+			continue
+		}
+		if r != '\'' {
+			space = true
+		}
+	}
+	return b.String()
+}
+
+// Vendors is the alias table that gives one merchant one name however the
+// receipt spells it. It is safe for concurrent use.
+type Vendors struct {
+	// Learn records every vendor the table does not know yet under its own name,
+	// a marked store number removed, so later spellings of it find the same one and the
+	// table grows into something worth editing.
+	Learn bool
+
+	mu      sync.Mutex
+	names   map[string]string // VendorKey -> canonical name
+	learned [][2]string       // alias, name pairs not yet saved
+}
+
+// ParseVendors reads an alias table: one "ALIAS = NAME" per line, or a lone
+// NAME, which is an alias for itself. A line starting with # is a comment; a #
+// anywhere else is a store number. Aliases match by VendorKey, so case and
+// store numbers need not be written out.
+func ParseVendors(r io.Reader) (*Vendors, error) {
+	v := &Vendors{names: make(map[string]string)}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		alias, name, ok := strings.Cut(line, "=")
+		alias, name = strings.TrimSpace(alias), strings.TrimSpace(name)
+		if !ok {
+			name = alias
+		}
+		if VendorKey(alias) == "" || name == "" {
+			return nil, fmt.Errorf("line %d: want ALIAS = NAME", n)
+		}
+		v.names[VendorKey(alias)] = name
+		if _, ok := v.names[VendorKey(name)]; !ok {
+			v.names[VendorKey(name)] = name
+		}
+	}
+	return v, sc.Err()
+}
+
+// Canonical is vendor's name in the table, found with or without a bare
+// number after it. A vendor it does not know is returned as it came, unless
+// Learn adds it.
+func (v *Vendors) Canonical(vendor string) string {
+	if v == nil {
+		return vendor
+	}
+	key := VendorKey(vendor)
+	if key == "" {
+		return vendor
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if name, ok := v.names[key]; ok {
+		return name
+	}
+	if stripped := StripStoreNumber(vendor); bareNumberRe.MatchString(stripped) {
+		if name, ok := v.names[VendorKey(bareNumberRe.ReplaceAllString(stripped, ""))]; ok {
+			return name
+		}
+	}
+	if !v.Learn {
+		return vendor
+	}
+	name := StripStoreNumber(vendor)
+	v.remember(name, name)
+	return name
+}
+
+// Correct records that what was read as from is really to, as when a person
+// fixes the vendor by hand. It is learned only under Learn.
+func (v *Vendors) Correct(from, to string) {
+	if v == nil || !v.Learn || VendorKey(from) == "" || strings.TrimSpace(to) == "" {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.names[VendorKey(from)] != to {
+		v.remember(from, to)
+	}
+}
+
+func (v *Vendors) remember(alias, name string) {
+	if v.names == nil {
+		v.names = make(map[string]string)
+	}
+	v.names[VendorKey(alias)] = name
+	v.learned = append(v.learned, [2]string{StripStoreNumber(alias), name})
+}
+
+// WriteLearned writes what was learned since the last call as lines
+// ParseVendors reads back, and forgets it.
+func (v *Vendors) WriteLearned(w io.Writer) error {
+	if v == nil {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, l := range v.learned {
+		line := l[1]
+		if l[0] != l[1] {
+			line = l[0] + " = " + l[1]
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	v.learned = nil
+	return nil
+}
+
+// HasLearned reports whether there is anything for WriteLearned to write.
+func (v *Vendors) HasLearned() bool {
+	if v == nil {
+		return false
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(v.learned) > 0
+}
@@ -0,0 +1,164 @@
+// Package cache keeps decoded model answers on disk, keyed by what the answer
+// depends on: the document's bytes and everything else that went into the
+// request. A hit costs one file hash instead of one inference.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// formatVersion is bumped whenever the shape of a stored value changes in a way
+// the request fingerprint cannot see, so an old entry is a miss rather than a
+// half-decoded answer.
+const formatVersion = "1"
+
+// Cache is a directory of JSON entries. A nil *Cache is a valid receiver that
+// never hits and never stores, so -no-cache needs no branches at the call sites.
+type Cache struct {
+	dir string
+	log *slog.Logger
+}
+
+// Open returns a cache rooted at dir. The directory is created on the first
+// store, not here: a run that never stores anything leaves nothing behind.
+func Open(dir string, log *slog.Logger) *Cache {
+	return &Cache{dir: dir, log: orDiscard(log)}
+}
+
+func (c *Cache) Dir() string {
+	if c == nil {
+		return ""
+	}
+	return c.dir
+}
+
+// Key hashes the file at path together with fingerprint, which names
+// everything besides the bytes that decides the answer.
+func Key(path, fingerprint string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	io.WriteString(h, "\x00"+formatVersion+"\x00"+fingerprint)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Get decodes the entry for key into v and reports whether there was one. An
+// unreadable entry is a miss: the cache only ever saves work, so damage to it
+// must cost a model call and nothing more.
+func (c *Cache) Get(key string, v any) bool {
+	if c == nil || key == "" {
+		return false
+	}
+	b, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return false
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		c.log.Debug("ignoring unreadable cache entry", "key", key, "err", err)
+		return false
+	}
+	return true
+}
+
+// Put stores v under key. The entry is written to a temporary file and renamed
+// into place, so a run killed mid-write never leaves a torn entry for the next
+// one to trip over.
+func (c *Cache) Put(key string, v any) error {
+	if c == nil || key == "" {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dst := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// path fans entries out by the first two hex digits so no one directory grows
+// to tens of thousands of files.
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+// Clear removes every entry and reports how many there were. It deletes only
+// what looks like an entry, so pointing it at the wrong directory by mistake
+// cannot empty someone's home folder.
+func Clear(dir string) (int, error) {
+	n := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !isEntry(d.Name()) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	// The fan-out directories are left empty; removing them is tidiness, so a
+	// failure here is not worth reporting.
+	if ents, err := os.ReadDir(dir); err == nil {
+		for _, e := range ents {
+			if e.IsDir() && len(e.Name()) == 2 {
+				os.Remove(filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	return n, nil
+}
+
+func isEntry(name string) bool {
+	key, ok := strings.CutSuffix(name, ".json")
+	if !ok || len(key) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+func orDiscard(log *slog.Logger) *slog.Logger {
+	if log != nil {
+		return log
+	}
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyDependsOnBytesAndFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.pdf")
+	b := filepath.Join(dir, "renamed copy.pdf")
+	os.WriteFile(a, []byte("same bytes"), 0o644)
+	os.WriteFile(b, []byte("same bytes"), 0o644)
+
+	ka, err := Key(a, "model-1")
+	if err != nil {
+		t.Fatalf("Key: %v", err)
+	}
+	if kb, _ := Key(b, "model-1"); kb != ka {
+		t.Errorf("a renamed copy got a different key: %s vs %s", kb, ka)
+	}
+	if kc, _ := Key(a, "model-2"); kc == ka {
+		t.Error("a different fingerprint got the same key")
+	}
+	if _, err := Key(filepath.Join(dir, "missing"), "model-1"); err == nil {
+		t.Error("Key of a missing file succeeded")
+	}
+}
+
+func TestPutGetClear(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	c := Open(dir, nil)
+	key := strings.Repeat("ab", 32)
+
+	var got struct{ Vendor string }
+	if c.Get(key, &got) {
+		t.Fatal("hit in an empty cache")
+	}
+	if err := c.Put(key, struct{ Vendor string }{"Test Store"}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if !c.Get(key, &got) || got.Vendor != "Test Store" {
+		t.Fatalf("Get = %+v, want the stored value", got)
+	}
+
+	// Clear removes entries and nothing else.
+	keep := filepath.Join(dir, "notes.txt")
+	os.WriteFile(keep, []byte("mine"), 0o644)
+	n, err := Clear(dir)
+	if err != nil || n != 1 {
+		t.Fatalf("Clear = %d, %v; want 1, nil", n, err)
+	}
+	if c.Get(key, &got) {
+		t.Error("hit after Clear")
+	}
+	if _, err := os.Stat(keep); err != nil {
+		t.Errorf("Clear removed a file that is not an entry: %v", err)
+	}
+	if n, err := Clear(filepath.Join(dir, "never-created")); err != nil || n != 0 {
+		t.Errorf("Clear of a missing directory = %d, %v; want 0, nil", n, err)
+	}
+}
+
+func TestDamagedEntryIsAMiss(t *testing.T) {
+	c := Open(t.TempDir(), nil)
+	key := strings.Repeat("cd", 32)
+	if err := c.Put(key, "ok"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	os.WriteFile(c.path(key), []byte("{truncated"), 0o600)
+	var v string
+	if c.Get(key, &v) {
+		t.Error("a damaged entry was a hit")
+	}
+}
+
+func TestNilCacheIsInert(t *testing.T) {
+	var c *Cache
+	var v string
+	if c.Get("ab", &v) {
+		t.Error("nil cache hit")
+	}
+	if err := c.Put("ab", "x"); err != nil {
+		t.Errorf("nil cache Put: %v", err)
+	}
+}
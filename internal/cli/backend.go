@@ -0,0 +1,31 @@
+package cli
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/llm"
+	"github.com/scottdensmore/rcptpixie/v2/internal/ollama"
+	"github.com/scottdensmore/rcptpixie/v2/internal/openai"
+)
+
+const (
+	backendOllama = "ollama"
+	backendOpenAI = "openai"
+)
+
+// newBackend connects to the model server -backend names. Only ollama spreads
+// work over several hosts; an OpenAI-compatible server is usually one process
+// with its own batching, so it takes one address.
+func (o *opts) newBackend(log *slog.Logger) (llm.Backend, error) {
+	switch o.Backend {
+	case backendOllama:
+		return ollama.NewHosts(o.hosts(), o.Timeout, log)
+	case backendOpenAI:
+		if hosts := o.hosts(); len(hosts) > 1 {
+			return nil, fmt.Errorf("-backend openai takes one -host, got %d", len(hosts))
+		}
+		return openai.New(o.Host, o.apiKey, o.Timeout, log)
+	}
+	return nil, fmt.Errorf("-backend must be ollama or openai, not %q", o.Backend)
+}
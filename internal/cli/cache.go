@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/cache"
+)
+
+// cacheDir is where the analysis cache lives, or "" when Env provides no user
+// cache directory.
+func cacheDir(env Env) (string, error) {
+	if env.UserCacheDir == nil {
+		return "", nil
+	}
+	dir, err := env.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "rcptpixie", "analysis"), nil
+}
+
+// openCache returns nil, which caches nothing, when there is nowhere to put the
+// cache: a missing cache costs time, never a failed run.
+func openCache(env Env, log *slog.Logger) *cache.Cache {
+	dir, err := cacheDir(env)
+	if err != nil {
+		log.Debug("no user cache directory; answers will not be cached", "err", err)
+		return nil
+	}
+	if dir == "" {
+		return nil
+	}
+	return cache.Open(dir, log)
+}
+
+func runCache(ctx context.Context, env Env, args []string) ExitCode {
+	if ctx.Err() != nil {
+		return ExitInterrupted
+	}
+
+	var o opts
+	flags := newFlagSet(modeCache, env.Stderr)
+	rest, err := o.parseInto(flags, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			commandUsage(env.Stdout, modeCache, flags)
+			return ExitOK
+		}
+		fmt.Fprintf(env.Stderr, "rcptpixie cache: %v\n\n", err)
+		commandUsage(env.Stderr, modeCache, flags)
+		return ExitUsage
+	}
+	if len(rest) != 1 || rest[0] != "clear" {
+		fmt.Fprintln(env.Stderr, "rcptpixie cache: expected \"clear\"")
+		fmt.Fprintln(env.Stderr)
+		commandUsage(env.Stderr, modeCache, flags)
+		return ExitUsage
+	}
+
+	dir, err := cacheDir(env)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "rcptpixie cache: no user cache directory: %v\n", err)
+		return ExitFailure
+	}
+	if dir == "" {
+		fmt.Fprintln(env.Stderr, "rcptpixie cache: no user cache directory")
+		return ExitFailure
+	}
+	n, err := cache.Clear(dir)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "rcptpixie cache: %v\n", err)
+		return ExitFailure
+	}
+	fmt.Fprintf(env.Stderr, "removed %d cached answers from %s\n", n, dir)
+	return ExitOK
+}
@@ -27,6 +27,12 @@ const (
 	modeReceipts = "receipts"
 	modeOrganize = "organize"
 	modeUndo     = "undo"
+	modeCache    = "cache"
+	modeWatch    = "watch"
+	modeHistory  = "history"
+	modeVendors  = "vendors"
+	modeDoctor   = "doctor"
+	modeExplain  = "explain"
 )
 
 // Env is everything Run touches outside its own arguments. Nothing in this
@@ -38,6 +44,10 @@ type Env struct {
 	Stdin  io.Reader
 	Getenv func(string) string
 	IsTTY  func(any) bool
+
+	// UserCacheDir locates the analysis cache. Nil disables the cache, which is
+	// what keeps one test's answers from leaking into the next.
+	UserCacheDir func() (string, error)
 }
 
 func Run(ctx context.Context, env Env) (code ExitCode) {
@@ -91,6 +101,18 @@ func Run(ctx context.Context, env Env) (code ExitCode) {
 		code = runOrganize(ctx, env, rest)
 	case modeUndo:
 		code = runUndo(ctx, env, rest)
+	case modeCache:
+		code = runCache(ctx, env, rest)
+	case modeWatch:
+		code = runWatch(ctx, env, rest)
+	case modeHistory:
+		code = runHistory(ctx, env, rest)
+	case modeVendors:
+		code = runVendors(ctx, env, rest)
+	case modeDoctor:
+		code = runDoctor(ctx, env, rest)
+	case modeExplain:
+		code = runExplain(ctx, env, rest)
 	default:
 		code = runReceipts(ctx, env, rest)
 	}
@@ -115,7 +137,7 @@ func route(args []string) (cmd string, rest []string) {
 
 func isCommand(s string) bool {
 	switch s {
-	case modeReceipts, modeOrganize, modeUndo:
+	case modeReceipts, modeOrganize, modeUndo, modeCache, modeWatch, modeHistory, modeVendors, modeDoctor, modeExplain:
 		return true
 	}
 	return false
@@ -128,7 +150,9 @@ func isCommand(s string) bool {
 // layer exists to prevent.
 func scanMeta(args []string) string {
 	fs := newFlagSet("scan", io.Discard)
-	(&opts{}).register(fs, nil)
+	o := &opts{}
+	o.register(fs, nil)
+	o.registerReceipts(fs)
 
 	for i := 0; i < len(args); i++ {
 		a := args[i]
@@ -168,12 +192,18 @@ func rootUsage(w io.Writer) {
 	fmt.Fprint(w, `rcptpixie renames receipts and documents from what is written inside them.
 
 Usage:
-  rcptpixie <command> [flags] <file-or-directory>
+  rcptpixie <command> [flags] <file-or-directory>...
 
 Commands:
   receipts   rename receipts to "MM-DD-YYYY - TOTAL - Vendor - Category.ext" (default)
   organize   rename any document to "YYYY-MM-DD - Descriptive Subject.ext"
-  undo       revert the renames recorded in a directory
+  watch      rename receipts as they arrive in a directory, until Ctrl-C
+  undo       revert the renames recorded in a directory (-last, -run ID, -since TIME, -r)
+  history    list the runs recorded in a directory's undo journal
+  vendors    list the vendors in a directory's receipt names, to write aliases from
+  explain    show what the model was given and said for one file, and the name it makes
+  doctor     check the model server, the model and the image tools a run needs
+  cache      "cache clear" forgets every remembered model answer
   version    print version information
   help       print this message
 
@@ -182,8 +212,9 @@ A bare path runs receipts mode: rcptpixie receipt.pdf
 Use -- or ./name for a path that collides with a command name.
 
 Common flags (see "rcptpixie <command> -h" for the full list):
-  -model NAME   ollama model (default gemma4:e2b, env RCPTPIXIE_MODEL)
-  -host URL     ollama base URL (env RCPTPIXIE_HOST, OLLAMA_HOST)
+  -model NAME   model to use (default gemma4:e2b, env RCPTPIXIE_MODEL)
+  -host URL     model server base URL (env RCPTPIXIE_HOST, OLLAMA_HOST)
+  -backend API  ollama (default) or openai for an OpenAI-compatible server
   -r            descend into subdirectories (off by default)
   -n            print the plan and rename nothing
   -y            skip the confirmation prompt
@@ -191,7 +222,7 @@ Common flags (see "rcptpixie <command> -h" for the full list):
 
 Exit codes:
   0    everything succeeded
-  1    nothing could be processed, or ollama is unreachable
+  1    nothing could be processed, or the model server is unreachable
   2    usage error, unknown path, or confirmation needed without a terminal
   3    some files were processed and some failed
   130  interrupted
@@ -201,6 +232,7 @@ Examples:
   rcptpixie receipts -r ~/Receipts
   rcptpixie organize --dry-run ~/Downloads
   rcptpixie organize ~/Documents/Scans
+  rcptpixie watch -out ~/Receipts/Filed ~/Receipts/Inbox
   rcptpixie undo ~/Documents/Scans
 `)
 }
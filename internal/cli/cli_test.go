@@ -3,20 +3,26 @@ package cli
 import (
 	"bytes"
 	"context"
+	"encoding/csv"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/scottdensmore/rcptpixie/v2/internal/analyze"
 	"github.com/scottdensmore/rcptpixie/v2/internal/ollama"
 	"github.com/scottdensmore/rcptpixie/v2/internal/rename"
 	"github.com/scottdensmore/rcptpixie/v2/internal/testutil"
@@ -564,14 +570,14 @@ func planFor(t *testing.T, dir, old, newName string) *rename.Plan {
 // .rcptpixie-undo.jsonl is litter that "rcptpixie undo" then rejects.
 func TestApplyPlanWritesNoEmptyJournal(t *testing.T) {
 	log := newLogger(io.Discard, slog.LevelError)
-	quiet := Env{Stdout: io.Discard, Stderr: io.Discard}
+	ignoreRenamed := func(string, string) {}
 
 	t.Run("cancelled before the first rename", func(t *testing.T) {
 		dir := t.TempDir()
 		p := planFor(t, dir, "a.txt", "b.txt")
 		ctx, cancel := context.WithCancel(context.Background())
 		cancel()
-		if n := applyPlan(ctx, quiet, p, log); n != 0 {
+		if n := applyPlan(ctx, p, rename.Run{}, log, ignoreRenamed); n != 0 {
 			t.Fatalf("renamed = %d, want 0", n)
 		}
 		if got := listing(t, dir); !slices.Equal(got, []string{"a.txt"}) {
@@ -582,7 +588,7 @@ func TestApplyPlanWritesNoEmptyJournal(t *testing.T) {
 	t.Run("every rename fails", func(t *testing.T) {
 		dir := t.TempDir()
 		p := planFor(t, dir, "a.txt", "..") // Apply refuses an unsafe name
-		if n := applyPlan(context.Background(), quiet, p, log); n != 0 {
+		if n := applyPlan(context.Background(), p, rename.Run{}, log, ignoreRenamed); n != 0 {
 			t.Fatalf("renamed = %d, want 0", n)
 		}
 		if got := listing(t, dir); !slices.Equal(got, []string{"a.txt"}) {
@@ -597,7 +603,7 @@ func TestApplyPlanWritesNoEmptyJournal(t *testing.T) {
 		p := planFor(t, dir, "a.txt", "..")
 		history := writeFile(t, filepath.Join(dir, rename.JournalName),
 			`{"t":"2024-01-01T00:00:00Z","old":"x.txt","new":"y.txt"}`+"\n")
-		applyPlan(context.Background(), quiet, p, log)
+		applyPlan(context.Background(), p, rename.Run{}, log, ignoreRenamed)
 		b, err := os.ReadFile(history)
 		if err != nil || !strings.Contains(string(b), "x.txt") {
 			t.Errorf("earlier history was destroyed: err=%v content=%q", err, b)
@@ -702,3 +708,1966 @@ func TestMetaCommandsStillRecognised(t *testing.T) {
 		t.Errorf("scanMeta with -model=help = %q, want \"\"", got)
 	}
 }
+
+func TestTemplateFlag(t *testing.T) {
+	t.Run("renames with the pattern", func(t *testing.T) {
+		dir := t.TempDir()
+		path := writeFile(t, filepath.Join(dir, "receipt.txt"), "Test Store\nTOTAL 123.45\n")
+		f := newFake(t, receiptReply)
+		got := runFake(t, f, "-template", "{{.Date}} {{underscore .Vendor}} {{.Total}}", path)
+		if got.code != ExitOK {
+			t.Fatalf("run: %s", got.dump())
+		}
+		if want := []string{rename.JournalName, "2023-01-15 Test_Store 123.45.txt"}; !slices.Equal(listing(t, dir), want) {
+			t.Errorf("dir = %q, want %q", listing(t, dir), want)
+		}
+	})
+
+	// A bad pattern is a usage error before ollama is contacted at all.
+	t.Run("bad pattern is a usage error", func(t *testing.T) {
+		dir := t.TempDir()
+		path := writeFile(t, filepath.Join(dir, "receipt.txt"), "Test Store\nTOTAL 123.45\n")
+		f := newFake(t, receiptReply)
+		got := runFake(t, f, "-template", "{{.Vendr}}", path)
+		if got.code != ExitUsage {
+			t.Errorf("code = %d, want %d\n%s", got.code, ExitUsage, got.dump())
+		}
+		if !strings.Contains(got.stderr, "-template") {
+			t.Errorf("stderr does not name the flag:\n%s", got.stderr)
+		}
+		if f.Count() != 0 {
+			t.Errorf("fake saw %d generate calls, want 0", f.Count())
+		}
+	})
+
+	// Each mode is held to the fields it fills, or every name would lack one.
+	t.Run("field of the other mode is a usage error", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "receipt.txt"), "Test Store\n")
+		f := newFake(t, receiptReply)
+		for _, args := range [][]string{
+			{"-template", "{{.Date}} {{.Subject}}", dir},
+			{"organize", "-y", "-template", "{{.Date}} {{.Vendor}}", dir},
+		} {
+			got := runFake(t, f, args...)
+			if got.code != ExitUsage || !strings.Contains(got.stderr, "is never filled in") {
+				t.Errorf("%q: code = %d\n%s", args, got.code, got.dump())
+			}
+		}
+		if f.Count() != 0 {
+			t.Errorf("fake saw %d generate calls, want 0", f.Count())
+		}
+	})
+
+	// Under a template a dated name is not a finished one, so organize must not
+	// skip it as already organized.
+	t.Run("organize does not skip a dated name", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "2024-03-11 - Comcast Bill.txt"), "Comcast internet statement.\n")
+		f := newFake(t, subjectReply(t, "2024-03-11", "Comcast Internet Service Invoice"))
+		got := runFake(t, f, "organize", "-y", "-template", "{{.Subject}} {{.Date}}", dir)
+		if got.code != ExitOK {
+			t.Fatalf("organize: %s", got.dump())
+		}
+		if want := []string{rename.JournalName, "Comcast Internet Service Invoice 2024-03-11.txt"}; !slices.Equal(listing(t, dir), want) {
+			t.Errorf("dir = %q, want %q", listing(t, dir), want)
+		}
+	})
+}
+
+// decodeLines reads -format jsonl output, failing on anything that is not one
+// JSON object per line: stdout has to stay clean enough to pipe.
+func decodeLines(t *testing.T, out string) []map[string]any {
+	t.Helper()
+	var recs []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var m map[string]any
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("stdout line is not JSON: %q: %v\nstdout:\n%s", line, err, out)
+		}
+		recs = append(recs, m)
+	}
+	return recs
+}
+
+func TestFormatJSONLines(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, filepath.Join(dir, "receipt.txt"), "Test Store\nTOTAL 123.45\n")
+	writeFile(t, filepath.Join(dir, "broken.txt"), "unreadable\n")
+	// Files are read in name order, so broken.txt takes the first reply.
+	f := newFake(t, `{"vendor":""}`, receiptReply)
+
+	got := runFake(t, f, "-format", "jsonl", "-ext", ".txt", dir)
+	if got.code != ExitPartial {
+		t.Fatalf("code = %d, want %d\n%s", got.code, ExitPartial, got.dump())
+	}
+	recs := decodeLines(t, got.stdout)
+	if len(recs) != 3 {
+		t.Fatalf("got %d records, want 2 items and a summary:\n%s", len(recs), got.stdout)
+	}
+
+	failed, ok := recs[0], recs[1]
+	if failed["action"] != "error" || failed["error"] == "" {
+		t.Errorf("broken.txt record = %v, want an error", failed)
+	}
+	want := filepath.Join(dir, "01-15-2023 - 123.45 - Test_Store - Food.txt")
+	if ok["path"] != path || ok["new_path"] != want || ok["action"] != "rename" {
+		t.Errorf("receipt record = %v", ok)
+	}
+	if ok["vendor"] != "Test Store" || ok["date"] != "2023-01-15" || ok["total"] != 123.45 || ok["category"] != "Food" {
+		t.Errorf("receipt record lacks the extracted fields: %v", ok)
+	}
+	sum := recs[2]
+	if sum["record"] != "summary" || sum["renamed"] != 1.0 || sum["failed"] != 1.0 || sum["dry_run"] != false {
+		t.Errorf("summary = %v", sum)
+	}
+}
+
+func TestFormatJSONDryRunAndUndo(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "scan.txt"), "Comcast internet statement.\n")
+	f := newFake(t, subjectReply(t, "2024-03-11", "Comcast Internet Service Invoice"))
+
+	got := runFake(t, f, "organize", "-n", "-format", "json", dir)
+	if got.code != ExitOK {
+		t.Fatalf("organize -n: %s", got.dump())
+	}
+	var recs []map[string]any
+	if err := json.Unmarshal([]byte(got.stdout), &recs); err != nil {
+		t.Fatalf("stdout is not one JSON document: %v\n%s", err, got.stdout)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("got %d records, want an item and a summary:\n%s", len(recs), got.stdout)
+	}
+	if recs[0]["new_name"] != "2024-03-11 - Comcast Internet Service Invoice.txt" || recs[0]["new_path"] != "" {
+		t.Errorf("dry-run item = %v", recs[0])
+	}
+	if recs[0]["subject"] != "Comcast Internet Service Invoice" {
+		t.Errorf("dry-run item lacks the subject: %v", recs[0])
+	}
+	if recs[1]["to_rename"] != 1.0 || recs[1]["renamed"] != 0.0 || recs[1]["dry_run"] != true {
+		t.Errorf("summary = %v", recs[1])
+	}
+
+	if got := runFake(t, f, "organize", "-y", dir); got.code != ExitOK {
+		t.Fatalf("organize: %s", got.dump())
+	}
+	got = runFake(t, f, "undo", "-y", "-format", "jsonl", dir)
+	if got.code != ExitOK {
+		t.Fatalf("undo: %s", got.dump())
+	}
+	undone := decodeLines(t, got.stdout)
+	if len(undone) != 2 || undone[0]["action"] != "reverted" || undone[0]["new_name"] != "scan.txt" {
+		t.Errorf("undo records = %v", undone)
+	}
+	if undone[1]["record"] != "summary" || undone[1]["reverted"] != 1.0 {
+		t.Errorf("undo summary = %v", undone[1])
+	}
+}
+
+func TestSummaryCountsFailedRenamesAsPlanned(t *testing.T) {
+	dir := t.TempDir()
+	gone := filepath.Join(dir, "gone.txt")
+	p := &rename.Plan{Dir: dir, Items: []rename.Item{
+		{OldPath: gone, Action: rename.ActionRename, NewName: "renamed.txt"},
+		{OldPath: filepath.Join(dir, "unread.txt"), Action: rename.ActionError, Err: fmt.Errorf("unreadable")},
+	}}
+	// gone.txt was never written, so applying its rename fails.
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if n := applyPlan(context.Background(), p, newRun(modeReceipts, testModel), log, func(string, string) {}); n != 0 {
+		t.Fatalf("renamed %d, want 0", n)
+	}
+
+	var out bytes.Buffer
+	if err := writeRecords(&out, formatJSONL, []*rename.Plan{p}, nil, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	recs := decodeLines(t, out.String())
+	sum := recs[len(recs)-1]
+	if sum["to_rename"] != 1.0 || sum["renamed"] != 0.0 || sum["failed"] != 2.0 {
+		t.Errorf("summary = %v, want the failed rename counted as planned", sum)
+	}
+}
+
+func TestFormatIsValidated(t *testing.T) {
+	f := newFake(t, receiptReply)
+	got := runFake(t, f, "-format", "yaml", "x.pdf")
+	if got.code != ExitUsage || !strings.Contains(got.stderr, "-format") {
+		t.Errorf("-format yaml was not a usage error:\n%s", got.dump())
+	}
+}
+
+func readCSV(t *testing.T, path string) [][]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return rows
+}
+
+func TestExportCSV(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, filepath.Join(dir, "receipt.txt"), "Test Store\nTOTAL 123.45\n")
+	out := filepath.Join(t.TempDir(), "expenses.csv")
+	want := filepath.Join(dir, "01-15-2023 - 123.45 - Test_Store - Food.txt")
+
+	// A dry run exports the plan, so the sheet can be reviewed first.
+	f := newFake(t, receiptReply)
+	if got := runFake(t, f, "-n", "-export", out, path); got.code != ExitOK {
+		t.Fatalf("dry run: %s", got.dump())
+	}
+	rows := readCSV(t, out)
+	if len(rows) != 2 || !slices.Equal(rows[0], exportHeader) {
+		t.Fatalf("rows = %q, want the header and one file", rows)
+	}
+	wantRow := []string{path, want, "rename", "2023-01-15", "", "123.45", "Test Store", "Food", "text", "", "", "", "", "", "", "", "high", ""}
+	if !slices.Equal(rows[1], wantRow) {
+		t.Errorf("dry-run row = %q, want %q", rows[1], wantRow)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("the dry run renamed the file: %v", err)
+	}
+
+	if got := runFake(t, f, "-export", out, path); got.code != ExitOK {
+		t.Fatalf("run: %s", got.dump())
+	}
+	if rows := readCSV(t, out); len(rows) != 2 || rows[1][1] != want {
+		t.Errorf("rows after the run = %q, want final_path %q", rows, want)
+	}
+}
+
+func TestExportUnwritableIsAUsageError(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, filepath.Join(dir, "receipt.txt"), "Test Store\nTOTAL 123.45\n")
+	f := newFake(t, receiptReply)
+	got := runFake(t, f, "-export", filepath.Join(dir, "missing", "out.csv"), path)
+	if got.code != ExitUsage {
+		t.Errorf("code = %d, want %d\n%s", got.code, ExitUsage, got.dump())
+	}
+	if f.Count() != 0 {
+		t.Errorf("fake saw %d generate calls before the export path was checked", f.Count())
+	}
+}
+
+// The vendor comes from an untrusted document, so it must never reach a
+// spreadsheet as a formula.
+func TestExportDefusesFormulas(t *testing.T) {
+	var b bytes.Buffer
+	rc := analyze.Receipt{Vendor: "=HYPERLINK(\"http://x\")", Category: "Food", Items: []analyze.LineItem{{Description: "Widget"}}}
+	// Relative paths, as a run in the receipts folder itself gives, with a name
+	// a vendor-first -template made of the model's answer.
+	plans := []*rename.Plan{{Dir: "", Items: []rename.Item{{OldPath: "@scan.pdf", NewName: "=1+1 - Food.pdf", Action: rename.ActionRename}}}}
+	found := map[string]facts{"@scan.pdf": {Receipt: &rc}}
+	if err := writeExport(&b, plans, found, nil, true); err != nil {
+		t.Fatalf("writeExport: %v", err)
+	}
+	rows, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	for _, col := range []int{0, 1, 6} {
+		if got := rows[1][col]; !strings.HasPrefix(got, "'") {
+			t.Errorf("%s cell = %q, want it quoted as text", exportHeader[col], got)
+		}
+	}
+
+	b.Reset()
+	if err := writeItemsExport(&b, plans, found, nil, true); err != nil {
+		t.Fatalf("writeItemsExport: %v", err)
+	}
+	if rows, err = csv.NewReader(&b).ReadAll(); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got := rows[1][:2]; got[0] != "'@scan.pdf" || got[1] != "'=1+1 - Food.pdf" {
+		t.Errorf("items paths = %q, want both quoted as text", got)
+	}
+}
+
+const itemsReply = `{"is_hotel":false,"vendor":"Test Store","date":"2023-01-15","end_date":"","total":123.45,"currency":"USD","category":"Food",` +
+	`"items":[{"description":"=Widget","quantity":3,"unit_price":"20.00","amount":"60.00"},{"description":"Gadget","quantity":1,"unit_price":"","amount":"63.45"}]}`
+
+func TestItemsExport(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, filepath.Join(dir, "receipt.txt"), "Test Store\nTOTAL 123.45\n")
+	out := filepath.Join(t.TempDir(), "items.csv")
+	want := filepath.Join(dir, "01-15-2023 - 123.45 - Test_Store - Food.txt")
+
+	f := newFake(t, itemsReply)
+	got := runFake(t, f, "-n", "-items", "-export-items", out, "-format", "jsonl", path)
+	if got.code != ExitOK {
+		t.Fatalf("run: %s", got.dump())
+	}
+	rows := readCSV(t, out)
+	wantRows := [][]string{
+		itemsHeader,
+		{path, want, "1", "'=Widget", "3", "20.00", "60.00", "USD"},
+		{path, want, "2", "Gadget", "1", "", "63.45", "USD"},
+	}
+	if !slices.EqualFunc(rows, wantRows, slices.Equal) {
+		t.Errorf("rows = %q, want %q", rows, wantRows)
+	}
+
+	recs := decodeLines(t, got.stdout)
+	items, _ := recs[0]["items"].([]any)
+	if len(items) != 2 {
+		t.Fatalf("record items = %v, want two", recs[0]["items"])
+	}
+	if first := items[0].(map[string]any); first["description"] != "=Widget" || first["quantity"] != 3.0 || first["unit_price"] != 20.0 || first["amount"] != 60.0 {
+		t.Errorf("first item = %v", first)
+	}
+	if _, ok := recs[0]["doubts"]; ok {
+		t.Errorf("record = %v, want no doubts for lines that add up", recs[0])
+	}
+}
+
+func TestExportItemsNeedsItems(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, filepath.Join(dir, "receipt.txt"), "Test Store\n")
+	got := runCLI(t, nil, "", false, "-export-items", filepath.Join(dir, "items.csv"), path)
+	if got.code != ExitUsage || !strings.Contains(got.stderr, "-export-items needs -items") {
+		t.Errorf("code = %d, want a usage error\n%s", got.code, got.dump())
+	}
+}
+
+// noTotalReply reads cleanly except for the total, which leaves the receipt at
+// low confidence.
+const noTotalReply = `{"is_hotel":false,"vendor":"Test Store","date":"2023-01-15","end_date":"","category":"Food"}`
+
+func TestMinConfidenceSkips(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.txt"), "Test Store\n")
+	writeFile(t, filepath.Join(dir, "b.txt"), "Test Store\nTOTAL 123.45\n")
+	f := newFake(t, noTotalReply, receiptReply)
+
+	got := runFake(t, f, "-min-confidence", "medium", "-ext", ".txt", dir)
+	if got.code != ExitOK {
+		t.Fatalf("run: %s", got.dump())
+	}
+	want := []string{rename.JournalName, "01-15-2023 - 123.45 - Test_Store - Food.txt", "a.txt"}
+	if !slices.Equal(listing(t, dir), want) {
+		t.Errorf("dir = %q, want %q", listing(t, dir), want)
+	}
+	if !strings.Contains(got.stdout, "low confidence, below -min-confidence") || !strings.Contains(got.stdout, "low: no total") {
+		t.Errorf("plan does not say why a.txt was held back:\n%s", got.stdout)
+	}
+}
+
+func TestReviewRoutesDoubtfulFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.txt"), "Test Store\n")
+	f := newFake(t, noTotalReply)
+
+	got := runFake(t, f, "-min-confidence", "high", "-review", "-format", "jsonl", filepath.Join(dir, "a.txt"))
+	if got.code != ExitOK {
+		t.Fatalf("run: %s", got.dump())
+	}
+	want := filepath.Join(dir, reviewDir, "01-15-2023 - 0.00 - Test_Store - Food.txt")
+	recs := decodeLines(t, got.stdout)
+	if recs[0]["new_path"] != want || recs[0]["confidence"] != "low" {
+		t.Errorf("record = %v, want it moved to %s at low confidence", recs[0], want)
+	}
+	if doubts, _ := recs[0]["doubts"].([]any); len(doubts) == 0 {
+		t.Errorf("record = %v, want the doubts listed", recs[0])
+	}
+
+	// A second look finds it already in review and leaves it where it is.
+	if got := runFake(t, f, "-min-confidence", "high", "-review", want); got.code != ExitOK || !strings.Contains(got.stdout, "unchanged") {
+		t.Errorf("second run: %s", got.dump())
+	}
+}
+
+func TestMinConfidenceIsValidated(t *testing.T) {
+	got := runCLI(t, nil, "", false, "-min-confidence", "sure", t.TempDir())
+	if got.code != ExitUsage || !strings.Contains(got.stderr, "-min-confidence must be low, medium or high") {
+		t.Errorf("code = %d\n%s", got.code, got.dump())
+	}
+}
+
+func TestInteractiveReview(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt", "d.txt"} {
+		writeFile(t, filepath.Join(dir, name), "Test Store\n"+name+"\n")
+	}
+	f := testutil.NewFake(t, []string{testModel, "big"}, receiptReply, receiptReply, noTotalReply, receiptReply)
+	answers := strings.Join([]string{
+		"?",
+		"f", "Other Shop", "", "", "", "", "", "a", // a.txt: correct the vendor, then accept
+		"n", "lunch", "a", // b.txt: name it by hand
+		"m", "big", "a", // c.txt: read again with the bigger model
+		// d.txt: stdin ends, which skips it
+	}, "\n") + "\n"
+
+	got := runCLI(t, env(map[string]string{"RCPTPIXIE_HOST": f.URL}), answers, true, "-interactive", "-ext", ".txt", dir)
+	if got.code != ExitOK {
+		t.Fatalf("run: %s", got.dump())
+	}
+	want := []string{
+		rename.JournalName,
+		"01-15-2023 - 123.45 - Other_Shop - Food.txt",
+		"01-15-2023 - 123.45 - Test_Store - Food.txt",
+		"d.txt",
+		"lunch.txt",
+	}
+	if !slices.Equal(listing(t, dir), want) {
+		t.Errorf("dir = %q, want %q\n%s", listing(t, dir), want, got.stderr)
+	}
+	// Once a.txt was corrected, b.txt no longer collides with it, and the name
+	// offered for it says so.
+	if !strings.Contains(got.stderr, "b.txt\n  -> 01-15-2023 - 123.45 - Test_Store - Food.txt\n") {
+		t.Errorf("b.txt was not offered its collision-free name:\n%s", got.stderr)
+	}
+	if !strings.Contains(got.stderr, "low: no total") || !strings.Contains(got.stderr, "reading with big") {
+		t.Errorf("c.txt's doubts or the second read are missing:\n%s", got.stderr)
+	}
+	if !strings.Contains(got.stdout, "skipped: not reviewed") {
+		t.Errorf("d.txt is not reported as left alone:\n%s", got.stdout)
+	}
+}
+
+func TestInteractiveCategoryMustBeListed(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.txt"), "Test Store\n")
+	f := newFake(t, receiptReply)
+	answers := strings.Join([]string{
+		"f", "", "", "", "", "",
+		"Food",   // the model's choice, but not one of -categories
+		"travel", // taken as the list spells it
+		"a",
+	}, "\n") + "\n"
+
+	got := runCLI(t, env(map[string]string{"RCPTPIXIE_HOST": f.URL}), answers, true,
+		"-interactive", "-ext", ".txt", "-categories", "Meals,Travel", dir)
+	if got.code != ExitOK {
+		t.Fatalf("run: %s", got.dump())
+	}
+	if !strings.Contains(got.stderr, `"Food" is not one of the categories: Meals, Travel`) {
+		t.Errorf("an unlisted category was not refused:\n%s", got.stderr)
+	}
+	want := []string{rename.JournalName, "01-15-2023 - 123.45 - Test_Store - Travel.txt"}
+	if !slices.Equal(listing(t, dir), want) {
+		t.Errorf("dir = %q, want %q\n%s", listing(t, dir), want, got.stderr)
+	}
+}
+
+func TestInteractiveNeedsATerminal(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFile(t, filepath.Join(dir, "receipt.txt"), "Test Store\n")
+	f := newFake(t, receiptReply)
+	if got := runFake(t, f, "-interactive", path); got.code != ExitUsage || f.Count() != 0 {
+		t.Errorf("code = %d after %d model calls, want a usage error before any\n%s", got.code, f.Count(), got.dump())
+	}
+	if got := runFake(t, f, "-interactive", "-n", path); got.code != ExitUsage {
+		t.Errorf("-interactive -n: code = %d, want a usage error", got.code)
+	}
+}
+
+func TestFallbackModelRereadsMisreadFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		writeFile(t, filepath.Join(dir, name), "Test Store\n"+name+"\n")
+	}
+	other := `{"is_hotel":false,"vendor":"Corner Deli","date":"2023-01-16","end_date":"","total":9.5,"category":"Food"}`
+	f := testutil.NewFake(t, []string{testModel, "big"},
+		receiptReply,        // a.txt
+		`{"vendor":""}`,     // b.txt, no vendor
+		noTotalReply,        // c.txt, low confidence
+		receiptReply, other, // b.txt and c.txt again, with big
+	)
+
+	got := runFake(t, f, "-n", "-fallback-model", "big", "-format", "jsonl", "-ext", ".txt", dir)
+	if got.code != ExitOK {
+		t.Fatalf("run: %s", got.dump())
+	}
+	if f.Count() != 5 {
+		t.Fatalf("fake saw %d requests, want 3 and then 2 again", f.Count())
+	}
+	for i := range f.Count() {
+		want := testModel
+		if i >= 3 {
+			want = "big"
+		}
+		if got := f.Requests[i]["model"]; got != want {
+			t.Errorf("request %d went to %q, want %q", i, got, want)
+		}
+	}
+	recs := decodeLines(t, got.stdout)
+	if len(recs) != 4 {
+		t.Fatalf("got %d records, want 3 items and a summary:\n%s", len(recs), got.stdout)
+	}
+	if recs[0]["escalated"] != nil || recs[1]["escalated"] != true || recs[2]["escalated"] != true {
+		t.Errorf("escalated = %v %v %v, want b.txt and c.txt only", recs[0]["escalated"], recs[1]["escalated"], recs[2]["escalated"])
+	}
+	if recs[1]["action"] != "rename" || recs[2]["vendor"] != "Corner Deli" {
+		t.Errorf("the fallback's answers were not used: %v %v", recs[1], recs[2])
+	}
+	if recs[3]["escalated"] != 2.0 {
+		t.Errorf("summary = %v, want 2 escalated", recs[3])
+	}
+	if !strings.Contains(got.stderr, "2 read again with big") {
+		t.Errorf("stderr does not report the escalations:\n%s", got.stderr)
+	}
+}
+
+// A file the fallback gave no answer for keeps the first one, and is not
+// counted as read again.
+func TestFallbackModelFailureIsNotAnEscalation(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.txt"), "Test Store\n")
+	f := testutil.NewFake(t, []string{testModel, "big"}, noTotalReply, "not json")
+
+	got := runFake(t, f, "-n", "-fallback-model", "big", "-format", "jsonl", "-ext", ".txt", dir)
+	if f.Count() < 2 || f.Requests[1]["model"] != "big" {
+		t.Fatalf("the fallback was not asked:\n%s", got.dump())
+	}
+	recs := decodeLines(t, got.stdout)
+	if len(recs) != 2 {
+		t.Fatalf("got %d records, want an item and a summary:\n%s", len(recs), got.stdout)
+	}
+	if recs[0]["escalated"] != nil || recs[0]["vendor"] != "Test Store" {
+		t.Errorf("item = %v, want the first answer and no escalation", recs[0])
+	}
+	if recs[1]["escalated"] != 0.0 {
+		t.Errorf("summary = %v, want 0 escalated", recs[1])
+	}
+	if strings.Contains(got.stderr, "read again with big") {
+		t.Errorf("stderr counts a failed reread:\n%s", got.stderr)
+	}
+}
+
+func TestFallbackModelMustDiffer(t *testing.T) {
+	got := runCLI(t, nil, "", false, "-model", "m", "-fallback-model", "m", t.TempDir())
+	if got.code != ExitUsage || !strings.Contains(got.stderr, "-fallback-model must differ from -model") {
+		t.Errorf("code = %d\n%s", got.code, got.dump())
+	}
+}
+
+// runCached is runFake with the analysis cache enabled under cacheDir.
+// otherReply and thirdReply are receipts unlike receiptReply, and each other,
+// in every field compared.
+const (
+	otherReply = `{"is_hotel":false,"vendor":"Other Shop","date":"2023-02-01","end_date":"","total":9.99,"category":"Food"}`
+	thirdReply = `{"is_hotel":false,"vendor":"Third Shop","date":"2023-03-01","end_date":"","total":1.50,"category":"Food"}`
+)
+
+func TestDuplicatesAcrossARecursiveRun(t *testing.T) {
+	dir := t.TempDir()
+	a := writeFile(t, filepath.Join(dir, "a.txt"), "Test Store\n123.45\n")
+	mkdir(t, filepath.Join(dir, "sub"))
+	b := writeFile(t, filepath.Join(dir, "sub", "b.txt"), "TEST STORE photo\n")
+	c := writeFile(t, filepath.Join(dir, "sub", "c.txt"), "Test Store\n123.45\n")
+	writeFile(t, filepath.Join(dir, "sub", "d.txt"), "Other Shop\n")
+	// b reads as the same purchase as a; c is a's bytes, whatever the model
+	// made of it; d is something else.
+	f := newFake(t, receiptReply, `{"is_hotel":false,"vendor":"Test Store.","date":"2023-01-15","end_date":"","total":123.45,"category":"Food"}`, otherReply, thirdReply)
+
+	got := runFake(t, f, "-r", "-ext", ".txt", "-duplicates", "skip", "-format", "jsonl", dir)
+	if got.code != ExitOK {
+		t.Fatalf("run: %s", got.dump())
+	}
+	recs := decodeLines(t, got.stdout)
+	byPath := make(map[string]map[string]any)
+	for _, r := range recs {
+		if p, ok := r["path"].(string); ok {
+			byPath[p] = r
+		}
+	}
+	for _, p := range []string{b, c} {
+		if r := byPath[p]; r["action"] != "duplicate" || r["duplicate_of"] != a {
+			t.Errorf("%s = %v, want a duplicate of %s", p, r, a)
+		}
+	}
+	if byPath[a]["action"] != "rename" || byPath[filepath.Join(dir, "sub", "d.txt")]["action"] != "rename" {
+		t.Errorf("records = %v, want a.txt and d.txt renamed", recs)
+	}
+	if sum := recs[len(recs)-1]; sum["duplicates"] != 2.0 || sum["skipped"] != 2.0 {
+		t.Errorf("summary = %v, want 2 duplicates skipped", sum)
+	}
+	if !slices.Contains(listing(t, filepath.Join(dir, "sub")), "b.txt") {
+		t.Errorf("sub = %q, want b.txt left alone", listing(t, filepath.Join(dir, "sub")))
+	}
+}
+
+func TestDuplicatesMarkAndMove(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-duplicates", "mark"}, "01-15-2023 - 123.45 - Test_Store - Food (duplicate).txt"},
+		{[]string{"-duplicates", "move"}, filepath.Join(duplicatesDir, "01-15-2023 - 123.45 - Test_Store - Food.txt")},
+		{[]string{"-duplicates", "move", "-duplicates-dir", "dups"}, "01-15-2023 - 123.45 - Test_Store - Food.txt"},
+	} {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "a.txt"), "Test Store\n")
+		writeFile(t, filepath.Join(dir, "b.txt"), "Test Store\n")
+		f := newFake(t, receiptReply, receiptReply)
+		args := append(slices.Clone(tc.args), "-ext", ".txt", dir)
+		for i, a := range args {
+			if a == "dups" {
+				args[i] = filepath.Join(dir, "dups")
+			}
+		}
+
+		got := runFake(t, f, args...)
+		if got.code != ExitOK {
+			t.Fatalf("%v: %s", tc.args, got.dump())
+		}
+		if !strings.Contains(got.stdout, "duplicate of a.txt") {
+			t.Errorf("%v: plan does not name the original:\n%s", tc.args, got.stdout)
+		}
+		where := filepath.Join(dir, tc.want)
+		if slices.Contains(tc.args, "-duplicates-dir") {
+			where = filepath.Join(dir, "dups", tc.want)
+		}
+		if _, err := os.Stat(where); err != nil {
+			t.Errorf("%v: b.txt not at %s: %v\n%s", tc.args, where, err, got.dump())
+		}
+	}
+}
+
+func TestDuplicatesIsValidated(t *testing.T) {
+	for _, args := range [][]string{
+		{"-duplicates", "delete"},
+		{"-duplicates", "skip", "-duplicates-dir", "x"},
+	} {
+		got := runCLI(t, nil, "", false, append(args, t.TempDir())...)
+		if got.code != ExitUsage || !strings.Contains(got.stderr, "-duplicates") {
+			t.Errorf("%v: code = %d\n%s", args, got.code, got.dump())
+		}
+	}
+}
+
+func TestConfigFilesAndProfiles(t *testing.T) {
+	root := t.TempDir()
+	cfg := filepath.Dir(mkdir(t, filepath.Join(root, "cfg", "rcptpixie")))
+	trips := mkdir(t, filepath.Join(root, "trips"))
+	eu := mkdir(t, filepath.Join(trips, "eu"))
+	file := writeFile(t, filepath.Join(eu, "a.txt"), "Test Store\n")
+	f := testutil.NewFake(t, []string{testModel, "big", "bigger"}, receiptReply)
+
+	writeFile(t, filepath.Join(cfg, "rcptpixie", "config"), `# every folder
+model = "big"   # the scans need it
+
+[profile.travel]
+format = "jsonl"
+`)
+	vars := map[string]string{"RCPTPIXIE_HOST": f.URL, "XDG_CONFIG_HOME": cfg}
+	modelFor := func(args ...string) (string, result) {
+		t.Helper()
+		before := f.Count()
+		got := runCLI(t, env(vars), "", false, append([]string{"-n"}, append(args, file)...)...)
+		if got.code != ExitOK || f.Count() != before+1 {
+			t.Fatalf("%v: %s", args, got.dump())
+		}
+		m, _ := f.Requests[before]["model"].(string)
+		return m, got
+	}
+
+	if m, _ := modelFor(); m != "big" {
+		t.Errorf("user file: model = %q, want big", m)
+	}
+	// The nearest directory file beats the user file, found from above the
+	// target.
+	writeFile(t, filepath.Join(trips, ".rcptpixie.json"), `{"model": "bigger", "profile": {"travel": {"date-order": "day-first"}}}`)
+	if m, _ := modelFor(); m != "bigger" {
+		t.Errorf("directory file: model = %q, want bigger", m)
+	}
+	vars["RCPTPIXIE_MODEL"] = testModel
+	if m, _ := modelFor(); m != testModel {
+		t.Errorf("environment: model = %q, want %s", m, testModel)
+	}
+	if m, _ := modelFor("-model", "big"); m != "big" {
+		t.Errorf("flag: model = %q, want big", m)
+	}
+
+	// A profile is laid over both files.
+	_, got := modelFor("-profile", "travel")
+	if recs := decodeLines(t, got.stdout); len(recs) != 2 {
+		t.Errorf("-profile travel: want jsonl from the user file's profile, got\n%s", got.stdout)
+	}
+	if got := runCLI(t, env(vars), "", false, "-n", "-profile", "home", file); got.code != ExitUsage || !strings.Contains(got.stderr, `no profile "home"`) {
+		t.Errorf("unknown profile: %s", got.dump())
+	}
+}
+
+func TestConfigTOML(t *testing.T) {
+	c := &config{values: map[string][]string{}, profiles: map[string]map[string][]string{}}
+	err := c.parseTOML([]byte(`
+date_order = 'day-first'
+host = ["a:11434", "b:11434"]
+template = "{{.Vendor}} # not a comment"
+recursive = true
+
+[profile."eu travel"]
+jobs = 4
+`))
+	if err != nil {
+		t.Fatalf("parseTOML: %v", err)
+	}
+	want := map[string][]string{
+		"date-order": {"day-first"},
+		"host":       {"a:11434", "b:11434"},
+		"template":   {"{{.Vendor}} # not a comment"},
+		"recursive":  {"true"},
+	}
+	if !maps.EqualFunc(c.values, want, slices.Equal) || !slices.Equal(c.profiles["eu travel"]["jobs"], []string{"4"}) {
+		t.Errorf("values = %q, profiles = %q", c.values, c.profiles)
+	}
+	if err := c.parseTOML([]byte("[scans]\nmodel = \"big\"\n")); err == nil {
+		t.Error("a table other than [profile.NAME] was accepted")
+	}
+}
+
+// TestDirectoryConfigCannotRedirect is a shared folder whose file tries to send
+// its documents to another server: the run stops before anything is read.
+func TestDirectoryConfigCannotRedirect(t *testing.T) {
+	f := newFake(t, receiptReply)
+	for _, cfg := range []string{
+		"host = \"http://collector.example:11434\"\n",
+		"[profile.scans]\nyes = true\n",
+		"dest = \"/tmp/elsewhere\"\n",
+	} {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, ".rcptpixie.toml"), cfg)
+		writeFile(t, filepath.Join(dir, "a.txt"), "Test Store\n")
+
+		got := runFake(t, f, "-n", "-ext", ".txt", dir)
+		if got.code != ExitUsage || !strings.Contains(got.stderr, "cannot be set in a directory's file") {
+			t.Errorf("%q: code = %d\n%s", cfg, got.code, got.dump())
+		}
+	}
+	if f.Count() != 0 {
+		t.Errorf("the model was asked %d times", f.Count())
+	}
+}
+
+// A folder's file may pick one of the user's profiles only if the profile sets
+// nothing the folder's file could not set itself.
+func TestDirectoryConfigCannotChooseAPowerfulProfile(t *testing.T) {
+	f := newFake(t, receiptReply)
+	home := t.TempDir()
+	elsewhere := t.TempDir()
+	writeFile(t, filepath.Join(mkdir(t, filepath.Join(home, "rcptpixie")), "config"),
+		"[profile.archive]\ndest = "+strconv.Quote(elsewhere)+"\n\n[profile.travel]\ndate-order = \"day-first\"\n")
+	vars := env(map[string]string{"RCPTPIXIE_HOST": f.URL, "XDG_CONFIG_HOME": home})
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.txt"), "Test Store\n")
+	writeFile(t, filepath.Join(dir, ".rcptpixie.toml"), "profile = \"archive\"\n")
+	got := runCLI(t, vars, "", false, "-ext", ".txt", dir)
+	if got.code != ExitUsage || !strings.Contains(got.stderr, `profile "archive" sets dest`) {
+		t.Errorf("code = %d\n%s", got.code, got.dump())
+	}
+	if names := listing(t, elsewhere); len(names) != 0 {
+		t.Errorf("files were moved to %v", names)
+	}
+	// Given by the user, the same profile is theirs to choose.
+	if got := runCLI(t, vars, "", false, "-n", "-ext", ".txt", "-profile", "archive", dir); got.code != ExitOK {
+		t.Errorf("-profile archive: %s", got.dump())
+	}
+
+	writeFile(t, filepath.Join(dir, ".rcptpixie.toml"), "profile = \"travel\"\n")
+	if got := runCLI(t, vars, "", false, "-n", "-ext", ".txt", dir); got.code != ExitOK {
+		t.Errorf("profile travel: %s", got.dump())
+	}
+}
+
+// Settings are read once, from the first target; a later one under another
+// folder's file is refused rather than named by the wrong settings.
+func TestTargetsUnderDifferentFolderSettings(t *testing.T) {
+	f := newFake(t, receiptReply)
+	plain := t.TempDir()
+	configured := t.TempDir()
+	writeFile(t, filepath.Join(configured, ".rcptpixie.toml"), "template = \"{{.Vendor}}\"\n")
+	a := writeFile(t, filepath.Join(plain, "a.txt"), "Test Store\n")
+	b := writeFile(t, filepath.Join(configured, "b.txt"), "Test Store\n")
+	vars := env(map[string]string{"RCPTPIXIE_HOST": f.URL})
+
+	for _, tt := range []struct {
+		stdin string
+		args  []string
+	}{
+		{"", []string{"-n", a, b}},
+		{"", []string{"-n", b, a}},
+		{b + "\n", []string{"-n", "-files-from", "-", a}},
+	} {
+		got := runCLI(t, vars, tt.stdin, false, tt.args...)
+		if got.code != ExitUsage || !strings.Contains(got.stderr, "different folder settings") {
+			t.Errorf("%q: code = %d\n%s", tt.args, got.code, got.dump())
+		}
+	}
+	if f.Count() != 0 {
+		t.Errorf("the model was asked %d times", f.Count())
+	}
+
+	// Two files under the same folder's file are fine.
+	c := writeFile(t, filepath.Join(configured, "c.txt"), "Test Store\n")
+	if got := runCLI(t, vars, "", false, "-n", b, c); got.code != ExitOK {
+		t.Errorf("same settings: %s", got.dump())
+	}
+}
+
+func TestConfigRejectsUnknownKeys(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, ".rcptpixie.toml"), "date_ordr = \"day-first\"\n")
+	writeFile(t, filepath.Join(dir, "a.txt"), "Test Store\n")
+
+	got := runFake(t, newFake(t, receiptReply), "-n", "-ext", ".txt", dir)
+	if got.code != ExitUsage || !strings.Contains(got.stderr, "date-ordr: no command has this setting") {
+		t.Errorf("code = %d\n%s", got.code, got.dump())
+	}
+}
+
+func TestCategoriesFromAConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, ".rcptpixie.toml"), `
+categories = ["6100 Travel-Air", "Food", "6999 Misc"]
+category_rule = ['^test\s{1,2}store$=6100 travel-air']
+`)
+	writeFile(t, filepath.Join(dir, "a.txt"), "Test Store\n")
+	f := newFake(t, receiptReply)
+
+	got := runFake(t, f, "-ext", ".txt", dir)
+	if got.code != ExitOK {
+		t.Fatalf("run: %s", got.dump())
+	}
+	want := "01-15-2023 - 123.45 - Test_Store - 6100_Travel-Air.txt"
+	if !slices.Contains(listing(t, dir), want) {
+		t.Errorf("dir = %q, want %q", listing(t, dir), want)
+	}
+}
+
+func TestCategoriesAreValidated(t *testing.T) {
+	for _, args := range [][]string{
+		{"-category-rule", "starbucks"},
+		{"-categories", "Hotel,Food", "-category-rule", "marriott=Lodging"},
+	} {
+		got := runCLI(t, nil, "", false, append(args, t.TempDir())...)
+		if got.code != ExitUsage || !strings.Contains(got.stderr, "-categories") {
+			t.Errorf("%v: code = %d\n%s", args, got.code, got.dump())
+		}
+	}
+}
+
+func runCached(t *testing.T, f *testutil.Fake, cacheDir string, args ...string) result {
+	t.Helper()
+	var out, errb bytes.Buffer
+	code := Run(context.Background(), Env{
+		Args:         args,
+		Stdout:       &out,
+		Stderr:       &errb,
+		Getenv:       env(map[string]string{"RCPTPIXIE_HOST": f.URL}),
+		UserCacheDir: func() (string, error) { return cacheDir, nil },
+	})
+	return result{code: code, stdout: out.String(), stderr: errb.String()}
+}
+
+func TestCacheSkipsTheModelOnARerun(t *testing.T) {
+	cacheDir := t.TempDir()
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "receipt.txt"), "Test Store\nTOTAL 123.45\n")
+	f := newFake(t, receiptReply)
+
+	if got := runCached(t, f, cacheDir, "-n", "-ext", ".txt", dir); got.code != ExitOK {
+		t.Fatalf("first run: %s", got.dump())
+	}
+	if f.Count() != 1 {
+		t.Fatalf("first run made %d model calls, want 1", f.Count())
+	}
+
+	// The dry run's answer carries over to the real run, and then survives the
+	// rename, because the key is the content and not the name.
+	if got := runCached(t, f, cacheDir, "-ext", ".txt", dir); got.code != ExitOK {
+		t.Fatalf("second run: %s", got.dump())
+	}
+	want := "01-15-2023 - 123.45 - Test_Store - Food.txt"
+	if !slices.Contains(listing(t, dir), want) {
+		t.Fatalf("listing = %q, want %q", listing(t, dir), want)
+	}
+	if got := runCached(t, f, cacheDir, "-ext", ".txt", "-template", "{{.Vendor}}", dir); got.code != ExitOK {
+		t.Fatalf("third run: %s", got.dump())
+	}
+	if !slices.Contains(listing(t, dir), "Test Store.txt") {
+		t.Errorf("listing = %q, want the new template applied to the cached answer", listing(t, dir))
+	}
+	if f.Count() != 1 {
+		t.Errorf("model calls = %d after three runs, want 1", f.Count())
+	}
+
+	// -no-cache asks again; a different model is a different question.
+	if got := runCached(t, f, cacheDir, "-n", "-no-cache", "-ext", ".txt", dir); got.code != ExitOK {
+		t.Fatalf("-no-cache run: %s", got.dump())
+	}
+	if f.Count() != 2 {
+		t.Errorf("model calls = %d after -no-cache, want 2", f.Count())
+	}
+	g := testutil.NewFake(t, []string{testModel, "other:latest"}, receiptReply)
+	if got := runCached(t, g, cacheDir, "-n", "-ext", ".txt", "-model", "other:latest", dir); got.code != ExitOK {
+		t.Fatalf("other model: %s", got.dump())
+	}
+	if g.Count() != 1 {
+		t.Errorf("a different model reused the cached answer")
+	}
+}
+
+func TestCacheKeepsNoFailures(t *testing.T) {
+	cacheDir := t.TempDir()
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "receipt.txt"), "Test Store\nTOTAL 123.45\n")
+	f := newFake(t, "not json", "still not json", receiptReply)
+
+	if got := runCached(t, f, cacheDir, "-n", "-ext", ".txt", dir); got.code != ExitFailure {
+		t.Fatalf("first run: %s", got.dump())
+	}
+	if got := runCached(t, f, cacheDir, "-n", "-ext", ".txt", dir); got.code != ExitOK {
+		t.Fatalf("a failed answer was cached: %s", got.dump())
+	}
+}
+
+func TestOrganizeCacheUsesTheCopysModTime(t *testing.T) {
+	cacheDir := t.TempDir()
+	dir := t.TempDir()
+	a := writeFile(t, filepath.Join(dir, "a.txt"), "a letter with no date in it")
+	f := newFake(t, subjectReply(t, "", "Undated Letter"))
+	if got := runCached(t, f, cacheDir, "organize", "-n", "-format", "jsonl", a); got.code != ExitOK {
+		t.Fatalf("first run: %s", got.dump())
+	}
+
+	b := writeFile(t, filepath.Join(t.TempDir(), "b.txt"), "a letter with no date in it")
+	when := time.Date(2020, 5, 6, 12, 0, 0, 0, time.Local)
+	if err := os.Chtimes(b, when, when); err != nil {
+		t.Fatal(err)
+	}
+	got := runCached(t, f, cacheDir, "organize", "-n", "-format", "jsonl", b)
+	if got.code != ExitOK || f.Count() != 1 {
+		t.Fatalf("second run made %d model calls: %s", f.Count(), got.dump())
+	}
+	if !strings.Contains(got.stdout, `"date":"2020-05-06"`) {
+		t.Errorf("stdout = %s, want the copy's own modification date", got.stdout)
+	}
+}
+
+func TestCacheClear(t *testing.T) {
+	cacheDir := t.TempDir()
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "receipt.txt"), "Test Store\nTOTAL 123.45\n")
+	f := newFake(t, receiptReply)
+	if got := runCached(t, f, cacheDir, "-n", "-ext", ".txt", dir); got.code != ExitOK {
+		t.Fatalf("run: %s", got.dump())
+	}
+
+	got := runCached(t, f, cacheDir, "cache", "clear")
+	if got.code != ExitOK || !strings.Contains(got.stderr, "removed 1 cached answers") {
+		t.Fatalf("cache clear: %s", got.dump())
+	}
+	if got := runCached(t, f, cacheDir, "-n", "-ext", ".txt", dir); got.code != ExitOK || f.Count() != 2 {
+		t.Errorf("model calls = %d after clearing, want 2\n%s", f.Count(), got.dump())
+	}
+
+	if got := runCached(t, f, cacheDir, "cache"); got.code != ExitUsage {
+		t.Errorf("bare cache: %s", got.dump())
+	}
+	if got := runCLI(t, nil, "", false, "cache", "clear"); got.code != ExitFailure {
+		t.Errorf("cache clear without a cache directory: %s", got.dump())
+	}
+}
+
+// eventually polls cond until it holds or a few seconds pass.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchSurvivesAnOllamaRestart(t *testing.T) {
+	inbox := t.TempDir()
+	out := filepath.Join(t.TempDir(), "filed")
+	f := newFake(t, receiptReply)
+	f.SetDown(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var stdout, stderr syncBuffer
+	done := make(chan ExitCode)
+	go func() {
+		done <- Run(ctx, Env{
+			Args:   []string{"watch", "-ext", ".txt", "-interval", "10ms", "-settle", "0s", "-out", out, inbox},
+			Stdout: &stdout,
+			Stderr: &stderr,
+			Getenv: env(map[string]string{"RCPTPIXIE_HOST": f.URL}),
+		})
+	}()
+
+	src := writeFile(t, filepath.Join(inbox, "scan.txt"), "Test Store\nTOTAL 123.45\n")
+	eventually(t, "a retry warning", func() bool { return strings.Contains(stderr.String(), "will retry") })
+	if _, err := os.Stat(src); err != nil {
+		t.Fatalf("the file was touched while ollama was down: %v", err)
+	}
+
+	f.SetDown(false)
+	want := filepath.Join(out, "01-15-2023 - 123.45 - Test_Store - Food.txt")
+	eventually(t, "the file to be filed", func() bool {
+		_, err := os.Stat(want)
+		return err == nil
+	})
+	cancel()
+	if code := <-done; code != ExitInterrupted {
+		t.Errorf("code = %d, want %d", code, ExitInterrupted)
+	}
+	if !strings.Contains(stdout.String(), "Renamed: "+src+" -> "+want) {
+		t.Errorf("stdout = %q", stdout.String())
+	}
+	if f.Count() != 1 {
+		t.Errorf("model calls = %d, want 1", f.Count())
+	}
+
+	// The journal stays in the inbox, and undo brings the file back there.
+	if got := runCLI(t, nil, "", false, "undo", "-y", inbox); got.code != ExitOK {
+		t.Fatalf("undo: %s", got.dump())
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("undo did not restore %s: %v", src, err)
+	}
+}
+
+// A 500 is the document's problem: the file fails once and is left alone,
+// rather than being retried forever and keeping the watcher in backoff.
+func TestWatchFailsAFileTheModelChokesOn(t *testing.T) {
+	inbox := t.TempDir()
+	out := filepath.Join(t.TempDir(), "filed")
+	f := newFake(t, receiptReply)
+	f.Choke("crash")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var stdout, stderr syncBuffer
+	done := make(chan ExitCode)
+	go func() {
+		done <- Run(ctx, Env{
+			Args:   []string{"watch", "-ext", ".txt", "-interval", "10ms", "-settle", "0s", "-out", out, inbox},
+			Stdout: &stdout,
+			Stderr: &stderr,
+			Getenv: env(map[string]string{"RCPTPIXIE_HOST": f.URL}),
+		})
+	}()
+
+	bad := writeFile(t, filepath.Join(inbox, "bad.txt"), "crash\n")
+	eventually(t, "the failure to be reported", func() bool { return strings.Contains(stderr.String(), "could not rename") })
+	calls := f.Count()
+
+	// A receipt arriving later is filed at once, not after a backoff.
+	writeFile(t, filepath.Join(inbox, "good.txt"), "Test Store\nTOTAL 123.45\n")
+	eventually(t, "the next receipt to be filed", func() bool { return strings.Contains(stdout.String(), "Renamed:") })
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	if f.Count() != calls+1 {
+		t.Errorf("model calls = %d, want %d: the failed file was read again", f.Count(), calls+1)
+	}
+	if strings.Contains(stderr.String(), "will retry") {
+		t.Errorf("a 500 was taken for an unavailable server:\n%s", stderr.String())
+	}
+	if _, err := os.Stat(bad); err != nil {
+		t.Errorf("the failed file was moved: %v", err)
+	}
+}
+
+func TestWatchWaitsForAFileToSettle(t *testing.T) {
+	inbox := t.TempDir()
+	f := newFake(t, receiptReply)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var stdout, stderr syncBuffer
+	done := make(chan ExitCode)
+	go func() {
+		done <- Run(ctx, Env{
+			Args:   []string{"watch", "-ext", ".txt", "-interval", "10ms", "-settle", "200ms", inbox},
+			Stdout: &stdout,
+			Stderr: &stderr,
+			Getenv: env(map[string]string{"RCPTPIXIE_HOST": f.URL}),
+		})
+	}()
+
+	// A file still being written keeps changing and must not be read.
+	path := filepath.Join(inbox, "scan.txt")
+	start := time.Now()
+	for time.Since(start) < 300*time.Millisecond {
+		writeFile(t, path, "Test Store\nTOTAL 123.45\n"+time.Since(start).String())
+		time.Sleep(20 * time.Millisecond)
+	}
+	if f.Count() != 0 {
+		t.Fatalf("a growing file was read %d times", f.Count())
+	}
+	eventually(t, "the settled file to be renamed", func() bool { return f.Count() == 1 && strings.Contains(stdout.String(), "Renamed:") })
+
+	// The renamed file is in the watched directory and must not be read again.
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+	<-done
+	if f.Count() != 1 {
+		t.Errorf("model calls = %d, want 1", f.Count())
+	}
+}
+
+func TestWatchRejectsJSONArray(t *testing.T) {
+	got := runCLI(t, nil, "", false, "watch", "-format", "json", t.TempDir())
+	if got.code != ExitUsage || !strings.Contains(got.stderr, "jsonl") {
+		t.Errorf("got %s", got.dump())
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe to read while a watcher writes to it.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+func TestDestMovesIntoATreeAndUndoBringsItBack(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(t.TempDir(), "Archive")
+	src := writeFile(t, filepath.Join(dir, "receipt.txt"), "Test Store\nTOTAL 123.45\n")
+	// Something already holds the name in the destination folder.
+	folder := mkdir(t, filepath.Join(archive, "2023", "Food"))
+	writeFile(t, filepath.Join(folder, "01-15-2023 - 123.45 - Test_Store - Food.txt"), "an earlier receipt")
+
+	f := newFake(t, receiptReply)
+	got := runFake(t, f, "-dest", archive+"/{{year}}/{{category}}", src)
+	if got.code != ExitOK {
+		t.Fatalf("run: %s", got.dump())
+	}
+	want := filepath.Join(folder, "01-15-2023 - 123.45 - Test_Store - Food (2).txt")
+	if _, err := os.Stat(want); err != nil {
+		t.Fatalf("not moved to %s: %v\n%s", want, err, got.dump())
+	}
+	if !strings.Contains(got.stderr, "rcptpixie undo "+dir) {
+		t.Errorf("the undo hint does not name the source directory:\n%s", got.stderr)
+	}
+
+	// The question names every folder undo would reach into.
+	got = runCLI(t, nil, "n\n", true, "undo", dir)
+	if !strings.Contains(got.stderr, "moving files back from "+folder+"?") {
+		t.Errorf("the prompt does not name %s:\n%s", folder, got.dump())
+	}
+	if got := runCLI(t, nil, "", false, "undo", "-y", dir); got.code != ExitOK {
+		t.Fatalf("undo: %s", got.dump())
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("undo did not restore %s: %v", src, err)
+	}
+	if names := listing(t, folder); len(names) != 1 {
+		t.Errorf("destination holds %q after undo, want only the earlier receipt", names)
+	}
+}
+
+func TestDestIsValidated(t *testing.T) {
+	got := runCLI(t, nil, "", false, "receipts", "-dest", "out/{{.Nope}}", t.TempDir())
+	if got.code != ExitUsage || !strings.Contains(got.stderr, "-dest") {
+		t.Errorf("got %s", got.dump())
+	}
+}
+
+func TestUndoLastTakesBackOnlyTheNewestRun(t *testing.T) {
+	dir := t.TempDir()
+	first := writeFile(t, filepath.Join(dir, "first.txt"), "Test Store\nTOTAL 123.45\n")
+	second := writeFile(t, filepath.Join(dir, "second.txt"), "Test Store\nTOTAL 123.45\n")
+	f := newFake(t, receiptReply)
+	for _, path := range []string{first, second} {
+		if got := runFake(t, f, path); got.code != ExitOK {
+			t.Fatalf("run over %s: %s", path, got.dump())
+		}
+	}
+
+	got := runCLI(t, nil, "", false, "history", "-format", "jsonl", dir)
+	if got.code != ExitOK {
+		t.Fatalf("history: %s", got.dump())
+	}
+	runs := decodeLines(t, got.stdout)
+	if len(runs) != 2 || runs[0]["mode"] != "receipts" || runs[0]["model"] != testModel || runs[1]["renames"] != 1.0 {
+		t.Fatalf("history = %v, want two one-file receipts runs", runs)
+	}
+	if text := runCLI(t, nil, "", false, "history", dir); !strings.Contains(text.stdout, runs[1]["run"].(string)) {
+		t.Errorf("history table does not list the run:\n%s", text.stdout)
+	}
+
+	if got := runCLI(t, nil, "", false, "undo", "-y", "-last", dir); got.code != ExitOK {
+		t.Fatalf("undo -last: %s", got.dump())
+	}
+	if _, err := os.Stat(second); err != nil {
+		t.Errorf("the newest run was not reverted: %v", err)
+	}
+	if _, err := os.Stat(first); err == nil {
+		t.Errorf("undo -last also reverted the run before it")
+	}
+
+	// The remaining run, by its ID.
+	if got := runCLI(t, nil, "", false, "undo", "-y", "-run", "no-such-run", dir); got.code != ExitUsage {
+		t.Errorf("undo of an unknown run: %s", got.dump())
+	}
+	if got := runCLI(t, nil, "", false, "undo", "-y", "-run", runs[0]["run"].(string), dir); got.code != ExitOK {
+		t.Fatalf("undo -run: %s", got.dump())
+	}
+	if _, err := os.Stat(first); err != nil {
+		t.Errorf("undo -run did not revert %s: %v", first, err)
+	}
+}
+
+func TestUndoSinceAndRecursive(t *testing.T) {
+	root := t.TempDir()
+	a := writeFile(t, filepath.Join(mkdir(t, filepath.Join(root, "a")), "r.txt"), "Test Store\nTOTAL 123.45\n")
+	b := writeFile(t, filepath.Join(mkdir(t, filepath.Join(root, "b", "deep")), "r.txt"), "Test Store\nTOTAL 123.45\n")
+	f := newFake(t, receiptReply)
+	if got := runFake(t, f, "-r", "-ext", ".txt", root); got.code != ExitOK {
+		t.Fatalf("run: %s", got.dump())
+	}
+
+	// Nothing in the future, and the top directory has no journal of its own.
+	if got := runCLI(t, nil, "", false, "undo", "-y", "-r", "-since", "2999-01-01", root); got.code != ExitUsage {
+		t.Errorf("undo -since the future: %s", got.dump())
+	}
+	if got := runCLI(t, nil, "", false, "undo", "-y", root); got.code != ExitUsage {
+		t.Errorf("undo without -r: %s", got.dump())
+	}
+	got := runCLI(t, nil, "", false, "undo", "-y", "-r", "-since", "1h", root)
+	if got.code != ExitOK || !strings.Contains(got.stderr, "2 reverted") {
+		t.Fatalf("undo -r -since 1h: %s", got.dump())
+	}
+	for _, path := range []string{a, b} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s not restored: %v", path, err)
+		}
+	}
+}
+
+func TestUndoSelectorsAreValidated(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, rename.JournalName), `{"t":"2025-01-01T00:00:00Z","old":"a.pdf","new":"b.pdf"}`+"\n")
+	for _, args := range [][]string{
+		{"-last", "-since", "1h"},
+		{"-since", "last tuesday"},
+		// The newest entry predates run IDs, so there is no run to pick.
+		{"-last"},
+	} {
+		got := runCLI(t, nil, "", false, append(append([]string{"undo", "-y"}, args...), dir)...)
+		if got.code != ExitUsage {
+			t.Errorf("undo %v: %s", args, got.dump())
+		}
+	}
+}
+
+func TestJobsKeepsThePlanInOrder(t *testing.T) {
+	dir := t.TempDir()
+	var replies []string
+	for i := range 8 {
+		writeFile(t, filepath.Join(dir, fmt.Sprintf("scan%d.txt", i)), fmt.Sprintf("Store %d\n", i))
+		replies = append(replies, fmt.Sprintf(`{"vendor":"Store %d","date":"2023-01-%02d","total":%d,"category":"Food"}`, i, i+1, i+1))
+	}
+	f := newFake(t, replies...)
+
+	got := runFake(t, f, "-n", "-jobs", "4", "-ext", ".txt", "-format", "jsonl", dir)
+	if got.code != ExitOK {
+		t.Fatalf("%s", got.dump())
+	}
+	recs := decodeLines(t, got.stdout)
+	if len(recs) != 9 {
+		t.Fatalf("got %d records, want 8 items and a summary:\n%s", len(recs), got.stdout)
+	}
+	// The fake answers in the order it is asked, so each file getting its own
+	// vendor back shows the model still saw the files one at a time, in order.
+	for i, r := range recs[:8] {
+		if want := filepath.Join(dir, fmt.Sprintf("scan%d.txt", i)); r["path"] != want {
+			t.Errorf("record %d path = %v, want %s", i, r["path"], want)
+		}
+		if want := fmt.Sprintf("Store %d", i); r["vendor"] != want {
+			t.Errorf("record %d vendor = %v, want %s", i, r["vendor"], want)
+		}
+	}
+}
+
+func TestJobsIsValidated(t *testing.T) {
+	got := runCLI(t, env(nil), "", false, "-jobs", "0", t.TempDir())
+	if got.code != ExitUsage || !strings.Contains(got.stderr, "-jobs must be at least 1") {
+		t.Errorf("%s", got.dump())
+	}
+}
+
+func TestReadAllStopsCleanlyOnCancel(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := range 6 {
+		files = append(files, writeFile(t, filepath.Join(dir, fmt.Sprintf("scan%d.txt", i)), "Test Store\n"))
+	}
+	f := testutil.NewFakeSlow(t, time.Minute)
+	client, err := ollama.New(f.URL, time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd := &reader{
+		an:   &analyze.Analyzer{C: client, Model: testModel},
+		mode: modeReceipts,
+		log:  slog.New(slog.DiscardHandler),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for f.Count() == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		cancel()
+	}()
+	items, _ := rd.readAll(ctx, files, 3, 1)
+	// The call in flight fails with the cancellation; nothing after it is asked.
+	if len(items) > 1 {
+		t.Errorf("got %d items after cancelling during the first, want at most 1", len(items))
+	}
+	if f.Count() != 1 {
+		t.Errorf("model calls = %d, want 1", f.Count())
+	}
+}
+
+func TestSeveralHostsShareTheWork(t *testing.T) {
+	a, b := newFake(t, receiptReply), newFake(t, receiptReply)
+	for _, tc := range []struct {
+		name   string
+		getenv func(string) string
+		args   []string
+	}{
+		{"repeated -host", env(nil), []string{"-host", a.URL, "-host", b.URL}},
+		{"comma list in the environment", env(map[string]string{"RCPTPIXIE_HOST": a.URL + "," + b.URL}), nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for i := range 6 {
+				writeFile(t, filepath.Join(dir, fmt.Sprintf("scan%d.txt", i)), fmt.Sprintf("Store %d\n", i))
+			}
+			beforeA, beforeB := a.Count(), b.Count()
+			args := append(tc.args, "-n", "-parallel", "2", "-ext", ".txt", "-format", "jsonl", dir)
+			got := runCLI(t, tc.getenv, "", false, args...)
+			if got.code != ExitOK {
+				t.Fatalf("%s", got.dump())
+			}
+			if a.Count() == beforeA || b.Count() == beforeB {
+				t.Errorf("requests = %d and %d, want both hosts used", a.Count()-beforeA, b.Count()-beforeB)
+			}
+			recs := decodeLines(t, got.stdout)
+			for i, r := range recs[:6] {
+				if want := filepath.Join(dir, fmt.Sprintf("scan%d.txt", i)); r["path"] != want {
+					t.Errorf("record %d path = %v, want %s", i, r["path"], want)
+				}
+			}
+		})
+	}
+}
+
+func TestParallelIsValidated(t *testing.T) {
+	got := runCLI(t, env(nil), "", false, "-parallel", "0", t.TempDir())
+	if got.code != ExitUsage || !strings.Contains(got.stderr, "-parallel must be at least 1") {
+		t.Errorf("%s", got.dump())
+	}
+}
+
+func TestOpenAIBackend(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "receipt.txt"), "Test Store\nTOTAL 123.45\n")
+	f := testutil.NewFakeOpenAI(t, []string{"gemma-3-4b"}, receiptReply)
+
+	got := runCLI(t, env(map[string]string{"RCPTPIXIE_BACKEND": "openai", "RCPTPIXIE_HOST": f.URL}), "", false,
+		"-model", "gemma-3-4b", "-ext", ".txt", dir)
+	if got.code != ExitOK {
+		t.Fatalf("%s", got.dump())
+	}
+	if want := "01-15-2023 - 123.45 - Test_Store - Food.txt"; !slices.Contains(listing(t, dir), want) {
+		t.Errorf("listing = %q, want %q", listing(t, dir), want)
+	}
+
+	// The default model is an ollama tag, which the server will not have; the
+	// preflight says what it does have.
+	got = runCLI(t, env(nil), "", false, "-backend", "openai", "-host", f.URL, "-n", dir)
+	if got.code != ExitFailure || !strings.Contains(got.stderr, "Available: gemma-3-4b") {
+		t.Errorf("%s", got.dump())
+	}
+}
+
+func TestBackendIsValidated(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-backend", "llamafile"}, "-backend must be ollama or openai"},
+		{[]string{"-backend", "openai", "-host", "a", "-host", "b"}, "-backend openai takes one -host"},
+	} {
+		got := runCLI(t, env(nil), "", false, append(tc.args, t.TempDir())...)
+		if got.code != ExitUsage || !strings.Contains(got.stderr, tc.want) {
+			t.Errorf("%q: %s", tc.args, got.dump())
+		}
+	}
+}
+
+func TestVendorAliasesRenameByOneName(t *testing.T) {
+	dir := t.TempDir()
+	table := filepath.Join(t.TempDir(), "vendors")
+	writeFile(t, table, "test store = Test Mart\n")
+	writeFile(t, filepath.Join(dir, "a.txt"), "TEST STORE #0452\n")
+	f := newFake(t, strings.Replace(receiptReply, `"Test Store"`, `"TEST STORE #0452"`, 1))
+
+	got := runFake(t, f, "-ext", ".txt", "-vendors", table, dir)
+	if got.code != ExitOK {
+		t.Fatalf("run: %s", got.dump())
+	}
+	want := "01-15-2023 - 123.45 - Test_Mart - Food.txt"
+	if !slices.Contains(listing(t, dir), want) {
+		t.Errorf("dir = %q, want %q", listing(t, dir), want)
+	}
+}
+
+func TestLearnVendors(t *testing.T) {
+	dir := t.TempDir()
+	table := filepath.Join(t.TempDir(), "rcptpixie", "vendors")
+	writeFile(t, filepath.Join(dir, "a.txt"), "a\n")
+	writeFile(t, filepath.Join(dir, "b.txt"), "b\n")
+	replies := []string{
+		strings.Replace(receiptReply, `"Test Store"`, `"Corner Shop #12"`, 1),
+		strings.Replace(otherReply, `"Other Shop"`, `"Corner Shop 0031"`, 1),
+	}
+
+	if got := runFake(t, newFake(t, replies...), "-n", "-ext", ".txt", "-vendors", table, "-learn-vendors", dir); got.code != ExitOK {
+		t.Fatalf("dry run: %s", got.dump())
+	}
+	if _, err := os.Stat(table); !os.IsNotExist(err) {
+		t.Errorf("a dry run wrote the vendors table: %v", err)
+	}
+
+	got := runFake(t, newFake(t, replies...), "-ext", ".txt", "-vendors", table, "-learn-vendors", dir)
+	if got.code != ExitOK {
+		t.Fatalf("run: %s", got.dump())
+	}
+	data, err := os.ReadFile(table)
+	if err != nil {
+		t.Fatalf("vendors table: %v", err)
+	}
+	if string(data) != "Corner Shop\n" {
+		t.Errorf("vendors table = %q, want the one vendor, store number stripped", data)
+	}
+	for _, name := range listing(t, dir) {
+		if name != rename.JournalName && !strings.Contains(name, "Corner_Shop - ") {
+			t.Errorf("%q is not filed under the learned name", name)
+		}
+	}
+
+	if got := runCLI(t, nil, "", false, "-learn-vendors", "-vendors", "", t.TempDir()); got.code != ExitUsage {
+		t.Errorf("-learn-vendors without a file: code = %d\n%s", got.code, got.dump())
+	}
+}
+
+func TestVendorsCommand(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"01-15-2023 - 4.50 - STARBUCKS_#1234 - Food.pdf",
+		"01-16-2023 - 5.25 - Starbucks - Food.pdf",
+		"01-17-2023 - 3.10 - Starbucks - Food.pdf",
+		"01-18-2023 - 19.99 - AMZN_Mktp_US - Office.pdf",
+		"scan0001.pdf",
+	} {
+		writeFile(t, filepath.Join(dir, name), "x")
+	}
+	table := filepath.Join(t.TempDir(), "vendors")
+	writeFile(t, table, "amzn mktp us = Amazon\n")
+
+	got := runCLI(t, nil, "", false, "vendors", "-vendors", table, dir)
+	if got.code != ExitOK {
+		t.Fatalf("vendors: %s", got.dump())
+	}
+	lines := strings.Split(strings.TrimSpace(got.stdout), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], "FILES") {
+		t.Fatalf("stdout = %q, want a header and three spellings", got.stdout)
+	}
+	if f := strings.Fields(lines[1]); !slices.Equal(f, []string{"1", "AMZN", "Mktp", "US", "Amazon"}) {
+		t.Errorf("line 1 = %q, want the alias's name beside it", lines[1])
+	}
+	if !strings.Contains(lines[2], "STARBUCKS #1234") || !strings.HasPrefix(lines[3], "2 ") {
+		t.Errorf("stdout = %q, want the spellings of one vendor together", got.stdout)
+	}
+
+	got = runCLI(t, nil, "", false, "vendors", "-format", "jsonl", dir)
+	recs := decodeLines(t, got.stdout)
+	if got.code != ExitOK || len(recs) != 3 || recs[2]["key"] != "starbucks" {
+		t.Errorf("jsonl = %v\n%s", recs, got.dump())
+	}
+}
+
+func TestSeveralPaths(t *testing.T) {
+	a, b := t.TempDir(), t.TempDir()
+	one := writeFile(t, filepath.Join(a, "one.txt"), "one\n")
+	writeFile(t, filepath.Join(a, "two.txt"), "two\n")
+	three := writeFile(t, filepath.Join(b, "three.txt"), "three\n")
+	f := newFake(t, receiptReply, otherReply, thirdReply)
+
+	// one.txt is named, then reached again through its directory, and
+	// three.txt by a second spelling of its path.
+	got := runFake(t, f, "-ext", ".txt", one, a, three, filepath.Join(b, "..", filepath.Base(b), "three.txt"))
+	if got.code != ExitOK {
+		t.Fatalf("run: %s", got.dump())
+	}
+	if f.Count() != 3 {
+		t.Errorf("fake saw %d generate calls, want one per file", f.Count())
+	}
+	if !strings.Contains(got.stderr, "3 renamed") {
+		t.Errorf("want one summary for every path:\n%s", got.dump())
+	}
+	if n := len(listing(t, a)) + len(listing(t, b)); n != 5 {
+		t.Errorf("a = %q, b = %q, want three receipts and two journals", listing(t, a), listing(t, b))
+	}
+}
+
+func TestFilesFrom(t *testing.T) {
+	dir := t.TempDir()
+	one := writeFile(t, filepath.Join(dir, "one.txt"), "one\n")
+	odd := "new\nline.txt" // what only -0 can pass
+	if runtime.GOOS == "windows" {
+		odd = "new line.txt"
+	}
+	odd = writeFile(t, filepath.Join(dir, odd), "two\n")
+	writeFile(t, filepath.Join(dir, "unlisted.txt"), "three\n")
+	f := newFake(t, receiptReply, otherReply)
+
+	vars := env(map[string]string{"RCPTPIXIE_HOST": f.URL})
+	got := runCLI(t, vars, one+"\x00"+odd+"\x00", false, "receipts", "-n", "-format", "jsonl", "-files-from", "-", "-0")
+	if got.code != ExitOK {
+		t.Fatalf("run: %s", got.dump())
+	}
+	var paths []string
+	for _, r := range decodeLines(t, got.stdout) {
+		if p, ok := r["path"].(string); ok {
+			paths = append(paths, p)
+		}
+	}
+	if slices.Sort(paths); !slices.Equal(paths, []string{odd, one}) {
+		t.Errorf("paths = %q, want the two listed", paths)
+	}
+
+	list := writeFile(t, filepath.Join(t.TempDir(), "list"), one+"\r\n\r\n")
+	if got := runCLI(t, vars, "", false, "receipts", "-n", "-files-from", list); got.code != ExitOK || !strings.Contains(got.stderr, "1 to rename") {
+		t.Errorf("newline list: code = %d\n%s", got.code, got.dump())
+	}
+	if got := runCLI(t, vars, "", false, "receipts", "-n", "-files-from", "-"); got.code != ExitOK || !strings.Contains(got.stderr, "no matching files") {
+		t.Errorf("empty list: code = %d\n%s", got.code, got.dump())
+	}
+}
+
+func TestFilesFromIsValidated(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		args  []string
+		stdin string
+		want  string
+	}{
+		{[]string{"-0", dir}, "", "-0 needs -files-from"},
+		{[]string{"-i", "-files-from", "-"}, "", "cannot be used together"},
+		{[]string{"-files-from", "-"}, filepath.Join(dir, "missing.pdf") + "\n", "missing.pdf"},
+		{[]string{"-files-from", filepath.Join(dir, "no-such-list")}, "", "cannot read -files-from"},
+		{nil, "", "expected at least one path"},
+	} {
+		got := runCLI(t, nil, tc.stdin, true, append([]string{"receipts"}, tc.args...)...)
+		if got.code != ExitUsage || !strings.Contains(got.stderr, tc.want) {
+			t.Errorf("%q: code = %d, want %q\n%s", tc.args, got.code, tc.want, got.dump())
+		}
+	}
+}
+
+func TestGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, rel string
+		want         bool
+	}{
+		{"Scan_*", "Scan_0001.pdf", true},
+		{"Scan_*", "2024/Scan_0001.pdf", true},
+		{"Scan_*", "Scan_/x.pdf", false},
+		{"**/Archive/**", "Archive/a.pdf", true},
+		{"**/Archive/**", "2024/Archive/old/a.pdf", true},
+		{"**/Archive/**", "Archived/a.pdf", false},
+		{"2024/*.pdf", "2024/a.pdf", true},
+		{"2024/*.pdf", "2024/q1/a.pdf", false},
+		{"2024/**/*.pdf", "2024/q1/a.pdf", true},
+		{"scan[0-9].jpg", "scan7.jpg", true},
+		{"scan[!0-9].jpg", "scan7.jpg", false},
+		{"receipt?.pdf", "receipt(1).pdf", false},
+	} {
+		g, err := compileGlob(tc.pattern)
+		if err != nil {
+			t.Fatalf("compileGlob(%q): %v", tc.pattern, err)
+		}
+		if got := g.match(tc.rel); got != tc.want {
+			t.Errorf("%q matching %q = %v, want %v", tc.pattern, tc.rel, got, tc.want)
+		}
+	}
+	if _, err := compileGlob("scan[0-9.jpg"); err == nil {
+		t.Error("compileGlob took an unclosed class")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{
+		"20MB":    20_000_000,
+		"20mb":    20_000_000,
+		"512KiB":  512 << 10,
+		"1.5 GB":  1_500_000_000,
+		"1048576": 1048576,
+	} {
+		if got, err := parseSize(in); err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "MB", "-1MB", "twenty"} {
+		if _, err := parseSize(in); err == nil {
+			t.Errorf("parseSize(%q) = nil error", in)
+		}
+	}
+}
+
+func TestWalkFilters(t *testing.T) {
+	dir := t.TempDir()
+	mkdir(t, filepath.Join(dir, "Archive"))
+	mkdir(t, filepath.Join(dir, "a", "b"))
+	writeFile(t, filepath.Join(dir, "Scan_1.txt"), "x\n")
+	writeFile(t, filepath.Join(dir, "Scan_big.txt"), strings.Repeat("x", 2048))
+	writeFile(t, filepath.Join(dir, "other.txt"), "x\n")
+	writeFile(t, filepath.Join(dir, "Archive", "Scan_2.txt"), "x\n")
+	writeFile(t, filepath.Join(dir, "a", "Scan_3.txt"), "x\n")
+	writeFile(t, filepath.Join(dir, "a", "b", "Scan_4.txt"), "x\n")
+	old := writeFile(t, filepath.Join(dir, "Scan_old.txt"), "x\n")
+	long := time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)
+	if err := os.Chtimes(old, long, long); err != nil {
+		t.Fatal(err)
+	}
+	f := newFake(t, receiptReply)
+
+	got := runFake(t, f, "-n", "-v", "-r", "-format", "jsonl", "-ext", ".txt",
+		"-include", "Scan_*", "-exclude", "**/Archive/**", "-newer", "2024-01-01", "-max-size", "1KB", "-max-depth", "2", dir)
+	if got.code != ExitOK {
+		t.Fatalf("run: %s", got.dump())
+	}
+	var paths []string
+	for _, r := range decodeLines(t, got.stdout) {
+		if p, ok := r["path"].(string); ok {
+			rel, _ := filepath.Rel(dir, p)
+			paths = append(paths, filepath.ToSlash(rel))
+		}
+	}
+	if slices.Sort(paths); !slices.Equal(paths, []string{"Scan_1.txt", "a/Scan_3.txt"}) {
+		t.Errorf("paths = %q", paths)
+	}
+	// Archive and a/b are never entered, so they count as folders.
+	for filter, count := range map[string]string{
+		"-max-depth": "folders=1", "-include": "files=1", "-exclude": "folders=1", "-newer": "files=1", "-max-size": "files=1",
+	} {
+		counted := slices.ContainsFunc(strings.Split(got.stderr, "\n"), func(line string) bool {
+			return strings.Contains(line, "filter="+filter+" ") && strings.HasSuffix(line, count)
+		})
+		if !counted {
+			t.Errorf("no %s for %s in the verbose log:\n%s", count, filter, got.stderr)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-max-depth", "2"},
+		{"-r", "-max-depth", "-1"},
+		{"-include", "[x"},
+		{"-newer", "last tuesday"},
+		{"-max-size", "big"},
+	} {
+		got := runCLI(t, nil, "", false, append(args, dir)...)
+		if got.code != ExitUsage {
+			t.Errorf("%q: code = %d\n%s", args, got.code, got.dump())
+		}
+	}
+}
+
+// TestWalkNeverEntersLeftOutFolders locks the folders -exclude and -max-depth
+// leave out: a walk that went in anyway would find them unreadable and say so.
+func TestWalkNeverEntersLeftOutFolders(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("chmod 0000 does not deny directory listing on Windows")
+	}
+	if os.Geteuid() == 0 {
+		t.Skip("root ignores directory permissions")
+	}
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.txt"), "x\n")
+	writeFile(t, filepath.Join(mkdir(t, filepath.Join(dir, "keep")), "b.txt"), "x\n")
+	for _, locked := range []string{
+		filepath.Join(dir, "keep", "Archive"),
+		filepath.Join(dir, "keep", "deep"),
+		filepath.Join(dir, "other", "Archive"),
+	} {
+		writeFile(t, filepath.Join(mkdir(t, locked), "c.txt"), "x\n")
+		if err := os.Chmod(locked, 0o000); err != nil {
+			t.Fatalf("chmod: %v", err)
+		}
+		t.Cleanup(func() { os.Chmod(locked, 0o755) })
+	}
+	filter, err := newWalkFilter(nil, []string{"**/Archive/**"}, "", "", 2, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var log bytes.Buffer
+	paths, _, err := collectLog(dir, true, nil, filter, newLogger(&log, slog.LevelDebug))
+	if err != nil {
+		t.Fatalf("collectLog: %v", err)
+	}
+	want := []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "keep", "b.txt")}
+	if !slices.Equal(paths, want) {
+		t.Errorf("paths = %q, want %q", paths, want)
+	}
+	if strings.Contains(log.String(), "unreadable") {
+		t.Errorf("the walk went into a folder it leaves out:\n%s", log.String())
+	}
+
+	// Nor does the non-recursive count of what -r would find.
+	if _, skipped, _ := collectLog(filepath.Join(dir, "other"), false, nil, filter, nil); skipped != 0 {
+		t.Errorf("skippedDirs = %d for a folder -exclude takes in whole, want 0", skipped)
+	}
+}
+
+// doctorStates reads doctor's checklist into check name -> PASS, FAIL or SKIP.
+func doctorStates(stdout string) map[string]string {
+	state := make(map[string]string)
+	for _, m := range regexp.MustCompile(`(?m)^(PASS|FAIL|SKIP) +(.+?)  `).FindAllStringSubmatch(stdout, -1) {
+		state[m[2]] = m[1]
+	}
+	return state
+}
+
+func TestDoctor(t *testing.T) {
+	f := newFake(t, receiptReply)
+	got := runFake(t, f, "doctor", "-model", testModel)
+	state := doctorStates(got.stdout)
+	for _, name := range []string{"server", "capabilities", "round trip"} {
+		if state[name] != "PASS" {
+			t.Errorf("%s = %q, want PASS\n%s", name, state[name], got.dump())
+		}
+	}
+	if f.Count() != 1 {
+		t.Errorf("generate calls = %d, want the one round trip", f.Count())
+	}
+	_, render := exec.LookPath("pdftoppm")
+	_, gs := exec.LookPath("gs")
+	if render != nil && gs != nil {
+		// No rasterizer here, so doctor has to say so and how to get one.
+		if state["rasterizer"] != "FAIL" || !strings.Contains(got.stdout, "Install poppler") {
+			t.Errorf("rasterizer = %q, want FAIL with an install hint\n%s", state["rasterizer"], got.stdout)
+		}
+		if got.code != ExitFailure {
+			t.Errorf("code = %d, want %d for a failed check", got.code, ExitFailure)
+		}
+	}
+	if !strings.Contains(got.stderr, "passed") {
+		t.Errorf("stderr = %q, want a summary", got.stderr)
+	}
+}
+
+func TestDoctorServerDown(t *testing.T) {
+	f := newFake(t, receiptReply)
+	f.SetDown(true)
+	got := runFake(t, f, "doctor", "-model", testModel)
+	if got.code != ExitFailure {
+		t.Errorf("code = %d, want %d", got.code, ExitFailure)
+	}
+	if state := doctorStates(got.stdout); state["server"] != "FAIL" || state["round trip"] != "SKIP" {
+		t.Errorf("checks = %v, want the server to fail and the round trip skipped\n%s", state, got.stdout)
+	}
+	if f.Count() != 0 {
+		t.Errorf("generate calls = %d, want none", f.Count())
+	}
+
+	got = runFake(t, f, "doctor", "extra")
+	if got.code != ExitUsage {
+		t.Errorf("doctor extra: code = %d, want %d", got.code, ExitUsage)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	path := writeFile(t, filepath.Join(t.TempDir(), "scan.txt"), "TEST STORE #0452\nDate: 06/03/2025\nTotal: 12.00 EUR\n")
+	table := writeFile(t, filepath.Join(t.TempDir(), "vendors"), "test store = Test Store\n")
+	f := newFake(t, "not json", `{"is_hotel":false,"vendor":"TEST STORE #0452","date_raw":"06/03/2025","date_order":"day-first","date":"2025-06-03","end_date":"","total":12,"currency":"EUR","category":"Food"}`)
+
+	got := runFake(t, f, "explain", "-vendors", table, path)
+	if got.code != ExitOK {
+		t.Fatalf("explain: %s", got.dump())
+	}
+	for _, want := range []string{
+		"via plain text, 1 page(s)",
+		"Total: 12.00 EUR",
+		"=== BEGIN DOCUMENT",
+		"PROMPT (seed 42, num_ctx 8192, num_predict 400)",
+		"\nnot json\n",
+		"RETRY PROMPT (seed 43",
+		"Your previous reply could not be used",
+		`date: 2025-06-03 re-read as 2025-03-06, the printed "06/03/2025" being day-first by the document`,
+		`vendor: "TEST STORE #0452" is "Test Store" in the -vendors table`,
+		"total       12.00 EUR",
+		"03-06-2025 - 12.00 - Test_Store - Food.txt",
+	} {
+		if !strings.Contains(got.stdout, want) {
+			t.Errorf("stdout is missing %q\n%s", want, got.stdout)
+		}
+	}
+	if f.Count() != 2 {
+		t.Errorf("generate calls = %d, want the first and the retry", f.Count())
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("explain must not rename: %v", err)
+	}
+
+	got = runFake(t, f, "explain", filepath.Dir(path))
+	if got.code != ExitUsage {
+		t.Errorf("explain DIR: code = %d, want %d", got.code, ExitUsage)
+	}
+}
+
+func TestExplainWritesPageImages(t *testing.T) {
+	src, err := os.ReadFile(filepath.Join("..", "..", "testdata", "receipt.png"))
+	if err != nil {
+		t.Skip("no testdata/receipt.png")
+	}
+	path := writeFile(t, filepath.Join(t.TempDir(), "receipt.png"), string(src))
+	got := runFake(t, newFake(t, receiptReply), "explain", path)
+	if got.code != ExitOK {
+		t.Fatalf("explain: %s", got.dump())
+	}
+	m := regexp.MustCompile(`(?m)^  (\S+page-1\.png)$`).FindStringSubmatch(got.stdout)
+	if m == nil {
+		t.Fatalf("stdout names no page image:\n%s", got.stdout)
+	}
+	t.Cleanup(func() { os.RemoveAll(filepath.Dir(m[1])) })
+	b, err := os.ReadFile(m[1])
+	if err != nil || !bytes.Equal(b, src) {
+		t.Errorf("page image differs from what the model was sent (err %v)", err)
+	}
+	if !strings.Contains(got.stdout, "1 image(s)") || !strings.Contains(got.stdout, "via direct image") {
+		t.Errorf("stdout = %s", got.stdout)
+	}
+}
+
+func TestTraceDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.txt"), "Test Store <Main St> & Co\nTotal: 123.45\n")
+	if src, err := os.ReadFile(filepath.Join("..", "..", "testdata", "receipt.png")); err == nil {
+		writeFile(t, filepath.Join(dir, "b.png"), string(src))
+	}
+	traces := t.TempDir()
+	f := newFake(t, "not\x1bjson", receiptReply, otherReply)
+
+	got := runFake(t, f, "receipts", "-n", "-ext", ".txt,.png", "-trace-dir", traces, dir)
+	if got.code != ExitOK {
+		t.Fatalf("receipts: %s", got.dump())
+	}
+	runs, _ := os.ReadDir(traces)
+	if len(runs) != 1 || !runs[0].IsDir() {
+		t.Fatalf("trace dir holds %v, want one folder for the run", runs)
+	}
+	run := filepath.Join(traces, runs[0].Name())
+	if runtime.GOOS != "windows" {
+		fi, _ := os.Stat(run)
+		files, _ := filepath.Glob(filepath.Join(run, "*"))
+		if fi.Mode().Perm() != 0o700 {
+			t.Errorf("run folder mode = %v, want 0700", fi.Mode().Perm())
+		}
+		for _, p := range files {
+			if fi, _ := os.Stat(p); fi.Mode().Perm() != 0o600 {
+				t.Errorf("%s mode = %v, want 0600", filepath.Base(p), fi.Mode().Perm())
+			}
+		}
+	}
+
+	var rec traceRecord
+	b, err := os.ReadFile(filepath.Join(run, "0001-a.txt.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &rec); err != nil {
+		t.Fatalf("trace is not JSON: %v\n%s", err, b)
+	}
+	if rec.Via != "plain text" || rec.Pages != 1 || rec.Model != testModel || len(rec.Calls) != 2 {
+		t.Fatalf("trace = %+v", rec)
+	}
+	first, retry := rec.Calls[0], rec.Calls[1]
+	// Raw, not condensed: the escape byte survives for a replay.
+	if first.Reply != "not\x1bjson" || retry.Reply != receiptReply {
+		t.Errorf("replies = %q, %q", first.Reply, retry.Reply)
+	}
+	if first.Options.Seed != 42 || retry.Options.Seed != 43 || first.Options.NumCtx == 0 || first.Options.NumPredict == 0 {
+		t.Errorf("options = %+v, %+v", first.Options, retry.Options)
+	}
+	if !strings.Contains(first.Prompt, "<Main St> & Co") || !strings.Contains(string(b), "<Main St> & Co") || len(first.Schema) == 0 {
+		t.Errorf("prompt = %q, want the text as sent, unescaped in the file", first.Prompt)
+	}
+	if rec.Result.Vendor != "Test Store" || rec.Result.NewName == "" {
+		t.Errorf("result = %+v", rec.Result)
+	}
+
+	if b, err = os.ReadFile(filepath.Join(run, "0002-b.png.json")); err != nil {
+		return // no image fixture in this checkout
+	}
+	rec = traceRecord{}
+	if err := json.Unmarshal(b, &rec); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Images) != 1 || strings.Contains(string(b), "iVBOR") {
+		t.Fatalf("images = %v; want a file, not base64 in the record", rec.Images)
+	}
+	if _, err := os.Stat(filepath.Join(run, rec.Images[0])); err != nil || rec.Calls[0].Images != 1 {
+		t.Errorf("traced page: %v, call images = %d", err, rec.Calls[0].Images)
+	}
+}
+
+func TestTraceDirOutsideWatchedDir(t *testing.T) {
+	dir := t.TempDir()
+	got := runCLI(t, nil, "", false, "watch", "-trace-dir", filepath.Join(dir, "traces"), dir)
+	if got.code != ExitUsage || !strings.Contains(got.stderr, "-trace-dir cannot be inside") {
+		t.Errorf("watch: %s", got.dump())
+	}
+}
+
+// The next run over the target would read the traced pages as receipts, so
+// every target is held to the same rule as the watched directory.
+func TestTraceDirOutsideTheTargets(t *testing.T) {
+	dir := t.TempDir()
+	other := t.TempDir()
+	f := newFake(t, receiptReply)
+	for _, args := range [][]string{
+		{"-r", "-trace-dir", filepath.Join(dir, "traces"), dir},
+		{"organize", "-r", "-trace-dir", filepath.Join(dir, "traces"), other, dir},
+	} {
+		got := runFake(t, f, args...)
+		if got.code != ExitUsage || !strings.Contains(got.stderr, "-trace-dir cannot be inside "+dir) {
+			t.Errorf("%q: %s", args, got.dump())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "traces")); err == nil {
+		t.Error("the trace directory was created anyway")
+	}
+	if f.Count() != 0 {
+		t.Errorf("fake saw %d generate calls, want 0", f.Count())
+	}
+}
@@ -0,0 +1,528 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The configuration files. A directory file is looked for in the target and
+// every directory above it, and the nearest one wins; the user file lives under
+// $XDG_CONFIG_HOME, or ~/.config when that is unset.
+var dirConfigNames = []string{".rcptpixie.toml", ".rcptpixie.json"}
+
+// dirSettings are the keys a directory file may set: which files are read and
+// how they are read and named. Such a file arrives with the receipts, from
+// whoever shared the folder or packed the archive, so it cannot say where
+// documents are sent, where anything is written or moved, or that the plan
+// needs no confirmation; those belong to the command line and the user file.
+var dirSettings = map[string]bool{
+	"profile":        true,
+	"model":          true,
+	"fallback-model": true,
+	"date-order":     true,
+	"template":       true,
+	"categories":     true,
+	"category-rule":  true,
+	"items":          true,
+	"min-confidence": true,
+	"ext":            true,
+	"include":        true,
+	"exclude":        true,
+	"newer":          true,
+	"max-size":       true,
+	"max-depth":      true,
+	"recursive":      true,
+	"r":              true,
+}
+
+// flagEnv names the environment variables that stand in for a flag. A setting
+// from a file gives way to them, the same as a default does in register.
+var flagEnv = map[string][]string{
+	"model":          {"RCPTPIXIE_MODEL"},
+	"fallback-model": {"RCPTPIXIE_FALLBACK_MODEL"},
+	"backend":        {"RCPTPIXIE_BACKEND"},
+	"host":           {"RCPTPIXIE_HOST", "OLLAMA_HOST"},
+	"profile":        {"RCPTPIXIE_PROFILE"},
+}
+
+// config is one configuration file: settings keyed by flag name, with the
+// named profiles that can be laid over them. A setting holds one value, or each
+// of a list's.
+type config struct {
+	path     string
+	values   map[string][]string
+	profiles map[string]map[string][]string
+}
+
+// repeatable is a flag that takes one value per use, such as -host, and so one
+// per entry of a list in a file. Any other flag is given a list joined with
+// commas.
+type repeatable interface {
+	flag.Value
+	repeatable()
+}
+
+// applyConfig fills in from the configuration files every flag that neither the
+// command line nor the environment set, so the order is flag, environment,
+// directory file, user file, default. Within a file a profile's settings beat
+// the file's own. target is the path the command was given. A key another
+// command has a flag for is left alone, so one file can serve every command;
+// a key no command has is an error, as is one a directory file may not set.
+func (o *opts) applyConfig(fs *flag.FlagSet, target string) error {
+	user, err := readConfig(userConfigPath(o.getenv))
+	if err != nil {
+		return err
+	}
+	o.dirConfig, o.dirTarget = findDirConfig(target), target
+	local, err := readConfig(o.dirConfig)
+	if err != nil {
+		return err
+	}
+	if err := user.check(nil); err != nil {
+		return err
+	}
+	if err := local.check(dirSettings); err != nil {
+		return err
+	}
+
+	// Short forms bind the same variable as the long ones, so "-n" given on the
+	// command line has to hold off "dry-run" in a file too.
+	var given []flag.Value
+	fs.Visit(func(f *flag.Flag) { given = append(given, f.Value) })
+	explicit := func(name string) bool {
+		for _, env := range flagEnv[name] {
+			if o.getenv(env) != "" {
+				return true
+			}
+		}
+		v := fs.Lookup(name).Value
+		for _, g := range given {
+			if g == v {
+				return true
+			}
+		}
+		return false
+	}
+
+	profile := o.Profile
+	if !explicit("profile") {
+		profile = firstNonEmpty(local.value("profile"), user.value("profile"))
+		if err := user.choosable(local.value("profile"), local); err != nil {
+			return err
+		}
+	}
+	if profile != "" && local.profile(profile) == nil && user.profile(profile) == nil {
+		return fmt.Errorf("-profile: no profile %q in %s", profile, strings.Join(configPaths(user, local), " or "))
+	}
+
+	type setting struct {
+		values []string
+		from   string
+	}
+	merged := make(map[string]setting)
+	for _, c := range []*config{user, local} {
+		if c == nil {
+			continue
+		}
+		for _, layer := range []map[string][]string{c.values, c.profile(profile)} {
+			for k, v := range layer {
+				merged[k] = setting{v, c.path}
+			}
+		}
+	}
+	names := make([]string, 0, len(merged))
+	for k := range merged {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "profile" || fs.Lookup(name) == nil || explicit(name) {
+			continue
+		}
+		s := merged[name]
+		values := []string{strings.Join(s.values, ",")}
+		if _, ok := fs.Lookup(name).Value.(repeatable); ok {
+			values = s.values
+		}
+		for _, v := range values {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("%s: %s: %w", s.from, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// check refuses a key of c, its profiles' included, that no command has a flag
+// for or, when only is not nil, that only does not hold.
+func (c *config) check(only map[string]bool) error {
+	if c == nil {
+		return nil
+	}
+	known := knownSettings()
+	layers := []map[string][]string{c.values}
+	names := make([]string, 0, len(c.profiles))
+	for name := range c.profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		layers = append(layers, c.profiles[name])
+	}
+	for _, layer := range layers {
+		keys := make([]string, 0, len(layer))
+		for k := range layer {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			switch {
+			case !known[k]:
+				return fmt.Errorf("%s: %s: no command has this setting", c.path, k)
+			case only != nil && !only[k]:
+				return fmt.Errorf("%s: %s cannot be set in a directory's file; give -%s on the command line or set it in the user file", c.path, k, k)
+			}
+		}
+	}
+	return nil
+}
+
+// choosable refuses a profile of c that the directory file local chose, when
+// it sets anything local could not set itself: otherwise a file that arrived
+// with the receipts could pick the user's own profile and, through it, the
+// host, -dest or -yes.
+func (c *config) choosable(profile string, local *config) error {
+	layer := c.profile(profile)
+	keys := make([]string, 0, len(layer))
+	for k := range layer {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !dirSettings[k] {
+			return fmt.Errorf("%s: profile %q sets %s in %s, so it cannot be chosen in a directory's file; give -profile on the command line", local.path, profile, k, c.path)
+		}
+	}
+	return nil
+}
+
+// knownSettings is every flag any command that reads the configuration files
+// has, which is every key a file may hold.
+func knownSettings() map[string]bool {
+	fs := newFlagSet("config", io.Discard)
+	o := &opts{}
+	o.register(fs, nil)
+	o.registerReceipts(fs)
+	o.registerRun(fs)
+	o.registerWatch(fs)
+	known := make(map[string]bool)
+	fs.VisitAll(func(f *flag.Flag) { known[f.Name] = true })
+	return known
+}
+
+func (c *config) value(key string) string {
+	if c == nil {
+		return ""
+	}
+	return strings.Join(c.values[key], ",")
+}
+
+func (c *config) profile(name string) map[string][]string {
+	if c == nil || name == "" {
+		return nil
+	}
+	return c.profiles[name]
+}
+
+func configPaths(cs ...*config) []string {
+	var paths []string
+	for _, c := range cs {
+		if c != nil {
+			paths = append(paths, c.path)
+		}
+	}
+	if len(paths) == 0 {
+		return []string{"any configuration file"}
+	}
+	return paths
+}
+
+// userConfigPath is the user file, or "" when there is no home to find it in.
+func userConfigPath(getenv func(string) string) string {
+	return userConfigFile(getenv, "config")
+}
+
+// userConfigFile is name in the user's rcptpixie configuration directory.
+func userConfigFile(getenv func(string) string, name string) string {
+	if dir := getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "rcptpixie", name)
+	}
+	if home := getenv("HOME"); home != "" {
+		return filepath.Join(home, ".config", "rcptpixie", name)
+	}
+	return ""
+}
+
+// sameDirConfig refuses a target under a directory file other than the one
+// applyConfig read. Settings are read once per run, from the first target, so
+// a second folder's file would otherwise be passed over without a word and
+// the first folder's model, template and categories used on its receipts.
+func (o *opts) sameDirConfig(targets []string) error {
+	for _, t := range targets {
+		if p := findDirConfig(t); p != o.dirConfig {
+			return fmt.Errorf("%s and %s have different folder settings (%s, %s); run them one at a time",
+				o.dirTarget, t, orNone(o.dirConfig), orNone(p))
+		}
+	}
+	return nil
+}
+
+func orNone(path string) string {
+	if path == "" {
+		return "none"
+	}
+	return path
+}
+
+// findDirConfig walks up from target to the nearest directory file, or returns
+// "" when there is none.
+func findDirConfig(target string) string {
+	dir, err := filepath.Abs(target)
+	if err != nil {
+		return ""
+	}
+	if fi, err := os.Stat(dir); err == nil && !fi.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+	for {
+		for _, name := range dirConfigNames {
+			p := filepath.Join(dir, name)
+			if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() {
+				return p
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// readConfig reads path as JSON when it says so, by its extension or by
+// starting with "{", and as TOML otherwise. A missing file is no configuration,
+// not an error.
+func readConfig(path string) (*config, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &config{path: path, values: map[string][]string{}, profiles: map[string]map[string][]string{}}
+	if filepath.Ext(path) == ".json" || bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		err = c.parseJSON(data)
+	} else {
+		err = c.parseTOML(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+func (c *config) parseJSON(data []byte) error {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for k, v := range raw {
+		if k != "profile" {
+			s, err := jsonSetting(k, v)
+			if err != nil {
+				return err
+			}
+			c.values[settingKey(k)] = s
+			continue
+		}
+		profiles, ok := v.(map[string]any)
+		if !ok {
+			return errors.New(`"profile" must be an object of profiles`)
+		}
+		for name, p := range profiles {
+			settings, ok := p.(map[string]any)
+			if !ok {
+				return fmt.Errorf("profile %q must be an object", name)
+			}
+			m := make(map[string][]string, len(settings))
+			for k, v := range settings {
+				s, err := jsonSetting(k, v)
+				if err != nil {
+					return fmt.Errorf("profile %q: %w", name, err)
+				}
+				m[settingKey(k)] = s
+			}
+			c.profiles[name] = m
+		}
+	}
+	return nil
+}
+
+// jsonSetting is v as the flag would be given it. A list is how several -host
+// values are written.
+func jsonSetting(key string, v any) ([]string, error) {
+	switch v := v.(type) {
+	case string:
+		return []string{v}, nil
+	case bool:
+		return []string{strconv.FormatBool(v)}, nil
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}, nil
+	case []any:
+		parts := make([]string, len(v))
+		for i, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s: a list may hold only strings", key)
+			}
+			parts[i] = s
+		}
+		return parts, nil
+	}
+	return nil, fmt.Errorf("%s: not a string, number, true/false or list", key)
+}
+
+// parseTOML reads the part of TOML a settings file needs: key = value lines,
+// with strings, numbers, true/false and one-line lists of strings, under no
+// table or a [profile.NAME] one, and # comments.
+func (c *config) parseTOML(data []byte) error {
+	into := c.values
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(sc.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			table, ok := strings.CutSuffix(strings.TrimPrefix(line, "["), "]")
+			name, isProfile := strings.CutPrefix(strings.TrimSpace(table), "profile.")
+			if !ok || !isProfile || name == "" {
+				return fmt.Errorf("line %d: only [profile.NAME] tables are understood", n)
+			}
+			if uq, err := strconv.Unquote(name); err == nil {
+				name = uq
+			}
+			if c.profiles[name] == nil {
+				c.profiles[name] = map[string][]string{}
+			}
+			into = c.profiles[name]
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" {
+			return fmt.Errorf("line %d: want key = value", n)
+		}
+		s, err := tomlValue(v)
+		if err != nil {
+			return fmt.Errorf("line %d: %s: %w", n, k, err)
+		}
+		into[settingKey(k)] = s
+	}
+	return sc.Err()
+}
+
+func tomlValue(v string) ([]string, error) {
+	if !strings.HasPrefix(v, "[") {
+		s, err := tomlScalar(v)
+		return []string{s}, err
+	}
+	inner, ok := strings.CutSuffix(v[1:], "]")
+	if !ok {
+		return nil, errors.New("a list must close on the same line")
+	}
+	var parts []string
+	for _, e := range splitOutsideQuotes(inner, ',') {
+		if e = strings.TrimSpace(e); e == "" {
+			continue
+		}
+		s, err := tomlScalar(e)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, s)
+	}
+	return parts, nil
+}
+
+func tomlScalar(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		return strconv.Unquote(v)
+	case strings.HasPrefix(v, "'"):
+		s, ok := strings.CutSuffix(v[1:], "'")
+		if !ok || strings.Contains(s, "'") {
+			return "", errors.New("unterminated string")
+		}
+		return s, nil
+	}
+	// true, false and numbers are what the flag takes already.
+	return v, nil
+}
+
+// stripComment drops a # comment, minding that a # inside quotes is not one.
+func stripComment(line string) string {
+	return splitOutsideQuotes(line, '#')[0]
+}
+
+// splitOutsideQuotes splits s at every sep that is not inside a quoted string,
+// so neither a # nor a comma in a regular expression is taken for syntax.
+func splitOutsideQuotes(s string, sep rune) []string {
+	var (
+		parts   []string
+		quote   rune
+		escaped bool
+		start   int
+	)
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+		case r == '"' || r == '\'':
+			quote = r
+		case r == sep:
+			parts = append(parts, s[start:i])
+			start = i + len(string(r))
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// settingKey is a key as a flag name: "date_order" and "-date-order" both mean
+// -date-order.
+func settingKey(k string) string {
+	if uq, err := strconv.Unquote(k); err == nil {
+		k = uq
+	}
+	return strings.ReplaceAll(strings.TrimLeft(k, "-"), "_", "-")
+}
@@ -0,0 +1,299 @@
+package cli
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/analyze"
+	"github.com/scottdensmore/rcptpixie/v2/internal/doc"
+	"github.com/scottdensmore/rcptpixie/v2/internal/llm"
+	"github.com/scottdensmore/rcptpixie/v2/internal/ollama"
+)
+
+// doctorSamples are what doctor reads: receipt.pdf, a copy of
+// testdata/receipt-text.pdf, and receipt.heic, a photo of the same receipt,
+// which a build carries only if scripts/genfixtures found a HEIC encoder.
+// Without it doctor makes a HEIC with the converter's own encoder.
+//
+//go:embed doctor
+var doctorSamples embed.FS
+
+const (
+	sampleReceipt = "doctor/receipt.pdf"
+	sampleHEIC    = "doctor/receipt.heic"
+)
+
+// What the round trip has to read from sampleReceipt.
+const (
+	sampleVendor = "Test Store"
+	sampleTotal  = 123.45
+)
+
+// capabilityReporter is a backend that can say what a model can do. Only
+// ollama can; an OpenAI-compatible server has no standard way to.
+type capabilityReporter interface {
+	Capabilities(ctx context.Context, model string) ([]string, error)
+}
+
+type checkState int
+
+const (
+	checkPass checkState = iota
+	checkFail
+	checkSkip
+)
+
+func (s checkState) String() string {
+	return [...]string{"PASS", "FAIL", "SKIP"}[s]
+}
+
+// check is one line of doctor's checklist, with what to do about a failure.
+type check struct {
+	name   string
+	state  checkState
+	detail string
+	hint   string
+}
+
+func checkPassed(name, detail string) check {
+	return check{name: name, state: checkPass, detail: detail}
+}
+func checkSkipped(name, detail string) check {
+	return check{name: name, state: checkSkip, detail: detail}
+}
+
+// checkFailed makes a check of err. An error's first line says what went wrong and
+// any further lines are already its install hint, as Preflight's are.
+func checkFailed(name string, err error, hint string) check {
+	detail, more, _ := strings.Cut(err.Error(), "\n")
+	if more != "" {
+		hint = strings.TrimSpace(more)
+	}
+	return check{name: name, state: checkFail, detail: detail, hint: hint}
+}
+
+// runDoctor checks everything a run depends on, in the order a run meets it,
+// and prints a checklist. Every check runs even after one fails, except those
+// that need what failed, so one report shows the whole state of a machine.
+func runDoctor(ctx context.Context, env Env, args []string) ExitCode {
+	if ctx.Err() != nil {
+		return ExitInterrupted
+	}
+
+	var o opts
+	flags := newFlagSet(modeDoctor, env.Stderr)
+	o.registerServer(flags, env.Getenv)
+	flags.BoolVar(&o.Verbose, "verbose", false, "log debug detail to stderr")
+	flags.BoolVar(&o.Verbose, "v", false, "short for -verbose")
+	rest, err := o.parseInto(flags, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			commandUsage(env.Stdout, modeDoctor, flags)
+			return ExitOK
+		}
+		fmt.Fprintf(env.Stderr, "rcptpixie doctor: %v\n\n", err)
+		commandUsage(env.Stderr, modeDoctor, flags)
+		return ExitUsage
+	}
+	if len(rest) != 0 {
+		fmt.Fprintf(env.Stderr, "rcptpixie doctor: expected no arguments, got %d\n\n", len(rest))
+		commandUsage(env.Stderr, modeDoctor, flags)
+		return ExitUsage
+	}
+
+	log := newLogger(env.Stderr, levelFor(o.Verbose, false))
+	dir, err := os.MkdirTemp("", "rcptpixie-doctor-")
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "rcptpixie doctor: %v\n", err)
+		return ExitFailure
+	}
+	defer os.RemoveAll(dir)
+
+	checks := diagnose(ctx, &o, dir, log)
+	if ctx.Err() != nil {
+		return ExitInterrupted
+	}
+	renderChecks(env.Stdout, checks)
+	counts := make(map[checkState]int)
+	for _, c := range checks {
+		counts[c.state]++
+	}
+	fmt.Fprintf(env.Stderr, "\n%d passed, %d failed, %d skipped\n", counts[checkPass], counts[checkFail], counts[checkSkip])
+	if counts[checkFail] > 0 {
+		return ExitFailure
+	}
+	return ExitOK
+}
+
+// diagnose runs the checks, writing the samples the tools need a path for into
+// dir.
+func diagnose(ctx context.Context, o *opts, dir string, log *slog.Logger) []check {
+	var checks []check
+
+	client, err := o.newBackend(log)
+	if err != nil {
+		return append(checks, checkFailed("server", err, ""))
+	}
+	usable := make(map[string]bool)
+	for _, model := range []string{o.Model, o.FallbackModel} {
+		if model == "" {
+			continue
+		}
+		if err := client.Preflight(ctx, model); err != nil {
+			checks = append(checks, checkFailed("server", err, ""))
+			continue
+		}
+		usable[model] = true
+		checks = append(checks, checkPassed("server", fmt.Sprintf("%s at %s has %s", o.Backend, o.Host, model)))
+	}
+	for _, model := range []string{o.Model, o.FallbackModel} {
+		if usable[model] {
+			checks = append(checks, capabilities(ctx, client, o.Backend, model))
+		}
+	}
+
+	raster := doc.Detect(log)
+	render, convert := doc.Tools(raster)
+	if render != "" {
+		checks = append(checks, checkPassed("rasterizer", render))
+	} else {
+		checks = append(checks, check{name: "rasterizer", state: checkFail, detail: "none found",
+			hint: "Install poppler: " + doc.PopplerHint() + " (Ghostscript also works.)"})
+	}
+	if convert != "" {
+		checks = append(checks, checkPassed("converter", convert))
+	} else {
+		checks = append(checks, check{name: "converter", state: checkFail, detail: "none found", hint: doc.ConverterHint()})
+	}
+
+	receipt, err := writeSample(dir, sampleReceipt)
+	if err != nil {
+		return append(checks, checkFailed("samples", err, ""))
+	}
+	switch {
+	case render == "":
+		checks = append(checks, checkSkipped("render PDF", "no rasterizer"))
+	default:
+		if _, err := raster.Render(ctx, receipt, 1); err != nil {
+			checks = append(checks, checkFailed("render PDF", err, ""))
+		} else {
+			checks = append(checks, checkPassed("render PDF", "the sample rendered with "+render))
+		}
+	}
+	if convert == "" {
+		checks = append(checks, checkSkipped("convert HEIC", "no converter"))
+	} else {
+		checks = append(checks, convertHEIC(ctx, raster, convert, dir))
+	}
+
+	if !usable[o.Model] {
+		return append(checks, checkSkipped("round trip", "the server cannot run "+o.Model))
+	}
+	return append(checks, roundTrip(ctx, o.analyzer(client, o.Model, log), receipt, raster, log))
+}
+
+// convertHEIC converts the bundled HEIC sample back, or one made on the spot
+// with the converter's own encoder when the build carries none.
+func convertHEIC(ctx context.Context, raster doc.Rasterizer, convert, dir string) check {
+	name := "convert HEIC"
+	heic, err := writeSample(dir, sampleHEIC)
+	made := ""
+	if errors.Is(err, fs.ErrNotExist) {
+		heic = filepath.Join(dir, path.Base(sampleHEIC))
+		var by string
+		if by, err = doc.SampleHEIC(ctx, raster, heic); errors.Is(err, doc.ErrNoEncoder) {
+			return checkSkipped(name, err.Error())
+		} else if err != nil {
+			return check{name: name, state: checkFail, detail: "could not make a HEIC sample: " + err.Error(),
+				hint: "The converter cannot write HEIC, so it most likely cannot read it either. " + doc.ConverterHint()}
+		}
+		made = " (made with " + by + ")"
+	}
+	if err != nil {
+		return checkFailed(name, err, "")
+	}
+	if _, err := raster.Convert(ctx, heic); err != nil {
+		return checkFailed(name, err, "")
+	}
+	return checkPassed(name, "the sample"+made+" converted with "+convert)
+}
+
+func capabilities(ctx context.Context, client llm.Backend, backend, model string) check {
+	name := "capabilities"
+	cr, ok := client.(capabilityReporter)
+	if !ok {
+		return checkSkipped(name, fmt.Sprintf("the %s backend does not report them", backend))
+	}
+	caps, err := cr.Capabilities(ctx, model)
+	switch {
+	case err != nil:
+		return checkFailed(name, err, "")
+	case len(caps) == 0:
+		return checkSkipped(name, "the server does not report them; update ollama to see them")
+	case !slices.Contains(caps, "vision"):
+		return check{name: name, state: checkFail,
+			detail: fmt.Sprintf("%s cannot read images (%s)", model, strings.Join(caps, ", ")),
+			hint:   "Scans and photos need a multimodal model, such as " + ollama.DefaultModel + "."}
+	}
+	return checkPassed(name, fmt.Sprintf("%s: %s", model, strings.Join(caps, ", ")))
+}
+
+// roundTrip reads the sample receipt with the model the way a run would, and
+// checks the answer.
+func roundTrip(ctx context.Context, an *analyze.Analyzer, receipt string, raster doc.Rasterizer, log *slog.Logger) check {
+	name := "round trip"
+	d, err := doc.Load(ctx, receipt, raster, log)
+	if err != nil {
+		return checkFailed(name, err, "")
+	}
+	start := time.Now()
+	rc, err := an.Receipt(ctx, d)
+	if err != nil {
+		return checkFailed(name, err, "")
+	}
+	took := time.Since(start).Round(100 * time.Millisecond)
+	if !strings.EqualFold(rc.Vendor, sampleVendor) || math.Abs(rc.Total-sampleTotal) >= 0.005 {
+		return check{name: name, state: checkFail,
+			detail: fmt.Sprintf("%s read %q, %s from the sample; want %q, %.2f", an.Model, rc.Vendor, analyze.FormatTotal(rc.Total, rc.Currency), sampleVendor, sampleTotal),
+			hint:   "The server answers, but the model misreads a plain receipt; try a larger one with -model."}
+	}
+	return checkPassed(name, fmt.Sprintf("%s read the sample receipt in %s", an.Model, took))
+}
+
+// writeSample copies an embedded sample into dir, for the tools that need a
+// file to read.
+func writeSample(dir, name string) (string, error) {
+	b, err := doctorSamples.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	p := filepath.Join(dir, path.Base(name))
+	return p, os.WriteFile(p, b, 0o644)
+}
+
+func renderChecks(w io.Writer, checks []check) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range checks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", c.state, c.name, c.detail)
+		for _, line := range strings.Split(c.hint, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				fmt.Fprintf(tw, "\t\t%s\n", line)
+			}
+		}
+	}
+	tw.Flush()
+}
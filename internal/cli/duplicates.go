@@ -0,0 +1,197 @@
+package cli
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/rename"
+)
+
+// The -duplicates policies. Without the flag no two files are compared.
+const (
+	dupSkip = "skip" // leave the repeat where it is, under its old name
+	dupMark = "mark" // rename it too, with duplicateMark after the name
+	dupMove = "move" // rename it into -duplicates-dir
+)
+
+// duplicateMark is what -duplicates mark adds to a repeat's new name.
+const duplicateMark = " (duplicate)"
+
+// duplicatesDir is where -duplicates move puts a repeat when -duplicates-dir
+// does not say: a folder beside wherever it would otherwise have gone.
+const duplicatesDir = "duplicates"
+
+// duplicates maps every file about to be renamed that repeats another one to
+// the file kept. A repeat is the same bytes, or for receipts the same vendor,
+// date and total, which is what an emailed PDF and a photo of the paper copy
+// share. Files are compared across the whole run, not per directory. The copy
+// kept is the one read most surely, a text layer before a photo, and otherwise
+// the first in the run.
+func (rd *reader) duplicates(items []rename.Item, found map[string]facts) map[string]string {
+	var paths []string
+	sizes := make(map[int64]int)
+	for _, it := range items {
+		if it.Action != rename.ActionRename {
+			continue
+		}
+		paths = append(paths, it.OldPath)
+		if fi, err := os.Stat(it.OldPath); err == nil {
+			sizes[fi.Size()]++
+		}
+	}
+	slices.SortStableFunc(paths, func(a, b string) int {
+		fa, fb := found[a], found[b]
+		if c := fb.assessment().Confidence - fa.assessment().Confidence; c != 0 {
+			return int(c)
+		}
+		if fa.Via != fb.Via && (fa.Via == "text" || fb.Via == "text") {
+			if fa.Via == "text" {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	})
+
+	kept := make(map[string]string)
+	dupOf := make(map[string]string)
+	for _, path := range paths {
+		keys := rd.sameness(path, found[path], sizes)
+		for _, k := range keys {
+			if orig, ok := kept[k]; ok {
+				dupOf[path] = orig
+				break
+			}
+		}
+		orig := path
+		if o, ok := dupOf[path]; ok {
+			orig = o
+		}
+		for _, k := range keys {
+			if _, ok := kept[k]; !ok {
+				kept[k] = orig
+			}
+		}
+	}
+	return dupOf
+}
+
+// sameness is what path has in common with any repeat of it. The contents are
+// hashed only when another file in the run has the same size, so a run of
+// unlike files reads each one once, for the model, and no more.
+func (rd *reader) sameness(path string, f facts, sizes map[int64]int) []string {
+	var keys []string
+	if fi, err := os.Stat(path); err == nil && sizes[fi.Size()] > 1 {
+		if sum, err := rd.checksum(path); err != nil {
+			rd.log.Debug("cannot compare the file's contents", "file", path, "err", err)
+		} else {
+			keys = append(keys, "sum:"+sum)
+		}
+	}
+	// A total of zero is one the model could not read, and two receipts from
+	// the same shop on the same day with no total are not the same purchase.
+	if rc := f.Receipt; rc != nil && rc.Total != 0 {
+		if v := foldVendor(rc.Vendor); v != "" {
+			keys = append(keys, fmt.Sprintf("receipt:%s|%s|%.2f|%s", v, isoDate(rc.StartDate), rc.Total, rc.Currency))
+		}
+	}
+	return keys
+}
+
+// checksum hashes path's contents, once per run: -interactive plans again
+// after every edit.
+func (rd *reader) checksum(path string) (string, error) {
+	if sum, ok := rd.sums[path]; ok {
+		return sum, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if rd.sums == nil {
+		rd.sums = make(map[string]string)
+	}
+	rd.sums[path] = sum
+	return sum, nil
+}
+
+// foldVendor reduces a vendor to its letters and digits, so "Joe's Café" read
+// from a PDF and "JOES CAFE." read from a photo can still match.
+func foldVendor(v string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(v) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// dedupe applies -duplicates to items, and wraps destOf so that under move a
+// repeat goes to -duplicates-dir. A file already in a duplicates folder stays
+// there rather than nesting another.
+func (rd *reader) dedupe(items []rename.Item, found map[string]facts, destOf func(rename.Item) string) func(rename.Item) string {
+	if rd.dupes == "" {
+		return destOf
+	}
+	dupOf := rd.duplicates(items, found)
+	for i := range items {
+		it := &items[i]
+		orig, ok := dupOf[it.OldPath]
+		if !ok {
+			continue
+		}
+		it.DuplicateOf = orig
+		switch rd.dupes {
+		case dupSkip:
+			it.Action, it.NewName = rename.ActionDuplicate, ""
+			it.Reason = "duplicate of " + orig
+		case dupMark:
+			ext := filepath.Ext(it.NewName)
+			it.NewName = rename.SanitizeFilename(strings.TrimSuffix(it.NewName, ext)+duplicateMark, ext)
+		}
+	}
+	if rd.dupes != dupMove {
+		return destOf
+	}
+	return func(it rename.Item) string {
+		dir := filepath.Dir(it.OldPath)
+		if destOf != nil {
+			dir = destOf(it)
+		}
+		switch {
+		case it.DuplicateOf == "":
+		case rd.dupDir != "":
+			dir = rd.dupDir
+		case filepath.Base(dir) != duplicatesDir:
+			dir = filepath.Join(dir, duplicatesDir)
+		}
+		return dir
+	}
+}
+
+// duplicateCount is how many files in plans repeat another.
+func duplicateCount(plans []*rename.Plan) int {
+	n := 0
+	for _, p := range plans {
+		for _, it := range p.Items {
+			if it.DuplicateOf != "" {
+				n++
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,217 @@
+package cli
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/analyze"
+	"github.com/scottdensmore/rcptpixie/v2/internal/doc"
+	"github.com/scottdensmore/rcptpixie/v2/internal/rename"
+)
+
+// runExplain reads one file the way receipts mode would and prints everything
+// in between: how it was loaded, the text or page images the model was given,
+// each prompt and reply verbatim, every correction made to the answer, and the
+// name it comes to. The cache is never consulted, since a remembered answer
+// would leave nothing to show.
+func runExplain(ctx context.Context, env Env, args []string) ExitCode {
+	if ctx.Err() != nil {
+		return ExitInterrupted
+	}
+
+	o := &opts{}
+	flags := newFlagSet(modeExplain, env.Stderr)
+	o.registerServer(flags, env.Getenv)
+	o.registerNaming(flags)
+	o.registerFiling(flags)
+	flags.BoolVar(&o.Items, "items", false, "also read the receipt's line items")
+	flags.BoolVar(&o.Verbose, "verbose", false, "log debug detail to stderr")
+	flags.BoolVar(&o.Verbose, "v", false, "short for -verbose")
+	rest, err := o.parseInto(flags, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			commandUsage(env.Stdout, modeExplain, flags)
+			return ExitOK
+		}
+		fmt.Fprintf(env.Stderr, "rcptpixie explain: %v\n\n", err)
+		commandUsage(env.Stderr, modeExplain, flags)
+		return ExitUsage
+	}
+	if len(rest) != 1 {
+		fmt.Fprintf(env.Stderr, "rcptpixie explain: expected exactly one file, got %d\n\n", len(rest))
+		commandUsage(env.Stderr, modeExplain, flags)
+		return ExitUsage
+	}
+	path := rest[0]
+	if fi, err := os.Stat(path); err != nil || !fi.Mode().IsRegular() {
+		if err == nil {
+			err = errors.New("not a regular file")
+		}
+		fmt.Fprintf(env.Stderr, "rcptpixie explain: cannot use %s: %v\n", path, err)
+		return ExitUsage
+	}
+
+	log := newLogger(env.Stderr, levelFor(o.Verbose, false))
+	client, err := o.newBackend(log)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "rcptpixie: %v\n", err)
+		return ExitFailure
+	}
+	if err := client.Preflight(ctx, o.Model); err != nil {
+		fmt.Fprintf(env.Stderr, "rcptpixie: %v\n", err)
+		return ExitFailure
+	}
+	rd := &reader{
+		an:      o.analyzer(client, o.Model, log),
+		raster:  doc.Detect(log),
+		mode:    modeReceipts,
+		naming:  o.naming,
+		vendors: o.vendors,
+		log:     log,
+	}
+
+	trace := &analyze.Trace{}
+	tctx := analyze.WithTrace(ctx, trace)
+	w := env.Stdout
+	l := rd.load(tctx, path)
+	if l.err != nil {
+		fmt.Fprintf(w, "LOADED\n  failed: %v\n", l.err)
+		return ExitFailure
+	}
+	if err := explainDoc(w, l.d); err != nil {
+		fmt.Fprintf(env.Stderr, "rcptpixie explain: writing the page images: %v\n", err)
+		return ExitFailure
+	}
+	it, f := rd.build(tctx, l)
+	if ctx.Err() != nil {
+		return ExitInterrupted
+	}
+	explainCalls(w, trace.Calls)
+	fmt.Fprintln(w, "\nCORRECTIONS")
+	if len(trace.Corrections) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	for _, c := range trace.Corrections {
+		fmt.Fprintf(w, "  %s\n", c)
+	}
+	explainResult(w, it, f)
+	if it.Action == rename.ActionError {
+		return ExitFailure
+	}
+	return ExitOK
+}
+
+// explainDoc shows what doc.Load made of the file: its text as the model gets
+// it, or its page images, written to a directory of their own that is left for
+// the user to look at.
+func explainDoc(w io.Writer, d *doc.Doc) error {
+	via := d.Via
+	if d.Tool != "" {
+		via += " (" + d.Tool + ")"
+	}
+	fmt.Fprintf(w, "LOADED\n  %s via %s, %d page(s)\n", d.Path, via, d.Pages)
+
+	if d.Kind == doc.KindText {
+		note := ""
+		if d.Truncated {
+			note = fmt.Sprintf(", cut to %d", doc.MaxTextChars)
+		}
+		fmt.Fprintf(w, "\nTEXT (%d characters%s)\n%s\n", len([]rune(d.Text)), note, d.Text)
+		return nil
+	}
+	dir, err := os.MkdirTemp("", "rcptpixie-explain-")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "\nIMAGES")
+	for i, img := range d.Images {
+		b, err := base64.StdEncoding.DecodeString(img)
+		if err != nil {
+			return err
+		}
+		p := filepath.Join(dir, fmt.Sprintf("page-%d%s", i+1, imageExt(b)))
+		if err := os.WriteFile(p, b, 0o644); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "  %s\n", p)
+	}
+	return nil
+}
+
+// imageExt names what the model was sent, which for a HEIC photo is the JPEG
+// the converter made of it.
+func imageExt(b []byte) string {
+	switch http.DetectContentType(b) {
+	case "image/png":
+		return ".png"
+	case "image/jpeg":
+		return ".jpg"
+	case "image/webp":
+		return ".webp"
+	}
+	return ".img"
+}
+
+// explainCalls prints each request and its reply verbatim, so a prompt can be
+// pasted into another client as it stands.
+func explainCalls(w io.Writer, calls []analyze.Call) {
+	for i, c := range calls {
+		what := "PROMPT"
+		if i > 0 {
+			what = "RETRY PROMPT"
+		}
+		if i == 0 || c.System != calls[i-1].System {
+			fmt.Fprintf(w, "\nSYSTEM\n%s\n", c.System)
+		}
+		images := ""
+		if c.Images > 0 {
+			images = fmt.Sprintf(", %d image(s)", c.Images)
+		}
+		fmt.Fprintf(w, "\n%s (seed %d, num_ctx %d, num_predict %d%s)\n%s\n", what, c.Seed, c.Context, c.MaxTokens, images, c.Prompt)
+		fmt.Fprintf(w, "\nREPLY (%s)\n", c.Took.Round(time.Millisecond))
+		if c.Err != "" {
+			fmt.Fprintf(w, "  failed: %s\n", c.Err)
+			continue
+		}
+		fmt.Fprintln(w, c.Reply)
+	}
+}
+
+func explainResult(w io.Writer, it rename.Item, f facts) {
+	if rc := f.Receipt; rc != nil {
+		fmt.Fprintln(w, "\nRECEIPT")
+		fmt.Fprintf(w, "  vendor      %s\n", rc.Vendor)
+		date := rc.StartDate.Format("2006-01-02")
+		if !rc.EndDate.IsZero() && !rc.EndDate.Equal(rc.StartDate) {
+			date += " to " + rc.EndDate.Format("2006-01-02")
+		}
+		fmt.Fprintf(w, "  date        %s\n", date)
+		total := analyze.FormatTotal(rc.Total, rc.Currency)
+		if rc.Currency != "" {
+			total += " " + rc.Currency
+		}
+		fmt.Fprintf(w, "  total       %s\n", total)
+		fmt.Fprintf(w, "  category    %s\n", rc.Category)
+		fmt.Fprintf(w, "  confidence  %s\n", rc.Confidence)
+		for _, d := range rc.Doubts {
+			fmt.Fprintf(w, "              %s\n", d)
+		}
+	}
+	fmt.Fprintln(w, "\nNAME")
+	switch it.Action {
+	case rename.ActionError:
+		fmt.Fprintf(w, "  failed: %v\n", it.Err)
+	case rename.ActionRename:
+		fmt.Fprintf(w, "  %s\n", it.NewName)
+	default:
+		fmt.Fprintf(w, "  %s: %s\n", it.Action, it.Reason)
+	}
+}
@@ -0,0 +1,140 @@
+package cli
+
+import (
+	"encoding/csv"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/analyze"
+	"github.com/scottdensmore/rcptpixie/v2/internal/rename"
+)
+
+// exportHeader only ever grows at the end, so a sheet that reads its columns
+// by position keeps working.
+var exportHeader = []string{
+	"original_path", "final_path", "action", "date", "end_date", "total", "vendor", "category", "via", "error", "currency",
+	"subtotal", "tax", "tip", "payment_method", "card_last4", "confidence", "doubts",
+}
+
+// writeExport writes one spreadsheet row per file. final_path is where the file
+// ended up, or on a dry run where it would go, so the sheet can be checked
+// before anything is renamed. A file that kept its name reports its own path;
+// one that failed reports none.
+func writeExport(w io.Writer, plans []*rename.Plan, found map[string]facts, moved map[string]string, dryRun bool) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(exportHeader); err != nil {
+		return err
+	}
+	for _, p := range plans {
+		for _, it := range p.Items {
+			f := found[it.OldPath]
+			row := make([]string, len(exportHeader))
+			row[0] = sheetSafe(it.OldPath)
+			row[1] = sheetSafe(finalPath(p, it, moved, dryRun))
+			row[2] = string(it.Action)
+			if rc := f.Receipt; rc != nil {
+				row[3] = isoDate(rc.StartDate)
+				if !rc.EndDate.Equal(rc.StartDate) {
+					row[4] = isoDate(rc.EndDate)
+				}
+				row[5] = analyze.FormatTotal(rc.Total, rc.Currency)
+				row[6] = sheetSafe(rc.Vendor)
+				row[7] = sheetSafe(rc.Category)
+				row[10] = rc.Currency
+				row[11] = amount(rc.Subtotal, rc.Currency)
+				row[12] = amount(rc.Tax, rc.Currency)
+				row[13] = amount(rc.Tip, rc.Currency)
+				row[14] = sheetSafe(rc.Payment)
+				row[15] = rc.CardLast4
+			}
+			row[8] = f.Via
+			row[16] = it.Confidence
+			row[17] = sheetSafe(strings.Join(it.Doubts, "; "))
+			if it.Err != nil {
+				row[9] = sheetSafe(it.Err.Error())
+			}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// itemsHeader is -export-items: one row per line item, keyed back to the file
+// by the same two paths as the -export sheet.
+var itemsHeader = []string{
+	"original_path", "final_path", "line", "description", "quantity", "unit_price", "amount", "currency",
+}
+
+// writeItemsExport writes one row per line item. A file without items, or one
+// that failed, has no rows; the -export sheet is where to look for it.
+func writeItemsExport(w io.Writer, plans []*rename.Plan, found map[string]facts, moved map[string]string, dryRun bool) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(itemsHeader); err != nil {
+		return err
+	}
+	for _, p := range plans {
+		for _, it := range p.Items {
+			rc := found[it.OldPath].Receipt
+			if rc == nil || it.Action == rename.ActionError {
+				continue
+			}
+			final := sheetSafe(finalPath(p, it, moved, dryRun))
+			for i, li := range rc.Items {
+				row := []string{
+					sheetSafe(it.OldPath),
+					final,
+					strconv.Itoa(i + 1),
+					sheetSafe(li.Description),
+					strconv.FormatFloat(li.Quantity, 'f', -1, 64),
+					amount(li.UnitPrice, rc.Currency),
+					analyze.FormatTotal(li.Amount, rc.Currency),
+					rc.Currency,
+				}
+				if err := cw.Write(row); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// finalPath is the final_path cell, shared by both sheets.
+func finalPath(p *rename.Plan, it rename.Item, moved map[string]string, dryRun bool) string {
+	switch {
+	case it.Action == rename.ActionUnchanged:
+		return it.OldPath
+	case it.Action == rename.ActionRename && dryRun:
+		return filepath.Join(p.Dir, it.NewName)
+	case it.Action == rename.ActionRename:
+		return moved[it.OldPath]
+	}
+	return ""
+}
+
+// amount leaves a cell empty for an amount the receipt did not show, which a
+// spreadsheet must not sum as zero.
+func amount(v *float64, currency string) string {
+	if v == nil {
+		return ""
+	}
+	return analyze.FormatTotal(*v, currency)
+}
+
+// sheetSafe defuses a cell a spreadsheet would evaluate. The vendor is read from
+// an untrusted document, and a receipt printed "=HYPERLINK(...)" must arrive in
+// the expense sheet as text, not as a formula. A path is no safer: a relative
+// one starts with a file name, and a -template that starts with {{.Vendor}}
+// puts the model's answer there.
+func sheetSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,276 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The walk filters, in the order a file is tested against them, which is the
+// order the one that dropped it is counted under.
+const (
+	filterDepth   = "-max-depth"
+	filterInclude = "-include"
+	filterExclude = "-exclude"
+	filterNewer   = "-newer"
+	filterSize    = "-max-size"
+)
+
+// walkFilter is what -include, -exclude, -newer, -max-size and -max-depth make
+// of a directory walk. A nil one lets every candidate through. It counts the
+// files and folders each filter drops, for the verbose log, and so is not safe
+// for concurrent walks.
+type walkFilter struct {
+	include, exclude []glob
+	newer            time.Time
+	maxSize          int64 // bytes; 0 is no limit
+	maxDepth         int   // 1 is the walked directory's own files; 0 is no limit
+	dropped, pruned  map[string]int
+}
+
+// glob is one -include or -exclude pattern. A pattern with a / in it is matched
+// against the path below the walked directory; one without, against the file
+// name alone, so "Scan_*" finds a scan at any depth. One that ends in /** also
+// has subtree, which matches the directories it takes in whole.
+type glob struct {
+	re       *regexp.Regexp
+	wholeRel bool
+	subtree  *regexp.Regexp
+}
+
+// newWalkFilter compiles the filter flags, or returns nil when none was given.
+func newWalkFilter(include, exclude []string, newer, maxSize string, maxDepth int, now time.Time) (*walkFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 && newer == "" && maxSize == "" && maxDepth == 0 {
+		return nil, nil
+	}
+	if maxDepth < 0 {
+		return nil, fmt.Errorf("-max-depth must be positive, not %d", maxDepth)
+	}
+	f := &walkFilter{maxDepth: maxDepth, dropped: make(map[string]int), pruned: make(map[string]int)}
+	for _, set := range []struct {
+		name     string
+		patterns []string
+		into     *[]glob
+	}{
+		{filterInclude, include, &f.include},
+		{filterExclude, exclude, &f.exclude},
+	} {
+		for _, p := range set.patterns {
+			g, err := compileGlob(p)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", set.name, err)
+			}
+			*set.into = append(*set.into, g)
+		}
+	}
+	if newer != "" {
+		t, err := parseMoment(filterNewer, newer, now)
+		if err != nil {
+			return nil, err
+		}
+		f.newer = t
+	}
+	if maxSize != "" {
+		n, err := parseSize(maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("-max-size: %w", err)
+		}
+		f.maxSize = n
+	}
+	return f, nil
+}
+
+// compileGlob turns a shell pattern into a regular expression over a slash
+// path: * and ? stay within one directory, ** crosses any number of them, and
+// [...] is a class, [!...] a negated one.
+func compileGlob(pattern string) (glob, error) {
+	p := filepath.ToSlash(strings.TrimPrefix(pattern, "./"))
+	if p == "" {
+		return glob{}, errors.New("empty pattern")
+	}
+	g := glob{wholeRel: strings.Contains(p, "/")}
+	var err error
+	if g.re, err = globRegexp(pattern, p); err != nil {
+		return glob{}, err
+	}
+	if dir, ok := strings.CutSuffix(p, "/**"); ok && dir != "" {
+		if g.subtree, err = globRegexp(pattern, dir); err != nil {
+			return glob{}, err
+		}
+	}
+	return g, nil
+}
+
+func globRegexp(pattern, p string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case strings.HasPrefix(p[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "/**") && i+3 == len(p):
+			b.WriteString("(?:/.*)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(p[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("%q: unclosed [", pattern)
+			}
+			class := p[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", pattern, err)
+	}
+	return re, nil
+}
+
+func (g glob) match(rel string) bool {
+	if g.wholeRel {
+		return g.re.MatchString(rel)
+	}
+	return g.re.MatchString(rel[strings.LastIndexByte(rel, '/')+1:])
+}
+
+func anyMatch(globs []glob, rel string) bool {
+	for _, g := range globs {
+		if g.match(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSize reads a size such as 20MB, 512KiB or 1048576. KB, MB and GB are
+// powers of 1000, KiB, MiB and GiB of 1024, and a bare number is bytes.
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		scale  float64
+	}{
+		{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+		{"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"B", 1},
+	}
+	num, scale := strings.ToUpper(strings.TrimSpace(s)), 1.0
+	for _, u := range units {
+		if n, ok := strings.CutSuffix(num, u.suffix); ok {
+			num, scale = strings.TrimSpace(n), u.scale
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("cannot read %q; use a size such as 20MB, 512KiB or 1048576", s)
+	}
+	return int64(v * scale), nil
+}
+
+// keep reports whether the candidate at rel, its slash path below the walked
+// directory, passes every filter, and counts it under the first it fails.
+func (f *walkFilter) keep(rel string, info func() (fs.FileInfo, error)) bool {
+	dropped := f.drops(rel, info)
+	if dropped == "" {
+		return true
+	}
+	f.dropped[dropped]++
+	return false
+}
+
+// skipDir reports whether the walk can leave out the directory at rel and all
+// below it, and counts it under the filter that says so.
+func (f *walkFilter) skipDir(rel string) bool {
+	pruned := f.dirDrops(rel)
+	if pruned == "" {
+		return false
+	}
+	f.pruned[pruned]++
+	return true
+}
+
+// dirDrops names the filter that would drop everything below the directory at
+// rel, or returns "" when something there could be kept: the directory is
+// already at -max-depth, or an -exclude ending in /** takes in all of it. An
+// -exclude of a bare name never does, as it is matched against the names of
+// files, not of the folders they are in.
+func (f *walkFilter) dirDrops(rel string) string {
+	if f == nil {
+		return ""
+	}
+	if f.maxDepth > 0 && strings.Count(rel, "/")+1 >= f.maxDepth {
+		return filterDepth
+	}
+	for _, g := range f.exclude {
+		if g.subtree != nil && g.subtree.MatchString(rel) {
+			return filterExclude
+		}
+	}
+	return ""
+}
+
+// drops names the first filter the candidate at rel fails, or returns "" when
+// it passes them all.
+func (f *walkFilter) drops(rel string, info func() (fs.FileInfo, error)) string {
+	if f == nil {
+		return ""
+	}
+	dropped := ""
+	switch {
+	case f.maxDepth > 0 && strings.Count(rel, "/")+1 > f.maxDepth:
+		dropped = filterDepth
+	case len(f.include) > 0 && !anyMatch(f.include, rel):
+		dropped = filterInclude
+	case anyMatch(f.exclude, rel):
+		dropped = filterExclude
+	case !f.newer.IsZero() || f.maxSize > 0:
+		fi, err := info()
+		switch {
+		case err != nil:
+			// candidate() has just looked at it; a file gone since is the walk's
+			// business, not a filter's.
+		case !f.newer.IsZero() && fi.ModTime().Before(f.newer):
+			dropped = filterNewer
+		case f.maxSize > 0 && fi.Size() > f.maxSize:
+			dropped = filterSize
+		}
+	}
+	return dropped
+}
+
+// report logs how many files and folders each filter dropped, at debug level.
+func (f *walkFilter) report(log *slog.Logger) {
+	if f == nil {
+		return
+	}
+	for _, name := range []string{filterDepth, filterInclude, filterExclude, filterNewer, filterSize} {
+		if n := f.pruned[name]; n > 0 {
+			log.Debug("folders left out", "filter", name, "folders", n)
+		}
+		if n := f.dropped[name]; n > 0 {
+			log.Debug("files left out", "filter", name, "files", n)
+		}
+	}
+}
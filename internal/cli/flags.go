@@ -5,10 +5,16 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/scottdensmore/rcptpixie/v2/internal/analyze"
+	"github.com/scottdensmore/rcptpixie/v2/internal/llm"
 	"github.com/scottdensmore/rcptpixie/v2/internal/ollama"
+	"github.com/scottdensmore/rcptpixie/v2/internal/openai"
 )
 
 // defaultReceiptExts is receipts mode's filter; organize mode defaults to the
@@ -20,11 +26,62 @@ const defaultReceiptExts = ".pdf,.jpg,.jpeg,.png,.heic"
 const defaultTimeout = 5 * time.Minute
 
 type opts struct {
-	Model, Host                            string
+	Model, FallbackModel, Host, Backend    string
 	Timeout                                time.Duration
 	Recursive, DryRun, Yes, Verbose, Quiet bool
 	Exts                                   string
 	DateOrder                              string
+	Template                               string
+	Format                                 string
+	Export, ExportItems                    string
+	Items                                  bool
+	NoCache                                bool
+	Dest                                   string
+	Jobs, Parallel                         int
+	MinConfidence                          string
+	Review, Interactive                    bool
+	Duplicates, DuplicatesDir              string
+	Profile                                string
+	Categories                             string
+	CategoryRules                          stringList
+	Vendors                                string
+	LearnVendors                           bool
+	FilesFrom                              string
+	Null                                   bool
+	Include, Exclude                       stringList
+	Newer, MaxSize                         string
+	MaxDepth                               int
+	TraceDir                               string
+	Out                                    string
+	Interval, Settle                       time.Duration
+
+	// host is the -host flag, which knows whether it was given; openaiHost is
+	// the default when it was not and -backend is openai, where OLLAMA_HOST has
+	// no say. apiKey is never a flag, so it stays out of shell history.
+	host       *hostList
+	openaiHost string
+	apiKey     string
+	// getenv is what register was given, kept for the configuration files.
+	getenv func(string) string
+	// dirConfig is the directory file applyConfig read, "" when there was
+	// none, and dirTarget the path it was looked for from.
+	dirConfig, dirTarget string
+
+	// naming is Template compiled by validate; nil means the built-in format.
+	naming *analyze.NameTemplate
+	// destination is Dest compiled by validate; nil leaves files where they are.
+	destination *analyze.DestTemplate
+	// minConfidence is MinConfidence parsed by validate.
+	minConfidence analyze.Confidence
+	// categories is Categories and CategoryRules compiled by validate; nil is
+	// the built-in list.
+	categories *analyze.Categories
+	// vendors is the table read from Vendors by validate; nil when there is
+	// none and nothing to learn.
+	vendors *analyze.Vendors
+	// filter is Include, Exclude, Newer, MaxSize and MaxDepth compiled by
+	// validate; nil when none was given.
+	filter *walkFilter
 }
 
 // newFlagSet always uses ContinueOnError. ExitOnError makes Parse call
@@ -42,18 +99,17 @@ func newFlagSet(name string, out io.Writer) *flag.FlagSet {
 // register defines the flags, applying environment fallbacks to the defaults so
 // that an explicit flag always wins over an environment variable.
 func (o *opts) register(fs *flag.FlagSet, getenv func(string) string) {
-	if getenv == nil {
-		getenv = func(string) string { return "" }
-	}
-	model := firstNonEmpty(getenv("RCPTPIXIE_MODEL"), ollama.DefaultModel)
-	host := firstNonEmpty(getenv("RCPTPIXIE_HOST"), getenv("OLLAMA_HOST"), ollama.DefaultHost)
-
-	fs.StringVar(&o.Model, "model", model, "ollama model to use (env RCPTPIXIE_MODEL)")
-	fs.StringVar(&o.Host, "host", host, "ollama base URL (env RCPTPIXIE_HOST, OLLAMA_HOST)")
-	fs.DurationVar(&o.Timeout, "timeout", defaultTimeout, "timeout for a single ollama request")
+	o.registerServer(fs, getenv)
 	fs.StringVar(&o.Exts, "ext", o.Exts, "comma-separated extensions to consider (empty means every file)")
-	fs.StringVar(&o.DateOrder, "date-order", "auto",
-		"how a numeric date like 06/03/2025 is written: auto, day-first or month-first")
+	fs.Var(&o.Include, "include", "in a directory, consider only files matching this glob, such as Scan_* or **/2024/*; repeatable")
+	fs.Var(&o.Exclude, "exclude", "in a directory, leave out files matching this glob, such as **/Archive/**; repeatable")
+	fs.StringVar(&o.Newer, "newer", "", "in a directory, consider only files modified at or after this time: 2006-01-02, RFC 3339, or a duration ago such as 72h")
+	fs.StringVar(&o.MaxSize, "max-size", "", "in a directory, leave out files larger than this, such as 20MB")
+	fs.IntVar(&o.MaxDepth, "max-depth", 0, "with -r, descend at most this many levels; 1 is the directory's own files (default no limit)")
+	o.registerNaming(fs)
+	fs.StringVar(&o.Format, "format", formatText, "stdout format: text, json or jsonl")
+	fs.StringVar(&o.Dest, "dest", "",
+		"move renamed files into this directory, whose folders may use the -template fields, e.g. ~/Archive/{{year}}/{{category}}")
 
 	// The stdlib flag package has no aliases, so each short form is a second
 	// binding onto the same target.
@@ -67,6 +123,91 @@ func (o *opts) register(fs *flag.FlagSet, getenv func(string) string) {
 	fs.BoolVar(&o.Verbose, "v", false, "short for -verbose")
 	fs.BoolVar(&o.Quiet, "quiet", false, "log errors only")
 	fs.BoolVar(&o.Quiet, "q", false, "short for -quiet")
+	fs.IntVar(&o.Jobs, "jobs", 1, "load and rasterize up to this many files ahead of the model")
+	fs.IntVar(&o.Parallel, "parallel", 1, "model requests to keep in flight at once, shared across the hosts")
+	fs.StringVar(&o.MinConfidence, "min-confidence", "low",
+		"skip files the model was less sure of than this: low, medium or high")
+	fs.BoolVar(&o.Review, "review", false, "move files below -min-confidence into a needs-review folder instead of skipping them")
+	fs.BoolVar(&o.NoCache, "no-cache", false, "ask the model about every file, ignoring and not updating the analysis cache")
+	fs.StringVar(&o.TraceDir, "trace-dir", "",
+		"write each file's prompts, raw replies, timings and result, and the page images it was sent, into a folder per run here")
+}
+
+// registerServer defines the flags that pick the model and the server it runs
+// on, which doctor and explain take as well.
+func (o *opts) registerServer(fs *flag.FlagSet, getenv func(string) string) {
+	if getenv == nil {
+		getenv = func(string) string { return "" }
+	}
+	o.getenv = getenv
+	model := firstNonEmpty(getenv("RCPTPIXIE_MODEL"), ollama.DefaultModel)
+	host := firstNonEmpty(getenv("RCPTPIXIE_HOST"), getenv("OLLAMA_HOST"), ollama.DefaultHost)
+
+	fs.StringVar(&o.Profile, "profile", getenv("RCPTPIXIE_PROFILE"),
+		"use this named profile from the configuration files (env RCPTPIXIE_PROFILE)")
+	fs.StringVar(&o.Model, "model", model, "model to use (env RCPTPIXIE_MODEL)")
+	fs.StringVar(&o.FallbackModel, "fallback-model", getenv("RCPTPIXIE_FALLBACK_MODEL"),
+		"read again with this larger model, at the end of the run, any file -model misread or read with low confidence (env RCPTPIXIE_FALLBACK_MODEL)")
+	fs.StringVar(&o.Backend, "backend", firstNonEmpty(getenv("RCPTPIXIE_BACKEND"), backendOllama),
+		"model server API: ollama, or openai for llama.cpp, vLLM, LM Studio and the like (env RCPTPIXIE_BACKEND)")
+	o.Host = host
+	o.host = &hostList{dst: &o.Host}
+	o.openaiHost = firstNonEmpty(getenv("RCPTPIXIE_HOST"), openai.DefaultHost)
+	o.apiKey = getenv("RCPTPIXIE_API_KEY")
+	fs.Var(o.host, "host", "model server base URL; repeat, or give a comma list, to spread work across ollama servers (env RCPTPIXIE_HOST, OLLAMA_HOST)")
+	fs.DurationVar(&o.Timeout, "timeout", defaultTimeout, "timeout for a single model request")
+}
+
+// registerNaming defines the flags that decide how what was read becomes a
+// name, which explain takes as well.
+func (o *opts) registerNaming(fs *flag.FlagSet) {
+	fs.StringVar(&o.DateOrder, "date-order", "auto",
+		"how a numeric date like 06/03/2025 is written: auto, day-first or month-first")
+	fs.StringVar(&o.Template, "template", "",
+		"name pattern over {{.Date}} {{.EndDate}} {{.Total}} {{.Vendor}} {{.Category}} {{.Subject}} {{.Original}}")
+}
+
+// registerFiling defines the flags that decide a receipt's vendor and category,
+// which watch and explain take as well as receipts.
+func (o *opts) registerFiling(fs *flag.FlagSet) {
+	vendors := ""
+	if o.getenv != nil {
+		vendors = userConfigFile(o.getenv, "vendors")
+	}
+	fs.StringVar(&o.Vendors, "vendors", vendors, "vendor alias table, one ALIAS = NAME per line")
+	fs.BoolVar(&o.LearnVendors, "learn-vendors", false, "add every vendor the -vendors table does not know to it, and each one corrected in -interactive")
+	fs.StringVar(&o.Categories, "categories", "",
+		"comma-separated categories for the model to choose from, the catch-all last (default the built-in twelve)")
+	fs.Var(&o.CategoryRules, "category-rule",
+		"REGEX=CATEGORY: file every vendor REGEX matches, ignoring case, under CATEGORY; repeat for more")
+}
+
+// registerReceipts defines the flags that only make sense for receipts.
+func (o *opts) registerReceipts(fs *flag.FlagSet) {
+	o.registerFiling(fs)
+	fs.StringVar(&o.Export, "export", "", "write the extracted fields of every file to this CSV file")
+	fs.BoolVar(&o.Items, "items", false, "also read each receipt's line items; slower, so off by default")
+	fs.StringVar(&o.ExportItems, "export-items", "", "write every line item to this CSV file, one row per line (needs -items)")
+}
+
+// registerRun defines the flags of a receipts or organize run that watch has no
+// use for.
+func (o *opts) registerRun(fs *flag.FlagSet) {
+	fs.BoolVar(&o.Interactive, "interactive", false, "go through the plan one file at a time: accept, skip, rename, correct the fields or ask another model")
+	fs.BoolVar(&o.Interactive, "i", false, "short for -interactive")
+	fs.StringVar(&o.Duplicates, "duplicates", "",
+		"find files that repeat another, by contents or by vendor, date and total, and skip, mark or move them")
+	fs.StringVar(&o.DuplicatesDir, "duplicates-dir", "",
+		"where -duplicates move puts them; a duplicates folder beside each file's destination by default")
+	fs.StringVar(&o.FilesFrom, "files-from", "", "also read the paths listed in this file, one per line; - for stdin")
+	fs.BoolVar(&o.Null, "0", false, "the -files-from list is separated by NUL bytes, as find -print0 writes it")
+}
+
+// registerWatch defines the flags only watch takes.
+func (o *opts) registerWatch(fs *flag.FlagSet) {
+	fs.StringVar(&o.Out, "out", "", "move renamed files into this directory instead of leaving them in place")
+	fs.DurationVar(&o.Interval, "interval", defaultInterval, "how often to look for new files")
+	fs.DurationVar(&o.Settle, "settle", defaultSettle, "how long a file must stop changing before it is read")
 }
 
 // validate checks the options that were actually registered. undo defines
@@ -76,6 +217,28 @@ func (o *opts) validate(fs *flag.FlagSet) error {
 	if o.Verbose && o.Quiet {
 		return errors.New("-verbose and -quiet cannot be used together")
 	}
+	if o.Interactive && o.DryRun {
+		return errors.New("-interactive and -dry-run cannot be used together")
+	}
+	if fs.Lookup("include") != nil {
+		if o.MaxDepth > 0 && !o.Recursive {
+			return errors.New("-max-depth needs -r")
+		}
+		f, err := newWalkFilter(o.Include, o.Exclude, o.Newer, o.MaxSize, o.MaxDepth, time.Now())
+		if err != nil {
+			return err
+		}
+		o.filter = f
+	}
+	if fs.Lookup("files-from") != nil {
+		if o.Null && o.FilesFrom == "" {
+			return errors.New("-0 needs -files-from")
+		}
+		// Both would read stdin, and the list would eat the answers.
+		if o.FilesFrom == stdinList && o.Interactive {
+			return errors.New("-files-from - and -interactive cannot be used together")
+		}
+	}
 	if fs.Lookup("date-order") != nil {
 		switch o.DateOrder {
 		case "", "auto", "day-first", "month-first":
@@ -83,19 +246,149 @@ func (o *opts) validate(fs *flag.FlagSet) error {
 			return fmt.Errorf("-date-order must be auto, day-first or month-first, not %q", o.DateOrder)
 		}
 	}
+	if fs.Lookup("format") != nil {
+		switch o.Format {
+		case formatText, formatJSON, formatJSONL:
+		default:
+			return fmt.Errorf("-format must be text, json or jsonl, not %q", o.Format)
+		}
+	}
+	if fs.Lookup("template") != nil && o.Template != "" {
+		mode := analyze.ReceiptTemplate
+		if fs.Name() == modeOrganize {
+			mode = analyze.SubjectTemplate
+		}
+		nt, err := analyze.ParseNameTemplate(o.Template, mode)
+		if err != nil {
+			return fmt.Errorf("-template: %w", err)
+		}
+		o.naming = nt
+	}
+	if o.FallbackModel != "" && o.FallbackModel == o.Model {
+		return errors.New("-fallback-model must differ from -model")
+	}
+	if fs.Lookup("jobs") != nil && o.Jobs < 1 {
+		return errors.New("-jobs must be at least 1")
+	}
+	if fs.Lookup("parallel") != nil && o.Parallel < 1 {
+		return errors.New("-parallel must be at least 1")
+	}
+	if o.ExportItems != "" && !o.Items {
+		return errors.New("-export-items needs -items")
+	}
+	if fs.Lookup("min-confidence") != nil {
+		c, ok := analyze.ParseConfidence(o.MinConfidence)
+		if !ok {
+			return fmt.Errorf("-min-confidence must be low, medium or high, not %q", o.MinConfidence)
+		}
+		o.minConfidence = c
+	}
+	if fs.Lookup("duplicates") != nil {
+		switch o.Duplicates {
+		case "", dupSkip, dupMark, dupMove:
+		default:
+			return fmt.Errorf("-duplicates must be skip, mark or move, not %q", o.Duplicates)
+		}
+		if o.DuplicatesDir != "" && o.Duplicates != dupMove {
+			return errors.New("-duplicates-dir needs -duplicates move")
+		}
+	}
+	if fs.Lookup("categories") != nil && (o.Categories != "" || len(o.CategoryRules) > 0) {
+		var names []string
+		if o.Categories != "" {
+			names = strings.Split(o.Categories, ",")
+		}
+		c, err := analyze.NewCategories(names, o.CategoryRules)
+		if err != nil {
+			return fmt.Errorf("-categories: %w", err)
+		}
+		o.categories = c
+	}
+	if fs.Lookup("vendors") != nil {
+		if o.LearnVendors && o.Vendors == "" {
+			return errors.New("-learn-vendors needs a -vendors file to learn into")
+		}
+		v, err := readVendors(expandHome(o.Vendors), o.LearnVendors)
+		if err != nil {
+			return fmt.Errorf("-vendors: %w", err)
+		}
+		o.vendors = v
+	}
+	if fs.Lookup("dest") != nil && o.Dest != "" {
+		dt, err := analyze.ParseDestTemplate(expandHome(o.Dest))
+		if err != nil {
+			return fmt.Errorf("-dest: %w", err)
+		}
+		o.destination = dt
+	}
 	if fs.Lookup("host") == nil {
 		return nil
 	}
 	if o.Timeout <= 0 {
 		return errors.New("-timeout must be greater than zero")
 	}
-	if _, err := ollama.New(o.Host, o.Timeout, nil); err != nil {
+	if o.Backend == backendOpenAI && !o.host.set {
+		o.Host = o.openaiHost
+	}
+	if _, err := o.newBackend(nil); err != nil {
 		return err
 	}
 	return nil
 }
 
-// parseInto parses args into o and returns the positionals FROM THE SAME
+// analyzer is the Analyzer for model with the run's reading options.
+func (o *opts) analyzer(c llm.Backend, model string, log *slog.Logger) *analyze.Analyzer {
+	return &analyze.Analyzer{C: c, Model: model, Log: log, DateOrder: analyze.ParseDateOrder(o.DateOrder), Items: o.Items, Categories: o.categories}
+}
+
+// hosts splits Host, which holds every -host or the comma list from the
+// environment.
+func (o *opts) hosts() []string {
+	return strings.Split(o.Host, ",")
+}
+
+// hostList is the -host flag. The first use replaces the default taken from the
+// environment, and each further one adds a server rather than overriding the
+// one before it.
+type hostList struct {
+	dst *string
+	set bool
+}
+
+func (h *hostList) String() string {
+	if h.dst == nil {
+		return ""
+	}
+	return *h.dst
+}
+
+func (h *hostList) repeatable() {}
+
+func (h *hostList) Set(v string) error {
+	if h.set {
+		*h.dst += "," + v
+	} else {
+		*h.dst = v
+		h.set = true
+	}
+	return nil
+}
+
+// stringList is a flag that may be given more than once, each use adding one
+// value.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ", ") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func (l *stringList) repeatable() {}
+
+// parseInto parses args into o, fills in what the configuration files say for
+// the commands that read them, and returns the positionals FROM THE SAME
 // FlagSet. Every subcommand goes through here, so flag permutation and
 // validation cannot drift apart between them. The shipped bug was exactly this:
 // parseFlags discarded fs.Args() and main read the global flag.Args(), which was
@@ -104,6 +397,15 @@ func (o *opts) parseInto(fs *flag.FlagSet, args []string) ([]string, error) {
 	if err := fs.Parse(permute(fs, args)); err != nil {
 		return nil, err
 	}
+	if fs.Lookup("profile") != nil {
+		target := "."
+		if fs.NArg() > 0 {
+			target = fs.Arg(0)
+		}
+		if err := o.applyConfig(fs, target); err != nil {
+			return nil, err
+		}
+	}
 	if err := o.validate(fs); err != nil {
 		return nil, err
 	}
@@ -182,3 +484,17 @@ func firstNonEmpty(vals ...string) string {
 	}
 	return ""
 }
+
+// expandHome resolves a leading "~/", which the shell leaves alone in
+// -dest=~/Archive and inside quotes.
+func expandHome(path string) string {
+	rest, ok := strings.CutPrefix(filepath.ToSlash(path), "~/")
+	if !ok {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, filepath.FromSlash(rest))
+}
@@ -0,0 +1,267 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/rename"
+)
+
+// journal is one directory's undo history.
+type journal struct {
+	dir     string
+	entries []rename.Entry
+}
+
+// readHistory loads dir's journal and, when recursive, every journal below it,
+// skipping hidden directories as the rename walk does. Only the top directory's
+// journal is required: one unreadable subdirectory is logged, not fatal, so it
+// cannot hold the rest of the tree's history hostage. No journal anywhere is
+// fs.ErrNotExist.
+func readHistory(dir string, recursive bool, log *slog.Logger) ([]journal, error) {
+	if !recursive {
+		entries, err := rename.Read(dir, log)
+		if err != nil {
+			return nil, err
+		}
+		return []journal{{dir: dir, entries: entries}}, nil
+	}
+	var hist []journal
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			log.Warn("skipping unreadable entry", "path", path, "err", err)
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			return fs.SkipDir
+		}
+		entries, err := rename.Read(path, log)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			log.Warn("skipping unreadable undo journal", "dir", path, "err", err)
+		case len(entries) > 0:
+			hist = append(hist, journal{dir: path, entries: entries})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(hist) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return hist, nil
+}
+
+// selectEntries turns -last, -run and -since into a filter, or nil for every
+// entry. -last means the run that made the newest rename anywhere in hist.
+func selectEntries(hist []journal, last bool, runID, since string, now time.Time) (func(rename.Entry) bool, error) {
+	n := 0
+	for _, set := range []bool{last, runID != "", since != ""} {
+		if set {
+			n++
+		}
+	}
+	switch {
+	case n > 1:
+		return nil, errors.New("-last, -run and -since cannot be combined")
+	case last:
+		var newest *rename.Entry
+		for _, h := range hist {
+			for i := range h.entries {
+				if e := &h.entries[i]; newest == nil || !e.Time.Before(newest.Time) {
+					newest = e
+				}
+			}
+		}
+		if newest == nil {
+			return nil, nil
+		}
+		if newest.ID == "" {
+			return nil, errors.New("the newest rename was recorded before runs had IDs; use -since instead")
+		}
+		id := newest.ID
+		return func(e rename.Entry) bool { return e.ID == id }, nil
+	case runID != "":
+		return func(e rename.Entry) bool { return e.ID == runID }, nil
+	case since != "":
+		t, err := parseMoment("-since", since, now)
+		if err != nil {
+			return nil, err
+		}
+		return func(e rename.Entry) bool { return !e.Time.Before(t) }, nil
+	}
+	return nil, nil
+}
+
+// parseMoment reads the value of the flag name, -since or -newer, as a moment or as a
+// duration before now. A date or time without a zone is local, since that is
+// the clock the user was reading.
+func parseMoment(name, s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%s: cannot read %q; use 2006-01-02, 2006-01-02T15:04, RFC 3339, or a duration such as 2h", name, s)
+}
+
+// filterHistory keeps the entries match accepts and drops journals left empty.
+func filterHistory(hist []journal, match func(rename.Entry) bool) []journal {
+	if match == nil {
+		return hist
+	}
+	var out []journal
+	for _, h := range hist {
+		var keep []rename.Entry
+		for _, e := range h.entries {
+			if match(e) {
+				keep = append(keep, e)
+			}
+		}
+		if len(keep) > 0 {
+			out = append(out, journal{dir: h.dir, entries: keep})
+		}
+	}
+	return out
+}
+
+// runRecord is one run in history's structured output.
+type runRecord struct {
+	Record  string    `json:"record"`
+	ID      string    `json:"run"`
+	Started time.Time `json:"started"`
+	Mode    string    `json:"mode"`
+	Model   string    `json:"model"`
+	Renames int       `json:"renames"`
+	Dirs    []string  `json:"dirs"`
+}
+
+// summarizeRuns groups the entries by run, oldest first. Entries from before
+// run IDs share the empty ID and so form one group.
+func summarizeRuns(hist []journal) []runRecord {
+	byID := make(map[string]*runRecord)
+	for _, h := range hist {
+		for _, e := range h.entries {
+			r, ok := byID[e.ID]
+			if !ok {
+				r = &runRecord{Record: "run", ID: e.ID, Started: e.Time, Mode: e.Mode, Model: e.Model}
+				byID[e.ID] = r
+			}
+			if e.Time.Before(r.Started) {
+				r.Started = e.Time
+			}
+			if !slices.Contains(r.Dirs, h.dir) {
+				r.Dirs = append(r.Dirs, h.dir)
+			}
+			r.Renames++
+		}
+	}
+	runs := make([]runRecord, 0, len(byID))
+	for _, r := range byID {
+		runs = append(runs, *r)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Started.Before(runs[j].Started) })
+	return runs
+}
+
+func runHistory(ctx context.Context, env Env, args []string) ExitCode {
+	if ctx.Err() != nil {
+		return ExitInterrupted
+	}
+
+	var o opts
+	flags := newFlagSet(modeHistory, env.Stderr)
+	flags.BoolVar(&o.Recursive, "recursive", false, "include the journals in every subdirectory")
+	flags.BoolVar(&o.Recursive, "r", false, "short for -recursive")
+	flags.StringVar(&o.Format, "format", formatText, "stdout format: text, json or jsonl")
+	rest, err := o.parseInto(flags, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			commandUsage(env.Stdout, modeHistory, flags)
+			return ExitOK
+		}
+		fmt.Fprintf(env.Stderr, "rcptpixie history: %v\n\n", err)
+		commandUsage(env.Stderr, modeHistory, flags)
+		return ExitUsage
+	}
+	dir := "."
+	switch len(rest) {
+	case 0:
+	case 1:
+		dir = rest[0]
+	default:
+		fmt.Fprintf(env.Stderr, "rcptpixie history: expected at most one directory, got %d\n\n", len(rest))
+		commandUsage(env.Stderr, modeHistory, flags)
+		return ExitUsage
+	}
+
+	hist, err := readHistory(dir, o.Recursive, newLogger(env.Stderr, levelFor(false, false)))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(env.Stderr, "rcptpixie history: no rename history in %s\n", dir)
+			return ExitUsage
+		}
+		fmt.Fprintf(env.Stderr, "rcptpixie history: %v\n", err)
+		return ExitFailure
+	}
+	runs := summarizeRuns(hist)
+
+	if o.Format != formatText {
+		e := newEmitter(env.Stdout, o.Format)
+		for _, r := range runs {
+			if err := e.add(r); err != nil {
+				fmt.Fprintf(env.Stderr, "rcptpixie history: writing %s output: %v\n", o.Format, err)
+				return ExitFailure
+			}
+		}
+		if err := e.close(); err != nil {
+			fmt.Fprintf(env.Stderr, "rcptpixie history: writing %s output: %v\n", o.Format, err)
+			return ExitFailure
+		}
+		return ExitOK
+	}
+	renderHistory(env.Stdout, runs)
+	return ExitOK
+}
+
+func renderHistory(w io.Writer, runs []runRecord) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RUN\tSTARTED\tMODE\tMODEL\tRENAMES\tDIRECTORIES")
+	for _, r := range runs {
+		id, mode, model := r.ID, r.Mode, r.Model
+		if id == "" {
+			id, mode, model = "(no ID)", "-", "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", id, r.Started.Local().Format("2006-01-02 15:04"), mode, model, r.Renames,
+			strings.Join(r.Dirs, ", "))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,383 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/analyze"
+	"github.com/scottdensmore/rcptpixie/v2/internal/llm"
+	"github.com/scottdensmore/rcptpixie/v2/internal/rename"
+)
+
+const reviewHelp = `  a  accept this name
+  s  skip this file
+  n  type a new name
+  f  correct what was read; the name is made again from it
+  m  read the file again with another model
+  q  skip this file and every one after it
+`
+
+// reviewer is -interactive: it walks the plan one file at a time and lets the
+// user settle each one. Questions and answers go to stderr, leaving stdout to
+// the plan and the records as in any other run.
+type reviewer struct {
+	rd       *reader
+	client   llm.Backend
+	analyzer func(model string) *analyze.Analyzer // as the run builds one, for m
+	found    map[string]facts
+	out      io.Writer
+	lines    <-chan string
+	done     chan struct{}
+}
+
+// newReviewer reads stdin on its own goroutine, so that a prompt waiting for an
+// answer still gives way to Ctrl-C. close lets that goroutine go.
+func newReviewer(env Env, rd *reader, client llm.Backend, analyzer func(string) *analyze.Analyzer, found map[string]facts) *reviewer {
+	lines := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		defer close(lines)
+		sc := bufio.NewScanner(env.Stdin)
+		for sc.Scan() {
+			select {
+			case lines <- sc.Text():
+			case <-done:
+				return
+			}
+		}
+	}()
+	return &reviewer{rd: rd, client: client, analyzer: analyzer, found: found, out: env.Stderr, lines: lines, done: done}
+}
+
+func (rv *reviewer) close() { close(rv.done) }
+
+// errQuit ends the walk, whether asked for with q or by closing stdin.
+var errQuit = errors.New("quit")
+
+// walk asks about every file the model read and returns items as decided. An
+// edit is planned again at once, so each name shown is the one that would be
+// used, collision suffix and all.
+func (rv *reviewer) walk(ctx context.Context, items []rename.Item, plans []*rename.Plan) ([]rename.Item, error) {
+	items = append([]rename.Item(nil), items...)
+	total := 0
+	for _, it := range items {
+		if rv.reviewable(it) {
+			total++
+		}
+	}
+	fmt.Fprintf(rv.out, "\nReviewing %d file(s); ? for help.\n", total)
+
+	n := 0
+	for i := range items {
+		if !rv.reviewable(items[i]) {
+			continue
+		}
+		n++
+		for decided := false; !decided; {
+			at, dir := resolved(plans, items[i].OldPath)
+			if at.Action == rename.ActionUnchanged || at.Action == rename.ActionDuplicate {
+				break
+			}
+			rv.show(n, total, at, dir)
+			choice, err := rv.ask(ctx, "[a,s,n,f,m,q,?] ")
+			if err != nil {
+				choice = "q"
+			}
+			edited := false
+			switch strings.ToLower(choice) {
+			case "a":
+				items[i] = rv.accept(items[i])
+				decided = true
+			case "s":
+				items[i] = skipped(items[i], "skipped at review")
+				decided = true
+			case "n":
+				edited = rv.editName(ctx, &items[i])
+			case "f":
+				edited = rv.editFields(ctx, &items[i])
+			case "m":
+				edited = rv.reread(ctx, &items[i])
+			case "q":
+				for j := i; j < len(items); j++ {
+					if rv.reviewable(items[j]) {
+						items[j] = skipped(items[j], "not reviewed")
+					}
+				}
+				return items, ctx.Err()
+			default:
+				fmt.Fprint(rv.out, reviewHelp)
+			}
+			if edited {
+				if plans, err = rv.rd.plan(items, rv.found); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return items, nil
+}
+
+// reviewable is a file the model read: one on its way to a new name, or one
+// held back below -min-confidence that a person may still vouch for.
+func (rv *reviewer) reviewable(it rename.Item) bool {
+	f := rv.found[it.OldPath]
+	if f.Receipt == nil && f.Subject == nil {
+		return false
+	}
+	return it.Action == rename.ActionRename || it.Action == rename.ActionSkip
+}
+
+func (rv *reviewer) show(n, total int, it rename.Item, dir string) {
+	fmt.Fprintf(rv.out, "\n[%d/%d] %s\n", n, total, it.OldPath)
+	switch it.Action {
+	case rename.ActionRename:
+		to := it.NewName
+		if filepath.Clean(filepath.Dir(it.OldPath)) != filepath.Clean(dir) {
+			to = filepath.Join(dir, it.NewName)
+		}
+		fmt.Fprintf(rv.out, "  -> %s\n", to)
+	case rename.ActionError:
+		fmt.Fprintf(rv.out, "  -- error: %v\n", it.Err)
+	default:
+		fmt.Fprintf(rv.out, "  -- %s: %s\n", it.Action, it.Reason)
+	}
+	if it.Confidence != "" && it.Confidence != analyze.ConfidenceHigh.String() {
+		fmt.Fprintf(rv.out, "     %s: %s\n", it.Confidence, strings.Join(it.Doubts, "; "))
+	}
+}
+
+// ask prompts and waits for one line. Closing stdin and interrupting both end
+// the walk.
+func (rv *reviewer) ask(ctx context.Context, prompt string) (string, error) {
+	fmt.Fprint(rv.out, prompt)
+	select {
+	case line, ok := <-rv.lines:
+		if !ok {
+			fmt.Fprintln(rv.out)
+			return "", errQuit
+		}
+		return strings.TrimSpace(line), nil
+	case <-ctx.Done():
+		fmt.Fprintln(rv.out)
+		return "", ctx.Err()
+	}
+}
+
+// accept renames the file as proposed. A person has now looked at it, so a
+// file held back for its confidence goes ahead, and -review no longer diverts
+// it.
+func (rv *reviewer) accept(it rename.Item) rename.Item {
+	if it.Action == rename.ActionRename && it.Confidence == analyze.ConfidenceHigh.String() {
+		return it
+	}
+	name := it.NewName
+	f := rv.vouch(it.OldPath)
+	it = rv.rd.name(it.OldPath, f)
+	if name != "" {
+		it.NewName = name
+	}
+	return rv.rd.assess(it, f)
+}
+
+// vouch marks what was read from path as checked by hand.
+func (rv *reviewer) vouch(path string) facts {
+	f := rv.found[path]
+	checked := analyze.Assessment{Confidence: analyze.ConfidenceHigh}
+	if f.Receipt != nil {
+		rc := *f.Receipt
+		rc.Assessment = checked
+		f.Receipt = &rc
+	}
+	if f.Subject != nil {
+		s := *f.Subject
+		s.Assessment = checked
+		f.Subject = &s
+	}
+	rv.found[path] = f
+	return f
+}
+
+func skipped(it rename.Item, reason string) rename.Item {
+	it.Action, it.NewName, it.Reason = rename.ActionSkip, "", reason
+	return it
+}
+
+// editName takes a name as typed. The extension is kept when none is given,
+// and the name is sanitized like any other.
+func (rv *reviewer) editName(ctx context.Context, it *rename.Item) bool {
+	line, err := rv.ask(ctx, "  new name: ")
+	if err != nil || line == "" {
+		return false
+	}
+	ext := filepath.Ext(it.OldPath)
+	stem := line
+	if e := filepath.Ext(line); strings.EqualFold(e, ext) {
+		stem = strings.TrimSuffix(line, e)
+	}
+	name := rename.SanitizeFilename(stem, ext)
+	if name == "" || !rename.IsSafeBase(name) {
+		fmt.Fprintf(rv.out, "  %q cannot be used as a file name\n", line)
+		return false
+	}
+	*it = rv.accept(rename.Item{OldPath: it.OldPath, Action: rename.ActionRename})
+	it.Action, it.NewName, it.Err = rename.ActionRename, name, nil
+	return true
+}
+
+// editFields asks for each field in turn, an empty answer keeping it, and then
+// names the file again from the result.
+func (rv *reviewer) editFields(ctx context.Context, it *rename.Item) bool {
+	f := rv.found[it.OldPath]
+	var err error
+	switch {
+	case f.Receipt != nil:
+		rc := *f.Receipt
+		err = rv.receiptFields(ctx, &rc)
+		f.Receipt = &rc
+	case f.Subject != nil:
+		s := *f.Subject
+		err = rv.subjectFields(ctx, &s)
+		f.Subject = &s
+	}
+	if err != nil {
+		return false
+	}
+	rv.found[it.OldPath] = f
+	*it = rv.accept(rename.Item{OldPath: it.OldPath, Action: rename.ActionRename})
+	return true
+}
+
+func (rv *reviewer) receiptFields(ctx context.Context, rc *analyze.Receipt) error {
+	wasStay := !rc.EndDate.Equal(rc.StartDate)
+	steps := []struct {
+		label, cur string
+		set        func(string) error
+	}{
+		{"vendor", rc.Vendor, func(s string) error {
+			rv.rd.vendors.Correct(rc.Vendor, s)
+			rc.Vendor = s
+			return nil
+		}},
+		{"date", isoDate(rc.StartDate), func(s string) error { return setDate(&rc.StartDate, s) }},
+		{"end date", isoDate(rc.EndDate), func(s string) error { return setDate(&rc.EndDate, s) }},
+		{"total", analyze.FormatTotal(rc.Total, rc.Currency), func(s string) error {
+			v, err := analyze.ParseAmount(s)
+			if err == nil {
+				rc.Total = v
+			}
+			return err
+		}},
+		{"currency", rc.Currency, func(s string) error { rc.Currency = strings.ToUpper(s); return nil }},
+		{"category", rc.Category, func(s string) error {
+			cats := rv.rd.an.Categories
+			name, ok := cats.Lookup(s)
+			if !ok {
+				return fmt.Errorf("%q is not one of the categories: %s", s, strings.Join(cats.List(), ", "))
+			}
+			rc.Category = name
+			return nil
+		}},
+	}
+	for i, st := range steps {
+		if i == 2 && !wasStay {
+			// A one-day receipt follows its date; only a stay has a second one.
+			rc.EndDate = rc.StartDate
+			st.cur = isoDate(rc.EndDate)
+		}
+		if err := rv.field(ctx, st.label, st.cur, st.set); err != nil {
+			return err
+		}
+	}
+	if rc.EndDate.Before(rc.StartDate) {
+		rc.EndDate = rc.StartDate
+	}
+	return nil
+}
+
+func (rv *reviewer) subjectFields(ctx context.Context, s *analyze.Subject) error {
+	if err := rv.field(ctx, "subject", s.Title, func(v string) error { s.Title = v; return nil }); err != nil {
+		return err
+	}
+	return rv.field(ctx, "date", isoDate(s.Date), func(v string) error { return setDate(&s.Date, v) })
+}
+
+// field asks for one value until it is empty or set accepts it.
+func (rv *reviewer) field(ctx context.Context, label, cur string, set func(string) error) error {
+	for {
+		line, err := rv.ask(ctx, fmt.Sprintf("  %s [%s]: ", label, cur))
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return nil
+		}
+		if err := set(line); err != nil {
+			fmt.Fprintf(rv.out, "  %v\n", err)
+			continue
+		}
+		return nil
+	}
+}
+
+func setDate(dst *time.Time, s string) error {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return fmt.Errorf("%q is not a date in the form 2006-01-02", s)
+	}
+	*dst = t
+	return nil
+}
+
+// reread asks another model about the file, usually a larger one than the run
+// uses. Its answer replaces the first only if it has one; the cache keeps both,
+// since each is keyed by its model.
+func (rv *reviewer) reread(ctx context.Context, it *rename.Item) bool {
+	prompt, model := "  model: ", ""
+	if fb := rv.rd.fallback; fb != nil {
+		prompt, model = fmt.Sprintf("  model [%s]: ", fb.Model), fb.Model
+	}
+	line, err := rv.ask(ctx, prompt)
+	if err != nil {
+		return false
+	}
+	if line != "" {
+		model = line
+	}
+	if model == "" {
+		return false
+	}
+	if err := rv.client.Preflight(ctx, model); err != nil {
+		fmt.Fprintf(rv.out, "  %v\n", err)
+		return false
+	}
+	alt := *rv.rd
+	alt.an, alt.fallback = rv.analyzer(model), nil
+	fmt.Fprintf(rv.out, "  reading with %s...\n", model)
+	got, f := alt.buildItem(ctx, it.OldPath)
+	if got.Action == rename.ActionError {
+		fmt.Fprintf(rv.out, "  %s could not read it either: %v\n", model, got.Err)
+		return false
+	}
+	rv.found[it.OldPath] = f
+	*it = got
+	return true
+}
+
+// resolved finds path's item in the planned groups, with the directory it goes
+// to.
+func resolved(plans []*rename.Plan, path string) (rename.Item, string) {
+	for _, p := range plans {
+		for _, it := range p.Items {
+			if it.OldPath == path {
+				return it, p.Dir
+			}
+		}
+	}
+	return rename.Item{OldPath: path}, filepath.Dir(path)
+}
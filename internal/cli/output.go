@@ -0,0 +1,270 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/analyze"
+	"github.com/scottdensmore/rcptpixie/v2/internal/rename"
+)
+
+const (
+	formatText  = "text"
+	formatJSON  = "json"
+	formatJSONL = "jsonl"
+)
+
+// facts is what the model read out of one file. It rides beside the plan item
+// rather than inside it, because rename knows nothing about receipts.
+type facts struct {
+	Receipt *analyze.Receipt
+	Subject *analyze.Subject
+	Via     string // "text" or "vision": how the model saw the document
+
+	// Escalated is set when the file was read again with -fallback-model,
+	// whichever answer was kept.
+	Escalated bool
+}
+
+func (f facts) assessment() analyze.Assessment {
+	switch {
+	case f.Receipt != nil:
+		return f.Receipt.Assessment
+	case f.Subject != nil:
+		return f.Subject.Assessment
+	}
+	return analyze.Assessment{}
+}
+
+// itemRecord is one file in -format json or jsonl. Every field a script might
+// key on is present even when empty, except the extracted ones, which exist
+// only for the mode that produced them.
+type itemRecord struct {
+	Record   string       `json:"record"`
+	Path     string       `json:"path"`
+	NewName  string       `json:"new_name"`
+	NewPath  string       `json:"new_path"`
+	Action   string       `json:"action"`
+	Reason   string       `json:"reason"`
+	Error    string       `json:"error"`
+	Vendor   string       `json:"vendor,omitempty"`
+	Date     string       `json:"date,omitempty"`
+	EndDate  string       `json:"end_date,omitempty"`
+	Total    *float64     `json:"total,omitempty"`
+	Currency string       `json:"currency,omitempty"`
+	Subtotal *float64     `json:"subtotal,omitempty"`
+	Tax      *float64     `json:"tax,omitempty"`
+	Tip      *float64     `json:"tip,omitempty"`
+	Payment  string       `json:"payment_method,omitempty"`
+	Last4    string       `json:"card_last4,omitempty"`
+	Items    []lineRecord `json:"items,omitempty"`
+	Category string       `json:"category,omitempty"`
+	Subject  string       `json:"subject,omitempty"`
+
+	Confidence string   `json:"confidence,omitempty"`
+	Doubts     []string `json:"doubts,omitempty"`
+	Escalated  bool     `json:"escalated,omitempty"`
+
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+}
+
+// lineRecord is one line item under -items.
+type lineRecord struct {
+	Description string   `json:"description"`
+	Quantity    float64  `json:"quantity"`
+	UnitPrice   *float64 `json:"unit_price,omitempty"`
+	Amount      float64  `json:"amount"`
+}
+
+// summaryRecord is always the last record, so a consumer reading a stream knows
+// the run finished rather than died. ToRename is what the plan proposed, a
+// rename that then failed included, and Renamed is what actually happened,
+// which a dry run leaves at zero.
+type summaryRecord struct {
+	Record     string `json:"record"`
+	DryRun     bool   `json:"dry_run"`
+	ToRename   int    `json:"to_rename"`
+	Renamed    int    `json:"renamed"`
+	Unchanged  int    `json:"unchanged"`
+	Skipped    int    `json:"skipped"`
+	Failed     int    `json:"failed"`
+	Escalated  int    `json:"escalated"`
+	Duplicates int    `json:"duplicates"`
+}
+
+// emitter writes records in the chosen structured format: jsonl as one object
+// per line, json as a single array. Nothing else may reach stdout while it is
+// in use, so the output stays parseable end to end.
+type emitter struct {
+	w      io.Writer
+	format string
+	recs   []any
+}
+
+func newEmitter(w io.Writer, format string) *emitter {
+	return &emitter{w: w, format: format}
+}
+
+func (e *emitter) add(v any) error {
+	if e.format == formatJSONL {
+		return json.NewEncoder(e.w).Encode(v)
+	}
+	e.recs = append(e.recs, v)
+	return nil
+}
+
+func (e *emitter) close() error {
+	if e.format != formatJSON {
+		return nil
+	}
+	if e.recs == nil {
+		e.recs = []any{}
+	}
+	b, err := json.MarshalIndent(e.recs, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(e.w, "%s\n", b)
+	return err
+}
+
+// planRecord describes one plan item. newPath is where the file now lives, and
+// is empty until it has actually been renamed.
+func planRecord(it rename.Item, newPath string, f facts) itemRecord {
+	r := itemRecord{
+		Record:  "item",
+		Path:    it.OldPath,
+		NewPath: newPath,
+		Action:  string(it.Action),
+		Reason:  it.Reason,
+
+		Confidence: it.Confidence,
+		Doubts:     it.Doubts,
+		Escalated:  f.Escalated,
+
+		DuplicateOf: it.DuplicateOf,
+	}
+	if it.Action == rename.ActionRename || it.Action == rename.ActionUnchanged {
+		r.NewName = it.NewName
+	}
+	if it.Err != nil {
+		r.Error = it.Err.Error()
+	}
+	if rc := f.Receipt; rc != nil {
+		r.Vendor = rc.Vendor
+		r.Date = isoDate(rc.StartDate)
+		if !rc.EndDate.Equal(rc.StartDate) {
+			r.EndDate = isoDate(rc.EndDate)
+		}
+		total := rc.Total
+		r.Total = &total
+		r.Currency = rc.Currency
+		r.Subtotal, r.Tax, r.Tip = rc.Subtotal, rc.Tax, rc.Tip
+		r.Payment, r.Last4 = rc.Payment, rc.CardLast4
+		for _, li := range rc.Items {
+			r.Items = append(r.Items, lineRecord{Description: li.Description, Quantity: li.Quantity, UnitPrice: li.UnitPrice, Amount: li.Amount})
+		}
+		r.Category = rc.Category
+	}
+	if s := f.Subject; s != nil {
+		r.Subject = s.Title
+		r.Date = isoDate(s.Date)
+	}
+	return r
+}
+
+func isoDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+// writeRecords emits every plan item and then the summary. renamed maps an
+// item's old path to where it went; a dry run passes nil.
+func writeRecords(w io.Writer, format string, plans []*rename.Plan, found map[string]facts, renamed map[string]string, dryRun bool) error {
+	e := newEmitter(w, format)
+	sum := summaryRecord{Record: "summary", DryRun: dryRun}
+	for _, p := range plans {
+		for _, it := range p.Items {
+			newPath := renamed[it.OldPath]
+			f := found[it.OldPath]
+			if err := e.add(planRecord(it, newPath, f)); err != nil {
+				return err
+			}
+			if f.Escalated {
+				sum.Escalated++
+			}
+			if it.DuplicateOf != "" {
+				sum.Duplicates++
+			}
+			switch it.Action {
+			case rename.ActionRename:
+				sum.ToRename++
+				if newPath != "" {
+					sum.Renamed++
+				}
+			case rename.ActionUnchanged:
+				sum.Unchanged++
+			case rename.ActionSkip, rename.ActionDuplicate:
+				sum.Skipped++
+			case rename.ActionError:
+				sum.Failed++
+				// Only a rename that failed as it was applied keeps the name
+				// it was going to get.
+				if it.NewName != "" {
+					sum.ToRename++
+				}
+			}
+		}
+	}
+	if err := e.add(sum); err != nil {
+		return err
+	}
+	return e.close()
+}
+
+// undoRecord is one journal entry in undo's structured output. Path is where
+// the file is now and NewName is the name it goes back to.
+type undoRecord struct {
+	Record  string `json:"record"`
+	Path    string `json:"path"`
+	NewName string `json:"new_name"`
+	Action  string `json:"action"`
+	Reason  string `json:"reason"`
+	Run     string `json:"run,omitempty"`
+}
+
+type undoSummary struct {
+	Record   string `json:"record"`
+	DryRun   bool   `json:"dry_run"`
+	Reverted int    `json:"reverted"`
+	Skipped  int    `json:"skipped"`
+}
+
+func writeUndoRecords(w io.Writer, format string, results []undone, dryRun bool) error {
+	e := newEmitter(w, format)
+	sum := undoSummary{Record: "summary", DryRun: dryRun}
+	for _, u := range results {
+		for _, o := range u.res.Outcomes {
+			r := undoRecord{Record: "item", Path: o.Entry.Where(u.dir), NewName: o.Entry.Old, Action: "revert", Reason: o.Reason, Run: o.Entry.ID}
+			switch {
+			case !o.Reverted:
+				r.Action = string(rename.ActionSkip)
+			case !dryRun:
+				r.Action = "reverted"
+			}
+			if err := e.add(r); err != nil {
+				return err
+			}
+		}
+		sum.Reverted += u.res.Reverted
+		sum.Skipped += u.res.Skipped
+	}
+	if err := e.add(sum); err != nil {
+		return err
+	}
+	return e.close()
+}
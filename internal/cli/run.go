@@ -2,6 +2,8 @@ package cli
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
@@ -10,12 +12,15 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/scottdensmore/rcptpixie/v2/internal/analyze"
+	"github.com/scottdensmore/rcptpixie/v2/internal/cache"
 	"github.com/scottdensmore/rcptpixie/v2/internal/doc"
-	"github.com/scottdensmore/rcptpixie/v2/internal/ollama"
 	"github.com/scottdensmore/rcptpixie/v2/internal/rename"
 )
 
@@ -34,6 +39,10 @@ func execute(ctx context.Context, env Env, args []string, mode string) ExitCode
 	}
 	flags := newFlagSet(mode, env.Stderr)
 	o.register(flags, env.Getenv)
+	if mode == modeReceipts {
+		o.registerReceipts(flags)
+	}
+	o.registerRun(flags)
 
 	rest, err := o.parseInto(flags, args)
 	if err != nil {
@@ -46,60 +55,138 @@ func execute(ctx context.Context, env Env, args []string, mode string) ExitCode
 		return ExitUsage
 	}
 
-	if len(rest) != 1 {
-		fmt.Fprintf(env.Stderr, "rcptpixie %s: expected exactly one path, got %d\n\n", mode, len(rest))
+	targets := rest
+	if o.FilesFrom != "" {
+		listed, err := readFileList(o.FilesFrom, env.Stdin, o.Null)
+		if err != nil {
+			fmt.Fprintf(env.Stderr, "rcptpixie %s: cannot read -files-from: %v\n", mode, err)
+			return ExitUsage
+		}
+		targets = append(targets, listed...)
+	} else if len(targets) == 0 {
+		fmt.Fprintf(env.Stderr, "rcptpixie %s: expected at least one path, or -files-from\n\n", mode)
 		commandUsage(env.Stderr, mode, flags)
 		return ExitUsage
 	}
-	root := rest[0]
-	fi, err := os.Stat(root)
-	if err != nil {
-		fmt.Fprintf(env.Stderr, "rcptpixie %s: cannot use %s: %v\n", mode, root, err)
+	for _, t := range targets {
+		if err := checkTarget(t); err != nil {
+			fmt.Fprintf(env.Stderr, "rcptpixie %s: cannot use %s: %v\n", mode, t, err)
+			return ExitUsage
+		}
+		// The traced pages are images, which the next run would read as
+		// receipts.
+		if o.TraceDir != "" && inside(t, expandHome(o.TraceDir)) {
+			fmt.Fprintf(env.Stderr, "rcptpixie %s: -trace-dir cannot be inside %s\n", mode, t)
+			return ExitUsage
+		}
+	}
+	if err := o.sameDirConfig(targets); err != nil {
+		fmt.Fprintf(env.Stderr, "rcptpixie %s: %v\n", mode, err)
 		return ExitUsage
 	}
-	// The walk drops fifos, devices and sockets in candidate(); an explicitly
-	// named one has to be refused here or reading it blocks forever, with no
-	// timeout covering the open.
-	if !fi.IsDir() && !fi.Mode().IsRegular() {
-		fmt.Fprintf(env.Stderr, "rcptpixie %s: cannot use %s: not a regular file\n", mode, root)
+
+	// The walk needs answers typed at a terminal; finding that out after every
+	// file has been read would waste the whole run.
+	if o.Interactive && !env.IsTTY(env.Stdin) {
+		fmt.Fprintf(env.Stderr, "rcptpixie %s: -interactive needs a terminal on stdin\n", mode)
 		return ExitUsage
 	}
 
 	log := newLogger(env.Stderr, levelFor(o.Verbose, o.Quiet))
 
-	client, err := ollama.New(o.Host, o.Timeout, log)
+	// Created before any model call, so a mistyped -export path costs nothing.
+	var export, exportItems *os.File
+	if o.Export != "" {
+		if export, err = os.Create(o.Export); err != nil {
+			fmt.Fprintf(env.Stderr, "rcptpixie %s: cannot write -export: %v\n", mode, err)
+			return ExitUsage
+		}
+		defer export.Close()
+	}
+	if o.ExportItems != "" {
+		if exportItems, err = os.Create(o.ExportItems); err != nil {
+			fmt.Fprintf(env.Stderr, "rcptpixie %s: cannot write -export-items: %v\n", mode, err)
+			return ExitUsage
+		}
+		defer exportItems.Close()
+	}
+	exportTo := func(plans []*rename.Plan, found map[string]facts, moved map[string]string) bool {
+		ok := true
+		write := func(f *os.File, name string, fn func(io.Writer, []*rename.Plan, map[string]facts, map[string]string, bool) error) {
+			if f == nil {
+				return
+			}
+			err := fn(f, plans, found, moved, o.DryRun)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				fmt.Fprintf(env.Stderr, "rcptpixie: writing %s: %v\n", name, err)
+				ok = false
+			}
+		}
+		write(export, o.Export, writeExport)
+		write(exportItems, o.ExportItems, writeItemsExport)
+		return ok
+	}
+
+	client, err := o.newBackend(log)
 	if err != nil {
 		fmt.Fprintf(env.Stderr, "rcptpixie: %v\n", err)
 		return ExitFailure
 	}
 	// Once, before any file work: N confusing per-file dial errors become one
 	// actionable message in milliseconds.
-	if err := client.Preflight(ctx, o.Model); err != nil {
-		fmt.Fprintf(env.Stderr, "rcptpixie: %v\n", err)
-		return ExitFailure
+	for _, model := range []string{o.Model, o.FallbackModel} {
+		if model == "" {
+			continue
+		}
+		if err := client.Preflight(ctx, model); err != nil {
+			fmt.Fprintf(env.Stderr, "rcptpixie: %v\n", err)
+			return ExitFailure
+		}
 	}
 
-	raster := doc.Detect(log)
-	an := &analyze.Analyzer{C: client, Model: o.Model, Log: log, DateOrder: analyze.ParseDateOrder(o.DateOrder)}
+	rd := &reader{
+		an:      o.analyzer(client, o.Model, log),
+		raster:  doc.Detect(log),
+		mode:    mode,
+		naming:  o.naming,
+		dest:    o.destination,
+		trust:   o.minConfidence,
+		review:  o.Review,
+		dupes:   o.Duplicates,
+		dupDir:  expandHome(o.DuplicatesDir),
+		vendors: o.vendors,
+		log:     log,
+	}
+	if o.FallbackModel != "" {
+		rd.fallback = o.analyzer(client, o.FallbackModel, log)
+	}
+	if !o.NoCache {
+		rd.cache = openCache(env, log)
+	}
 
-	var (
-		files       []string
-		skippedDirs int
-	)
-	if fi.IsDir() {
-		files, skippedDirs, err = collectLog(root, o.Recursive, splitExts(o.Exts), log)
-		if err != nil {
-			fmt.Fprintf(env.Stderr, "rcptpixie: cannot read %s: %v\n", root, err)
-			return ExitFailure
-		}
-		if skippedDirs > 0 {
-			log.Warn(fmt.Sprintf("%d subdirectories skipped; pass -r to include them", skippedDirs))
-		}
-	} else {
-		files = []string{root}
+	files, skippedDirs, err := gather(targets, o.Recursive, splitExts(o.Exts), o.filter, log)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "rcptpixie: %v\n", err)
+		return ExitFailure
+	}
+	o.filter.report(log)
+	// After the walk, so that a trace folder inside a directory being read is
+	// never read itself.
+	if rd.traces, err = newTracer(expandHome(o.TraceDir), log); err != nil {
+		fmt.Fprintf(env.Stderr, "rcptpixie %s: cannot write -trace-dir: %v\n", mode, err)
+		return ExitUsage
+	}
+	if skippedDirs > 0 {
+		log.Warn(fmt.Sprintf("%d subdirectories skipped; pass -r to include them", skippedDirs))
 	}
 	if len(files) == 0 {
-		fmt.Fprintf(env.Stderr, "rcptpixie %s: no matching files in %s\n", mode, root)
+		fmt.Fprintf(env.Stderr, "rcptpixie %s: no matching files in %s\n", mode, describeTargets(targets))
+		if !exportTo(nil, nil, nil) {
+			return ExitFailure
+		}
 		return ExitOK
 	}
 
@@ -108,35 +195,53 @@ func execute(ctx context.Context, env Env, args []string, mode string) ExitCode
 			len(files), o.Model)
 	}
 
-	// Sequential on purpose: a single ollama serializes generation per model, so
-	// concurrency would buy a fraction of one model call at the price of an
-	// ordered committer.
-	items := make([]rename.Item, 0, len(files))
-	for _, path := range files {
+	// One model call at a time unless -parallel says otherwise: a single ollama
+	// serializes generation per model by default, so concurrency there would buy
+	// a fraction of one call. -jobs overlaps only the loading.
+	items, found := rd.readAll(ctx, files, o.Jobs, o.Parallel)
+	escalated := rd.escalate(ctx, items, found, o.Jobs, o.Parallel)
+
+	plans, err := rd.plan(items, found)
+	if err == nil && o.Interactive && ctx.Err() == nil {
+		analyzer := func(model string) *analyze.Analyzer { return o.analyzer(client, model, log) }
+		rv := newReviewer(env, rd, client, analyzer, found)
+		if items, err = rv.walk(ctx, items, plans); err == nil {
+			plans, err = rd.plan(items, found)
+		}
+		rv.close()
 		if ctx.Err() != nil {
-			break
+			fmt.Fprintln(env.Stderr, "\nnothing was renamed")
+			return ExitInterrupted
 		}
-		items = append(items, buildItem(ctx, an, raster, mode, path, log))
 	}
-
-	plans := groupByDir(items)
-	for _, p := range plans {
-		if err := p.Resolve(); err != nil {
-			fmt.Fprintf(env.Stderr, "rcptpixie: cannot plan renames in %s: %v\n", p.Dir, err)
-			return ExitFailure
-		}
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "rcptpixie: %v\n", err)
+		return ExitFailure
 	}
 
-	for i, p := range plans {
-		if i > 0 {
-			fmt.Fprintln(env.Stdout)
-		}
-		p.Render(env.Stdout)
+	structured := o.Format != formatText
+	if !structured {
+		renderPlans(env.Stdout, plans)
 	}
 	toRename, unchanged, skipped, failed := totals(plans)
 	fmt.Fprintf(env.Stderr, "\n%d to rename, %d unchanged, %d skipped, %d failed\n", toRename, unchanged, skipped, failed)
+	if escalated > 0 {
+		fmt.Fprintf(env.Stderr, "%d read again with %s\n", escalated, o.FallbackModel)
+	}
+	if n := duplicateCount(plans); n > 0 {
+		fmt.Fprintf(env.Stderr, "%d duplicate(s) of another file in the run\n", n)
+	}
 
 	if o.DryRun {
+		if !exportTo(plans, found, nil) {
+			return ExitFailure
+		}
+		if structured {
+			if err := writeRecords(env.Stdout, o.Format, plans, found, nil, true); err != nil {
+				fmt.Fprintf(env.Stderr, "rcptpixie: writing %s output: %v\n", o.Format, err)
+				return ExitFailure
+			}
+		}
 		// A dry run reports the same health as a real one. Returning ExitOK
 		// unconditionally would let `rcptpixie -n dir && rcptpixie dir` proceed
 		// after a run in which every single file failed to be read.
@@ -151,7 +256,12 @@ func execute(ctx context.Context, env Env, args []string, mode string) ExitCode
 		return ExitFailure
 	}
 
-	if mode == modeOrganize && !o.Yes && toRename > 0 {
+	if mode == modeOrganize && !o.Yes && !o.Interactive && toRename > 0 {
+		// What the user confirms has to be on screen, and stdout is reserved for
+		// the records, so the table goes to stderr with the prompt.
+		if structured && env.IsTTY(env.Stdin) {
+			renderPlans(env.Stderr, plans)
+		}
 		ok, err := confirm(env.Stdin, env.Stderr, env.IsTTY(env.Stdin), fmt.Sprintf("Rename %d files? [y/N] ", toRename))
 		if err != nil {
 			if errors.Is(err, ErrNotATTY) {
@@ -168,23 +278,37 @@ func execute(ctx context.Context, env Env, args []string, mode string) ExitCode
 	}
 
 	renamed := 0
+	moved := make(map[string]string)
+	run := newRun(mode, o.Model)
 	for _, p := range plans {
-		renamed += applyPlan(ctx, env, p, log)
+		renamed += applyPlan(ctx, p, run, log, func(oldPath, newPath string) {
+			moved[oldPath] = newPath
+			if !structured {
+				fmt.Fprintf(env.Stdout, "Renamed: %s -> %s\n", oldPath, newPath)
+			}
+		})
+	}
+	// Learned only from a real run: a dry run's vendors may yet be corrected.
+	saveVendors(expandHome(o.Vendors), rd.vendors, log)
+	exported := exportTo(plans, found, moved)
+	if structured {
+		if err := writeRecords(env.Stdout, o.Format, plans, found, moved, false); err != nil {
+			fmt.Fprintf(env.Stderr, "rcptpixie: writing %s output: %v\n", o.Format, err)
+			return ExitFailure
+		}
 	}
 
 	_, unchanged, skipped, failed = totals(plans)
 	fmt.Fprintf(env.Stderr, "\n%d renamed, %d unchanged, %d skipped, %d failed\n", renamed, unchanged, skipped, failed)
-	if renamed > 0 {
-		for _, p := range plans {
-			if hasRenames(p) {
-				fmt.Fprintf(env.Stderr, "Undo with:  rcptpixie undo %s\n", p.Dir)
-			}
-		}
+	for _, dir := range sourceDirs(moved) {
+		fmt.Fprintf(env.Stderr, "Undo with:  rcptpixie undo %s\n", dir)
 	}
 
 	switch {
 	case ctx.Err() != nil:
 		return ExitInterrupted
+	case !exported:
+		return ExitFailure
 	case failed == 0:
 		return ExitOK
 	case renamed+unchanged+skipped > 0:
@@ -193,31 +317,23 @@ func execute(ctx context.Context, env Env, args []string, mode string) ExitCode
 	return ExitFailure
 }
 
-func applyPlan(ctx context.Context, env Env, p *rename.Plan, log *slog.Logger) int {
+func renderPlans(w io.Writer, plans []*rename.Plan) {
+	for i, p := range plans {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		p.Render(w)
+	}
+}
+
+// applyPlan performs p's renames and reports each one that lands through done.
+// Every journal entry is tagged with run.
+func applyPlan(ctx context.Context, p *rename.Plan, run rename.Run, log *slog.Logger, done func(oldPath, newPath string)) int {
 	if !hasRenames(p) {
 		return 0
 	}
-	// The journal is opened on the first rename actually attempted, not up front,
-	// and dropped again if nothing was ever appended: a run that is cancelled or
-	// fails outright must not leave a stray dotfile in the user's directory.
-	var (
-		j      *rename.Journal
-		opened bool
-	)
-	openJournal := func() *rename.Journal {
-		if !opened {
-			opened = true
-			var err error
-			if j, err = rename.Open(p.Dir, log); err != nil {
-				log.Warn("could not open the undo journal; renames will not be reversible", "dir", p.Dir, "err", err)
-			}
-		}
-		return j
-	}
-	defer func() {
-		j.Close()
-		dropEmptyJournal(j.Path())
-	}()
+	js := &journals{run: run, log: log}
+	defer js.close()
 
 	renamed := 0
 	for i := range p.Items {
@@ -228,19 +344,68 @@ func applyPlan(ctx context.Context, env Env, p *rename.Plan, log *slog.Logger) i
 		if ctx.Err() != nil {
 			return renamed
 		}
-		newPath, err := rename.Apply(ctx, p.Dir, *it, openJournal())
+		newPath, err := rename.Apply(ctx, p.Dir, *it, js.get(filepath.Dir(it.OldPath)))
 		if err != nil {
 			it.Action = rename.ActionError
 			it.Err = err
 			log.Warn("rename failed", "file", it.OldPath, "err", err)
 			continue
 		}
-		fmt.Fprintf(env.Stdout, "Renamed: %s -> %s\n", it.OldPath, newPath)
+		done(it.OldPath, newPath)
 		renamed++
 	}
 	return renamed
 }
 
+// journals holds one undo journal per source directory: the history lives where
+// the files were found, which is where the user will look to undo it, even when
+// the plan moved them somewhere else.
+//
+// A journal is opened on the first rename actually attempted, not up front, and
+// dropped again if nothing was ever appended: a run that is cancelled or fails
+// outright must not leave a stray dotfile in the user's directory.
+type journals struct {
+	run  rename.Run
+	log  *slog.Logger
+	open map[string]*rename.Journal
+}
+
+func (js *journals) get(dir string) *rename.Journal {
+	if j, ok := js.open[dir]; ok {
+		return j
+	}
+	if js.open == nil {
+		js.open = make(map[string]*rename.Journal)
+	}
+	j, err := rename.Open(dir, js.log)
+	if err != nil {
+		js.log.Warn("could not open the undo journal; renames will not be reversible", "dir", dir, "err", err)
+	}
+	j.SetRun(js.run)
+	js.open[dir] = j
+	return j
+}
+
+// newRun names one invocation's renames.
+func newRun(mode, model string) rename.Run {
+	return rename.Run{ID: newRunID(), Mode: mode, Model: model}
+}
+
+// newRunID sorts by time, and its random tail keeps two runs started in the
+// same second apart.
+func newRunID() string {
+	var b [3]byte
+	rand.Read(b[:])
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b[:])
+}
+
+func (js *journals) close() {
+	for _, j := range js.open {
+		j.Close()
+		dropEmptyJournal(j.Path())
+	}
+}
+
 // dropEmptyJournal removes a journal that never received an entry. Size, not the
 // rename count, is what decides: a journal carrying an earlier run's history is
 // non-empty and must survive a run that renamed nothing.
@@ -253,47 +418,460 @@ func dropEmptyJournal(path string) {
 	}
 }
 
-func buildItem(ctx context.Context, an *analyze.Analyzer, r doc.Rasterizer, mode, path string, log *slog.Logger) rename.Item {
-	base := filepath.Base(path)
+// reader is what every file in a run is read with.
+type reader struct {
+	an *analyze.Analyzer
+	// fallback reads again what an misread or doubted; nil without
+	// -fallback-model.
+	fallback *analyze.Analyzer
+	raster   doc.Rasterizer
+	mode     string
+	naming   *analyze.NameTemplate // the -template pattern, or nil for the mode's built-in format
+	dest     *analyze.DestTemplate // the -dest pattern, or nil to rename in place
+	cache    *cache.Cache          // nil under -no-cache
+	trust    analyze.Confidence    // -min-confidence
+	review   bool                  // route files below trust to reviewDir rather than skip them
+	dupes    string                // -duplicates: skip, mark, move, or "" to compare nothing
+	dupDir   string                // -duplicates-dir
+	sums     map[string]string     // contents hashed so far, by path
+	vendors  *analyze.Vendors      // -vendors, or nil to keep each vendor as read
+	traces   *tracer               // -trace-dir, or nil
+	log      *slog.Logger
+}
+
+// buildItem reads one file and proposes its new name, returning what the model
+// extracted alongside it.
+func (rd *reader) buildItem(ctx context.Context, path string) (rename.Item, facts) {
+	return rd.build(ctx, rd.load(ctx, path))
+}
+
+// loaded is one file made ready for the model: decided without reading it,
+// answered from the cache, or read and waiting for its model call.
+type loaded struct {
+	path string
+	skip string // why the file needs no model call at all
+	key  string // the cache key, "" when not caching
+	hit  bool   // f came from the cache
+	f    facts
+	d    *doc.Doc
+	err  error
+	took time.Duration // spent in doc.Load
+}
+
+// load does everything for path that does not need the model, which is the
+// part -jobs runs ahead on several workers.
+func (rd *reader) load(ctx context.Context, path string) loaded {
+	l := loaded{path: path}
 	// Before any model call, so a second run over 500 files costs one directory
-	// listing rather than 500 inferences.
-	if mode == modeOrganize && analyze.IsOrganized(base) {
-		return rename.Item{OldPath: path, Action: rename.ActionSkip, Reason: "already organized"}
+	// listing rather than 500 inferences. Only the built-in format is a fixed
+	// point it can recognise: under -template a dated name is not a finished one,
+	// and under -dest a finished one may still need to move.
+	if rd.mode == modeOrganize && rd.naming == nil && rd.dest == nil && analyze.IsOrganized(filepath.Base(path)) {
+		l.skip = "already organized"
+		return l
+	}
+
+	if rd.cache != nil {
+		fingerprint := rd.an.ReceiptFingerprint()
+		if rd.mode == modeOrganize {
+			fingerprint = rd.an.SubjectFingerprint()
+		}
+		var err error
+		if l.key, err = cache.Key(path, fingerprint); err != nil {
+			rd.log.Debug("not caching", "file", path, "err", err)
+		}
+	}
+	if rd.cache.Get(l.key, &l.f) && (l.f.Receipt != nil || l.f.Subject != nil) {
+		rd.log.Debug("using the cached analysis", "file", path)
+		l.hit = true
+		return l
+	}
+	l.f = facts{}
+	start := time.Now()
+	l.d, l.err = doc.Load(ctx, path, rd.raster, rd.log)
+	l.took = time.Since(start)
+	return l
+}
+
+// build is read, recording under -trace-dir what it took.
+func (rd *reader) build(ctx context.Context, l loaded) (rename.Item, facts) {
+	if rd.traces == nil || l.skip != "" {
+		return rd.read(ctx, l)
 	}
+	trace := &analyze.Trace{}
+	start := time.Now()
+	it, f := rd.read(analyze.WithTrace(ctx, trace), l)
+	rd.traces.write(rd.an.Model, l, trace, it, f, time.Since(start))
+	return it, f
+}
 
-	d, err := doc.Load(ctx, path, r, log)
+// read asks the model about a loaded file, unless the cache already answered,
+// and names it.
+func (rd *reader) read(ctx context.Context, l loaded) (rename.Item, facts) {
+	path := l.path
+	if l.skip != "" {
+		return rename.Item{OldPath: path, Action: rename.ActionSkip, Reason: l.skip}, facts{}
+	}
+	f, err := rd.analyze(ctx, l)
 	if err != nil {
-		return rename.Item{OldPath: path, Action: rename.ActionError, Err: err}
+		return rename.Item{OldPath: path, Action: rename.ActionError, Err: err}, f
 	}
+	it := rd.name(path, f)
+	if it.Action != rename.ActionRename {
+		return it, f
+	}
+	return rd.assess(it, f), f
+}
+
+// name proposes path's new name from what was read out of it, through -template
+// when one was given and the mode's built-in format otherwise.
+func (rd *reader) name(path string, f facts) rename.Item {
 	ext := filepath.Ext(path)
+	original := strings.TrimSuffix(filepath.Base(path), ext)
+
+	var (
+		name string
+		err  error
+	)
+	switch {
+	case f.Subject != nil && rd.naming != nil:
+		name, err = rd.naming.Subject(*f.Subject, original, ext)
+	case f.Subject != nil:
+		name = analyze.SubjectName(*f.Subject, ext)
+	case rd.naming != nil:
+		name, err = rd.naming.Receipt(*f.Receipt, original, ext)
+	default:
+		name = analyze.ReceiptName(*f.Receipt, ext)
+	}
+	if err != nil {
+		return rename.Item{OldPath: path, Action: rename.ActionError, Err: fmt.Errorf("-template: %w", err)}
+	}
+	return rename.Item{OldPath: path, NewName: name, Action: rename.ActionRename}
+}
+
+// assess carries the analyzer's confidence onto the item, and holds back a file
+// below -min-confidence unless -review is to route it to a folder instead.
+func (rd *reader) assess(it rename.Item, f facts) rename.Item {
+	a := f.assessment()
+	it.Confidence, it.Doubts = a.Confidence.String(), a.Doubts
+	if a.Below(rd.trust) && !rd.review {
+		it.Action, it.NewName = rename.ActionSkip, ""
+		it.Reason = it.Confidence + " confidence, below -min-confidence"
+	}
+	return it
+}
+
+// reviewDir is where -review puts a file below -min-confidence: a folder beside
+// wherever it would otherwise have gone, renamed so the guess can be checked.
+const reviewDir = "needs-review"
+
+// reviewing wraps destOf so that a file below -min-confidence lands in
+// reviewDir. A file already in one stays there rather than nesting another.
+func (rd *reader) reviewing(destOf func(rename.Item) string, found map[string]facts) func(rename.Item) string {
+	if !rd.review {
+		return destOf
+	}
+	return func(it rename.Item) string {
+		dir := filepath.Dir(it.OldPath)
+		if destOf != nil {
+			dir = destOf(it)
+		}
+		if found[it.OldPath].assessment().Below(rd.trust) && filepath.Base(dir) != reviewDir {
+			dir = filepath.Join(dir, reviewDir)
+		}
+		return dir
+	}
+}
 
-	if mode == modeOrganize {
-		s, err := an.Subject(ctx, d)
+// destinations renders -dest for every file about to be renamed and returns
+// where each one goes, or nil without -dest. A file whose folder cannot be
+// rendered fails rather than being renamed in place: staying behind is not what
+// was asked for.
+func (rd *reader) destinations(items []rename.Item, found map[string]facts) func(rename.Item) string {
+	if rd.dest == nil {
+		return nil
+	}
+	dirs := make(map[string]string, len(items))
+	for i := range items {
+		it := &items[i]
+		if it.Action != rename.ActionRename {
+			continue
+		}
+		f := found[it.OldPath]
+		original := strings.TrimSuffix(filepath.Base(it.OldPath), filepath.Ext(it.OldPath))
+		var (
+			dir string
+			err error
+		)
+		if f.Subject != nil {
+			dir, err = rd.dest.Subject(*f.Subject, original)
+		} else {
+			dir, err = rd.dest.Receipt(*f.Receipt, original)
+		}
 		if err != nil {
-			return rename.Item{OldPath: path, Action: rename.ActionError, Err: err}
+			it.Action, it.NewName, it.Err = rename.ActionError, "", fmt.Errorf("-dest: %w", err)
+			continue
+		}
+		dirs[it.OldPath] = dir
+	}
+	return func(it rename.Item) string { return dirs[it.OldPath] }
+}
+
+// analyze returns what the model makes of a loaded file, from the cache when
+// the same bytes were already answered under the same model and prompt. Only
+// answers are cached: a failure is retried on the next run, since it may have
+// been the server's and not the document's.
+func (rd *reader) analyze(ctx context.Context, l loaded) (facts, error) {
+	f := l.f
+	if !l.hit {
+		if l.err != nil {
+			return facts{}, l.err
+		}
+		f = facts{Via: "text"}
+		if l.d.Kind == doc.KindImages {
+			f.Via = "vision"
+		}
+		if rd.mode == modeOrganize {
+			s, err := rd.an.Subject(ctx, l.d)
+			if err != nil {
+				return f, err
+			}
+			f.Subject = &s
+		} else {
+			rc, err := rd.an.Receipt(ctx, l.d)
+			if err != nil {
+				return f, err
+			}
+			f.Receipt = &rc
 		}
-		if s.Date.IsZero() {
-			s.Date = d.ModTime
-			log.Debug("no date in the document, using its modification time", "file", path)
+		if err := rd.cache.Put(l.key, f); err != nil {
+			rd.log.Warn("could not cache the analysis", "file", l.path, "err", err)
 		}
-		return rename.Item{OldPath: path, NewName: analyze.SubjectName(s, ext), Action: rename.ActionRename}
 	}
 
-	rc, err := an.Receipt(ctx, d)
-	if err != nil {
-		return rename.Item{OldPath: path, Action: rename.ActionError, Err: err}
+	// After the cache, not before it: the modification time belongs to this copy
+	// of the file, not to the bytes the answer was keyed on, and the alias table
+	// may have changed since the answer was.
+	if rc := f.Receipt; rc != nil {
+		if v := rd.vendors.Canonical(rc.Vendor); v != rc.Vendor {
+			analyze.TraceFrom(ctx).Corrected("vendor: %q is %q in the -vendors table", rc.Vendor, v)
+			rc.Vendor = v
+		}
+	}
+	if s := f.Subject; s != nil && s.Date.IsZero() {
+		if fi, err := os.Stat(l.path); err == nil {
+			s.Date = fi.ModTime()
+		}
+		rd.log.Debug("no date in the document, using its modification time", "file", l.path)
 	}
-	return rename.Item{OldPath: path, NewName: analyze.ReceiptName(rc, ext), Action: rename.ActionRename}
+	return f, nil
 }
 
-// groupByDir splits the items into one plan per parent directory: collision
-// resolution and the O_EXCL claim are both per directory, and a recursive run
-// must never rename a file out of the subdirectory it was found in.
-func groupByDir(items []rename.Item) []*rename.Plan {
+// readAll builds an item for every file, in order, stopping early if ctx is
+// cancelled. With jobs above one, up to jobs files are loaded ahead on as many
+// workers, so PDF extraction, rasterizing and HEIC conversion overlap with the
+// model calls. With parallel above one, that many model calls are in flight at
+// once, which pays off with several -host servers or one that runs requests in
+// parallel itself. Items come back in the order of files either way, so the
+// plan is the same as a sequential run's.
+func (rd *reader) readAll(ctx context.Context, files []string, jobs, parallel int) ([]rename.Item, map[string]facts) {
+	items := make([]rename.Item, 0, len(files))
+	found := make(map[string]facts, len(files))
+	keep := func(path string, it rename.Item, f facts) {
+		items = append(items, it)
+		found[path] = f
+	}
+	if jobs <= 1 && parallel <= 1 {
+		for _, path := range files {
+			if ctx.Err() != nil {
+				break
+			}
+			it, f := rd.buildItem(ctx, path)
+			keep(path, it, f)
+		}
+		return items, found
+	}
+	jobs, parallel = max(jobs, 1), max(parallel, 1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	// The workers are waited for, not abandoned: after Ctrl-C no pdftoppm may be
+	// left running, and no late load may log over the summary.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	spawn := func(n int, fn func()) {
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fn()
+			}()
+		}
+	}
+
+	type built struct {
+		it rename.Item
+		f  facts
+	}
+	// ahead holds one token per file started but not yet consumed, which bounds
+	// how many rendered pages can sit in memory at once. Each slot is written
+	// exactly once and buffered, so no worker ever blocks on a consumer that has
+	// gone.
+	ahead := make(chan struct{}, jobs+parallel)
+	loadedSlots := make([]chan loaded, len(files))
+	builtSlots := make([]chan built, len(files))
+	for i := range files {
+		loadedSlots[i] = make(chan loaded, 1)
+		builtSlots[i] = make(chan built, 1)
+	}
+
+	toLoad := make(chan int)
+	spawn(1, func() {
+		defer close(toLoad)
+		for i := range files {
+			select {
+			case ahead <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case toLoad <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+	spawn(jobs, func() {
+		for i := range toLoad {
+			loadedSlots[i] <- rd.load(ctx, files[i])
+		}
+	})
+
+	// Loaded files reach the model in order, so with one call in flight the
+	// model is asked exactly what a sequential run would ask it.
+	type job struct {
+		i int
+		l loaded
+	}
+	toBuild := make(chan job)
+	spawn(1, func() {
+		defer close(toBuild)
+		for i := range files {
+			var l loaded
+			select {
+			case l = <-loadedSlots[i]:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case toBuild <- job{i, l}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+	spawn(parallel, func() {
+		for j := range toBuild {
+			it, f := rd.build(ctx, j.l)
+			builtSlots[j.i] <- built{it, f}
+		}
+	})
+
+	for i, path := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		var b built
+		select {
+		case b = <-builtSlots[i]:
+		case <-ctx.Done():
+			return items, found
+		}
+		<-ahead
+		keep(path, b.it, b.f)
+	}
+	return items, found
+}
+
+// escalate reads again with the fallback model every file the first one
+// misread or read with low confidence, and reports how many that was. It runs
+// once, after everything else has been read, because each switch of model
+// costs a reload on the server and the fallback's own context size settles
+// once for the whole batch rather than once per file. The fallback's answer
+// replaces the first one unless it is an error or less certain, and only a file
+// it answered counts as read again.
+func (rd *reader) escalate(ctx context.Context, items []rename.Item, found map[string]facts, jobs, parallel int) int {
+	if rd.fallback == nil || ctx.Err() != nil {
+		return 0
+	}
+	var (
+		at    []int
+		paths []string
+	)
+	for i, it := range items {
+		f := found[it.OldPath]
+		if (it.Action == rename.ActionError && analyze.Misread(it.Err)) || f.assessment().Below(analyze.ConfidenceMedium) {
+			at = append(at, i)
+			paths = append(paths, it.OldPath)
+		}
+	}
+	if len(paths) == 0 {
+		return 0
+	}
+	rd.log.Info("reading again with the fallback model", "files", len(paths), "model", rd.fallback.Model)
+
+	alt := *rd
+	alt.an, alt.fallback = rd.fallback, nil
+	again, againFound := alt.readAll(ctx, paths, jobs, parallel)
+	n := 0
+	for k, it := range again {
+		// A file the fallback gave no answer for, cancelled or failed, was
+		// not read again as far as the summary goes.
+		if it.Action == rename.ActionError {
+			rd.log.Debug("the fallback model could not read it either", "file", it.OldPath, "err", it.Err)
+			continue
+		}
+		i, f := at[k], againFound[it.OldPath]
+		first := found[it.OldPath]
+		if first.assessment().Confidence > f.assessment().Confidence {
+			rd.log.Debug("keeping the first answer, which was more certain", "file", it.OldPath)
+		} else {
+			items[i], first = it, f
+		}
+		first.Escalated = true
+		found[it.OldPath] = first
+		n++
+	}
+	return n
+}
+
+// plan groups items by where each one goes and resolves every group. items
+// itself is left alone, so -interactive can plan the same list again after each
+// edit and the names, and which files repeat which, stay right.
+func (rd *reader) plan(items []rename.Item, found map[string]facts) ([]*rename.Plan, error) {
+	items = slices.Clone(items)
+	plans := groupByDir(items, rd.dedupe(items, found, rd.reviewing(rd.destinations(items, found), found)))
+	for _, p := range plans {
+		if err := p.Resolve(); err != nil {
+			return nil, fmt.Errorf("cannot plan renames in %s: %w", p.Dir, err)
+		}
+	}
+	return plans, nil
+}
+
+// groupByDir splits the items into one plan per destination directory:
+// collision resolution and the O_EXCL claim are both per directory. destOf names
+// where a file to be renamed should end up; nil keeps every file in the
+// directory it was found in, so a recursive run never moves one out of its
+// subdirectory. A file that is not being renamed always stays where it is.
+func groupByDir(items []rename.Item, destOf func(rename.Item) string) []*rename.Plan {
 	byDir := make(map[string]*rename.Plan)
 	var dirs []string
 	for _, it := range items {
 		dir := filepath.Dir(it.OldPath)
+		if destOf != nil && it.Action == rename.ActionRename {
+			dir = filepath.Clean(destOf(it))
+		}
 		p, ok := byDir[dir]
 		if !ok {
 			p = &rename.Plan{Dir: dir}
@@ -321,6 +899,21 @@ func totals(plans []*rename.Plan) (toRename, unchanged, skipped, failed int) {
 	return toRename, unchanged, skipped, failed
 }
 
+// sourceDirs lists the directories files were renamed from, which is where
+// their undo journals are.
+func sourceDirs(moved map[string]string) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for old := range moved {
+		if dir := filepath.Dir(old); !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
 func hasRenames(p *rename.Plan) bool {
 	for _, it := range p.Items {
 		if it.Action == rename.ActionRename {
@@ -331,13 +924,14 @@ func hasRenames(p *rename.Plan) bool {
 }
 
 func collect(root string, recursive bool, exts []string) (paths []string, skippedDirs int, err error) {
-	return collectLog(root, recursive, exts, nil)
+	return collectLog(root, recursive, exts, nil, nil)
 }
 
-// collectLog walks root. A per-entry error is logged and skipped, never
-// returned: the shipped code returned it, so one unreadable subdirectory or a
-// file removed mid-walk aborted every remaining file.
-func collectLog(root string, recursive bool, exts []string, log *slog.Logger) (paths []string, skippedDirs int, err error) {
+// collectLog walks root, keeping the candidates filter lets through. A
+// per-entry error is logged and skipped, never returned: the shipped code
+// returned it, so one unreadable subdirectory or a file removed mid-walk
+// aborted every remaining file.
+func collectLog(root string, recursive bool, exts []string, filter *walkFilter, log *slog.Logger) (paths []string, skippedDirs int, err error) {
 	if log == nil {
 		log = newLogger(io.Discard, slog.LevelError)
 	}
@@ -353,12 +947,12 @@ func collectLog(root string, recursive bool, exts []string, log *slog.Logger) (p
 				continue
 			}
 			if e.IsDir() {
-				if dirHasCandidates(full, exts) {
+				if dirHasCandidates(root, full, exts, filter) {
 					skippedDirs++
 				}
 				continue
 			}
-			if candidate(full, exts) {
+			if candidate(full, exts) && filter.keep(e.Name(), e.Info) {
 				paths = append(paths, full)
 			}
 		}
@@ -381,11 +975,18 @@ func collectLog(root string, recursive bool, exts []string, log *slog.Logger) (p
 			return nil
 		}
 		if d.IsDir() {
+			if rel, err := filepath.Rel(root, path); err == nil && path != root && filter.skipDir(filepath.ToSlash(rel)) {
+				return fs.SkipDir
+			}
 			return nil
 		}
-		if candidate(path, exts) {
-			paths = append(paths, path)
+		if !candidate(path, exts) {
+			return nil
 		}
+		if rel, err := filepath.Rel(root, path); err == nil && !filter.keep(filepath.ToSlash(rel), d.Info) {
+			return nil
+		}
+		paths = append(paths, path)
 		return nil
 	})
 	if walkErr != nil {
@@ -409,19 +1010,24 @@ func candidate(path string, exts []string) bool {
 	return doc.IsSupported(path, exts)
 }
 
-func dirHasCandidates(dir string, exts []string) bool {
+// dirHasCandidates reports whether -r would find anything in dir, a
+// subdirectory of root, that filter lets through. It walks no further than the
+// real walk would and leaves filter's counts alone.
+func dirHasCandidates(root, dir string, exts []string, filter *walkFilter) bool {
 	found := false
 	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return nil
 		}
+		rel, rerr := filepath.Rel(root, path)
+		rel = filepath.ToSlash(rel)
 		if d.IsDir() {
-			if path != dir && strings.HasPrefix(d.Name(), ".") {
+			if path != dir && strings.HasPrefix(d.Name(), ".") || rerr == nil && filter.dirDrops(rel) != "" {
 				return fs.SkipDir
 			}
 			return nil
 		}
-		if candidate(path, exts) {
+		if candidate(path, exts) && (rerr != nil || filter.drops(rel, d.Info) == "") {
 			found = true
 			return fs.SkipAll
 		}
@@ -433,19 +1039,42 @@ func dirHasCandidates(dir string, exts []string) bool {
 var modeBlurb = map[string]string{
 	modeReceipts: `Renames receipts to "MM-DD-YYYY - TOTAL - Vendor - Category.ext".`,
 	modeOrganize: `Renames documents to "YYYY-MM-DD - Descriptive Subject.ext", asking before it does.`,
-	modeUndo:     "Reverts the renames recorded in a directory's .rcptpixie-undo.jsonl.",
+	modeUndo:     "Reverts the renames recorded in a directory's .rcptpixie-undo.jsonl, all of them or one run's.",
+	modeCache:    "Removes every model answer remembered by earlier runs.",
+	modeWatch:    "Renames receipts as they arrive in a directory, journaled for undo, until interrupted.",
+	modeHistory:  "Lists the runs recorded in a directory's undo journal, newest last.",
+	modeVendors:  "Lists every spelling of a vendor in a directory's receipt names, with the name the -vendors table gives it.",
+	modeExplain:  "Reads one receipt without the cache and shows every step: how it was loaded, the text or images, each prompt and reply, the corrections and the name.",
+	modeDoctor:   "Checks the model server, the model and the image tools a run needs, and says how to fix what is missing.",
 }
 
 func commandUsage(w io.Writer, mode string, flags *flag.FlagSet) {
-	arg := "<file-or-directory>"
-	if mode == modeUndo {
+	arg := "<file-or-directory>..."
+	switch mode {
+	case modeUndo, modeHistory, modeVendors:
 		arg = "[directory]"
+	case modeCache:
+		arg = "clear"
+	case modeWatch:
+		arg = "<directory>"
+	case modeExplain:
+		arg = "<file>"
+	case modeDoctor:
+		arg = ""
+	}
+	n := 0
+	flags.VisitAll(func(*flag.Flag) { n++ })
+	if n > 0 {
+		arg = strings.TrimSpace("[flags] " + arg)
+	}
+	fmt.Fprintf(w, "Usage: rcptpixie %s %s\n\n%s\n", mode, arg, modeBlurb[mode])
+	if n > 0 {
+		fmt.Fprint(w, "\nFlags:\n")
+		flags.SetOutput(w)
+		flags.PrintDefaults()
+		flags.SetOutput(io.Discard)
 	}
-	fmt.Fprintf(w, "Usage: rcptpixie %s [flags] %s\n\n%s\n\nFlags:\n", mode, arg, modeBlurb[mode])
-	flags.SetOutput(w)
-	flags.PrintDefaults()
-	flags.SetOutput(io.Discard)
-	if mode != modeUndo {
+	if mode == modeReceipts || mode == modeOrganize {
 		fmt.Fprintf(w, "\nSubdirectories are skipped unless -r is given.\n")
 	}
 }
@@ -0,0 +1,126 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stdinList is the -files-from name for standard input.
+const stdinList = "-"
+
+// readFileList reads the paths -files-from names, one per line, or separated by
+// NUL bytes under -0, which is what `find -print0` writes and the only way to
+// pass a name with a newline in it. Blank entries are skipped.
+func readFileList(name string, stdin io.Reader, nul bool) ([]string, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if name == stdinList {
+		data, err = io.ReadAll(stdin)
+	} else {
+		data, err = os.ReadFile(expandHome(name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	sep := []byte("\n")
+	if nul {
+		sep = []byte{0}
+	}
+	var paths []string
+	for _, entry := range bytes.Split(data, sep) {
+		p := string(entry)
+		if !nul {
+			p = strings.TrimSuffix(p, "\r")
+		}
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// checkTarget refuses a path the run cannot use. The walk drops fifos, devices
+// and sockets in candidate(); an explicitly named one has to be refused here
+// or reading it blocks forever, with no timeout covering the open.
+func checkTarget(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() && !fi.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	}
+	return nil
+}
+
+// gather expands targets into the files to read: a directory into its
+// candidates that filter lets through, a file into itself. A file reached twice, whether named twice,
+// through a symlink, or named and inside a named directory, is read once,
+// under the first path that reached it.
+func gather(targets []string, recursive bool, exts []string, filter *walkFilter, log *slog.Logger) (files []string, skippedDirs int, err error) {
+	seen := make(map[string]bool)
+	first := func(path string) bool {
+		key := resolvedPath(path)
+		if seen[key] {
+			return false
+		}
+		seen[key] = true
+		return true
+	}
+	for _, t := range targets {
+		fi, err := os.Stat(t)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !fi.IsDir() {
+			if first(t) {
+				files = append(files, t)
+			}
+			continue
+		}
+		if !first(t) {
+			continue
+		}
+		found, skipped, err := collectLog(t, recursive, exts, filter, log)
+		if err != nil {
+			return nil, 0, fmt.Errorf("cannot read %s: %w", t, err)
+		}
+		skippedDirs += skipped
+		for _, path := range found {
+			if first(path) {
+				files = append(files, path)
+			}
+		}
+	}
+	return files, skippedDirs, nil
+}
+
+// resolvedPath is the one name every route to path shares: absolute, with its
+// symlinks followed.
+func resolvedPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if r, err := filepath.EvalSymlinks(abs); err == nil {
+		return r
+	}
+	return abs
+}
+
+// describeTargets names what a run was given, for the message that says it
+// held nothing to read.
+func describeTargets(targets []string) string {
+	if len(targets) == 0 {
+		return "the -files-from list"
+	}
+	return strings.Join(targets, ", ")
+}
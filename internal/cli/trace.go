@@ -0,0 +1,156 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/analyze"
+	"github.com/scottdensmore/rcptpixie/v2/internal/rename"
+)
+
+// tracer writes -trace-dir: a folder per run holding one JSON record for every
+// file read, and the page images each model call was sent beside it as files.
+// Files are numbered in the order they finish, which a parallel run does not
+// fix, so every record carries its path. A nil tracer writes nothing.
+type tracer struct {
+	dir string
+	n   atomic.Int64
+	log *slog.Logger
+}
+
+// traceRecord is one file's trace. Every text field is kept exactly as sent or
+// received, control characters and all, so that the calls can be replayed
+// against another model; nothing here is condensed the way an error message is.
+type traceRecord struct {
+	Path        string      `json:"path"`
+	Model       string      `json:"model"`
+	Via         string      `json:"via,omitempty"`
+	Tool        string      `json:"tool,omitempty"`
+	Pages       int         `json:"pages"`
+	Truncated   bool        `json:"truncated,omitempty"`
+	Images      []string    `json:"images,omitempty"` // file names beside the record
+	Cached      bool        `json:"cached,omitempty"`
+	LoadMS      int64       `json:"load_ms"`
+	AnalyzeMS   int64       `json:"analyze_ms"`
+	Calls       []traceCall `json:"calls"`
+	Corrections []string    `json:"corrections"`
+	Result      itemRecord  `json:"result"`
+}
+
+type traceCall struct {
+	System  string          `json:"system"`
+	Prompt  string          `json:"prompt"`
+	Images  int             `json:"images"`
+	Schema  json.RawMessage `json:"schema,omitempty"`
+	Options traceOptions    `json:"options"`
+	Reply   string          `json:"reply"`
+	Error   string          `json:"error,omitempty"`
+	TookMS  int64           `json:"took_ms"`
+}
+
+// traceOptions are named as ollama names them.
+type traceOptions struct {
+	Seed       int `json:"seed"`
+	NumCtx     int `json:"num_ctx"`
+	NumPredict int `json:"num_predict"`
+}
+
+// newTracer makes this run's folder in dir, or returns nil when dir is empty.
+// A trace holds whole documents, card digits and all, so like the cache it is
+// kept to the user: the folder is 0700 and every file in it 0600.
+func newTracer(dir string, log *slog.Logger) (*tracer, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	run := filepath.Join(dir, newRunID())
+	if err := os.MkdirAll(run, 0o700); err != nil {
+		return nil, err
+	}
+	log.Info("tracing every file", "dir", run)
+	return &tracer{dir: run, log: log}, nil
+}
+
+// write records what reading l came to. A trace that cannot be written is
+// worth a warning, never the file.
+func (t *tracer) write(model string, l loaded, trace *analyze.Trace, it rename.Item, f facts, took time.Duration) {
+	if t == nil {
+		return
+	}
+	base := fmt.Sprintf("%04d-%s", t.n.Add(1), filepath.Base(l.path))
+	rec := traceRecord{
+		Path:        l.path,
+		Model:       model,
+		Cached:      l.hit,
+		LoadMS:      l.took.Milliseconds(),
+		AnalyzeMS:   took.Milliseconds(),
+		Calls:       []traceCall{},
+		Corrections: trace.Corrections,
+		Result:      planRecord(it, "", f),
+	}
+	if rec.Corrections == nil {
+		rec.Corrections = []string{}
+	}
+	if d := l.d; d != nil {
+		rec.Via, rec.Tool, rec.Pages, rec.Truncated = d.Via, d.Tool, d.Pages, d.Truncated
+		for i, img := range d.Images {
+			name := fmt.Sprintf("%s-page-%d", base, i+1)
+			b, err := base64.StdEncoding.DecodeString(img)
+			if err == nil {
+				name += imageExt(b)
+				err = os.WriteFile(filepath.Join(t.dir, name), b, 0o600)
+			}
+			if err != nil {
+				t.log.Warn("could not write a traced page", "file", l.path, "err", err)
+				continue
+			}
+			rec.Images = append(rec.Images, name)
+		}
+	}
+	for _, c := range trace.Calls {
+		rec.Calls = append(rec.Calls, traceCall{
+			System:  c.System,
+			Prompt:  c.Prompt,
+			Images:  c.Images,
+			Schema:  c.Schema,
+			Options: traceOptions{Seed: c.Seed, NumCtx: c.Context, NumPredict: c.MaxTokens},
+			Reply:   c.Reply,
+			Error:   c.Err,
+			TookMS:  c.Took.Milliseconds(),
+		})
+	}
+
+	// Left unescaped, a prompt's < and & read as they were sent.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(rec)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(t.dir, base+".json"), buf.Bytes(), 0o600)
+	}
+	if err != nil {
+		t.log.Warn("could not write the trace", "file", l.path, "err", err)
+	}
+}
+
+// inside reports whether path is dir or somewhere below it.
+func inside(dir, path string) bool {
+	d, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	p, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(d, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -8,7 +8,9 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/scottdensmore/rcptpixie/v2/internal/rename"
 )
@@ -20,7 +22,11 @@ func runUndo(ctx context.Context, env Env, args []string) ExitCode {
 		return ExitInterrupted
 	}
 
-	var o opts
+	var (
+		o            opts
+		last         bool
+		runID, since string
+	)
 	flags := newFlagSet(modeUndo, env.Stderr)
 	flags.BoolVar(&o.DryRun, "dry-run", false, "print what would be reverted and change nothing")
 	flags.BoolVar(&o.DryRun, "n", false, "short for -dry-run")
@@ -30,6 +36,12 @@ func runUndo(ctx context.Context, env Env, args []string) ExitCode {
 	flags.BoolVar(&o.Verbose, "v", false, "short for -verbose")
 	flags.BoolVar(&o.Quiet, "quiet", false, "log errors only")
 	flags.BoolVar(&o.Quiet, "q", false, "short for -quiet")
+	flags.StringVar(&o.Format, "format", formatText, "stdout format: text, json or jsonl")
+	flags.BoolVar(&o.Recursive, "recursive", false, "also revert the journals in every subdirectory")
+	flags.BoolVar(&o.Recursive, "r", false, "short for -recursive")
+	flags.BoolVar(&last, "last", false, "revert only the most recent run")
+	flags.StringVar(&runID, "run", "", "revert only the run with this ID (see rcptpixie history)")
+	flags.StringVar(&since, "since", "", "revert only renames made at or after this time: 2006-01-02, 2006-01-02T15:04, RFC 3339, or a duration ago such as 2h")
 
 	rest, err := o.parseInto(flags, args)
 	if err != nil {
@@ -55,7 +67,7 @@ func runUndo(ctx context.Context, env Env, args []string) ExitCode {
 
 	log := newLogger(env.Stderr, levelFor(o.Verbose, o.Quiet))
 
-	entries, err := rename.Read(dir, log)
+	hist, err := readHistory(dir, o.Recursive, log)
 	if err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
 			fmt.Fprintf(env.Stderr, "rcptpixie undo: no rename history in %s\n", dir)
@@ -64,18 +76,73 @@ func runUndo(ctx context.Context, env Env, args []string) ExitCode {
 		fmt.Fprintf(env.Stderr, "rcptpixie undo: %v\n", err)
 		return ExitFailure
 	}
-	if len(entries) == 0 {
-		fmt.Fprintf(env.Stderr, "rcptpixie undo: no rename history in %s\n", dir)
+	match, err := selectEntries(hist, last, runID, since, time.Now())
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "rcptpixie undo: %v\n", err)
+		return ExitUsage
+	}
+	picked := filterHistory(hist, match)
+	total := 0
+	for _, h := range picked {
+		total += len(h.entries)
+	}
+	if total == 0 {
+		if match != nil {
+			fmt.Fprintf(env.Stderr, "rcptpixie undo: no renames in %s match\n", dir)
+		} else {
+			fmt.Fprintf(env.Stderr, "rcptpixie undo: no rename history in %s\n", dir)
+		}
 		return ExitUsage
 	}
 
-	renderUndo(env.Stdout, dir, entries)
+	structured := o.Format != formatText
+	show := func(w io.Writer) {
+		for i, h := range picked {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			renderUndo(w, h.dir, h.entries)
+		}
+	}
+	undoAll := func(dryRun bool) ([]undone, error) {
+		var out []undone
+		for _, h := range picked {
+			res, err := rename.UndoMatching(h.dir, dryRun, match, log)
+			if err != nil {
+				return out, fmt.Errorf("%s: %w", h.dir, err)
+			}
+			out = append(out, undone{dir: h.dir, res: res})
+		}
+		return out, nil
+	}
+
+	if !structured {
+		show(env.Stdout)
+	}
 	if o.DryRun {
+		if structured {
+			results, err := undoAll(true)
+			if err != nil {
+				fmt.Fprintf(env.Stderr, "rcptpixie undo: %v\n", err)
+				return ExitFailure
+			}
+			if err := writeUndoRecords(env.Stdout, o.Format, results, true); err != nil {
+				fmt.Fprintf(env.Stderr, "rcptpixie undo: writing %s output: %v\n", o.Format, err)
+				return ExitFailure
+			}
+		}
 		return ExitOK
 	}
 
 	if !o.Yes {
-		ok, err := confirm(env.Stdin, env.Stderr, env.IsTTY(env.Stdin), fmt.Sprintf("Undo %d renames? [y/N] ", len(entries)))
+		if structured && env.IsTTY(env.Stdin) {
+			show(env.Stderr)
+		}
+		question := fmt.Sprintf("Undo %d renames? [y/N] ", total)
+		if from := movedFrom(picked); len(from) > 0 {
+			question = fmt.Sprintf("Undo %d renames, moving files back from %s? [y/N] ", total, strings.Join(from, ", "))
+		}
+		ok, err := confirm(env.Stdin, env.Stderr, env.IsTTY(env.Stdin), question)
 		if err != nil {
 			if errors.Is(err, ErrNotATTY) {
 				fmt.Fprintln(env.Stderr, "rcptpixie undo: refusing to rename non-interactively without -y")
@@ -90,37 +157,83 @@ func runUndo(ctx context.Context, env Env, args []string) ExitCode {
 		}
 	}
 
-	res, err := rename.Undo(dir, false, log)
+	results, err := undoAll(false)
+	reverted, skipped := 0, 0
+	for _, u := range results {
+		for _, d := range u.res.Details {
+			fmt.Fprintf(env.Stderr, "  %s\n", d)
+		}
+		reverted += u.res.Reverted
+		skipped += u.res.Skipped
+	}
 	if err != nil {
 		fmt.Fprintf(env.Stderr, "rcptpixie undo: %v\n", err)
 		return ExitFailure
 	}
-	for _, d := range res.Details {
-		fmt.Fprintf(env.Stderr, "  %s\n", d)
+	fmt.Fprintf(env.Stderr, "\n%d reverted, %d skipped\n", reverted, skipped)
+	if structured {
+		if err := writeUndoRecords(env.Stdout, o.Format, results, false); err != nil {
+			fmt.Fprintf(env.Stderr, "rcptpixie undo: writing %s output: %v\n", o.Format, err)
+			return ExitFailure
+		}
 	}
-	fmt.Fprintf(env.Stderr, "\n%d reverted, %d skipped\n", res.Reverted, res.Skipped)
 
 	switch {
-	case res.Skipped == 0:
+	case skipped == 0:
 		return ExitOK
-	case res.Reverted > 0:
+	case reverted > 0:
 		return ExitPartial
 	}
 	return ExitFailure
 }
 
+// undone is what undo did in one directory.
+type undone struct {
+	dir string
+	res rename.UndoResult
+}
+
 // renderUndo prints the journal backwards, which is the order Undo reverts in.
 func renderUndo(w io.Writer, dir string, entries []rename.Entry) {
 	fmt.Fprintf(w, "UNDO — %d renames in %s\n\n", len(entries), dir)
+	// A file moved out of dir is shown by its full path, since its base name
+	// alone would suggest it is still here.
+	names := make([]string, len(entries))
 	width := 0
-	for _, e := range entries {
-		if n := len([]rune(e.New)); n > width {
+	for i, e := range entries {
+		names[i] = e.New
+		if e.Dir != "" {
+			names[i] = e.Where(dir)
+		}
+		if n := len([]rune(names[i])); n > width {
 			width = n
 		}
 	}
 	for i := len(entries) - 1; i >= 0; i-- {
-		fmt.Fprintf(w, "  %s  ->  %s\n", padRunes(entries[i].New, width), entries[i].Old)
+		e := entries[i]
+		if e.Dir != "" && !e.WrittenIn(dir) {
+			fmt.Fprintf(w, "  %s  ->  %s  (left alone: not written here)\n", padRunes(names[i], width), e.Old)
+			continue
+		}
+		fmt.Fprintf(w, "  %s  ->  %s\n", padRunes(names[i], width), e.Old)
+	}
+}
+
+// movedFrom lists the directories outside their journal's own that undo would
+// move files back from, so the question names every place it reaches into.
+func movedFrom(picked []journal) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, h := range picked {
+		for _, e := range h.entries {
+			if e.Dir != "" && e.WrittenIn(h.dir) && !seen[e.Dir] {
+				seen[e.Dir] = true
+				dirs = append(dirs, e.Dir)
+			}
+		}
 	}
+	sort.Strings(dirs)
+	return dirs
 }
 
 func padRunes(s string, width int) string {
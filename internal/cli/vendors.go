@@ -0,0 +1,172 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/analyze"
+)
+
+// readVendors loads the -vendors table. A missing file is an empty table when
+// there is something to learn into it, and no table at all otherwise.
+func readVendors(path string, learn bool) (*analyze.Vendors, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && learn:
+		return &analyze.Vendors{Learn: true}, nil
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	defer f.Close()
+	v, err := analyze.ParseVendors(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	v.Learn = learn
+	return v, nil
+}
+
+// saveVendors appends what -learn-vendors picked up to the table, so a hand
+// edit made while the run was going is kept.
+func saveVendors(path string, v *analyze.Vendors, log *slog.Logger) {
+	if !v.HasLearned() {
+		return
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644); err == nil {
+			err = v.WriteLearned(f)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	if err != nil {
+		log.Warn("could not save the vendors learned", "file", path, "err", err)
+	}
+}
+
+// vendorRecord is one spelling of a vendor in vendors' output. Key is what the
+// spellings of one vendor share, and Name is what the -vendors table makes of
+// it, if anything.
+type vendorRecord struct {
+	Vendor string `json:"vendor"`
+	Files  int    `json:"files"`
+	Key    string `json:"key"`
+	Name   string `json:"name,omitempty"`
+}
+
+// runVendors lists the vendors in the names of a folder's renamed receipts, the
+// spellings of one vendor side by side, which is most of the work of writing
+// the -vendors table.
+func runVendors(ctx context.Context, env Env, args []string) ExitCode {
+	if ctx.Err() != nil {
+		return ExitInterrupted
+	}
+
+	var o opts
+	o.getenv = env.Getenv
+	flags := newFlagSet(modeVendors, env.Stderr)
+	flags.BoolVar(&o.Recursive, "recursive", false, "include every subdirectory")
+	flags.BoolVar(&o.Recursive, "r", false, "short for -recursive")
+	flags.StringVar(&o.Format, "format", formatText, "stdout format: text, json or jsonl")
+	flags.StringVar(&o.Vendors, "vendors", userConfigFile(env.Getenv, "vendors"), "vendor alias table to show each vendor's name from")
+	rest, err := o.parseInto(flags, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			commandUsage(env.Stdout, modeVendors, flags)
+			return ExitOK
+		}
+		fmt.Fprintf(env.Stderr, "rcptpixie vendors: %v\n\n", err)
+		commandUsage(env.Stderr, modeVendors, flags)
+		return ExitUsage
+	}
+	dir := "."
+	switch len(rest) {
+	case 0:
+	case 1:
+		dir = rest[0]
+	default:
+		fmt.Fprintf(env.Stderr, "rcptpixie vendors: expected at most one directory, got %d\n\n", len(rest))
+		commandUsage(env.Stderr, modeVendors, flags)
+		return ExitUsage
+	}
+
+	files, _, err := collectLog(dir, o.Recursive, nil, nil, newLogger(env.Stderr, levelFor(false, false)))
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "rcptpixie vendors: cannot read %s: %v\n", dir, err)
+		return ExitUsage
+	}
+	recs := vendorsIn(files, o.vendors)
+
+	if o.Format != formatText {
+		e := newEmitter(env.Stdout, o.Format)
+		for _, r := range recs {
+			if err := e.add(r); err != nil {
+				fmt.Fprintf(env.Stderr, "rcptpixie vendors: writing %s output: %v\n", o.Format, err)
+				return ExitFailure
+			}
+		}
+		if err := e.close(); err != nil {
+			fmt.Fprintf(env.Stderr, "rcptpixie vendors: writing %s output: %v\n", o.Format, err)
+			return ExitFailure
+		}
+		return ExitOK
+	}
+	if len(recs) == 0 {
+		fmt.Fprintf(env.Stderr, "rcptpixie vendors: no renamed receipts in %s\n", dir)
+		return ExitOK
+	}
+	renderVendors(env.Stdout, recs)
+	return ExitOK
+}
+
+// vendorsIn counts each vendor spelling in files' names, sorted by key so the
+// spellings of one vendor are listed together.
+func vendorsIn(files []string, table *analyze.Vendors) []vendorRecord {
+	counts := make(map[string]int)
+	for _, path := range files {
+		if v, ok := analyze.VendorFromName(filepath.Base(path)); ok {
+			counts[v]++
+		}
+	}
+	recs := make([]vendorRecord, 0, len(counts))
+	for v, n := range counts {
+		r := vendorRecord{Vendor: v, Files: n, Key: analyze.VendorKey(v)}
+		if name := table.Canonical(v); name != v {
+			r.Name = name
+		}
+		recs = append(recs, r)
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		if recs[i].Key != recs[j].Key {
+			return recs[i].Key < recs[j].Key
+		}
+		return recs[i].Vendor < recs[j].Vendor
+	})
+	return recs
+}
+
+func renderVendors(w io.Writer, recs []vendorRecord) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILES\tVENDOR\tNAME")
+	for _, r := range recs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", r.Files, r.Vendor, r.Name)
+	}
+	tw.Flush()
+}
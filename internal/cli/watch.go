@@ -0,0 +1,329 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/doc"
+	"github.com/scottdensmore/rcptpixie/v2/internal/llm"
+	"github.com/scottdensmore/rcptpixie/v2/internal/rename"
+)
+
+const (
+	defaultInterval = 2 * time.Second
+	defaultSettle   = 5 * time.Second
+
+	// maxBackoff caps the wait between attempts to reach a server that has gone
+	// away: long enough not to spam the log overnight, short enough that a
+	// restarted ollama is picked up while someone is still looking.
+	maxBackoff = time.Minute
+)
+
+// runWatch polls a directory and renames receipts as they arrive. Polling
+// rather than filesystem notifications keeps it dependency-free and behaving
+// the same on every platform and on network shares, where notifications are
+// unreliable; a receipt waits a few seconds either way while it settles.
+func runWatch(ctx context.Context, env Env, args []string) ExitCode {
+	o := &opts{Exts: defaultReceiptExts}
+	flags := newFlagSet(modeWatch, env.Stderr)
+	o.register(flags, env.Getenv)
+	o.registerFiling(flags)
+	o.registerWatch(flags)
+
+	rest, err := o.parseInto(flags, args)
+	if err == nil {
+		switch {
+		case o.Format == formatJSON:
+			err = errors.New("-format json is one array written at exit; use jsonl to stream")
+		case o.Interval <= 0:
+			err = errors.New("-interval must be greater than zero")
+		case o.Settle < 0:
+			err = errors.New("-settle cannot be negative")
+		case o.Out != "" && o.Dest != "":
+			err = errors.New("-out and -dest cannot be used together")
+		}
+	}
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			commandUsage(env.Stdout, modeWatch, flags)
+			return ExitOK
+		}
+		fmt.Fprintf(env.Stderr, "rcptpixie watch: %v\n\n", err)
+		commandUsage(env.Stderr, modeWatch, flags)
+		return ExitUsage
+	}
+	if len(rest) != 1 {
+		fmt.Fprintf(env.Stderr, "rcptpixie watch: expected exactly one directory, got %d\n\n", len(rest))
+		commandUsage(env.Stderr, modeWatch, flags)
+		return ExitUsage
+	}
+	root := rest[0]
+	if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+		if err == nil {
+			err = errors.New("not a directory")
+		}
+		fmt.Fprintf(env.Stderr, "rcptpixie watch: cannot use %s: %v\n", root, err)
+		return ExitUsage
+	}
+	// The traced pages would arrive as new receipts, whose traces would too.
+	if o.TraceDir != "" && inside(root, expandHome(o.TraceDir)) {
+		fmt.Fprintf(env.Stderr, "rcptpixie watch: -trace-dir cannot be inside %s\n", root)
+		return ExitUsage
+	}
+
+	log := newLogger(env.Stderr, levelFor(o.Verbose, o.Quiet))
+	client, err := o.newBackend(log)
+	if err != nil {
+		fmt.Fprintf(env.Stderr, "rcptpixie: %v\n", err)
+		return ExitFailure
+	}
+	// A missing model will not fix itself, so that still ends the command. An
+	// unreachable server is only logged: a watcher started at login routinely
+	// comes up before the model server does.
+	for _, model := range []string{o.Model, o.FallbackModel} {
+		if model == "" {
+			continue
+		}
+		if err := client.Preflight(ctx, model); err != nil {
+			if errors.Is(err, llm.ErrModelMissing) {
+				fmt.Fprintf(env.Stderr, "rcptpixie: %v\n", err)
+				return ExitFailure
+			}
+			log.Warn("the model server is not reachable yet; files will wait for it", "err", err)
+			break
+		}
+	}
+
+	w := &watcher{
+		env:    env,
+		o:      o,
+		root:   root,
+		out:    o.Out,
+		settle: o.Settle,
+		client: client,
+		log:    log,
+		exts:   splitExts(o.Exts),
+		rd: &reader{
+			an:      o.analyzer(client, o.Model, log),
+			raster:  doc.Detect(log),
+			mode:    modeReceipts,
+			naming:  o.naming,
+			dest:    o.destination,
+			trust:   o.minConfidence,
+			review:  o.Review,
+			vendors: o.vendors,
+			log:     log,
+		},
+		seen: make(map[string]sighting),
+		done: make(map[string]sighting),
+	}
+	if o.FallbackModel != "" {
+		w.rd.fallback = o.analyzer(client, o.FallbackModel, log)
+	}
+	if !o.NoCache {
+		w.rd.cache = openCache(env, log)
+	}
+	if w.rd.traces, err = newTracer(expandHome(o.TraceDir), log); err != nil {
+		fmt.Fprintf(env.Stderr, "rcptpixie watch: cannot write -trace-dir: %v\n", err)
+		return ExitUsage
+	}
+	if !o.Quiet {
+		fmt.Fprintf(env.Stderr, "Watching %s for receipts; Ctrl-C to stop.\n", root)
+	}
+
+	var backoff time.Duration
+	for {
+		wait := o.Interval
+		if ready := w.poll(time.Now()); len(ready) > 0 {
+			if w.process(ctx, ready) {
+				backoff = min(max(2*backoff, o.Interval), maxBackoff)
+				wait = backoff
+				log.Warn("the model server is unavailable; will retry", "in", backoff)
+			} else {
+				backoff = 0
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ExitInterrupted
+		case <-time.After(wait):
+		}
+	}
+}
+
+// sighting is a file's size and modification time when it was last looked at,
+// and since when they have held.
+type sighting struct {
+	size  int64
+	mod   time.Time
+	since time.Time
+}
+
+func (s sighting) same(o sighting) bool { return s.size == o.size && s.mod.Equal(o.mod) }
+
+type watcher struct {
+	env       Env
+	o         *opts
+	root, out string
+	settle    time.Duration
+	client    llm.Backend
+	rd        *reader
+	log       *slog.Logger
+	exts      []string
+	seen      map[string]sighting // waiting to settle
+	done      map[string]sighting // handled, as it was when handled
+}
+
+// poll returns the files that have stopped changing. A scanner writes a page at
+// a time and a sync client may hold a half-downloaded file under its final
+// name; reading either early would hand the model a truncated document.
+func (w *watcher) poll(at time.Time) []string {
+	files, _, err := collectLog(w.root, w.o.Recursive, w.exts, w.o.filter, w.log)
+	if err != nil {
+		w.log.Warn("cannot read the watched directory", "dir", w.root, "err", err)
+		return nil
+	}
+	present := make(map[string]bool, len(files))
+	var ready []string
+	for _, path := range files {
+		present[path] = true
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		cur := sighting{size: fi.Size(), mod: fi.ModTime(), since: at}
+		if d, ok := w.done[path]; ok && d.same(cur) {
+			continue
+		}
+		prev, ok := w.seen[path]
+		if !ok || !prev.same(cur) {
+			w.seen[path] = cur
+			continue
+		}
+		if at.Sub(prev.since) >= w.settle {
+			ready = append(ready, path)
+		}
+	}
+	for path := range w.seen {
+		if !present[path] {
+			delete(w.seen, path)
+		}
+	}
+	for path := range w.done {
+		if !present[path] {
+			delete(w.done, path)
+		}
+	}
+	return ready
+}
+
+// process runs one batch through the same plan and apply steps as receipts
+// mode. It reports whether the batch hit an unavailable server, in which case
+// the files it could not read stay pending for the next attempt rather than
+// being written off as failures.
+func (w *watcher) process(ctx context.Context, files []string) (unavailable bool) {
+	if err := w.client.Preflight(ctx, w.o.Model); err != nil {
+		w.log.Debug("preflight failed", "err", err)
+		return ctx.Err() == nil
+	}
+	// Checked on its own, so a host it failed on gets back in; without it the
+	// batch still goes ahead on the first model's answers.
+	if fb := w.o.FallbackModel; fb != "" {
+		if err := w.client.Preflight(ctx, fb); err != nil {
+			w.log.Debug("preflight of the fallback model failed", "err", err)
+		}
+	}
+
+	all, found := w.rd.readAll(ctx, files, w.o.Jobs, w.o.Parallel)
+	w.rd.escalate(ctx, all, found, w.o.Jobs, w.o.Parallel)
+	if ctx.Err() != nil {
+		return false
+	}
+	var items []rename.Item
+	for _, it := range all {
+		if it.Action == rename.ActionError && transient(it.Err) {
+			unavailable = true
+			w.log.Debug("will retry", "file", it.OldPath, "err", it.Err)
+			delete(found, it.OldPath)
+			continue
+		}
+		items = append(items, it)
+	}
+	if len(items) == 0 {
+		return unavailable
+	}
+
+	destOf := w.rd.destinations(items, found)
+	if w.out != "" {
+		destOf = func(rename.Item) string { return w.out }
+	}
+	plans := groupByDir(items, w.rd.reviewing(destOf, found))
+	for _, p := range plans {
+		if err := p.Resolve(); err != nil {
+			w.log.Warn("cannot plan renames", "dir", p.Dir, "err", err)
+			return unavailable
+		}
+	}
+
+	structured := w.o.Format != formatText
+	if !structured && w.o.DryRun {
+		renderPlans(w.env.Stdout, plans)
+	}
+	moved := make(map[string]string)
+	if !w.o.DryRun {
+		// Each batch is its own run, so `undo -last` takes back the latest
+		// arrivals and not everything since the watcher started.
+		run := newRun(modeWatch, w.o.Model)
+		for _, p := range plans {
+			applyPlan(ctx, p, run, w.log, func(oldPath, newPath string) {
+				moved[oldPath] = newPath
+				if !structured {
+					fmt.Fprintf(w.env.Stdout, "Renamed: %s -> %s\n", oldPath, newPath)
+				}
+			})
+		}
+		saveVendors(expandHome(w.o.Vendors), w.rd.vendors, w.log)
+	}
+	if structured {
+		if err := writeRecords(w.env.Stdout, w.o.Format, plans, found, moved, w.o.DryRun); err != nil {
+			w.log.Warn("cannot write output", "format", w.o.Format, "err", err)
+		}
+	}
+
+	for _, p := range plans {
+		for _, it := range p.Items {
+			if it.Action == rename.ActionError {
+				w.log.Warn("could not rename", "file", it.OldPath, "err", it.Err)
+			}
+			w.handled(it.OldPath)
+			if newPath, ok := moved[it.OldPath]; ok {
+				w.handled(newPath)
+			}
+		}
+	}
+	return unavailable
+}
+
+// handled records path as finished in its current state, so it is not read
+// again unless it changes. That covers a renamed file still inside the watched
+// tree, and a failure: retrying the same bytes every two seconds would only
+// fail again.
+func (w *watcher) handled(path string) {
+	delete(w.seen, path)
+	if fi, err := os.Stat(path); err == nil {
+		w.done[path] = sighting{size: fi.Size(), mod: fi.ModTime()}
+	}
+}
+
+// transient reports whether err says the server is down or overloaded rather
+// than anything about the document. A plain 500 is not: a file that crashes
+// the model would crash it again on every retry, holding up all that arrive
+// after it.
+func transient(err error) bool {
+	return errors.Is(err, llm.ErrUnavailable)
+}
@@ -25,14 +25,28 @@ const (
 )
 
 type Doc struct {
-	Path    string
-	Kind    Kind
-	Text    string   // KindText, already truncated
-	Images  []string // KindImages: bare StdEncoding base64, no data: prefix
-	Pages   int
-	ModTime time.Time
+	Path      string
+	Kind      Kind
+	Text      string   // KindText, already truncated
+	Truncated bool     // Text is shorter than what the file holds
+	Images    []string // KindImages: bare StdEncoding base64, no data: prefix
+	Pages     int
+	ModTime   time.Time
+
+	// Via is how the content was got: ViaPDFText, ViaPlainText, ViaRasterizer,
+	// ViaConverter or ViaImage. Tool names the rasterizer or converter.
+	Via  string
+	Tool string
 }
 
+const (
+	ViaPDFText    = "pdf text"
+	ViaPlainText  = "plain text"
+	ViaRasterizer = "rasterizer"
+	ViaConverter  = "converter"
+	ViaImage      = "direct image"
+)
+
 const (
 	MaxTextChars  = 12000   // ~3-4k tokens, comfortably inside num_ctx 8192
 	MaxImageBytes = 8 << 20 // guard against posting a 40MB scan
@@ -87,8 +101,9 @@ func Load(ctx context.Context, path string, r Rasterizer, log *slog.Logger) (*Do
 		}
 		d.Kind = KindText
 		d.Pages = 1
-		d.Text, _ = Truncate(string(b), MaxTextChars)
-		log.Debug("loaded", "path", path, "via", "plain text", "chars", len(d.Text))
+		d.Via = ViaPlainText
+		d.Text, d.Truncated = Truncate(string(b), MaxTextChars)
+		log.Debug("loaded", "path", path, "via", d.Via, "chars", len(d.Text))
 		return d, nil
 	}
 	return nil, fmt.Errorf("%w: %s", ErrUnsupported, ext)
@@ -110,8 +125,9 @@ func loadPDF(ctx context.Context, d *Doc, r Rasterizer, log *slog.Logger) (*Doc,
 	if usableText(text) {
 		d.Kind = KindText
 		d.Pages = pages
-		d.Text, _ = Truncate(text, MaxTextChars)
-		log.Debug("loaded", "path", d.Path, "via", "pdf text", "pages", pages, "chars", len(d.Text))
+		d.Via = ViaPDFText
+		d.Text, d.Truncated = Truncate(text, MaxTextChars)
+		log.Debug("loaded", "path", d.Path, "via", d.Via, "pages", pages, "chars", len(d.Text))
 		return d, nil
 	}
 
@@ -138,7 +154,8 @@ func renderInto(ctx context.Context, d *Doc, r Rasterizer, log *slog.Logger) err
 	}
 	d.Kind = KindImages
 	d.Pages = len(d.Images)
-	log.Debug("loaded", "path", d.Path, "via", "rasterizer", "tool", r.Name(), "pages", d.Pages)
+	d.Via, d.Tool = ViaRasterizer, r.Name()
+	log.Debug("loaded", "path", d.Path, "via", d.Via, "tool", d.Tool, "pages", d.Pages)
 	return nil
 }
 
@@ -146,7 +163,6 @@ func loadImage(ctx context.Context, d *Doc, ext string, size int64, r Rasterizer
 	var (
 		b   []byte
 		err error
-		via string
 	)
 	switch ext {
 	case ".heic", ".heif", ".webp":
@@ -154,7 +170,7 @@ func loadImage(ctx context.Context, d *Doc, ext string, size int64, r Rasterizer
 		if b, err = r.Convert(ctx, d.Path); err != nil {
 			return nil, err
 		}
-		via = r.Name()
+		d.Via, d.Tool = ViaConverter, r.Name()
 	default:
 		if size > MaxImageBytes {
 			return nil, fmt.Errorf("%s is %d bytes, over the %d byte limit", d.Path, size, MaxImageBytes)
@@ -162,7 +178,7 @@ func loadImage(ctx context.Context, d *Doc, ext string, size int64, r Rasterizer
 		if b, err = os.ReadFile(d.Path); err != nil {
 			return nil, err
 		}
-		via = "direct"
+		d.Via = ViaImage
 	}
 	if len(b) > MaxImageBytes {
 		return nil, fmt.Errorf("%s is %d bytes, over the %d byte limit", d.Path, len(b), MaxImageBytes)
@@ -171,6 +187,10 @@ func loadImage(ctx context.Context, d *Doc, ext string, size int64, r Rasterizer
 	d.Kind = KindImages
 	d.Pages = 1
 	d.Images = []string{base64.StdEncoding.EncodeToString(b)}
+	via := d.Via
+	if d.Tool != "" {
+		via = d.Tool
+	}
 	log.Debug("loaded", "path", d.Path, "via", via, "bytes", len(b))
 	return d, nil
 }
@@ -314,6 +314,9 @@ func TestLoadTextPDFStaysText(t *testing.T) {
 	if d.ModTime.IsZero() {
 		t.Error("ModTime is zero")
 	}
+	if d.Via != doc.ViaPDFText || d.Tool != "" || d.Truncated {
+		t.Errorf("Via = %q, Tool = %q, Truncated = %v; want pdf text, no tool, whole", d.Via, d.Tool, d.Truncated)
+	}
 }
 
 func scannedPDF(t *testing.T) string {
@@ -396,6 +399,9 @@ func assertVision(t *testing.T, path string, r doc.Rasterizer) {
 	if len(d.Images) == 0 || d.Pages != len(d.Images) {
 		t.Fatalf("Images = %d, Pages = %d", len(d.Images), d.Pages)
 	}
+	if d.Via != doc.ViaRasterizer || d.Tool != r.Name() {
+		t.Errorf("Via = %q, Tool = %q; want the rasterizer, %s", d.Via, d.Tool, r.Name())
+	}
 	for i, img := range d.Images {
 		if strings.HasPrefix(img, "data:") {
 			t.Fatalf("image %d carries a data: prefix", i)
@@ -475,6 +481,9 @@ func TestLoadImageIsBareBase64(t *testing.T) {
 		if len(d.Images) != 1 || d.Pages != 1 {
 			t.Fatalf("%s Images = %d, Pages = %d, want 1 and 1", path, len(d.Images), d.Pages)
 		}
+		if d.Via != doc.ViaImage {
+			t.Errorf("%s Via = %q, want %q", path, d.Via, doc.ViaImage)
+		}
 		if strings.HasPrefix(d.Images[0], "data:") {
 			t.Errorf("%s carries a data: prefix", path)
 		}
@@ -0,0 +1,87 @@
+package doc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// ErrNoEncoder is SampleHEIC finding no tool to write HEIC with, which says
+// nothing about whether the converter can read it.
+var ErrNoEncoder = errors.New("no HEIC encoder found")
+
+// SampleHEIC writes a HEIC image to dst with the encoder that goes with r's
+// converter, and reports which tool made it. It is how doctor tests a
+// converter when its build carries no HEIC of its own: ImageMagick and sips
+// write the format they read, and heif-convert comes with heif-enc. A
+// converter that cannot decode HEIC usually cannot encode it either, so a
+// failure here is worth showing too.
+func SampleHEIC(ctx context.Context, r Rasterizer, dst string) (string, error) {
+	e, ok := r.(*external)
+	if !ok || e.convert == "" {
+		return "", noConverterError()
+	}
+	dir, err := os.MkdirTemp("", "rcptpixie-heic-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "sample.png")
+	if err := writeSamplePNG(src); err != nil {
+		return "", err
+	}
+
+	tool := e.convert
+	var args []string
+	switch e.convert {
+	case "sips":
+		args = []string{"-s", "format", "heic", src, "--out", toolPath(dst)}
+	case "magick", "convert":
+		args = []string{src, toolPath(dst)}
+	case "heif-convert":
+		tool = "heif-enc"
+		if _, err := exec.LookPath(tool); err != nil {
+			return "", fmt.Errorf("%w: heif-enc, which writes HEIC for heif-convert, is not on PATH", ErrNoEncoder)
+		}
+		args = []string{"-q", "50", "-o", toolPath(dst), src}
+	default:
+		return "", noConverterError()
+	}
+	if stderr, err := e.run(ctx, tool, args); err != nil {
+		return "", fmt.Errorf("%s could not write HEIC: %v%s", tool, err, stderrTail(stderr))
+	}
+	if fi, err := os.Stat(dst); err != nil || fi.Size() == 0 {
+		return "", fmt.Errorf("%s wrote no HEIC image", tool)
+	}
+	return tool, nil
+}
+
+// writeSamplePNG draws a page of ruled lines, busy enough that its conversion
+// back clears minImageBytes and is not taken for a blank page.
+func writeSamplePNG(path string) error {
+	img := image.NewGray(image.Rect(0, 0, 320, 480))
+	for y := 0; y < 480; y++ {
+		for x := 0; x < 320; x++ {
+			c := uint8(0xff)
+			if y%16 < 3 && (x*7+y)%40 < 30 {
+				c = uint8(x ^ y)
+			}
+			img.SetGray(x, y, color.Gray{Y: c})
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
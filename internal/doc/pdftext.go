@@ -128,8 +128,9 @@ func orDiscard(log *slog.Logger) *slog.Logger {
 	return slog.New(slog.NewTextHandler(io.Discard, nil))
 }
 
-// stdoutMu serialises the os.Stdout swap in withoutStdout. Files are processed
-// sequentially, so this only ever contends between parallel tests.
+// stdoutMu serialises the os.Stdout swap in withoutStdout. Under -jobs several
+// PDFs are parsed at once; the lock makes them take turns at the parse itself,
+// which is cheap next to rasterizing, so nothing restores another's stdout.
 var stdoutMu sync.Mutex
 
 // withoutStdout runs fn with the process stdout pointed at the null device.
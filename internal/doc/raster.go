@@ -111,6 +111,16 @@ func (e *external) Name() string {
 	return "none"
 }
 
+// Tools reports the tools r runs to render a PDF and to convert an image, ""
+// for each one that was not found. A Rasterizer Detect did not make reports
+// only its Name.
+func Tools(r Rasterizer) (render, convert string) {
+	if e, ok := r.(*external); ok {
+		return e.render, e.convert
+	}
+	return r.Name(), ""
+}
+
 func (e *external) Render(ctx context.Context, pdfPath string, pages int) ([][]byte, error) {
 	if e.render == "" {
 		return nil, noRasterizerError()
@@ -340,15 +350,16 @@ func blankImage(b []byte) bool {
 
 func noRasterizerError() error {
 	return fmt.Errorf("%w: PDF has no text layer and no rasterizer was found.\n  Install poppler: %s\n  (Ghostscript also works.)",
-		ErrNoRasterizer, popplerHint())
+		ErrNoRasterizer, PopplerHint())
 }
 
 func noConverterError() error {
 	return fmt.Errorf("%w: HEIC cannot be decoded without a converter.\n  %s",
-		ErrNoConverter, converterHint())
+		ErrNoConverter, ConverterHint())
 }
 
-func popplerHint() string {
+// PopplerHint is how to install a PDF rasterizer on this platform.
+func PopplerHint() string {
 	switch runtime.GOOS {
 	case "darwin":
 		return "brew install poppler"
@@ -358,7 +369,8 @@ func popplerHint() string {
 	return "sudo apt install poppler-utils"
 }
 
-func converterHint() string {
+// ConverterHint is how to install a HEIC converter on this platform.
+func ConverterHint() string {
 	if runtime.GOOS == "darwin" {
 		return "macOS has sips built in; if it is missing: brew install imagemagick"
 	}
@@ -2,6 +2,7 @@ package doc
 
 import (
 	"context"
+	"errors"
 	"image"
 	"image/color"
 	"image/png"
@@ -164,6 +165,32 @@ func TestConvertLeadingDashPath(t *testing.T) {
 	}
 }
 
+// TestSampleHEICRoundTrip makes the sample doctor converts when its build
+// carries none, and converts it back with the same tool.
+func TestSampleHEICRoundTrip(t *testing.T) {
+	stubTools(t)
+
+	e := &external{convert: "magick", log: orDiscard(nil)}
+	dst := filepath.Join(t.TempDir(), "-receipt.heic")
+	by, err := SampleHEIC(context.Background(), e, dst)
+	if err != nil || by != "magick" {
+		t.Fatalf("SampleHEIC = %q, %v", by, err)
+	}
+	if _, err := e.Convert(context.Background(), dst); err != nil {
+		t.Errorf("Convert of the sample: %v", err)
+	}
+
+	// heif-convert only reads; without heif-enc there is nothing to write with.
+	t.Setenv("PATH", t.TempDir())
+	e = &external{convert: "heif-convert", log: orDiscard(nil)}
+	if _, err := SampleHEIC(context.Background(), e, dst); !errors.Is(err, ErrNoEncoder) {
+		t.Errorf("SampleHEIC with no heif-enc = %v, want ErrNoEncoder", err)
+	}
+	if _, err := SampleHEIC(context.Background(), unavailable(), dst); !errors.Is(err, ErrNoConverter) {
+		t.Errorf("SampleHEIC with no converter = %v, want ErrNoConverter", err)
+	}
+}
+
 // TestRenderLeadingDashRealGhostscript runs the fix against the binary that
 // actually mis-parses the name, when it is installed.
 func TestRenderLeadingDashRealGhostscript(t *testing.T) {
@@ -0,0 +1,55 @@
+// Package llm is the seam between the analyzer and the server that runs the
+// model. It holds only what every backend shares: the request the analyzer
+// builds, and the two failures a caller has to tell apart from the rest.
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Backend is a model server. Each implementation maps Request onto its own
+// wire format and reports its failures with errors that match ErrUnavailable
+// or ErrModelMissing where they apply.
+type Backend interface {
+	// Complete returns the model's reply to req as text.
+	Complete(ctx context.Context, req Request) (string, error)
+	// Preflight reports, quickly, whether the server is up and has model.
+	Preflight(ctx context.Context, model string) error
+}
+
+// Request is one deterministic, schema-constrained completion.
+type Request struct {
+	Model  string
+	System string
+	Prompt string
+	Images []string        // bare StdEncoding base64, no data: prefix
+	Schema json.RawMessage // JSON schema the reply must satisfy
+
+	Seed      int
+	MaxTokens int
+	// Context is the context window the prompt needs. A backend that sizes it
+	// per request uses it; one whose window is fixed at startup ignores it.
+	Context int
+}
+
+var (
+	// ErrUnavailable matches a failure of the server rather than of the request:
+	// it is down, unreachable or overloaded, and may recover.
+	ErrUnavailable = errors.New("model server unavailable")
+	// ErrModelMissing matches a server that is up but does not have the model.
+	ErrModelMissing = errors.New("model not installed")
+)
+
+// UnavailableStatus reports whether an HTTP status says the server, or a proxy
+// in front of it, cannot take requests just now. A plain 500 is left out: a
+// model that chokes on one document answers it for that document every time.
+func UnavailableStatus(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
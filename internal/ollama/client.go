@@ -12,8 +12,13 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/llm"
 )
 
 const (
@@ -25,18 +30,63 @@ const (
 	defaultTimeout   = 5 * time.Minute
 	preflightTimeout = 5 * time.Second
 	maxErrorBody     = 500
+
+	// maxServerErrors is how many 500s in a row take a host out. One is more
+	// likely a document the runner could not cope with than a host gone bad.
+	maxServerErrors = 3
 )
 
+// Client talks to one or more ollama servers. With several, each generate
+// request goes to the least busy server that is up for its model, and a server
+// that fails a model is left out for that model until the next Preflight of it.
+// Models are tracked apart because hosts need not hold the same ones.
 type Client struct {
-	base *url.URL
-	hc   *http.Client
-	log  *slog.Logger
+	servers []*server
+	hc      *http.Client
+	log     *slog.Logger
+	next    atomic.Uint32 // rotates the tie-break between equally busy servers
+}
+
+// server is one ollama host and what this run has learned about it.
+type server struct {
+	base  *url.URL
+	busy  atomic.Int32 // generate requests in flight
+	fails atomic.Int32 // 500s in a row
+
+	mu   sync.Mutex
+	down map[string]bool // by normalizeModel
 }
 
-// New resolves host into an absolute base URL, accepting every form ollama's own
-// envconfig does: a bare "host" or "host:port" is assumed to be http, ":port"
-// alone means localhost, and a missing port becomes 11434 (443 under https).
+func (s *server) isDown(model string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.down[normalizeModel(model)]
+}
+
+// setDown records whether s is down for model and reports whether it was.
+func (s *server) setDown(model string, down bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down == nil {
+		s.down = make(map[string]bool)
+	}
+	m := normalizeModel(model)
+	was := s.down[m]
+	s.down[m] = down
+	return was
+}
+
+// New is NewHosts with a single host.
 func New(host string, timeout time.Duration, log *slog.Logger) (*Client, error) {
+	return NewHosts([]string{host}, timeout, log)
+}
+
+// NewHosts resolves every host into an absolute base URL, accepting every form
+// ollama's own envconfig does: a bare "host" or "host:port" is assumed to be
+// http, ":port" alone means localhost, and a missing port becomes 11434 (443
+// under https). Blank entries are dropped, a host given twice is used once, and
+// no hosts at all means the default.
+func NewHosts(hosts []string, timeout time.Duration, log *slog.Logger) (*Client, error) {
 	if log == nil {
 		log = slog.New(slog.NewTextHandler(io.Discard, nil))
 	}
@@ -44,10 +94,33 @@ func New(host string, timeout time.Duration, log *slog.Logger) (*Client, error)
 		timeout = defaultTimeout
 	}
 
-	h := strings.TrimSpace(host)
-	if h == "" {
-		h = DefaultHost
+	c := &Client{hc: &http.Client{Timeout: timeout}, log: log}
+	seen := make(map[string]bool)
+	for _, host := range hosts {
+		if strings.TrimSpace(host) == "" {
+			continue
+		}
+		u, err := parseHost(host)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[u.String()] {
+			seen[u.String()] = true
+			c.servers = append(c.servers, &server{base: u})
+		}
 	}
+	if len(c.servers) == 0 {
+		u, err := parseHost(DefaultHost)
+		if err != nil {
+			return nil, err
+		}
+		c.servers = []*server{{base: u}}
+	}
+	return c, nil
+}
+
+func parseHost(host string) (*url.URL, error) {
+	h := strings.TrimSpace(host)
 	if !strings.Contains(h, "://") {
 		h = "http://" + bracketIPv6(h)
 	}
@@ -75,8 +148,7 @@ func New(host string, timeout time.Duration, log *slog.Logger) (*Client, error)
 		}
 		u.Host = net.JoinHostPort(u.Hostname(), port)
 	}
-
-	return &Client{base: u, hc: &http.Client{Timeout: timeout}, log: log}, nil
+	return u, nil
 }
 
 // bracketIPv6 accepts a bare "::1" the way ollama's envconfig does; url.Parse
@@ -88,8 +160,17 @@ func bracketIPv6(h string) string {
 	return h
 }
 
-// Host is the resolved base URL, e.g. "http://localhost:11434".
-func (c *Client) Host() string { return c.base.String() }
+// Host is the first resolved base URL, e.g. "http://localhost:11434".
+func (c *Client) Host() string { return c.servers[0].base.String() }
+
+// Hosts is every resolved base URL, in the order given.
+func (c *Client) Hosts() []string {
+	hosts := make([]string, len(c.servers))
+	for i, s := range c.servers {
+		hosts[i] = s.base.String()
+	}
+	return hosts
+}
 
 type GenerateRequest struct {
 	Model   string          `json:"model"`
@@ -108,6 +189,33 @@ type generateResponse struct {
 	Error      string `json:"error"`
 }
 
+// Complete implements llm.Backend. Sampling is pinned to greedy so the same
+// document gets the same answer.
+func (c *Client) Complete(ctx context.Context, req llm.Request) (string, error) {
+	return c.Generate(ctx, GenerateRequest{
+		Model:  req.Model,
+		System: req.System,
+		Prompt: req.Prompt,
+		Images: req.Images,
+		Format: req.Schema,
+		Options: map[string]any{
+			"temperature": 0,
+			"top_p":       1,
+			"top_k":       1,
+			"seed":        req.Seed,
+			"num_predict": req.MaxTokens,
+			"num_ctx":     req.Context,
+		},
+	})
+}
+
+// Generate sends req to the least busy server that is up for its model. With
+// several servers, one that cannot be reached, is unavailable, has lost the
+// model or has answered 500 too many times in a row is marked down for the
+// model and the request is retried on the next. A lone 500 fails only this
+// request, since another host would most likely choke on the same document.
+// With one server, its error is returned as is, so a caller can wait for it to
+// come back.
 func (c *Client) Generate(ctx context.Context, req GenerateRequest) (string, error) {
 	req.Stream = false
 
@@ -116,18 +224,89 @@ func (c *Client) Generate(ctx context.Context, req GenerateRequest) (string, err
 		return "", fmt.Errorf("encoding ollama request: %w", err)
 	}
 
-	endpoint := c.base.JoinPath("api", "generate").String()
+	var lastErr error
+	for {
+		s := c.pick(req.Model)
+		if s == nil {
+			if lastErr == nil {
+				lastErr = &UnreachableError{Host: strings.Join(c.Hosts(), ", "), Err: errAllDown}
+			}
+			return "", lastErr
+		}
+		s.busy.Add(1)
+		out, err := c.generate(ctx, s, req, body)
+		s.busy.Add(-1)
+		if err == nil {
+			s.fails.Store(0)
+			return out, nil
+		}
+		if len(c.servers) == 1 || ctx.Err() != nil || !s.failing(err) {
+			return out, err
+		}
+		c.markDown(s, req.Model, err)
+		lastErr = err
+	}
+}
+
+// pick returns the server up for model with the fewest requests in flight, or
+// nil when every server is down for it. A single server is never down: there is
+// nothing to fail over to, and its own error says more than "no servers left".
+func (c *Client) pick(model string) *server {
+	if len(c.servers) == 1 {
+		return c.servers[0]
+	}
+	n := len(c.servers)
+	start := int(c.next.Add(1)) % n
+	var best *server
+	for i := range n {
+		s := c.servers[(start+i)%n]
+		if s.isDown(model) {
+			continue
+		}
+		if best == nil || s.busy.Load() < best.busy.Load() {
+			best = s
+		}
+	}
+	return best
+}
+
+func (c *Client) markDown(s *server, model string, err error) {
+	if !s.setDown(model, true) {
+		c.log.Warn("ollama host failed; not using it again for this model", "host", s.base.String(), "model", model, "err", err)
+	}
+}
+
+// failing reports whether err says s itself is unusable rather than that it
+// could not handle this one request: it cannot be reached, it is unavailable
+// or lacks the model, or it has answered 500 maxServerErrors times in a row.
+func (s *server) failing(err error) bool {
+	var unreachable *UnreachableError
+	var missing *ModelNotFoundError
+	var apiErr *APIError
+	switch {
+	case errors.As(err, &unreachable), errors.As(err, &missing):
+		return true
+	case errors.As(err, &apiErr) && llm.UnavailableStatus(apiErr.Status):
+		return true
+	case errors.As(err, &apiErr) && apiErr.Status >= http.StatusInternalServerError:
+		return s.fails.Add(1) >= maxServerErrors
+	}
+	return false
+}
+
+func (c *Client) generate(ctx context.Context, s *server, req GenerateRequest, body []byte) (string, error) {
+	endpoint := s.base.JoinPath("api", "generate").String()
 	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
 	if err != nil {
 		return "", fmt.Errorf("building ollama request: %w", err)
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
 
-	c.log.Debug("ollama generate", "model", req.Model, "prompt_bytes", len(req.Prompt), "images", len(req.Images))
+	c.log.Debug("ollama generate", "host", s.base.String(), "model", req.Model, "prompt_bytes", len(req.Prompt), "images", len(req.Images))
 
 	resp, err := c.hc.Do(httpReq)
 	if err != nil {
-		return "", c.transportError(ctx, err)
+		return "", c.transportError(ctx, s, err)
 	}
 	defer resp.Body.Close()
 
@@ -173,8 +352,13 @@ func (c *Client) Generate(ctx context.Context, req GenerateRequest) (string, err
 	return out.String(), nil
 }
 
+// Tags lists the models installed on the first host.
 func (c *Client) Tags(ctx context.Context) ([]string, error) {
-	endpoint := c.base.JoinPath("api", "tags").String()
+	return c.tags(ctx, c.servers[0])
+}
+
+func (c *Client) tags(ctx context.Context, s *server) ([]string, error) {
+	endpoint := s.base.JoinPath("api", "tags").String()
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
 	if err != nil {
 		return nil, fmt.Errorf("building ollama request: %w", err)
@@ -182,7 +366,7 @@ func (c *Client) Tags(ctx context.Context) ([]string, error) {
 
 	resp, err := c.hc.Do(req)
 	if err != nil {
-		return nil, c.transportError(ctx, err)
+		return nil, c.transportError(ctx, s, err)
 	}
 	defer resp.Body.Close()
 
@@ -208,21 +392,97 @@ func (c *Client) Tags(ctx context.Context) ([]string, error) {
 	return names, nil
 }
 
+// Capabilities lists what model can do as the first host reports it, such as
+// "completion" and "vision". A server older than the field reports none.
+func (c *Client) Capabilities(ctx context.Context, model string) ([]string, error) {
+	s := c.servers[0]
+	body, err := json.Marshal(map[string]string{"model": model})
+	if err != nil {
+		return nil, fmt.Errorf("encoding ollama request: %w", err)
+	}
+	endpoint := s.base.JoinPath("api", "show").String()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("building ollama request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, c.transportError(ctx, s, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, &ModelNotFoundError{Model: model}
+	default:
+		return nil, &APIError{Status: resp.StatusCode, Message: errorMessage(resp.Body)}
+	}
+	var payload struct {
+		Capabilities []string `json:"capabilities"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, fmt.Errorf("decoding ollama show: %w", err)
+	}
+	return payload.Capabilities, nil
+}
+
 // Preflight reports whether model is installed, using its own short deadline so
 // an unreachable server fails in milliseconds rather than after the generate
-// timeout.
+// timeout. Every host is checked, at once, and the ones that fail are marked
+// down for model alone; it succeeds if any host is usable. It is also how a
+// host marked down gets back in, so a long-running caller should repeat it now
+// and then for each model it uses.
 func (c *Client) Preflight(ctx context.Context, model string) error {
 	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
 	defer cancel()
 
-	installed, err := c.Tags(ctx)
+	errs := make([]error, len(c.servers))
+	var wg sync.WaitGroup
+	for i, s := range c.servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = c.preflight(ctx, s, model)
+		}()
+	}
+	wg.Wait()
+
+	var first error
+	for i, s := range c.servers {
+		err := errs[i]
+		s.setDown(model, err != nil)
+		if err == nil {
+			s.fails.Store(0)
+			continue
+		}
+		if len(c.servers) > 1 {
+			c.log.Warn("ollama host is not usable; leaving it out", "host", s.base.String(), "err", err)
+		}
+		// A missing model is reported only if no host is merely unreachable: that
+		// one might still come up, and a caller that waits needs to know it.
+		var missing *ModelNotFoundError
+		if first == nil || errors.As(first, &missing) && !errors.As(err, &missing) {
+			first = err
+		}
+	}
+	if slices.Contains(errs, nil) {
+		return nil
+	}
+	return first
+}
+
+func (c *Client) preflight(ctx context.Context, s *server, model string) error {
+	installed, err := c.tags(ctx, s)
 	if err != nil {
 		var apiErr *APIError
 		var unreachable *UnreachableError
 		if errors.As(err, &apiErr) || errors.As(err, &unreachable) {
 			return err
 		}
-		return &UnreachableError{Host: c.base.String(), Err: err}
+		return &UnreachableError{Host: s.base.String(), Err: err}
 	}
 
 	want := normalizeModel(model)
@@ -244,11 +504,11 @@ func normalizeModel(m string) string {
 	return m
 }
 
-func (c *Client) transportError(ctx context.Context, err error) error {
+func (c *Client) transportError(ctx context.Context, s *server, err error) error {
 	if ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
 		return fmt.Errorf("ollama request failed: %w", err)
 	}
-	return &UnreachableError{Host: c.base.String(), Err: err}
+	return &UnreachableError{Host: s.base.String(), Err: err}
 }
 
 func errorMessage(r io.Reader) string {
@@ -261,6 +521,9 @@ func errorMessage(r io.Reader) string {
 
 var ErrEmptyResponse = errors.New("ollama returned an empty response")
 
+// errAllDown is why a request fails when every host has been marked down.
+var errAllDown = errors.New("every host failed earlier in this run")
+
 type UnreachableError struct {
 	Host string
 	Err  error
@@ -272,6 +535,8 @@ func (e *UnreachableError) Error() string {
 
 func (e *UnreachableError) Unwrap() error { return e.Err }
 
+func (e *UnreachableError) Is(target error) bool { return target == llm.ErrUnavailable }
+
 type ModelNotFoundError struct {
 	Model     string
 	Available []string
@@ -285,6 +550,8 @@ func (e *ModelNotFoundError) Error() string {
 	return msg
 }
 
+func (e *ModelNotFoundError) Is(target error) bool { return target == llm.ErrModelMissing }
+
 type APIError struct {
 	Status  int
 	Message string
@@ -293,3 +560,10 @@ type APIError struct {
 func (e *APIError) Error() string {
 	return fmt.Sprintf("ollama returned HTTP %d: %s", e.Status, e.Message)
 }
+
+// Is makes a status that says the server is busy match llm.ErrUnavailable:
+// ollama answers 503 while it is still loading, and that passes. A lone 500 is
+// the document's problem, not the server's.
+func (e *APIError) Is(target error) bool {
+	return target == llm.ErrUnavailable && llm.UnavailableStatus(e.Status)
+}
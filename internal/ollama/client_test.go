@@ -6,9 +6,11 @@ import (
 	"encoding/json"
 	"errors"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -445,3 +447,190 @@ func TestNewPortOnlyHostReachesServer(t *testing.T) {
 		t.Fatalf("Preflight via %q: %v", c.Host(), err)
 	}
 }
+
+func newHostsClient(t *testing.T, hosts ...string) *ollama.Client {
+	t.Helper()
+	c, err := ollama.NewHosts(hosts, 0, nil)
+	if err != nil {
+		t.Fatalf("NewHosts(%q): %v", hosts, err)
+	}
+	return c
+}
+
+func TestNewHostsDropsBlanksAndDuplicates(t *testing.T) {
+	t.Parallel()
+
+	c := newHostsClient(t, "gpu1", " ", "http://gpu1:11434/", "gpu2:8080")
+	want := []string{"http://gpu1:11434", "http://gpu2:8080"}
+	if got := c.Hosts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Hosts() = %q, want %q", got, want)
+	}
+	if got := newHostsClient(t).Hosts(); !reflect.DeepEqual(got, []string{ollama.DefaultHost}) {
+		t.Errorf("Hosts() with none = %q, want the default", got)
+	}
+	if _, err := ollama.NewHosts([]string{"gpu1", "http://"}, 0, nil); err == nil {
+		t.Error("NewHosts accepted a host without a hostname")
+	}
+}
+
+func TestGenerateSpreadsAcrossHosts(t *testing.T) {
+	t.Parallel()
+
+	a := testutil.NewFake(t, []string{"gemma4:e2b"}, `{"ok":true}`)
+	b := testutil.NewFake(t, []string{"gemma4:e2b"}, `{"ok":true}`)
+	c := newHostsClient(t, a.URL, b.URL)
+	if err := c.Preflight(context.Background(), "gemma4:e2b"); err != nil {
+		t.Fatalf("Preflight: %v", err)
+	}
+	for range 4 {
+		if _, err := c.Generate(context.Background(), ollama.GenerateRequest{Model: "gemma4:e2b"}); err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+	}
+	if a.Count() != 2 || b.Count() != 2 {
+		t.Errorf("requests = %d and %d, want 2 each", a.Count(), b.Count())
+	}
+}
+
+func TestGenerateFailsOverAndMarksTheHostDown(t *testing.T) {
+	t.Parallel()
+
+	bad := testutil.NewFakeStatus(t, http.StatusServiceUnavailable, "loading model")
+	good := testutil.NewFake(t, []string{"gemma4:e2b"}, `{"ok":true}`)
+	c := newHostsClient(t, bad.URL, good.URL)
+	for range 3 {
+		got, err := c.Generate(context.Background(), ollama.GenerateRequest{Model: "gemma4:e2b"})
+		if err != nil || got != `{"ok":true}` {
+			t.Fatalf("Generate = %q, %v; want the good host's answer", got, err)
+		}
+	}
+	if bad.Count() != 1 {
+		t.Errorf("failing host got %d requests, want 1 before being marked down", bad.Count())
+	}
+
+	good.SetDown(true)
+	_, err := c.Generate(context.Background(), ollama.GenerateRequest{Model: "gemma4:e2b"})
+	var unreachable *ollama.UnreachableError
+	if !errors.As(err, &unreachable) {
+		t.Errorf("err = %v (%T) with every host down, want *ollama.UnreachableError", err, err)
+	}
+}
+
+// TestGenerateLoneServerErrorKeepsTheHost is one document the runner cannot
+// cope with, on any host: its 500 fails that request alone, without being tried
+// on the other host, and later requests still reach both.
+func TestGenerateLoneServerErrorKeepsTheHost(t *testing.T) {
+	t.Parallel()
+
+	var crashes atomic.Int32
+	chokes := func() (*httptest.Server, *atomic.Int32) {
+		var answers atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req ollama.GenerateRequest
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			if req.Prompt == "crash" {
+				crashes.Add(1)
+				http.Error(w, "llama runner process has terminated", http.StatusInternalServerError)
+				return
+			}
+			answers.Add(1)
+			_ = json.NewEncoder(w).Encode(map[string]any{"response": `{"ok":true}`, "done": true})
+		}))
+		t.Cleanup(srv.Close)
+		return srv, &answers
+	}
+	a, aAnswers := chokes()
+	b, bAnswers := chokes()
+
+	c := newHostsClient(t, a.URL, b.URL)
+	_, err := c.Generate(context.Background(), ollama.GenerateRequest{Model: "gemma4:e2b", Prompt: "crash"})
+	var apiErr *ollama.APIError
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusInternalServerError {
+		t.Fatalf("err = %v (%T), want the 500", err, err)
+	}
+	if crashes.Load() != 1 {
+		t.Errorf("the failing request was sent %d times, want once", crashes.Load())
+	}
+	for range 4 {
+		if _, err := c.Generate(context.Background(), ollama.GenerateRequest{Model: "gemma4:e2b"}); err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+	}
+	if aAnswers.Load() != 2 || bAnswers.Load() != 2 {
+		t.Errorf("requests = %d and %d after one 500, want 2 each", aAnswers.Load(), bAnswers.Load())
+	}
+}
+
+func TestPreflightChecksEveryHost(t *testing.T) {
+	t.Parallel()
+
+	down := testutil.NewFake(t, []string{"gemma4:e2b"})
+	down.SetDown(true)
+	missing := testutil.NewFake(t, []string{"llama3.2:latest"})
+	good := testutil.NewFake(t, []string{"gemma4:e2b"}, `{"ok":true}`)
+
+	c := newHostsClient(t, down.URL, missing.URL, good.URL)
+	if err := c.Preflight(context.Background(), "gemma4:e2b"); err != nil {
+		t.Fatalf("Preflight = %v, want nil while one host is usable", err)
+	}
+	for range 3 {
+		if _, err := c.Generate(context.Background(), ollama.GenerateRequest{Model: "gemma4:e2b"}); err != nil {
+			t.Fatalf("Generate: %v", err)
+		}
+	}
+	if missing.Count() != 0 || good.Count() != 3 {
+		t.Errorf("requests = %d to the host without the model and %d to the good one, want 0 and 3", missing.Count(), good.Count())
+	}
+
+	// With no usable host, an unreachable one is reported over a missing model:
+	// it may yet come up.
+	err := newHostsClient(t, missing.URL, down.URL).Preflight(context.Background(), "gemma4:e2b")
+	var unreachable *ollama.UnreachableError
+	if !errors.As(err, &unreachable) {
+		t.Errorf("err = %v (%T), want *ollama.UnreachableError", err, err)
+	}
+}
+
+// TestPreflightTracksEachModelApart is a run with -fallback-model whose two
+// models sit on different hosts: checking the second must not take out the host
+// that has only the first.
+func TestPreflightTracksEachModelApart(t *testing.T) {
+	t.Parallel()
+
+	primary := testutil.NewFake(t, []string{"gemma4:e2b"}, `{"ok":true}`)
+	fallback := testutil.NewFake(t, []string{"gemma4:31b"}, `{"ok":true}`)
+	c := newHostsClient(t, primary.URL, fallback.URL)
+	for _, model := range []string{"gemma4:e2b", "gemma4:31b"} {
+		if err := c.Preflight(context.Background(), model); err != nil {
+			t.Fatalf("Preflight(%s) = %v, want nil", model, err)
+		}
+	}
+	for range 2 {
+		for _, model := range []string{"gemma4:e2b", "gemma4:31b"} {
+			if _, err := c.Generate(context.Background(), ollama.GenerateRequest{Model: model}); err != nil {
+				t.Fatalf("Generate(%s): %v", model, err)
+			}
+		}
+	}
+	if primary.Count() != 2 || fallback.Count() != 2 {
+		t.Errorf("requests = %d to the primary's host and %d to the fallback's, want 2 each", primary.Count(), fallback.Count())
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	t.Parallel()
+
+	fake := testutil.NewFake(t, []string{"gemma4:e2b"})
+	c := newClient(t, fake.URL, 0)
+	caps, err := c.Capabilities(context.Background(), "gemma4:e2b")
+	if err != nil || !reflect.DeepEqual(caps, []string{"completion", "vision"}) {
+		t.Fatalf("Capabilities = %v, %v; want completion and vision", caps, err)
+	}
+
+	missing := newClient(t, testutil.NewFakeStatus(t, http.StatusNotFound, `{"error":"model 'nope' not found"}`).URL, 0)
+	_, err = missing.Capabilities(context.Background(), "nope")
+	var notFound *ollama.ModelNotFoundError
+	if !errors.As(err, &notFound) {
+		t.Errorf("err = %v (%T), want *ollama.ModelNotFoundError", err, err)
+	}
+}
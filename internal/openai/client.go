@@ -0,0 +1,327 @@
+// Package openai talks to servers that speak the OpenAI chat completions API,
+// as llama.cpp's server, vLLM and LM Studio do.
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/llm"
+)
+
+const (
+	// DefaultHost is llama.cpp's server; vLLM listens on 8000 and LM Studio on
+	// 1234, so those need -host.
+	DefaultHost = "http://localhost:8080"
+
+	defaultTimeout   = 5 * time.Minute
+	preflightTimeout = 5 * time.Second
+	maxErrorBody     = 500
+)
+
+type Client struct {
+	base   *url.URL // up to and including /v1
+	apiKey string
+	hc     *http.Client
+	log    *slog.Logger
+}
+
+// New resolves host into the API's base URL. A bare "host:port" is assumed to
+// be http, and the /v1 prefix is added unless host already ends with it, so
+// both the server's address and the base URL its documentation prints work.
+// apiKey, when set, is sent as a bearer token.
+func New(host, apiKey string, timeout time.Duration, log *slog.Logger) (*Client, error) {
+	if log == nil {
+		log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	h := strings.TrimSpace(host)
+	if h == "" {
+		h = DefaultHost
+	}
+	if !strings.Contains(h, "://") {
+		h = "http://" + h
+	}
+	u, err := url.Parse(strings.TrimRight(h, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid server address %q: %w", host, err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid server address %q: no host in URL", host)
+	}
+	if !strings.HasSuffix(u.Path, "/v1") {
+		u = u.JoinPath("v1")
+	}
+	return &Client{base: u, apiKey: apiKey, hc: &http.Client{Timeout: timeout}, log: log}, nil
+}
+
+// Host is the resolved base URL, e.g. "http://localhost:8080/v1".
+func (c *Client) Host() string { return c.base.String() }
+
+type chatRequest struct {
+	Model          string          `json:"model"`
+	Messages       []message       `json:"messages"`
+	Temperature    float64         `json:"temperature"`
+	TopP           float64         `json:"top_p"`
+	Seed           int             `json:"seed"`
+	MaxTokens      int             `json:"max_tokens,omitempty"`
+	ResponseFormat *responseFormat `json:"response_format,omitempty"`
+	Stream         bool            `json:"stream"`
+}
+
+// message content is a plain string, or a list of parts when there are images:
+// several servers reject the list form on a text-only model.
+type message struct {
+	Role    string `json:"role"`
+	Content any    `json:"content"`
+}
+
+type part struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *imageURL `json:"image_url,omitempty"`
+}
+
+type imageURL struct {
+	URL string `json:"url"`
+}
+
+type responseFormat struct {
+	Type       string      `json:"type"`
+	JSONSchema *jsonSchema `json:"json_schema,omitempty"`
+}
+
+type jsonSchema struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
+}
+
+type chatResponse struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+}
+
+// Complete implements llm.Backend with greedy sampling, so the same document
+// gets the same answer. req.Context is ignored: these servers fix the context
+// window when they start.
+func (c *Client) Complete(ctx context.Context, req llm.Request) (string, error) {
+	cr := chatRequest{
+		Model:       req.Model,
+		Temperature: 0,
+		TopP:        1,
+		Seed:        req.Seed,
+		MaxTokens:   req.MaxTokens,
+	}
+	if req.System != "" {
+		cr.Messages = append(cr.Messages, message{Role: "system", Content: req.System})
+	}
+	user := message{Role: "user", Content: req.Prompt}
+	if len(req.Images) > 0 {
+		parts := []part{{Type: "text", Text: req.Prompt}}
+		for _, img := range req.Images {
+			parts = append(parts, part{Type: "image_url", ImageURL: &imageURL{URL: dataURL(img)}})
+		}
+		user.Content = parts
+	}
+	cr.Messages = append(cr.Messages, user)
+	if len(req.Schema) > 0 {
+		cr.ResponseFormat = &responseFormat{Type: "json_schema", JSONSchema: &jsonSchema{Name: "answer", Schema: req.Schema}}
+	}
+
+	body, err := json.Marshal(cr)
+	if err != nil {
+		return "", fmt.Errorf("encoding chat request: %w", err)
+	}
+	httpReq, err := c.newRequest(ctx, http.MethodPost, "chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	c.log.Debug("chat completion", "model", req.Model, "prompt_bytes", len(req.Prompt), "images", len(req.Images))
+
+	resp, err := c.hc.Do(httpReq)
+	if err != nil {
+		return "", c.transportError(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", &ModelNotFoundError{Model: req.Model}
+	case resp.StatusCode != http.StatusOK:
+		return "", &APIError{Status: resp.StatusCode, Message: errorMessage(resp.Body)}
+	}
+
+	var out chatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", ctxErr
+		}
+		return "", fmt.Errorf("decoding chat response: %w", err)
+	}
+	if len(out.Choices) == 0 || strings.TrimSpace(out.Choices[0].Message.Content) == "" {
+		return "", ErrEmptyResponse
+	}
+	c.log.Debug("chat response", "bytes", len(out.Choices[0].Message.Content), "finish_reason", out.Choices[0].FinishReason)
+	return out.Choices[0].Message.Content, nil
+}
+
+// dataURL wraps a bare base64 image in the data: URL the API expects, with the
+// media type read from the image itself.
+func dataURL(b64 string) string {
+	head, _ := base64.StdEncoding.DecodeString(b64[:min(len(b64), 64)])
+	return "data:" + http.DetectContentType(head) + ";base64," + b64
+}
+
+// Models lists the model IDs the server offers.
+func (c *Client) Models(ctx context.Context) ([]string, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "models", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, c.transportError(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &APIError{Status: resp.StatusCode, Message: errorMessage(resp.Body)}
+	}
+	var payload struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, fmt.Errorf("decoding model list: %w", err)
+	}
+	ids := make([]string, 0, len(payload.Data))
+	for _, m := range payload.Data {
+		if m.ID != "" {
+			ids = append(ids, m.ID)
+		}
+	}
+	return ids, nil
+}
+
+// Preflight reports whether the server offers model, using its own short
+// deadline so an unreachable server fails in milliseconds. IDs are compared
+// exactly: unlike ollama's tags they have no implied ":latest".
+func (c *Client) Preflight(ctx context.Context, model string) error {
+	ctx, cancel := context.WithTimeout(ctx, preflightTimeout)
+	defer cancel()
+
+	ids, err := c.Models(ctx)
+	if err != nil {
+		var apiErr *APIError
+		var unreachable *UnreachableError
+		if errors.As(err, &apiErr) || errors.As(err, &unreachable) {
+			return err
+		}
+		return &UnreachableError{Host: c.base.String(), Err: err}
+	}
+	for _, id := range ids {
+		if id == model {
+			return nil
+		}
+	}
+	return &ModelNotFoundError{Model: model, Available: ids}
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base.JoinPath(path).String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("building request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	return req, nil
+}
+
+func (c *Client) transportError(ctx context.Context, err error) error {
+	if ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	return &UnreachableError{Host: c.base.String(), Err: err}
+}
+
+// errorMessage prefers the API's {"error":{"message":...}} over the raw body.
+func errorMessage(r io.Reader) string {
+	b, err := io.ReadAll(io.LimitReader(r, maxErrorBody))
+	if err != nil {
+		return err.Error()
+	}
+	var payload struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(b, &payload) == nil && payload.Error.Message != "" {
+		return payload.Error.Message
+	}
+	return strings.TrimSpace(string(b))
+}
+
+var ErrEmptyResponse = errors.New("the server returned an empty response")
+
+type UnreachableError struct {
+	Host string
+	Err  error
+}
+
+func (e *UnreachableError) Error() string {
+	return fmt.Sprintf("cannot reach the OpenAI-compatible server at %s: %v\n  Is it running? Different address? Pass -host http://HOST:PORT", e.Host, e.Err)
+}
+
+func (e *UnreachableError) Unwrap() error { return e.Err }
+
+func (e *UnreachableError) Is(target error) bool { return target == llm.ErrUnavailable }
+
+type ModelNotFoundError struct {
+	Model     string
+	Available []string
+}
+
+func (e *ModelNotFoundError) Error() string {
+	msg := fmt.Sprintf("the server does not offer model %q", e.Model)
+	if len(e.Available) > 0 {
+		msg += "\n  Available: " + strings.Join(e.Available, ", ") + "\n  Pass one of them with -model"
+	}
+	return msg
+}
+
+func (e *ModelNotFoundError) Is(target error) bool { return target == llm.ErrModelMissing }
+
+type APIError struct {
+	Status  int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("the server returned HTTP %d: %s", e.Status, e.Message)
+}
+
+func (e *APIError) Is(target error) bool {
+	return target == llm.ErrUnavailable && llm.UnavailableStatus(e.Status)
+}
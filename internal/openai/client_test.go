@@ -0,0 +1,173 @@
+package openai_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/scottdensmore/rcptpixie/v2/internal/llm"
+	"github.com/scottdensmore/rcptpixie/v2/internal/openai"
+	"github.com/scottdensmore/rcptpixie/v2/internal/testutil"
+)
+
+func newClient(t *testing.T, host string) *openai.Client {
+	t.Helper()
+	c, err := openai.New(host, "", 0, nil)
+	if err != nil {
+		t.Fatalf("New(%q): %v", host, err)
+	}
+	return c
+}
+
+func TestCompleteSendsAChatRequest(t *testing.T) {
+	t.Parallel()
+
+	fake := testutil.NewFakeOpenAI(t, []string{"gemma-3-4b"}, `{"vendor":"Acme"}`)
+	schema := json.RawMessage(`{"type":"object","properties":{"vendor":{"type":"string"}}}`)
+	png := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n rest of the image"))
+
+	got, err := newClient(t, fake.URL).Complete(context.Background(), llm.Request{
+		Model: "gemma-3-4b", System: "be terse", Prompt: "read this",
+		Images: []string{png}, Schema: schema, Seed: 42, MaxTokens: 300, Context: 8192,
+	})
+	if err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	if got != `{"vendor":"Acme"}` {
+		t.Errorf("reply = %q", got)
+	}
+
+	body := fake.Requests[0]
+	if body["model"] != "gemma-3-4b" || body["seed"] != float64(42) || body["max_tokens"] != float64(300) || body["temperature"] != float64(0) {
+		t.Errorf("request = %v", body)
+	}
+	rf, _ := body["response_format"].(map[string]any)
+	js, _ := rf["json_schema"].(map[string]any)
+	if rf["type"] != "json_schema" || js["schema"] == nil {
+		t.Errorf("response_format = %v, want the schema", body["response_format"])
+	}
+
+	msgs, _ := body["messages"].([]any)
+	if len(msgs) != 2 {
+		t.Fatalf("messages = %v, want system and user", msgs)
+	}
+	if sys := msgs[0].(map[string]any); sys["role"] != "system" || sys["content"] != "be terse" {
+		t.Errorf("system message = %v", sys)
+	}
+	parts, _ := msgs[1].(map[string]any)["content"].([]any)
+	if len(parts) != 2 {
+		t.Fatalf("user content = %v, want text and one image", msgs[1])
+	}
+	img, _ := parts[1].(map[string]any)["image_url"].(map[string]any)
+	if url, _ := img["url"].(string); url != "data:image/png;base64,"+png {
+		t.Errorf("image url = %.40q, want a PNG data URL", url)
+	}
+}
+
+func TestCompleteTextOnlyIsAPlainString(t *testing.T) {
+	t.Parallel()
+
+	fake := testutil.NewFakeOpenAI(t, nil, `{}`)
+	if _, err := newClient(t, fake.URL).Complete(context.Background(), llm.Request{Model: "m", Prompt: "hi"}); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	msgs, _ := fake.Requests[0]["messages"].([]any)
+	if len(msgs) != 1 || msgs[0].(map[string]any)["content"] != "hi" {
+		t.Errorf("messages = %v, want one user message with string content", msgs)
+	}
+}
+
+func TestCompleteErrorsMatchTheSharedKinds(t *testing.T) {
+	t.Parallel()
+
+	for _, tt := range []struct {
+		code int
+		want error
+	}{
+		{http.StatusServiceUnavailable, llm.ErrUnavailable},
+		{http.StatusNotFound, llm.ErrModelMissing},
+	} {
+		fake := testutil.NewFakeStatus(t, tt.code, `{"error":{"message":"nope"}}`)
+		_, err := newClient(t, fake.URL).Complete(context.Background(), llm.Request{Model: "m"})
+		if !errors.Is(err, tt.want) {
+			t.Errorf("HTTP %d: err = %v, want it to match %v", tt.code, err, tt.want)
+		}
+	}
+
+	for _, code := range []int{http.StatusBadRequest, http.StatusInternalServerError} {
+		fake := testutil.NewFakeStatus(t, code, `{"error":{"message":"bad schema"}}`)
+		_, err := newClient(t, fake.URL).Complete(context.Background(), llm.Request{Model: "m"})
+		if errors.Is(err, llm.ErrUnavailable) || !strings.Contains(err.Error(), "bad schema") {
+			t.Errorf("HTTP %d: err = %v, want the API's message and not a server failure", code, err)
+		}
+	}
+
+	down := testutil.NewFakeOpenAI(t, nil)
+	down.SetDown(true)
+	if err := newClient(t, down.URL).Preflight(context.Background(), "m"); !errors.Is(err, llm.ErrUnavailable) {
+		t.Errorf("Preflight on a dead server = %v, want it to match llm.ErrUnavailable", err)
+	}
+}
+
+func TestPreflightMatchesIDsExactly(t *testing.T) {
+	t.Parallel()
+
+	fake := testutil.NewFakeOpenAI(t, []string{"gemma-3-4b", "qwen2.5-vl"})
+	c := newClient(t, fake.URL)
+	if err := c.Preflight(context.Background(), "qwen2.5-vl"); err != nil {
+		t.Errorf("Preflight(qwen2.5-vl) = %v, want nil", err)
+	}
+	err := c.Preflight(context.Background(), "gemma")
+	var missing *openai.ModelNotFoundError
+	if !errors.As(err, &missing) || !errors.Is(err, llm.ErrModelMissing) {
+		t.Fatalf("Preflight(gemma) = %v (%T), want *openai.ModelNotFoundError", err, err)
+	}
+	if !strings.Contains(err.Error(), "gemma-3-4b, qwen2.5-vl") {
+		t.Errorf("Error() = %q, want it to list what is available", err.Error())
+	}
+}
+
+func TestNewAddsTheV1Prefix(t *testing.T) {
+	t.Parallel()
+
+	for host, want := range map[string]string{
+		"localhost:8080":        "http://localhost:8080/v1",
+		"http://gpu:8000/":      "http://gpu:8000/v1",
+		"http://gpu:8000/v1":    "http://gpu:8000/v1",
+		"https://proxy/llm/v1/": "https://proxy/llm/v1",
+		"":                      openai.DefaultHost + "/v1",
+	} {
+		if got := newClient(t, host).Host(); got != want {
+			t.Errorf("New(%q).Host() = %q, want %q", host, got, want)
+		}
+	}
+	if _, err := openai.New("http://", "", 0, nil); err == nil {
+		t.Error("New accepted an address without a host")
+	}
+}
+
+func TestAPIKeyIsSentAsABearerToken(t *testing.T) {
+	t.Parallel()
+
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization")
+		w.Write([]byte(`{"data":[{"id":"m"}]}`))
+	}))
+	defer srv.Close()
+	c, err := openai.New(srv.URL, "sk-local", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Preflight(context.Background(), "m"); err != nil {
+		t.Fatalf("Preflight: %v", err)
+	}
+	if got != "Bearer sk-local" {
+		t.Errorf("Authorization = %q, want the key as a bearer token", got)
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
+	"syscall"
 	"time"
 )
 
@@ -16,6 +19,10 @@ var (
 )
 
 // Apply renames it.OldPath to dir/it.NewName without ever overwriting anything.
+// dir is usually the file's own directory; when it is not, the file is moved
+// there, dir is created if need be, and the journal entry records where it went
+// so undo can bring it back. A dir on another filesystem is copied into and the
+// original removed, since a rename cannot cross one.
 func Apply(ctx context.Context, dir string, it Item, j *Journal) (newPath string, err error) {
 	if err := ctx.Err(); err != nil {
 		return "", err
@@ -31,6 +38,15 @@ func Apply(ctx context.Context, dir string, it Item, j *Journal) (newPath string
 	if target == it.OldPath {
 		return target, nil
 	}
+	var moved string
+	if !sameDir(filepath.Dir(it.OldPath), dir) {
+		if moved, err = filepath.Abs(dir); err != nil {
+			return "", err
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return "", err
+		}
+	}
 
 	oldBase := filepath.Base(it.OldPath)
 	// A case-only rename on a case-INSENSITIVE filesystem would collide with the
@@ -57,7 +73,7 @@ func Apply(ctx context.Context, dir string, it Item, j *Journal) (newPath string
 		}()
 	}
 
-	if err = os.Rename(it.OldPath, target); err != nil {
+	if err = move(it.OldPath, target); err != nil {
 		return "", err
 	}
 
@@ -66,12 +82,84 @@ func Apply(ctx context.Context, dir string, it Item, j *Journal) (newPath string
 	// whatever file happens to hold that name by then. The window this loses is
 	// the microseconds between the rename and the append; the window it closes is
 	// permanent.
-	if jerr := j.Append(Entry{Time: time.Now(), Old: oldBase, New: it.NewName}); jerr != nil {
+	if jerr := j.Append(Entry{Time: time.Now(), Old: oldBase, New: it.NewName, Dir: moved}); jerr != nil {
 		j.logger().Warn("could not record rename for undo", "journal", j.Path(), "err", jerr)
 	}
 	return target, nil
 }
 
+// move renames oldPath to target, falling back to copyAcross when the two are
+// on different filesystems.
+func move(oldPath, target string) error {
+	err := os.Rename(oldPath, target)
+	if crossDevice(err) {
+		return copyAcross(oldPath, target)
+	}
+	return err
+}
+
+// errorNotSameDevice is Windows' ERROR_NOT_SAME_DEVICE, its EXDEV.
+const errorNotSameDevice = 17
+
+// crossDevice reports whether err is a rename refused for crossing filesystems.
+func crossDevice(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	return errno == syscall.EXDEV || runtime.GOOS == "windows" && errno == errorNotSameDevice
+}
+
+// copyAcross moves oldPath to target by copying it into target, which is
+// Apply's claim and so already exists, then removing oldPath. The copy is
+// synced before the original goes, and keeps its permissions and modification
+// time. On an error oldPath is left where it was, for Apply to drop the claim.
+func copyAcross(oldPath, target string) error {
+	src, err := os.Open(oldPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(target, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Chtimes(target, fi.ModTime(), fi.ModTime()); err != nil {
+		return err
+	}
+	// Closed first: Windows cannot remove a file that is still open.
+	src.Close()
+	return os.Remove(oldPath)
+}
+
+// sameDir compares two directory paths as locations, so "inbox" and
+// "/home/me/inbox" agree when the working directory is /home/me.
+func sameDir(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
 // sameFileOnDisk reports whether target already resolves to the very same file
 // as oldPath, which is what a case-only rename looks like on a case-insensitive
 // filesystem. A missing target, or one that is a genuinely different file,
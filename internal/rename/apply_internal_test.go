@@ -0,0 +1,85 @@
+package rename
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestCopyAcrossFillsTheClaim is the path a -dest on another filesystem takes:
+// the rename is refused with EXDEV, so the file is copied into Apply's claim and
+// the original removed.
+func TestCopyAcrossFillsTheClaim(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "scan.pdf")
+	if err := os.WriteFile(src, []byte("%PDF-1.4 receipt"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	when := time.Date(2024, 3, 15, 9, 30, 0, 0, time.UTC)
+	if err := os.Chtimes(src, when, when); err != nil {
+		t.Fatal(err)
+	}
+	claim := filepath.Join(dir, "dest", "03-15-2024 - Acme.pdf")
+	if err := os.MkdirAll(filepath.Dir(claim), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(claim, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyAcross(src, claim); err != nil {
+		t.Fatalf("copyAcross: %v", err)
+	}
+	if b, err := os.ReadFile(claim); err != nil || string(b) != "%PDF-1.4 receipt" {
+		t.Errorf("target holds %q, %v; want the original's bytes", b, err)
+	}
+	fi, err := os.Stat(claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(when) {
+		t.Errorf("target modified %v, want the original's %v", fi.ModTime(), when)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0o640 {
+		t.Errorf("target mode = %v, want the original's 0640 rather than the claim's", fi.Mode().Perm())
+	}
+	if _, err := os.Lstat(src); !os.IsNotExist(err) {
+		t.Errorf("original still there after the move (err = %v)", err)
+	}
+}
+
+func TestCopyAcrossLeavesTheOriginalOnFailure(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "scan.pdf")
+	if err := os.WriteFile(src, []byte("receipt"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// No claim: the target cannot be opened, as if it vanished mid-move.
+	if err := copyAcross(src, filepath.Join(dir, "gone", "x.pdf")); err == nil {
+		t.Fatal("copyAcross into a missing claim succeeded")
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("original lost after a failed copy: %v", err)
+	}
+}
+
+func TestCrossDevice(t *testing.T) {
+	t.Parallel()
+
+	if !crossDevice(&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.EXDEV}) {
+		t.Error("crossDevice(EXDEV) = false")
+	}
+	if crossDevice(&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.ENOENT}) {
+		t.Error("crossDevice(ENOENT) = true")
+	}
+	if crossDevice(nil) {
+		t.Error("crossDevice(nil) = true")
+	}
+}
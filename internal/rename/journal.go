@@ -16,10 +16,41 @@ import (
 
 const JournalName = ".rcptpixie-undo.jsonl"
 
+// Entry is one completed rename. Old and New are base names in the journal's
+// directory, except that a file moved elsewhere has New in Dir, an absolute path.
+// Entries written before runs were recorded have a zero Run and no Src.
 type Entry struct {
 	Time time.Time `json:"t"`
 	Old  string    `json:"old"`
 	New  string    `json:"new"`
+	Dir  string    `json:"dir,omitempty"`
+	Run
+	Src string `json:"src,omitempty"` // the journal's directory, absolute, when it was written
+}
+
+// Run identifies the invocation that made a rename, so a bad batch can be
+// undone without the good ones before it.
+type Run struct {
+	ID    string `json:"run,omitempty"`
+	Mode  string `json:"mode,omitempty"`
+	Model string `json:"model,omitempty"`
+}
+
+// Where returns the path the entry's file was renamed to.
+func (e Entry) Where(dir string) string {
+	if e.Dir != "" {
+		return filepath.Join(e.Dir, e.New)
+	}
+	return filepath.Join(dir, e.New)
+}
+
+// WrittenIn reports whether e was appended by a journal opened in dir, which
+// is what makes its Dir safe to move a file back from. The journal is an
+// ordinary file in the folder, so one that arrived with a shared folder or an
+// archive could otherwise name any file on disk to be pulled into it.
+func (e Entry) WrittenIn(dir string) bool {
+	abs, err := filepath.Abs(dir)
+	return err == nil && e.Src != "" && filepath.Clean(e.Src) == abs
 }
 
 // Journal is an append-only record of completed renames. A nil *Journal is a
@@ -27,6 +58,8 @@ type Entry struct {
 type Journal struct {
 	f    *os.File
 	path string
+	src  string
+	run  Run
 	log  *slog.Logger
 }
 
@@ -42,7 +75,18 @@ func Open(dir string, log *slog.Logger) (*Journal, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Journal{f: f, path: path, log: orDiscard(log)}, nil
+	src, err := filepath.Abs(dir)
+	if err != nil {
+		src = dir
+	}
+	return &Journal{f: f, path: path, src: src, log: orDiscard(log)}, nil
+}
+
+// SetRun tags every entry appended from now on with run.
+func (j *Journal) SetRun(run Run) {
+	if j != nil {
+		j.run = run
+	}
 }
 
 // dropTornTail truncates a final line that never got its newline, which is what
@@ -69,6 +113,12 @@ func (j *Journal) Append(e Entry) error {
 	if j == nil || j.f == nil {
 		return nil
 	}
+	if e.Run == (Run{}) {
+		e.Run = j.run
+	}
+	if e.Src == "" {
+		e.Src = j.src
+	}
 	line, err := json.Marshal(e)
 	if err != nil {
 		return err
@@ -129,11 +179,40 @@ func Read(dir string, log *slog.Logger) ([]Entry, error) {
 type UndoResult struct {
 	Reverted, Skipped int
 	Details           []string
+	// Outcomes holds one element per entry, in the order Undo visited them,
+	// for callers that report each entry rather than the summary.
+	Outcomes []UndoOutcome
+}
+
+// UndoOutcome is what became of one journal entry. Under a dry run Reverted
+// means the entry would have been reverted.
+type UndoOutcome struct {
+	Entry    Entry
+	Reverted bool
+	Reason   string // why it was skipped
+}
+
+func (r *UndoResult) skip(e Entry, reason string) {
+	r.Skipped++
+	r.Details = append(r.Details, fmt.Sprintf("%q: %s", e.New, reason))
+	r.Outcomes = append(r.Outcomes, UndoOutcome{Entry: e, Reason: reason})
+}
+
+func (r *UndoResult) revert(e Entry) {
+	r.Reverted++
+	r.Outcomes = append(r.Outcomes, UndoOutcome{Entry: e, Reverted: true})
 }
 
 // Undo reverts entries in reverse order. Reverse matters: A->B then B->C must
 // unwind backwards or the first revert recreates a collision.
 func Undo(dir string, dryRun bool, log *slog.Logger) (UndoResult, error) {
+	return UndoMatching(dir, dryRun, nil, log)
+}
+
+// UndoMatching is Undo restricted to the entries match accepts, which is how a
+// single run is taken back. The others stay in the journal untouched, and do
+// not appear in the result. A nil match accepts every entry.
+func UndoMatching(dir string, dryRun bool, match func(Entry) bool, log *slog.Logger) (UndoResult, error) {
 	var res UndoResult
 	entries, err := Read(dir, log)
 	if err != nil {
@@ -142,39 +221,41 @@ func Undo(dir string, dryRun bool, log *slog.Logger) (UndoResult, error) {
 	reverted := make([]bool, len(entries))
 	for i := len(entries) - 1; i >= 0; i-- {
 		e := entries[i]
-		if !IsSafeBase(e.New) || !IsSafeBase(e.Old) {
-			res.Skipped++
-			res.Details = append(res.Details, fmt.Sprintf("%q: journal entry is not a plain file name", e.New))
+		if match != nil && !match(e) {
+			continue
+		}
+		if !IsSafeBase(e.New) || !IsSafeBase(e.Old) || (e.Dir != "" && !filepath.IsAbs(e.Dir)) {
+			res.skip(e, "journal entry is not a plain file name")
+			continue
+		}
+		if e.Dir != "" && !e.WrittenIn(dir) {
+			res.skip(e, "journal entry moves a file in from elsewhere but was not written here")
 			continue
 		}
-		newPath := filepath.Join(dir, e.New)
+		newPath := e.Where(dir)
 		fi, err := os.Lstat(newPath)
 		if err != nil {
-			res.Skipped++
-			res.Details = append(res.Details, fmt.Sprintf("%q: no longer present", e.New))
+			res.skip(e, "no longer present")
 			continue
 		}
 		if !fi.Mode().IsRegular() {
-			res.Skipped++
-			res.Details = append(res.Details, fmt.Sprintf("%q: not a regular file", e.New))
+			res.skip(e, "not a regular file")
 			continue
 		}
 		if _, err := os.Lstat(filepath.Join(dir, e.Old)); err == nil {
-			res.Skipped++
-			res.Details = append(res.Details, fmt.Sprintf("%q: original name %q is taken", e.New, e.Old))
+			res.skip(e, fmt.Sprintf("original name %q is taken", e.Old))
 			continue
 		}
 		if dryRun {
-			res.Reverted++
+			res.revert(e)
 			continue
 		}
 		it := Item{OldPath: newPath, NewName: e.Old, Action: ActionRename}
 		if _, err := Apply(context.Background(), dir, it, nil); err != nil {
-			res.Skipped++
-			res.Details = append(res.Details, fmt.Sprintf("%q: %v", e.New, err))
+			res.skip(e, err.Error())
 			continue
 		}
-		res.Reverted++
+		res.revert(e)
 		reverted[i] = true
 	}
 	if dryRun {
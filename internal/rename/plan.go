@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -17,6 +18,10 @@ const (
 	ActionUnchanged Action = "unchanged"
 	ActionSkip      Action = "skip"
 	ActionError     Action = "error"
+
+	// ActionDuplicate leaves alone a file that repeats another in the run,
+	// named by DuplicateOf.
+	ActionDuplicate Action = "duplicate"
 )
 
 type Item struct {
@@ -25,8 +30,19 @@ type Item struct {
 	Action  Action
 	Reason  string // for ActionSkip
 	Err     error  // for ActionError
+
+	// Confidence is how far the answer behind NewName can be trusted, and
+	// Doubts are why it is not higher. Both are empty when nobody assessed it.
+	Confidence string
+	Doubts     []string
+
+	// DuplicateOf is the file this one repeats, whether it is left alone as
+	// ActionDuplicate or renamed anyway; "" when it repeats nothing.
+	DuplicateOf string
 }
 
+// Plan is the renames into one directory. Dir is where the files end up, which
+// is also where they were found unless the caller is moving them.
 type Plan struct {
 	Dir   string
 	Items []Item
@@ -38,8 +54,10 @@ var ErrTooManyCollisions = errors.New("more than 999 name collisions")
 // another plan item or with a file already on disk, and downgrades no-op
 // renames to ActionUnchanged. It must run before rendering or applying.
 func (p *Plan) Resolve() error {
+	// A destination that does not exist yet holds nothing to collide with;
+	// Apply creates it.
 	ents, err := os.ReadDir(p.Dir)
-	if err != nil {
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return err
 	}
 	// Keyed case-insensitively so a case-insensitive filesystem cannot be
@@ -60,7 +78,12 @@ func (p *Plan) Resolve() error {
 		if it.Action != ActionRename {
 			continue
 		}
+		// A file arriving from elsewhere has no entry here of its own: its old
+		// name is just another name to stay clear of.
 		oldBase := filepath.Base(it.OldPath)
+		if !sameDir(filepath.Dir(it.OldPath), p.Dir) {
+			oldBase = ""
+		}
 		if it.NewName == oldBase {
 			it.Action = ActionUnchanged
 			continue
@@ -68,7 +91,9 @@ func (p *Plan) Resolve() error {
 		// A file's own name is not a collision with itself, so drop exactly one
 		// entry — its own — from the count for the duration of the search.
 		ownKey := strings.ToLower(oldBase)
-		onDisk[ownKey]--
+		if oldBase != "" {
+			onDisk[ownKey]--
+		}
 
 		name, ok := freeName(onDisk, claimed, it.NewName)
 		switch {
@@ -87,7 +112,9 @@ func (p *Plan) Resolve() error {
 			it.NewName = name
 			claimed[strings.ToLower(name)] = true
 		}
-		onDisk[ownKey]++
+		if oldBase != "" {
+			onDisk[ownKey]++
+		}
 	}
 	return nil
 }
@@ -138,7 +165,7 @@ func (p *Plan) Tally() (renamed, unchanged, skipped, failed int) {
 			renamed++
 		case ActionUnchanged:
 			unchanged++
-		case ActionSkip:
+		case ActionSkip, ActionDuplicate:
 			skipped++
 		case ActionError:
 			failed++
@@ -158,8 +185,9 @@ func (p *Plan) Render(w io.Writer) {
 	fmt.Fprintf(w, "PLAN — %d %s in %s\n\n", len(p.Items), noun, p.Dir)
 
 	var wOld, wNew int
+	assessed := false
 	for _, it := range p.Items {
-		if n := utf8.RuneCountInString(filepath.Base(it.OldPath)); n > wOld {
+		if n := utf8.RuneCountInString(p.source(it)); n > wOld {
 			wOld = n
 		}
 		if it.Action == ActionRename {
@@ -167,16 +195,51 @@ func (p *Plan) Render(w io.Writer) {
 				wNew = n
 			}
 		}
+		assessed = assessed || it.Confidence != ""
 	}
 
-	for _, it := range p.Items {
-		old := filepath.Base(it.OldPath)
-		if it.Action == ActionRename {
-			fmt.Fprintf(w, "  %s  ->  %s  rename\n", pad(old, wOld), pad(it.NewName, wNew))
-			continue
+	lines := make([]string, len(p.Items))
+	var wLine int
+	for i, it := range p.Items {
+		old := p.source(it)
+		switch {
+		case it.Action == ActionRename && it.DuplicateOf != "":
+			lines[i] = fmt.Sprintf("  %s  ->  %s  %s", pad(old, wOld), pad(it.NewName, wNew), duplicateOf(it))
+		case it.Action == ActionRename:
+			lines[i] = fmt.Sprintf("  %s  ->  %s  rename", pad(old, wOld), pad(it.NewName, wNew))
+		default:
+			lines[i] = fmt.Sprintf("  %s  --  %s", pad(old, wOld), note(it))
+		}
+		if n := utf8.RuneCountInString(lines[i]); n > wLine {
+			wLine = n
 		}
-		fmt.Fprintf(w, "  %s  --  %s\n", pad(old, wOld), note(it))
 	}
+	// The confidence column appears only when the caller assessed something, so
+	// a plan without it reads exactly as it always has.
+	for i, it := range p.Items {
+		line := lines[i]
+		if assessed && it.Confidence != "" {
+			line = pad(line, wLine) + "  " + confidence(it)
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// confidence is the plan's last column: the level, then what lowered it.
+func confidence(it Item) string {
+	if len(it.Doubts) == 0 {
+		return it.Confidence
+	}
+	return it.Confidence + ": " + strings.Join(it.Doubts, "; ")
+}
+
+// source is how Render names a file: its base name when it is already in Dir,
+// its whole path when it is being moved in from somewhere else.
+func (p *Plan) source(it Item) string {
+	if sameDir(filepath.Dir(it.OldPath), p.Dir) {
+		return filepath.Base(it.OldPath)
+	}
+	return it.OldPath
 }
 
 func note(it Item) string {
@@ -193,10 +256,21 @@ func note(it Item) string {
 			return "error: " + it.Err.Error()
 		}
 		return "error"
+	case ActionDuplicate:
+		return duplicateOf(it)
 	}
 	return string(it.Action)
 }
 
+// duplicateOf names the file it repeats: by base name when the two sit side by
+// side, by whole path when it is in another directory.
+func duplicateOf(it Item) string {
+	if sameDir(filepath.Dir(it.DuplicateOf), filepath.Dir(it.OldPath)) {
+		return "duplicate of " + filepath.Base(it.DuplicateOf)
+	}
+	return "duplicate of " + it.DuplicateOf
+}
+
 // pad right-pads s to width display columns, counting runes rather than bytes
 // so accented vendor names stay in line.
 func pad(s string, width int) string {
@@ -3,10 +3,12 @@ package rename_test
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -334,6 +336,49 @@ func TestPlanResolveUnchanged(t *testing.T) {
 	}
 }
 
+func TestPlanRenderConfidenceColumn(t *testing.T) {
+	p := &rename.Plan{Dir: "/r", Items: []rename.Item{
+		{OldPath: "/r/a.pdf", NewName: "A.pdf", Action: rename.ActionRename, Confidence: "high"},
+		{OldPath: "/r/bb.pdf", Action: rename.ActionSkip, Reason: "low confidence", Confidence: "low", Doubts: []string{"no total", "dates reversed"}},
+	}}
+	var b strings.Builder
+	p.Render(&b)
+	want := "PLAN — 2 files in /r\n\n" +
+		"  a.pdf   ->  A.pdf  rename            high\n" +
+		"  bb.pdf  --  skipped: low confidence  low: no total; dates reversed\n"
+	if b.String() != want {
+		t.Errorf("Render =\n%s\nwant\n%s", b.String(), want)
+	}
+
+	// Without an assessment the table is exactly what it always was.
+	p.Items[0].Confidence, p.Items[1].Confidence = "", ""
+	b.Reset()
+	p.Render(&b)
+	if strings.Contains(b.String(), "high") || strings.Contains(b.String(), "no total") {
+		t.Errorf("Render without confidence = %q", b.String())
+	}
+}
+
+func TestPlanRenderDuplicates(t *testing.T) {
+	p := &rename.Plan{Dir: "/r", Items: []rename.Item{
+		{OldPath: "/r/a.pdf", NewName: "A.pdf", Action: rename.ActionRename},
+		{OldPath: "/r/b.jpg", Action: rename.ActionDuplicate, DuplicateOf: "/r/a.pdf"},
+		{OldPath: "/r/c.jpg", NewName: "A (duplicate).jpg", Action: rename.ActionRename, DuplicateOf: "/s/a.pdf"},
+	}}
+	var b strings.Builder
+	p.Render(&b)
+	want := "PLAN — 3 files in /r\n\n" +
+		"  a.pdf  ->  A.pdf              rename\n" +
+		"  b.jpg  --  duplicate of a.pdf\n" +
+		"  c.jpg  ->  A (duplicate).jpg  duplicate of /s/a.pdf\n"
+	if b.String() != want {
+		t.Errorf("Render =\n%s\nwant\n%s", b.String(), want)
+	}
+	if _, _, skipped, _ := p.Tally(); skipped != 1 {
+		t.Errorf("Tally skipped = %d, want the duplicate counted as skipped", skipped)
+	}
+}
+
 func TestJournalRoundTrip(t *testing.T) {
 	dir := t.TempDir()
 	j, err := rename.Open(dir, nil)
@@ -466,6 +511,10 @@ func TestUndoSkipsWhenOriginalTaken(t *testing.T) {
 	if len(res.Details) != 1 || !strings.Contains(res.Details[0], "a.pdf") {
 		t.Errorf("Details = %v, want a reason naming a.pdf", res.Details)
 	}
+	if len(res.Outcomes) != 1 || res.Outcomes[0].Reverted || res.Outcomes[0].Entry.New != "b.pdf" ||
+		!strings.Contains(res.Outcomes[0].Reason, "taken") {
+		t.Errorf("Outcomes = %+v, want one skipped b.pdf with its reason", res.Outcomes)
+	}
 	if got := readFile(t, src); got != "NEW OCCUPANT" {
 		t.Errorf("occupant was overwritten: %q", got)
 	}
@@ -692,3 +741,136 @@ func TestUndoDryRunChangesNothing(t *testing.T) {
 		t.Errorf("listing = %v, want %v", got, want)
 	}
 }
+
+func TestApplyMoveIsJournaledAndUndone(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(t.TempDir(), "out", "2025")
+	src := filepath.Join(dir, "scan.pdf")
+	writeFile(t, src, "moved content")
+
+	p := &rename.Plan{Dir: out, Items: []rename.Item{{OldPath: src, NewName: "scan.pdf", Action: rename.ActionRename}}}
+	if err := p.Resolve(); err != nil {
+		t.Fatalf("Resolve of a missing destination: %v", err)
+	}
+	// Keeping its name is still a move when the directory changes.
+	if p.Items[0].Action != rename.ActionRename {
+		t.Fatalf("Action = %s, want rename", p.Items[0].Action)
+	}
+
+	j, err := rename.Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	got, err := rename.Apply(context.Background(), out, p.Items[0], j)
+	j.Close()
+	if err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+	if want := filepath.Join(out, "scan.pdf"); got != want {
+		t.Errorf("Apply = %q, want %q", got, want)
+	}
+	entries, err := rename.Read(dir, nil)
+	if err != nil || len(entries) != 1 || entries[0].Dir != out {
+		t.Fatalf("journal = %+v, %v; want one entry with Dir %q", entries, err, out)
+	}
+
+	res, err := rename.Undo(dir, false, nil)
+	if err != nil || res.Reverted != 1 {
+		t.Fatalf("Undo = %+v, %v", res, err)
+	}
+	if got := readFile(t, src); got != "moved content" {
+		t.Errorf("source content = %q after undo", got)
+	}
+	if names := listing(t, out); len(names) != 0 {
+		t.Errorf("destination still holds %v", names)
+	}
+}
+
+func TestPlanResolveMoveAvoidsDestinationNames(t *testing.T) {
+	src := t.TempDir()
+	out := t.TempDir()
+	writeFile(t, filepath.Join(out, "a.pdf"), "already there")
+	old := filepath.Join(src, "a.pdf")
+	writeFile(t, old, "incoming")
+
+	p := &rename.Plan{Dir: out, Items: []rename.Item{{OldPath: old, NewName: "a.pdf", Action: rename.ActionRename}}}
+	if err := p.Resolve(); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if it := p.Items[0]; it.Action != rename.ActionRename || it.NewName != "a (2).pdf" {
+		t.Errorf("item = %+v, want a rename to %q", it, "a (2).pdf")
+	}
+}
+
+func TestUndoRefusesRelativeMoveDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, rename.JournalName),
+		`{"t":"2025-01-01T00:00:00Z","old":"a.pdf","new":"b.pdf","dir":"../elsewhere"}`+"\n")
+	res, err := rename.Undo(dir, false, nil)
+	if err != nil {
+		t.Fatalf("Undo: %v", err)
+	}
+	if res.Reverted != 0 || res.Skipped != 1 {
+		t.Errorf("Undo = %+v, want the entry skipped", res)
+	}
+}
+
+// A journal that came with the folder must not pull files in from elsewhere:
+// only an entry written by a journal opened here may name another directory.
+func TestUndoRefusesMoveDirNotWrittenHere(t *testing.T) {
+	dir := t.TempDir()
+	elsewhere := t.TempDir()
+	victim := filepath.Join(elsewhere, "b.pdf")
+	writeFile(t, victim, "not yours")
+	for _, src := range []string{"", `,"src":"/somewhere/else"`} {
+		writeFile(t, filepath.Join(dir, rename.JournalName),
+			`{"t":"2025-01-01T00:00:00Z","old":"a.pdf","new":"b.pdf","dir":`+strconv.Quote(elsewhere)+src+"}\n")
+		res, err := rename.Undo(dir, false, nil)
+		if err != nil {
+			t.Fatalf("Undo: %v", err)
+		}
+		if res.Reverted != 0 || res.Skipped != 1 {
+			t.Errorf("src %q: Undo = %+v, want the entry skipped", src, res)
+		}
+		if got := readFile(t, victim); got != "not yours" {
+			t.Fatalf("the file elsewhere was touched: %q", got)
+		}
+	}
+}
+
+func TestUndoMatchingTakesBackOneRun(t *testing.T) {
+	dir := t.TempDir()
+	for i, run := range []string{"first", "second"} {
+		src := filepath.Join(dir, fmt.Sprintf("%d.pdf", i))
+		writeFile(t, src, run)
+		j, err := rename.Open(dir, nil)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		j.SetRun(rename.Run{ID: run, Mode: "receipts", Model: "m"})
+		it := rename.Item{OldPath: src, NewName: run + ".pdf", Action: rename.ActionRename}
+		if _, err := rename.Apply(context.Background(), dir, it, j); err != nil {
+			t.Fatalf("Apply: %v", err)
+		}
+		j.Close()
+	}
+
+	entries, err := rename.Read(dir, nil)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Read = %+v, %v", entries, err)
+	}
+	if e := entries[1]; e.ID != "second" || e.Mode != "receipts" || e.Model != "m" || !filepath.IsAbs(e.Src) {
+		t.Errorf("entry = %+v, want the run recorded with an absolute source", e)
+	}
+
+	res, err := rename.UndoMatching(dir, false, func(e rename.Entry) bool { return e.ID == "second" }, nil)
+	if err != nil || res.Reverted != 1 || len(res.Outcomes) != 1 {
+		t.Fatalf("UndoMatching = %+v, %v", res, err)
+	}
+	if got := listing(t, dir); !slices.Equal(got, []string{rename.JournalName, "1.pdf", "first.pdf"}) {
+		t.Errorf("listing = %q, want only the second run reverted", got)
+	}
+	if left, _ := rename.Read(dir, nil); len(left) != 1 || left[0].ID != "first" {
+		t.Errorf("journal = %+v, want the first run kept", left)
+	}
+}
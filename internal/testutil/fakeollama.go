@@ -1,27 +1,46 @@
-// Package testutil provides an in-process fake of the Ollama HTTP API. It
-// depends only on the standard library so it can never pull a dependency into
-// the production require block.
+// Package testutil provides in-process fakes of the Ollama HTTP API and the
+// OpenAI-compatible one. It depends only on the standard library so it can
+// never pull a dependency into the production require block.
 package testutil
 
 import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-// Fake is an httptest server speaking just enough of the Ollama API.
+// Fake is an httptest server speaking just enough of a model server's API.
 //
-// Requests holds every decoded /api/generate body in call order; read it after
-// the call under test has returned. len(Requests) == 0 is how a test asserts no
-// generation happened.
+// Requests holds every decoded generation request body in call order; read it
+// after the call under test has returned. len(Requests) == 0 is how a test
+// asserts no generation happened.
 type Fake struct {
 	*httptest.Server
 
 	mu       sync.Mutex
 	Requests []map[string]any
+
+	down  atomic.Bool
+	choke atomic.Value // string
+}
+
+// SetDown makes the fake drop every connection unanswered, as a server that has
+// crashed or is restarting would, until it is set back up.
+func (f *Fake) SetDown(down bool) { f.down.Store(down) }
+
+// Choke makes NewFake answer 500 to every generation whose prompt contains
+// word, as ollama does when a runner crashes on one document.
+func (f *Fake) Choke(word string) { f.choke.Store(word) }
+
+func (f *Fake) chokes(prompt any) bool {
+	word, _ := f.choke.Load().(string)
+	p, _ := prompt.(string)
+	return word != "" && strings.Contains(p, word)
 }
 
 // Count is a race-free len(Requests) for tests that inspect a fake while a
@@ -40,18 +59,32 @@ func (f *Fake) record(r *http.Request) {
 	f.mu.Unlock()
 }
 
+func (f *Fake) last() map[string]any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Requests[len(f.Requests)-1]
+}
+
 func newFake(t *testing.T, h http.HandlerFunc) *Fake {
 	t.Helper()
 	f := &Fake{}
-	f.Server = httptest.NewServer(h)
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.down.Load() {
+			if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+				conn.Close()
+			}
+			return
+		}
+		h(w, r)
+	}))
 	t.Cleanup(f.Server.Close)
 	return f
 }
 
-// NewFake serves /api/tags with the given model names and answers each
-// /api/generate call with the next reply, which is the string placed in the
-// "response" field, i.e. the JSON the model "wrote". The final reply repeats
-// once the list is exhausted.
+// NewFake serves /api/tags with the given model names, /api/show with each of
+// them able to complete and see, and answers each /api/generate call with the
+// next reply, which is the string placed in the "response" field, i.e. the JSON
+// the model "wrote". The final reply repeats once the list is exhausted.
 func NewFake(t *testing.T, models []string, replies ...string) *Fake {
 	t.Helper()
 	var f *Fake
@@ -59,8 +92,14 @@ func NewFake(t *testing.T, models []string, replies ...string) *Fake {
 		switch r.URL.Path {
 		case "/api/tags":
 			writeTags(w, models)
+		case "/api/show":
+			writeJSON(w, http.StatusOK, map[string]any{"capabilities": []string{"completion", "vision"}})
 		case "/api/generate":
 			f.record(r)
+			if f.chokes(f.last()["prompt"]) {
+				writeJSON(w, http.StatusInternalServerError, map[string]any{"error": "llama runner process has terminated"})
+				return
+			}
 			reply := ""
 			if n := len(replies); n > 0 {
 				i := f.Count() - 1
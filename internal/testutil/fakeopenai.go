@@ -0,0 +1,42 @@
+package testutil
+
+import (
+	"net/http"
+	"testing"
+)
+
+// NewFakeOpenAI serves /v1/models with the given model IDs and answers each
+// /v1/chat/completions call with the next reply as the assistant message's
+// content. It shares Fake with NewFake, so Requests, Count and SetDown work the
+// same; Requests holds the decoded chat request bodies.
+func NewFakeOpenAI(t *testing.T, models []string, replies ...string) *Fake {
+	t.Helper()
+	var f *Fake
+	f = newFake(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/models":
+			list := make([]map[string]any, 0, len(models))
+			for _, m := range models {
+				list = append(list, map[string]any{"id": m, "object": "model"})
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"object": "list", "data": list})
+		case "/v1/chat/completions":
+			f.record(r)
+			reply := ""
+			if n := len(replies); n > 0 {
+				reply = replies[min(f.Count(), n)-1]
+			}
+			writeJSON(w, http.StatusOK, map[string]any{
+				"object": "chat.completion",
+				"choices": []map[string]any{{
+					"index":         0,
+					"message":       map[string]any{"role": "assistant", "content": reply},
+					"finish_reason": "stop",
+				}},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	return f
+}
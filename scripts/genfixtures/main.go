@@ -20,6 +20,10 @@ import (
 
 const outDir = "../../testdata"
 
+// doctorDir holds the samples rcptpixie doctor embeds, relative to outDir so
+// they go through out() like the rest.
+const doctorDir = "../internal/cli/doctor/"
+
 // errSkip marks a fixture that cannot be produced on this machine.
 var errSkip = errors.New("skipped")
 
@@ -52,6 +56,8 @@ func main() {
 		{"receipt.png", writePNG},
 		{"receipt.jpg", writeJPG},
 		{"receipt-scanned.pdf", writeScannedPDF},
+		{doctorDir + "receipt.pdf", writeDoctorPDF},
+		{doctorDir + "receipt.heic", writeDoctorHEIC},
 	}
 
 	if err := os.MkdirAll(outDir, 0o755); err != nil {
@@ -191,6 +197,42 @@ func writeScannedPDF() error {
 	return pdf.OutputFileAndClose(out("receipt-scanned.pdf"))
 }
 
+// writeDoctorPDF copies receipt-text.pdf to where doctor embeds it from; the
+// round trip there wants its text layer, so no model has to read an image.
+func writeDoctorPDF() error {
+	b, err := os.ReadFile(out("receipt-text.pdf"))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(out(doctorDir+"receipt.pdf"), b, 0o644)
+}
+
+// writeDoctorHEIC encodes receipt.png as HEIC for doctor's converter check.
+// There is no CGO-free encoder, so it takes heif-enc or ImageMagick, and a
+// build made without either simply carries no HEIC sample.
+func writeDoctorHEIC() error {
+	src, dst := out("receipt.png"), out(doctorDir+"receipt.heic")
+	var cmd *exec.Cmd
+	switch {
+	case lookPath("heif-enc"):
+		cmd = exec.Command("heif-enc", "-q", "50", "-o", dst, src)
+	case lookPath("magick"):
+		cmd = exec.Command("magick", src, dst)
+	default:
+		return fmt.Errorf("%w: neither heif-enc nor magick on PATH (install libheif-examples or imagemagick)", errSkip)
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(cmd.Path), err)
+	}
+	return nil
+}
+
+func lookPath(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
 func writePNG() error {
 	f, err := os.Create(out("receipt.png"))
 	if err != nil {